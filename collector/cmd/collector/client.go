@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// apiClient calls the API of the running collector.
+type apiClient struct {
+	base       string
+	auth       config.AuthCreds
+	ingestAuth config.AuthCreds // for /ingest, which may have credentials of its own
+}
+
+// clientFlags adds the -config and -url flags that locate the API.
+func clientFlags(fs *flag.FlagSet) (cfgPath, base *string) {
+	cfgPath = fs.String("config", "config.yaml", "collector config, for the API address and credentials")
+	base = fs.String("url", "", "collector API URL (default from api.listen)")
+	return cfgPath, base
+}
+
+// newAPIClient reads the credentials from the config at cfgPath and, if
+// base is empty, the address from api.listen.
+func newAPIClient(cfgPath, base string) (*apiClient, error) {
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	if base == "" {
+		host, port, err := net.SplitHostPort(cfg.API.Listen)
+		if err != nil {
+			return nil, fmt.Errorf("api.listen %q: %w", cfg.API.Listen, err)
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "localhost"
+		}
+		base = "http://" + net.JoinHostPort(host, port)
+	}
+	c := &apiClient{base: base, auth: cfg.API.BasicAuth, ingestAuth: cfg.API.Ingest.BasicAuth}
+	if c.ingestAuth.Username == "" {
+		c.ingestAuth = c.auth
+	}
+	return c, nil
+}
+
+// call sends a request and fails unless the response status is 2xx.
+func (c *apiClient) call(method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req, c.auth)
+}
+
+// push posts body to an /ingest endpoint.
+func (c *apiClient) push(path string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return c.do(req, c.ingestAuth)
+}
+
+func (c *apiClient) do(req *http.Request, auth config.AuthCreds) (*http.Response, error) {
+	if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, msg)
+	}
+	return resp, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// exportCommand downloads an export from the collector. The file only
+// appears once the collector reports that every row was sent.
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	cfgPath, base := clientFlags(fs)
+	out := fs.String("o", "", "file to write (default the name the collector suggests, - for stdout)")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return fmt.Errorf("want a dataset: metrics, processes or logs")
+	}
+	params := url.Values{}
+	for _, p := range fs.Args()[1:] {
+		name, value, ok := strings.Cut(p, "=")
+		if !ok {
+			return fmt.Errorf("parameter %q is not name=value", p)
+		}
+		params.Add(name, value)
+	}
+	c, err := newAPIClient(*cfgPath, *base)
+	if err != nil {
+		return err
+	}
+	resp, err := c.call("GET", "/export/"+url.PathEscape(fs.Arg(0))+"?"+params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	fn := *out
+	if fn == "" {
+		_, ps, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+		if fn = ps["filename"]; fn == "" || strings.ContainsAny(fn, `/\`) {
+			fn = fs.Arg(0) + ".export"
+		}
+	}
+	var w io.Writer = os.Stdout
+	var f *os.File
+	tmp := fn + ".tmp"
+	if fn != "-" {
+		if f, err = os.Create(tmp); err != nil {
+			return err
+		}
+		w = f
+	}
+	_, err = io.Copy(w, resp.Body)
+	if err == nil {
+		// trailers are set once the body has been read
+		if msg := resp.Trailer.Get("X-Export-Error"); msg != "" {
+			err = fmt.Errorf("collector: %s", msg)
+		}
+	}
+	if f == nil {
+		return err
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %s rows to %s\n", resp.Trailer.Get("X-Export-Rows"), fn)
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/api"
+	"github.com/aalish/pm2-full/internal/backfill"
+	"github.com/aalish/pm2-full/internal/storage"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// labelFlags collects a repeatable -label flag.
+type labelFlags []string
+
+func (l *labelFlags) String() string { return strings.Join(*l, ",") }
+
+func (l *labelFlags) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// importCommand stores PM2 log files or Prometheus dumps written before the
+// collector knew about a host under its job and target, pushing them
+// through the ingest API. Running it again with the same files stores
+// nothing twice: log lines are acknowledged per file and line number, a
+// file being known by its first line so that renaming it on rotation does
+// not import it again, and metric families already stored at a scrape's
+// time are left out.
+// The collector rolls the 5m and 1h buckets of metrics older than those it
+// has rolled up again in its next rollup round.
+func importCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "logs" && args[0] != "metrics") {
+		return fmt.Errorf("want logs or metrics")
+	}
+	kind := args[0]
+	fs := flag.NewFlagSet("import "+kind, flag.ExitOnError)
+	cfgPath, base := clientFlags(fs)
+	job := fs.String("job", "", "job to store the data under (required)")
+	target := fs.String("target", "", "target (instance) to store the data under (required)")
+	var ls labelFlags
+	fs.Var(&ls, "label", "target label as name=value, repeatable")
+	app := fs.String("app", "", "logs: app name (default from each file name)")
+	tz := fs.String("tz", "Local", "logs: time zone of PM2 timestamps written without one")
+	at := fs.String("time", "", "metrics: time of samples without a timestamp (RFC3339, default the file's modification time)")
+	fs.Parse(args[1:])
+	if *job == "" || *target == "" {
+		return fmt.Errorf("-job and -target are required")
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("want files to import")
+	}
+	loc, err := time.LoadLocation(*tz)
+	if err != nil {
+		return err
+	}
+	var def time.Time
+	if *at != "" {
+		if def, err = time.Parse(time.RFC3339, *at); err != nil {
+			return fmt.Errorf("-time: %w", err)
+		}
+	}
+	c, err := newAPIClient(*cfgPath, *base)
+	if err != nil {
+		return err
+	}
+	src := url.Values{"job": {*job}, "instance": {*target}, "label": ls}
+	for _, fn := range fs.Args() {
+		if kind == "logs" {
+			err = importLogs(c, src, fn, *app, loc)
+		} else {
+			err = importMetrics(c, src, fn, def)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", fn, err)
+		}
+	}
+	return nil
+}
+
+// importLogs streams the lines of one log file to /ingest/logs as spooled
+// lines of the file's stream, so the collector skips those it has stored.
+func importLogs(c *apiClient, src url.Values, fn, app string, loc *time.Location) error {
+	if app == "" {
+		app = backfill.AppFromLogName(fn)
+	}
+	stream, err := backfill.LogStream(fn)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	var lines uint64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bw := bufio.NewWriterSize(pw, 64*1024)
+		enc := json.NewEncoder(bw)
+		err := backfill.ReadLogFile(fn, app, loc, func(l backfill.LogLine) error {
+			lines = l.Seq
+			return enc.Encode(map[string]interface{}{
+				"stream": stream, "seq": l.Seq, "timestamp": l.Time.UTC().Format(time.RFC3339Nano), "line": l.Line,
+			})
+		})
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	resp, err := c.push("/ingest/logs?"+src.Encode(), nil, pr)
+	pr.CloseWithError(io.ErrClosedPipe) // stops the reader if the push failed early
+	<-done
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Acks map[string]uint64 `json:"acks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return err
+	}
+	if reply.Acks[stream] < lines {
+		return fmt.Errorf("collector stored %d of %d lines", reply.Acks[stream], lines)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d lines of app %s stored\n", fn, lines, app)
+	return nil
+}
+
+// importMetrics pushes the scrapes of one dump to /ingest/metrics, leaving
+// out the metric families already stored at their time for the job/target.
+func importMetrics(c *apiClient, src url.Values, fn string, def time.Time) error {
+	if def.IsZero() {
+		info, err := os.Stat(fn)
+		if err != nil {
+			return err
+		}
+		def = info.ModTime()
+	}
+	r, err := backfill.Open(fn)
+	if err != nil {
+		return err
+	}
+	scrapes, err := backfill.ReadDump(r, def)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if len(scrapes) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: no samples\n", fn)
+		return nil
+	}
+	stored, err := storedScrapes(c, src, scrapes[0].Time, scrapes[len(scrapes)-1].Time)
+	if err != nil {
+		return err
+	}
+	pushed := 0
+	for _, s := range scrapes {
+		for name, mf := range s.Families {
+			for _, sample := range storage.Samples(map[string]*dto.MetricFamily{name: mf}) {
+				if stored[storedSample{s.Time.UnixNano(), sample.Name}] {
+					delete(s.Families, name)
+					break
+				}
+			}
+		}
+		if len(s.Families) == 0 {
+			continue
+		}
+		var body bytes.Buffer
+		if err := backfill.WriteText(&body, s.Families); err != nil {
+			return err
+		}
+		header := http.Header{api.TimestampHeader: {s.Time.UTC().Format(time.RFC3339Nano)}}
+		resp, err := c.push("/ingest/metrics?"+src.Encode(), header, &body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		pushed++
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d of %d scrapes stored, %d already present\n", fn, pushed, len(scrapes), len(scrapes)-pushed)
+	return nil
+}
+
+// storedSample is a metric stored at a time, in Unix nanoseconds.
+type storedSample struct {
+	ts     int64
+	metric string
+}
+
+// storedScrapes returns the metrics of the raw scrapes stored for the job
+// and target of src within [start, end], read through /export.
+func storedScrapes(c *apiClient, src url.Values, start, end time.Time) (map[storedSample]bool, error) {
+	q := url.Values{
+		"job": {src.Get("job")}, "target": {src.Get("instance")}, "resolution": {"raw"},
+		"columns": {"timestamp,metric"}, "format": {"csv"},
+		"start": {start.UTC().Format(time.RFC3339Nano)}, "end": {end.UTC().Format(time.RFC3339Nano)},
+	}
+	resp, err := c.call("GET", "/export/metrics?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	stored := make(map[storedSample]bool)
+	cr := csv.NewReader(resp.Body)
+	cr.ReuseRecord = true
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ts, err := time.Parse(time.RFC3339Nano, rec[0]); err == nil {
+			stored[storedSample{ts.UnixNano(), rec[1]}] = true
+		}
+	}
+	if msg := resp.Trailer.Get("X-Export-Error"); msg != "" {
+		return nil, fmt.Errorf("collector: %s", msg)
+	}
+	return stored, nil
+}
@@ -1,32 +1,118 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
+	"github.com/aalish/pm2-full/internal/alerting"
 	"github.com/aalish/pm2-full/internal/api"
 	"github.com/aalish/pm2-full/internal/config"
 	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/live"
+	"github.com/aalish/pm2-full/internal/notify"
 	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/aalish/pm2-full/internal/tenant"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
 	cfg, err := config.Load("config.yaml")
 	if err != nil {
 		log.Fatalf("config load error: %v", err)
 	}
 
-	store, err := storage.New(cfg.Storage.Directory, cfg.Storage.RetentionDays)
+	store, err := storage.Open(cfg.Storage)
 	if err != nil {
 		log.Fatalf("storage init error: %v", err)
 	}
+	// Each tenant's jobs are stored in a backend of its own
+	tenants, err := tenant.Open(cfg.Tenants, cfg.Storage, store)
+	if err != nil {
+		log.Fatalf("tenants init error: %v", err)
+	}
+	// Alerting stops and buffered records are written and synced before
+	// exiting
+	ctx, stop := context.WithCancel(context.Background())
+	alertsDone := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		stop()
+		<-alertsDone
+		if err := tenants.Close(); err != nil {
+			log.Printf("storage close error: %v", err)
+		}
+		if err := store.Close(); err != nil {
+			log.Printf("storage close error: %v", err)
+		}
+		os.Exit(0)
+	}()
+
+	// Scrape outcomes per target, served at /targets and /metrics
+	health := discovery.NewHealth()
+
+	// Alert rules are evaluated over the same stores the scrapers write to,
+	// for the targets the scheduler currently scrapes and those of the jobs
+	// exporters push
+	if cfg.Alerting.StateFile == "" {
+		cfg.Alerting.StateFile = filepath.Join(cfg.Storage.Directory, "alerts_state.json")
+	}
+	scraped := make(map[string]bool)
+	for _, job := range cfg.Scrape.Jobs {
+		scraped[job.JobName] = true
+	}
+	targets := alerting.Targets{Scraped: health, Pushed: func(job string) bool {
+		return !scraped[job] && api.Pushable(cfg.API.Ingest, tenants, job)
+	}}
+	alerts, err := alerting.NewEngine(cfg.Alerting, targets, tenants)
+	if err != nil {
+		log.Fatalf("alerting init error: %v", err)
+	}
+
+	// Deliver firing and resolved alerts to the configured receivers
+	if cfg.Notify.SilencesFile == "" {
+		cfg.Notify.SilencesFile = filepath.Join(cfg.Storage.Directory, "silences.json")
+	}
+	if cfg.Notify.StateFile == "" {
+		cfg.Notify.StateFile = filepath.Join(cfg.Storage.Directory, "notify_state.json")
+	}
+	notifier, err := notify.New(cfg.Notify)
+	if err != nil {
+		log.Fatalf("notifier init error: %v", err)
+	}
+	alerts.OnEvaluate(notifier.Process)
+
+	// Newly stored log lines are fanned out to /logs/tail clients
+	hub := live.NewHub()
+	prometheus.MustRegister(health, hub)
+	if err := tenants.Register(prometheus.DefaultRegisterer); err != nil {
+		log.Fatalf("metrics init error: %v", err)
+	}
 
-	// Kick off all scrape jobs
+	// Kick off all scrape jobs; data over a tenant's quotas is dropped first
+	ingest := tenants.Limit(hub.WrapStore(alerts.WrapStore(tenants)))
+	scheduler := discovery.NewScheduler(ingest, health, cfg.Scrape.MaxConcurrent)
 	for _, job := range cfg.Scrape.Jobs {
-		go discovery.Start(job, store)
+		if err := scheduler.Start(job); err != nil {
+			log.Fatalf("scrape config error: %v", err)
+		}
 	}
+	go func() {
+		alerts.Run(ctx)
+		close(alertsDone)
+	}()
 
 	// Start API server
-	if err := api.Start(cfg.API, store); err != nil {
+	svc := api.Services{Store: tenants, Alerts: alerts, Notifier: notifier, Health: health, Ingest: ingest, Live: hub, Snapshots: tenants, Tenants: tenants}
+	if err := api.Start(cfg.API, svc); err != nil {
 		log.Fatalf("API server error: %v", err)
 	}
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/storage"
+)
+
+// Backups, exports and imports go through the API of the running collector,
+// which alone may touch its data directory; verify and restore work on
+// archives and run while the collector is stopped.
+const usage = `usage:
+  collector                                   run the collector
+  collector snapshot [-config FILE] [-url URL] [-o FILE] [-keep]
+                                              take a snapshot through the API and save it as a tar archive
+  collector verify ARCHIVE                    check an archive against its manifest
+  collector restore [-config FILE] [-dir DIR] ARCHIVE
+                                              restore an archive into an empty data directory
+  collector export [-config FILE] [-url URL] [-o FILE] DATASET [PARAM=VALUE ...]
+                                              export metrics, processes or logs through the API;
+                                              params as for /export/{dataset}, e.g. format=parquet
+  collector import logs|metrics [-config FILE] [-url URL] -job JOB -target TARGET [-label NAME=VALUE ...] FILE...
+                                              store PM2 log files (plain or gzipped) or Prometheus text/OpenMetrics
+                                              dumps through the ingest API (api.ingest.enabled); safe to re-run`
+
+// runCommand runs a subcommand and returns the exit code.
+func runCommand(name string, args []string) int {
+	var err error
+	switch name {
+	case "snapshot":
+		err = snapshotCommand(args)
+	case "verify":
+		err = verifyCommand(args)
+	case "restore":
+		err = restoreCommand(args)
+	case "export":
+		err = exportCommand(args)
+	case "import":
+		err = importCommand(args)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// snapshotCommand asks the collector for a snapshot, downloads its archive
+// and deletes the snapshot from the collector unless -keep is given.
+func snapshotCommand(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	cfgPath, base := clientFlags(fs)
+	out := fs.String("o", "", "archive to write (default pm2-snapshot-<name>.tar, - for stdout)")
+	keep := fs.Bool("keep", false, "keep the snapshot in the collector's data directory")
+	fs.Parse(args)
+	c, err := newAPIClient(*cfgPath, *base)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.call("POST", "/snapshots")
+	if err != nil {
+		return err
+	}
+	var m storage.SnapshotManifest
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "snapshot %s: %d files, %d bytes\n", m.Name, len(m.Files), m.Bytes)
+
+	resp, err = c.call("GET", "/snapshots/"+url.PathEscape(m.Name)+"/archive")
+	if err != nil {
+		return err
+	}
+	err = saveArchive(resp.Body, *out, m.Name)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if !*keep {
+		resp, err := c.call("DELETE", "/snapshots/"+url.PathEscape(m.Name))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// saveArchive writes an archive to fn, or stdout for "-". The file only
+// appears once the archive is complete and matches its manifest.
+func saveArchive(r io.Reader, fn, name string) error {
+	if fn == "-" {
+		_, err := io.Copy(os.Stdout, r)
+		return err
+	}
+	if fn == "" {
+		fn = "pm2-snapshot-" + name + ".tar"
+	}
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	c, err := storage.VerifyArchive(io.TeeReader(r, f))
+	if err == nil {
+		_, err = io.Copy(f, r) // padding after the end of the archive
+	}
+	if err == nil && !c.OK {
+		err = fmt.Errorf("downloaded archive does not match its manifest: %v", c.Problems)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %s\n", fn)
+	return nil
+}
+
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("want one archive")
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c, err := storage.VerifyArchive(f)
+	if err != nil {
+		return err
+	}
+	return report(c)
+}
+
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	cfgPath := fs.String("config", "config.yaml", "collector config, for the data directory and storage type")
+	dir := fs.String("dir", "", "data directory to restore into (default storage.directory)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("want one archive")
+	}
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		return err
+	}
+	if *dir == "" {
+		*dir = cfg.Storage.Directory
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// check the archive and its backend before touching the data directory
+	c, err := storage.VerifyArchive(f)
+	if err != nil {
+		return err
+	}
+	backend := cfg.Storage.Type
+	if backend == "" {
+		backend = "disk"
+	}
+	if c.Backend != backend {
+		return fmt.Errorf("archive holds %s storage, but storage.type is %s", c.Backend, backend)
+	}
+	if err := report(c); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	c, err = storage.RestoreArchive(f, filepath.Clean(*dir))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored snapshot %s into %s\n", c.Name, *dir)
+	return nil
+}
+
+// report prints the result of a verification, failing if it found problems.
+func report(c storage.SnapshotCheck) error {
+	for _, p := range c.Problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+	if !c.OK {
+		return fmt.Errorf("snapshot %s: %d problems", c.Name, len(c.Problems))
+	}
+	fmt.Fprintf(os.Stderr, "snapshot %s (%s): %d files, %d bytes ok\n", c.Name, c.Backend, c.Files, c.Bytes)
+	return nil
+}
@@ -0,0 +1,343 @@
+// internal/alerting/engine.go
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/storage"
+)
+
+// Alert states.
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// resolvedRetention is how long resolved alerts stay visible in the API.
+const resolvedRetention = 15 * time.Minute
+
+// Alert is one instance of a rule for a specific label set.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	State       string            `json:"state"`
+	Value       float64           `json:"value"`
+	ActiveAt    time.Time         `json:"active_at"`
+	FiredAt     time.Time         `json:"fired_at,omitzero"`
+	ResolvedAt  time.Time         `json:"resolved_at,omitzero"`
+	LastEval    time.Time         `json:"last_eval"`
+}
+
+// RuleStatus reports the health of the last evaluation of a rule.
+type RuleStatus struct {
+	Name         string            `json:"name"`
+	Kind         string            `json:"kind"`
+	Job          string            `json:"job,omitempty"`
+	For          string            `json:"for"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	LastEval     time.Time         `json:"last_eval"`
+	EvalDuration string            `json:"eval_duration"`
+	LastError    string            `json:"last_error,omitempty"`
+	Active       int               `json:"active"`
+}
+
+// Targets are the targets rules are evaluated against. Scraped lists those
+// the scheduler runs, discovered ones included, under the address their
+// data is stored under; *discovery.Health implements it. Pushed reports
+// whether exporters push the targets of a job: those are the targets the
+// storage catalog lists for it, so one that stops pushing is still
+// evaluated, and found down, until its data expires.
+type Targets struct {
+	Scraped interface {
+		Targets() []discovery.TargetHealth
+	}
+	Pushed func(job string) bool
+}
+
+// Engine evaluates alert rules on a schedule and tracks the
+// pending -> firing -> resolved lifecycle of every alert.
+type Engine struct {
+	cfg     config.AlertingConfig
+	targets Targets
+	store   storage.Store
+	rules   []*rule
+	logs    *logCounter
+
+	mu        sync.Mutex
+	alerts    map[string]*Alert // rule + label fingerprint -> alert
+	status    map[string]*RuleStatus
+	listeners []func(now time.Time, alerts []Alert)
+}
+
+// NewEngine compiles the configured rules and restores persisted alert state.
+func NewEngine(cfg config.AlertingConfig, targets Targets, store storage.Store) (*Engine, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	e := &Engine{
+		cfg:     cfg,
+		targets: targets,
+		store:   store,
+		alerts:  make(map[string]*Alert),
+		status:  make(map[string]*RuleStatus),
+	}
+	seen := make(map[string]bool)
+	for _, rc := range cfg.Rules {
+		r, err := compileRule(rc)
+		if err != nil {
+			return nil, err
+		}
+		if seen[rc.Name] {
+			return nil, fmt.Errorf("duplicate alert rule %q", rc.Name)
+		}
+		seen[rc.Name] = true
+		e.rules = append(e.rules, r)
+		e.status[rc.Name] = &RuleStatus{Name: rc.Name, Kind: rc.Kind, Job: rc.Job, For: rc.For.String(), Labels: rc.Labels}
+	}
+	e.logs = newLogCounter(e.rules)
+	if err := e.loadState(); err != nil {
+		log.Printf("alerting: could not restore state from %s: %v", cfg.StateFile, err)
+	}
+	return e, nil
+}
+
+// WrapStore returns a discovery.Store that also feeds ingested log lines to
+// log_match rules.
+func (e *Engine) WrapStore(next discovery.Store) discovery.Store {
+	return observedStore{Store: next, logs: e.logs}
+}
+
+// OnEvaluate registers fn to receive all current alerts after every
+// evaluation round. It must be called before Run.
+func (e *Engine) OnEvaluate(fn func(now time.Time, alerts []Alert)) {
+	e.listeners = append(e.listeners, fn)
+}
+
+// Run evaluates all rules every interval until ctx is done, then saves the
+// alert states one last time.
+func (e *Engine) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		e.Evaluate(time.Now().UTC())
+		select {
+		case <-ctx.Done():
+			e.mu.Lock()
+			err := e.saveState()
+			e.mu.Unlock()
+			if err != nil {
+				log.Printf("alerting: could not persist state: %v", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Evaluate runs every rule once at now and advances alert states.
+func (e *Engine) Evaluate(now time.Time) {
+	for _, r := range e.rules {
+		began := time.Now()
+		samples, err := e.eval(r, now)
+		e.mu.Lock()
+		st := e.status[r.cfg.Name]
+		st.LastEval = now
+		st.EvalDuration = time.Since(began).String()
+		st.LastError = ""
+		if err != nil {
+			// keep existing alerts as they are rather than resolving on a read error
+			st.LastError = err.Error()
+			e.mu.Unlock()
+			log.Printf("alerting: rule %q: %v", r.cfg.Name, err)
+			continue
+		}
+		st.Active = e.update(r, samples, now)
+		e.mu.Unlock()
+	}
+
+	e.mu.Lock()
+	err := e.saveState()
+	e.mu.Unlock()
+	if err != nil {
+		log.Printf("alerting: could not persist state: %v", err)
+	}
+
+	if len(e.listeners) > 0 {
+		current := e.Alerts("")
+		for _, fn := range e.listeners {
+			fn(now, current)
+		}
+	}
+}
+
+// update applies one evaluation of r to the alert set and returns the number
+// of pending or firing alerts for it. Caller must hold e.mu.
+func (e *Engine) update(r *rule, samples []sample, now time.Time) int {
+	active := make(map[string]bool, len(samples))
+	for _, s := range samples {
+		labels := map[string]string{"alertname": r.cfg.Name}
+		for k, v := range s.labels {
+			labels[k] = v
+		}
+		for k, v := range r.cfg.Labels {
+			labels[k] = v
+		}
+		k := alertKey(r.cfg.Name, labels)
+		active[k] = true
+
+		a := e.alerts[k]
+		if a == nil || a.State == StateResolved {
+			a = &Alert{Rule: r.cfg.Name, Labels: labels, State: StatePending, ActiveAt: now}
+			e.alerts[k] = a
+		}
+		a.Value = s.value
+		a.LastEval = now
+		a.Annotations = r.expandAnnotations(labels, s.value)
+		if a.State == StatePending && now.Sub(a.ActiveAt) >= r.cfg.For {
+			a.State = StateFiring
+			a.FiredAt = now
+		}
+	}
+
+	n := 0
+	for k, a := range e.alerts {
+		if a.Rule != r.cfg.Name {
+			continue
+		}
+		if active[k] {
+			n++
+			continue
+		}
+		switch a.State {
+		case StatePending:
+			// never fired, nothing to resolve
+			delete(e.alerts, k)
+		case StateFiring:
+			a.State = StateResolved
+			a.ResolvedAt = now
+			a.LastEval = now
+		case StateResolved:
+			if now.Sub(a.ResolvedAt) > resolvedRetention {
+				delete(e.alerts, k)
+			}
+		}
+	}
+	return n
+}
+
+// Key returns the identity of the alert: its rule and full label set.
+func (a Alert) Key() string {
+	return alertKey(a.Rule, a.Labels)
+}
+
+// alertKey builds a stable identity from the rule name and sorted labels.
+func alertKey(rule string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(rule)
+	for _, k := range keys {
+		b.WriteString("\xff")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(labels[k])
+	}
+	return b.String()
+}
+
+// Alerts returns the current alerts, optionally filtered by state, ordered
+// by rule and activation time.
+func (e *Engine) Alerts(state string) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		if state != "" && a.State != state {
+			continue
+		}
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Rule != out[j].Rule {
+			return out[i].Rule < out[j].Rule
+		}
+		return out[i].ActiveAt.Before(out[j].ActiveAt)
+	})
+	return out
+}
+
+// Rules returns the evaluation status of every configured rule.
+func (e *Engine) Rules() []RuleStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]RuleStatus, 0, len(e.rules))
+	for _, r := range e.rules {
+		out = append(out, *e.status[r.cfg.Name])
+	}
+	return out
+}
+
+// saveState writes all alerts to the state file atomically.
+// Caller must hold e.mu.
+func (e *Engine) saveState() error {
+	if e.cfg.StateFile == "" {
+		return nil
+	}
+	alerts := make([]*Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		alerts = append(alerts, a)
+	}
+	data, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(e.cfg.StateFile), 0o755); err != nil {
+		return err
+	}
+	tmp := e.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.cfg.StateFile)
+}
+
+// loadState restores alerts for rules that still exist.
+func (e *Engine) loadState() error {
+	if e.cfg.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(e.cfg.StateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var alerts []*Alert
+	if err := json.Unmarshal(data, &alerts); err != nil {
+		return err
+	}
+	for _, a := range alerts {
+		if _, ok := e.status[a.Rule]; !ok {
+			continue
+		}
+		e.alerts[alertKey(a.Rule, a.Labels)] = a
+	}
+	return nil
+}
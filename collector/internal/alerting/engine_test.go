@@ -0,0 +1,212 @@
+package alerting
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/aalish/pm2-full/internal/storage/storagetest"
+	"github.com/aalish/pm2-full/internal/tenant"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func gauge(name string, v float64) map[string]*dto.MetricFamily {
+	return map[string]*dto.MetricFamily{name: {
+		Name:   proto.String(name),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(v)}}},
+	}}
+}
+
+var targetDown = config.AlertRule{Name: "TargetDown", Kind: KindTargetDown, Window: time.Minute}
+
+// alerting returns the sorted job/target labels of the alerts of rule.
+func alerting(e *Engine, rule string) []string {
+	var out []string
+	for _, a := range e.Alerts("") {
+		if a.Rule == rule {
+			out = append(out, a.Labels["job"]+"/"+a.Labels["target"])
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// waitScraped waits until the scheduler has registered n targets.
+func waitScraped(t *testing.T, h *discovery.Health, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); len(h.Targets()) != n; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("scraped targets: got %d, want %d", len(h.Targets()), n)
+		}
+	}
+}
+
+func closedAddr(t *testing.T, host string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return net.JoinHostPort(host, port)
+}
+
+// Targets found by service discovery are evaluated like static ones.
+func TestTargetDownDiscovered(t *testing.T) {
+	store := storagetest.Open(t)
+	up, down := closedAddr(t, "127.0.0.1"), closedAddr(t, "127.0.0.2")
+	sd := filepath.Join(t.TempDir(), "targets.json")
+	if err := os.WriteFile(sd, []byte(`[{"targets":["`+up+`","`+down+`"]}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	health := discovery.NewHealth()
+	sched := discovery.NewScheduler(store, health, 0)
+	if err := sched.Start(config.Job{JobName: "web", Interval: time.Hour, FileSD: []config.FileSDConfig{{Files: []string{sd}}}}); err != nil {
+		t.Fatal(err)
+	}
+	defer sched.Stop("web")
+	waitScraped(t, health, 2)
+
+	e, err := NewEngine(config.AlertingConfig{Rules: []config.AlertRule{targetDown}}, Targets{Scraped: health}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	store.StoreMetrics("web", up, nil, now, gauge("pm2_up", 1))
+	e.Evaluate(now)
+	if got := alerting(e, "TargetDown"); !slices.Equal(got, []string{"web/" + down}) {
+		t.Fatalf("target_down alerts: got %v, want web/%s", got, down)
+	}
+}
+
+// Rules see targets as the scheduler stores them: after relabeling, under
+// their final address, and not at all if a rule dropped them.
+func TestTargetDownRelabeled(t *testing.T) {
+	store := storagetest.Open(t)
+	_, port, _ := net.SplitHostPort(closedAddr(t, "127.0.0.1"))
+	p, _ := strconv.Atoi(port)
+	job := config.Job{JobName: "web", Interval: time.Hour,
+		Targets: []config.Target{
+			{Host: "127.0.0.1", Port: p, Labels: map[string]string{"role": "canary"}},
+			{Host: "old-name", Port: p},
+			{Host: "127.0.0.3", Port: p},
+		},
+		RelabelConfigs: []config.RelabelConfig{
+			{SourceLabels: []string{"role"}, Regex: "canary", Action: "drop"},
+			{SourceLabels: []string{"__address__"}, Regex: "old-name:(.*)", TargetLabel: "__address__", Replacement: "127.0.0.2:$1"},
+		},
+	}
+	health := discovery.NewHealth()
+	sched := discovery.NewScheduler(store, health, 0)
+	if err := sched.Start(job); err != nil {
+		t.Fatal(err)
+	}
+	defer sched.Stop("web")
+	waitScraped(t, health, 2)
+
+	renamed := net.JoinHostPort("127.0.0.2", port)
+	rules := []config.AlertRule{targetDown, {Name: "RenamedDown", Kind: KindTargetDown, Target: renamed, Window: time.Minute}}
+	e, err := NewEngine(config.AlertingConfig{Rules: rules}, Targets{Scraped: health}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	store.StoreMetrics("web", renamed, nil, now, gauge("pm2_up", 1))
+	e.Evaluate(now)
+	if got, want := alerting(e, "TargetDown"), []string{"web/" + net.JoinHostPort("127.0.0.3", port)}; !slices.Equal(got, want) {
+		t.Fatalf("target_down alerts: got %v, want %v", got, want)
+	}
+	if got := alerting(e, "RenamedDown"); len(got) != 0 {
+		t.Fatalf("relabeled target looked up under the wrong key: %v", got)
+	}
+}
+
+// Targets that push are evaluated from the storage catalog, across the
+// tenants' backends too, and keep being evaluated once they stop pushing.
+func TestTargetDownPushed(t *testing.T) {
+	dir := t.TempDir()
+	sc := config.StorageConfig{Type: "disk", Directory: dir, FlushInterval: 10 * time.Millisecond}
+	def, err := storage.Open(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer def.Close()
+	tenants, err := tenant.Open([]config.TenantConfig{{Name: "team", Jobs: []string{"team-*"}, BasicAuth: config.AuthCreds{Username: "team", Password: "pw"}}}, sc, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenants.Close()
+
+	now := time.Now().UTC()
+	tenants.StoreMetrics("edge", "live", nil, now, gauge("pm2_up", 1))
+	tenants.StoreMetrics("edge", "gone", nil, now.Add(-time.Hour), gauge("pm2_up", 1))
+	tenants.StoreMetrics("team-edge", "gone", nil, now.Add(-time.Hour), gauge("pm2_up", 1))
+	tenants.StoreMetrics("imported", "old", nil, now.Add(-time.Hour), gauge("pm2_up", 1))
+
+	pushed := func(job string) bool { return job != "imported" }
+	e, err := NewEngine(config.AlertingConfig{Rules: []config.AlertRule{targetDown}}, Targets{Scraped: discovery.NewHealth(), Pushed: pushed}, tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Evaluate(now)
+	if got, want := alerting(e, "TargetDown"), []string{"edge/gone", "team-edge/gone"}; !slices.Equal(got, want) {
+		t.Fatalf("target_down alerts: got %v, want %v", got, want)
+	}
+}
+
+// Run stops once its context is cancelled and saves the alert states.
+func TestRunSavesStateOnStop(t *testing.T) {
+	store := storagetest.Open(t)
+	store.StoreMetrics("edge", "gone", nil, time.Now().UTC().Add(-time.Hour), gauge("pm2_up", 1))
+	cfg := config.AlertingConfig{Interval: time.Hour, StateFile: filepath.Join(t.TempDir(), "alerts_state.json"), Rules: []config.AlertRule{targetDown}}
+	targets := Targets{Scraped: discovery.NewHealth(), Pushed: func(string) bool { return true }}
+	e, err := NewEngine(cfg, targets, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+	// the first evaluation saves the state; only the stop may save it again
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(cfg.StateFile); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("state not saved after the first evaluation")
+		}
+	}
+	if err := os.Remove(cfg.StateFile); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+
+	restored, err := NewEngine(cfg, targets, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := alerting(restored, "TargetDown"); !slices.Equal(got, []string{"edge/gone"}) {
+		t.Fatalf("restored alerts: got %v, want edge/gone", got)
+	}
+}
@@ -0,0 +1,126 @@
+// internal/alerting/logs.go
+package alerting
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/storage"
+)
+
+// maxMatches caps the remembered match times per series so a log storm
+// cannot grow memory without bound.
+const maxMatches = 100000
+
+// logCounter keeps sliding windows of matching log lines for log_match rules.
+// Lines are counted as they are ingested so rules never rescan stored logs.
+type logCounter struct {
+	mu      sync.Mutex
+	rules   []*rule
+	matches map[string]*logSeries // rule|job|target|app -> match times
+}
+
+type logSeries struct {
+	rule   string
+	labels map[string]string
+	times  []time.Time
+}
+
+func newLogCounter(rules []*rule) *logCounter {
+	lc := &logCounter{matches: make(map[string]*logSeries)}
+	for _, r := range rules {
+		if r.cfg.Kind == KindLogMatch {
+			lc.rules = append(lc.rules, r)
+		}
+	}
+	return lc
+}
+
+// observe counts one ingested line against every log_match rule.
+func (lc *logCounter) observe(job, target, line string, now time.Time) {
+	if len(lc.rules) == 0 {
+		return
+	}
+	app, msg := storage.SplitAppPrefix(line)
+	for _, r := range lc.rules {
+		if !matches(r.cfg.Job, job) || !matches(r.cfg.Target, target) || !matches(r.cfg.App, app) {
+			continue
+		}
+		if !r.re.MatchString(msg) {
+			continue
+		}
+		k := strings.Join([]string{r.cfg.Name, job, target, app}, "|")
+		lc.mu.Lock()
+		s := lc.matches[k]
+		if s == nil {
+			s = &logSeries{rule: r.cfg.Name, labels: map[string]string{"job": job, "target": target, "app": app}}
+			lc.matches[k] = s
+		}
+		if len(s.times) < maxMatches {
+			// replayed lines can arrive out of order; keep times sorted
+			i := sort.Search(len(s.times), func(i int) bool { return s.times[i].After(now) })
+			s.times = append(s.times, time.Time{})
+			copy(s.times[i+1:], s.times[i:])
+			s.times[i] = now
+		}
+		lc.mu.Unlock()
+	}
+}
+
+// eval returns, per job/target/app, the number of matches within the
+// rule's window when that count satisfies the rule's condition.
+func (lc *logCounter) eval(r *rule, now time.Time) []sample {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	cutoff := now.Add(-r.cfg.Window)
+	var out []sample
+	for k, s := range lc.matches {
+		if s.rule != r.cfg.Name {
+			continue
+		}
+		i := 0
+		for i < len(s.times) && s.times[i].Before(cutoff) {
+			i++
+		}
+		s.times = s.times[i:]
+		if len(s.times) == 0 {
+			delete(lc.matches, k)
+			continue
+		}
+		n := float64(len(s.times))
+		if ok, _ := compare(r.cfg.Op, n, r.cfg.Threshold); ok {
+			out = append(out, sample{labels: s.labels, value: n})
+		}
+	}
+	return out
+}
+
+// observedStore forwards writes to the wrapped store and feeds every log
+// line to the engine's log counter.
+type observedStore struct {
+	discovery.Store
+	logs *logCounter
+}
+
+func (s observedStore) StoreLog(job, target string, ls map[string]string, ts time.Time, line string) {
+	s.Store.StoreLog(job, target, ls, ts, line)
+	s.logs.observe(job, target, line, ts)
+}
+
+// StoreLogEntries observes only the lines that were newly stored, so lines
+// replayed by an exporter are not counted twice.
+func (s observedStore) StoreLogEntries(job, target string, ls map[string]string, entries []discovery.LogEntry) (map[string]uint64, error) {
+	prev := s.Store.LogOffsets(job, target)
+	acks, err := s.Store.StoreLogEntries(job, target, ls, entries)
+	for _, e := range entries {
+		if e.Seq > prev[e.Stream] && e.Seq <= acks[e.Stream] {
+			prev[e.Stream] = e.Seq
+			s.logs.observe(job, target, e.Line, e.Timestamp)
+		}
+	}
+	return acks, err
+}
@@ -0,0 +1,296 @@
+// internal/alerting/rules.go
+package alerting
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"text/template"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/storage"
+)
+
+// Rule kinds understood by the engine.
+const (
+	KindMetric     = "metric"
+	KindRestarts   = "restarts"
+	KindStatus     = "status"
+	KindTargetDown = "target_down"
+	KindLogMatch   = "log_match"
+)
+
+// staleness is how far back a metric rule looks for the latest scrape.
+const staleness = 5 * time.Minute
+
+// rule is a validated, compiled config.AlertRule.
+type rule struct {
+	cfg         config.AlertRule
+	re          *regexp.Regexp
+	annotations map[string]*template.Template
+}
+
+// sample is one series produced by evaluating a rule. Only samples whose
+// condition holds are returned.
+type sample struct {
+	labels map[string]string
+	value  float64
+}
+
+// compileRule checks a rule definition and prepares its regex and templates.
+func compileRule(rc config.AlertRule) (*rule, error) {
+	if rc.Name == "" {
+		return nil, fmt.Errorf("alert rule without name")
+	}
+	r := &rule{cfg: rc, annotations: make(map[string]*template.Template)}
+	if r.cfg.Op == "" {
+		if rc.Kind == KindStatus {
+			r.cfg.Op = "!="
+		} else {
+			r.cfg.Op = ">"
+		}
+	}
+	if _, ok := compare(r.cfg.Op, 0, 0); !ok {
+		return nil, fmt.Errorf("rule %q: unknown op %q", rc.Name, rc.Op)
+	}
+
+	switch rc.Kind {
+	case KindMetric:
+		if rc.Metric == "" {
+			return nil, fmt.Errorf("rule %q: metric is required", rc.Name)
+		}
+	case KindRestarts, KindTargetDown:
+		if rc.Window <= 0 {
+			return nil, fmt.Errorf("rule %q: window is required", rc.Name)
+		}
+	case KindStatus:
+		if rc.Status == "" {
+			r.cfg.Status = "online"
+		}
+		if r.cfg.Op != "==" && r.cfg.Op != "!=" {
+			return nil, fmt.Errorf("rule %q: status rules only support == and !=", rc.Name)
+		}
+	case KindLogMatch:
+		if rc.Window <= 0 {
+			return nil, fmt.Errorf("rule %q: window is required", rc.Name)
+		}
+		re, err := regexp.Compile(rc.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: pattern: %w", rc.Name, err)
+		}
+		r.re = re
+	default:
+		return nil, fmt.Errorf("rule %q: unknown kind %q", rc.Name, rc.Kind)
+	}
+
+	for k, v := range rc.Annotations {
+		t, err := template.New(k).Option("missingkey=zero").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: annotation %q: %w", rc.Name, k, err)
+		}
+		r.annotations[k] = t
+	}
+	return r, nil
+}
+
+// compare applies op to v and threshold; ok is false for unknown ops.
+func compare(op string, v, threshold float64) (result, ok bool) {
+	switch op {
+	case ">":
+		return v > threshold, true
+	case ">=":
+		return v >= threshold, true
+	case "<":
+		return v < threshold, true
+	case "<=":
+		return v <= threshold, true
+	case "==":
+		return v == threshold, true
+	case "!=":
+		return v != threshold, true
+	}
+	return false, false
+}
+
+// matches reports whether a rule selector accepts value (empty accepts all).
+func matches(selector, value string) bool {
+	return selector == "" || selector == value
+}
+
+// expandAnnotations renders the rule's annotation templates for one alert.
+func (r *rule) expandAnnotations(labels map[string]string, value float64) map[string]string {
+	out := make(map[string]string, len(r.annotations))
+	data := struct {
+		Labels map[string]string
+		Value  float64
+	}{labels, value}
+	for k, t := range r.annotations {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			out[k] = r.cfg.Annotations[k]
+			continue
+		}
+		out[k] = buf.String()
+	}
+	return out
+}
+
+// eval runs the rule against current data and returns the series whose
+// condition holds at now.
+func (e *Engine) eval(r *rule, now time.Time) ([]sample, error) {
+	switch r.cfg.Kind {
+	case KindMetric:
+		return e.evalMetric(r, now)
+	case KindRestarts:
+		return e.evalRestarts(r, now)
+	case KindStatus:
+		return e.evalStatus(r)
+	case KindTargetDown:
+		return e.evalTargetDown(r, now)
+	case KindLogMatch:
+		return e.logs.eval(r, now), nil
+	}
+	return nil, nil
+}
+
+// jobTarget identifies the data of one target.
+type jobTarget struct{ job, target string }
+
+// forEachTarget calls fn for every current job/target the rule selects.
+func (e *Engine) forEachTarget(r *rule, fn func(job, target string) error) error {
+	for _, t := range e.currentTargets(r.cfg.Job) {
+		if !matches(r.cfg.Target, t.target) {
+			continue
+		}
+		if err := fn(t.job, t.target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentTargets returns the scraped targets of the jobs the selector
+// accepts, followed by the pushed ones.
+func (e *Engine) currentTargets(job string) []jobTarget {
+	var out []jobTarget
+	seen := make(map[jobTarget]bool)
+	add := func(t jobTarget) {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	for _, th := range e.targets.Scraped.Targets() {
+		if matches(job, th.Job) {
+			add(jobTarget{th.Job, th.Target})
+		}
+	}
+	if e.targets.Pushed == nil {
+		return out
+	}
+	for _, ce := range e.store.Catalog(storage.CatalogQuery{Job: job}) {
+		if e.targets.Pushed(ce.Job) {
+			add(jobTarget{ce.Job, ce.Target})
+		}
+	}
+	return out
+}
+
+func (e *Engine) evalMetric(r *rule, now time.Time) ([]sample, error) {
+	var out []sample
+	err := e.forEachTarget(r, func(job, target string) error {
+		recs, err := e.store.QueryMetrics(storage.MetricQuery{Selector: storage.Selector{Job: job, Target: target, Start: now.Add(-staleness)}, Resolution: "raw"})
+		if err != nil || len(recs) == 0 {
+			return err
+		}
+		_, mfs, err := storage.DecodeMetricsRecord(recs[len(recs)-1])
+		if err != nil {
+			return err
+		}
+		for _, s := range storage.Samples(mfs) {
+			if s.Name != r.cfg.Metric || !matches(r.cfg.App, s.Labels["name"]) {
+				continue
+			}
+			if ok, _ := compare(r.cfg.Op, s.Value, r.cfg.Threshold); !ok {
+				continue
+			}
+			labels := map[string]string{"job": job, "target": target}
+			for k, v := range s.Labels {
+				labels[k] = v
+			}
+			out = append(out, sample{labels: labels, value: s.Value})
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (e *Engine) evalRestarts(r *rule, now time.Time) ([]sample, error) {
+	var out []sample
+	err := e.forEachTarget(r, func(job, target string) error {
+		diff, err := e.store.DiffProcesses(storage.ProcessQuery{Selector: storage.Selector{Job: job, Target: target, App: r.cfg.App, Start: now.Add(-r.cfg.Window), End: now}})
+		if err != nil {
+			return err
+		}
+		for _, c := range diff.Changed {
+			fc, ok := c.Fields["restart_time"]
+			if !ok {
+				continue
+			}
+			from, _ := fc.From.(int)
+			to, _ := fc.To.(int)
+			delta := float64(to - from)
+			if ok, _ := compare(r.cfg.Op, delta, r.cfg.Threshold); !ok {
+				continue
+			}
+			out = append(out, sample{labels: map[string]string{"job": job, "target": target, "app": c.Name}, value: delta})
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (e *Engine) evalStatus(r *rule) ([]sample, error) {
+	var out []sample
+	err := e.forEachTarget(r, func(job, target string) error {
+		recs, err := e.store.QueryProcesses(storage.ProcessQuery{Selector: storage.Selector{Job: job, Target: target}})
+		if err != nil || len(recs) == 0 {
+			return err
+		}
+		_, states, err := storage.ParseProcessSnapshot(recs[len(recs)-1])
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			if !matches(r.cfg.App, s.Name) {
+				continue
+			}
+			equal := s.Status == r.cfg.Status
+			if (r.cfg.Op == "==") != equal {
+				continue
+			}
+			out = append(out, sample{
+				labels: map[string]string{"job": job, "target": target, "app": s.Name},
+				value:  1,
+			})
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (e *Engine) evalTargetDown(r *rule, now time.Time) ([]sample, error) {
+	var out []sample
+	err := e.forEachTarget(r, func(job, target string) error {
+		recs, err := e.store.QueryMetrics(storage.MetricQuery{Selector: storage.Selector{Job: job, Target: target, Start: now.Add(-r.cfg.Window)}, Resolution: "raw"})
+		if err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			out = append(out, sample{labels: map[string]string{"job": job, "target": target}, value: r.cfg.Window.Seconds()})
+		}
+		return nil
+	})
+	return out, err
+}
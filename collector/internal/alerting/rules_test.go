@@ -0,0 +1,223 @@
+package alerting
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/aalish/pm2-full/internal/storage/storagetest"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// appGauge is a gauge with one series per app, labelled name as PM2
+// exporters do.
+func appGauge(name string, values map[string]float64) map[string]*dto.MetricFamily {
+	mf := &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum()}
+	for app, v := range values {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto.String("name"), Value: proto.String(app)}},
+			Gauge: &dto.Gauge{Value: proto.Float64(v)},
+		})
+	}
+	return map[string]*dto.MetricFamily{name: mf}
+}
+
+func procs(apiRestarts int, workerStatus string) []byte {
+	return []byte(fmt.Sprintf(`[{"name":"api","pm_id":0,"pid":100,"status":"online","restart_time":%d},`+
+		`{"name":"worker","pm_id":1,"pid":200,"status":%q,"restart_time":0}]`, apiRestarts, workerStatus))
+}
+
+// newEngine evaluates rules against every target in the store, as for
+// pushed targets.
+func newEngine(t *testing.T, store storage.Store, rules ...config.AlertRule) *Engine {
+	t.Helper()
+	e, err := NewEngine(config.AlertingConfig{Rules: rules}, Targets{Scraped: discovery.NewHealth(), Pushed: func(string) bool { return true }}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// summary lists the alerts of e as "state target app=value", sorted. Metric
+// alerts carry the series' name label instead of app.
+func summary(e *Engine) []string {
+	out := []string{}
+	for _, a := range e.Alerts("") {
+		app := a.Labels["app"] + a.Labels["name"]
+		out = append(out, fmt.Sprintf("%s %s %s=%g", a.State, a.Labels["target"], app, a.Value))
+	}
+	slices.Sort(out)
+	return out
+}
+
+// Each kind of rule alerts on the series whose condition holds.
+func TestRuleKinds(t *testing.T) {
+	store := storagetest.Open(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	store.StoreMetrics("web", "h1", nil, now.Add(-time.Minute), appGauge("pm2_memory_mb", map[string]float64{"api": 300, "worker": 50}))
+	store.StoreMetrics("web", "h2", nil, now.Add(-10*time.Minute), appGauge("pm2_memory_mb", map[string]float64{"api": 900}))
+	store.StoreProcesses("web", "h1", nil, now.Add(-20*time.Minute), procs(0, "online"))
+	store.StoreProcesses("web", "h1", nil, now.Add(-10*time.Minute), procs(1, "online"))
+	store.StoreProcesses("web", "h1", nil, now.Add(-time.Minute), procs(4, "stopped"))
+
+	for _, c := range []struct {
+		rule config.AlertRule
+		want []string
+	}{
+		// h2's scrape is older than the staleness limit
+		{config.AlertRule{Kind: KindMetric, Metric: "pm2_memory_mb", Threshold: 100}, []string{"firing h1 api=300"}},
+		{config.AlertRule{Kind: KindMetric, Metric: "pm2_memory_mb", App: "worker", Op: "<", Threshold: 100}, []string{"firing h1 worker=50"}},
+		{config.AlertRule{Kind: KindMetric, Metric: "pm2_cpu", Threshold: 0}, []string{}},
+		{config.AlertRule{Kind: KindRestarts, Window: 5 * time.Minute, Op: ">=", Threshold: 3}, []string{"firing h1 api=3"}},
+		{config.AlertRule{Kind: KindRestarts, Window: 15 * time.Minute, Threshold: 3}, []string{"firing h1 api=4"}},
+		{config.AlertRule{Kind: KindRestarts, Window: 5 * time.Minute, Threshold: 3}, []string{}},
+		// no snapshot was in effect at the start of the window
+		{config.AlertRule{Kind: KindRestarts, Window: time.Hour}, []string{}},
+		{config.AlertRule{Kind: KindStatus}, []string{"firing h1 worker=1"}},
+		{config.AlertRule{Kind: KindStatus, Status: "stopped", Op: "==", App: "api"}, []string{}},
+		{config.AlertRule{Kind: KindStatus, Status: "online", Op: "==", Target: "h1"}, []string{"firing h1 api=1"}},
+	} {
+		c.rule.Name = "Rule"
+		e := newEngine(t, store, c.rule)
+		e.Evaluate(now)
+		if got := summary(e); !slices.Equal(got, c.want) {
+			t.Errorf("%+v: got %v, want %v", c.rule, got, c.want)
+		}
+	}
+}
+
+// log_match rules count the matching lines that were stored within the
+// window.
+func TestRuleLogMatch(t *testing.T) {
+	store := storagetest.Open(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	rules := []config.AlertRule{
+		{Name: "Errors", Kind: KindLogMatch, Pattern: "ERROR|FATAL", Window: 5 * time.Minute, Threshold: 2},
+		{Name: "WorkerErrors", Kind: KindLogMatch, Pattern: "ERROR", App: "worker", Window: 5 * time.Minute},
+		{Name: "Storm", Kind: KindLogMatch, Pattern: "ERROR", Window: 5 * time.Minute, Threshold: 10},
+	}
+	e := newEngine(t, store, rules...)
+	w := e.WrapStore(store)
+	w.StoreLog("web", "h1", nil, now.Add(-time.Hour), "[api] ERROR old")
+	w.StoreLog("web", "h1", nil, now.Add(-3*time.Minute), "[api] ERROR one")
+	w.StoreLog("web", "h1", nil, now.Add(-2*time.Minute), "[api] FATAL two")
+	w.StoreLog("web", "h1", nil, now.Add(-time.Minute), "[api] ERROR three")
+	w.StoreLog("web", "h1", nil, now.Add(-time.Minute), "[api] all good")
+	w.StoreLog("web", "h1", nil, now.Add(-time.Minute), "[worker] ERROR once")
+	e.Evaluate(now)
+
+	got := map[string][]string{}
+	for _, a := range e.Alerts("") {
+		got[a.Rule] = append(got[a.Rule], fmt.Sprintf("%s=%g", a.Labels["app"], a.Value))
+	}
+	if !slices.Equal(got["Errors"], []string{"api=3"}) || !slices.Equal(got["WorkerErrors"], []string{"worker=1"}) || len(got["Storm"]) != 0 {
+		t.Fatalf("log_match alerts: %v", got)
+	}
+
+	// lines age out of the window
+	e.Evaluate(now.Add(5 * time.Minute))
+	if got := e.Alerts(StateFiring); len(got) != 0 {
+		t.Fatalf("alerts after the lines left the window: %+v", got)
+	}
+}
+
+// An alert is pending until its condition held for the rule's for, fires,
+// resolves when the condition stops holding and is forgotten after
+// resolvedRetention; one that stops while pending is dropped.
+func TestAlertLifecycle(t *testing.T) {
+	store := storagetest.Open(t)
+	t0 := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	store.StoreMetrics("web", "h1", nil, t0, appGauge("pm2_memory_mb", map[string]float64{"api": 300}))
+	e := newEngine(t, store,
+		config.AlertRule{Name: "HighMemory", Kind: KindMetric, Metric: "pm2_memory_mb", Threshold: 100, For: 2 * time.Minute,
+			Labels: map[string]string{"severity": "page"}, Annotations: map[string]string{"summary": "{{ .Labels.name }} uses {{ .Value }}MB"}},
+		config.AlertRule{Name: "SlowHighMemory", Kind: KindMetric, Metric: "pm2_memory_mb", Threshold: 100, For: 10 * time.Minute},
+	)
+	state := func(rule string) string {
+		for _, a := range e.Alerts("") {
+			if a.Rule == rule {
+				return a.State
+			}
+		}
+		return ""
+	}
+
+	for _, c := range []struct {
+		at         time.Duration
+		fast, slow string
+	}{
+		{0, StatePending, StatePending},
+		{time.Minute, StatePending, StatePending},
+		{2 * time.Minute, StateFiring, StatePending},
+	} {
+		e.Evaluate(t0.Add(c.at))
+		if got, slow := state("HighMemory"), state("SlowHighMemory"); got != c.fast || slow != c.slow {
+			t.Fatalf("after %v: %s and %s, want %s and %s", c.at, got, slow, c.fast, c.slow)
+		}
+	}
+	a := e.Alerts(StateFiring)[0]
+	if !a.ActiveAt.Equal(t0) || !a.FiredAt.Equal(t0.Add(2*time.Minute)) || a.Labels["severity"] != "page" || a.Labels["alertname"] != "HighMemory" ||
+		a.Annotations["summary"] != "api uses 300MB" {
+		t.Fatalf("firing alert: %+v", a)
+	}
+	if rs := e.Rules(); rs[0].Active != 1 || rs[0].LastError != "" || !rs[0].LastEval.Equal(t0.Add(2*time.Minute)) {
+		t.Fatalf("rule status: %+v", rs[0])
+	}
+
+	store.StoreMetrics("web", "h1", nil, t0.Add(3*time.Minute), appGauge("pm2_memory_mb", map[string]float64{"api": 50}))
+	e.Evaluate(t0.Add(3 * time.Minute))
+	if got, slow := state("HighMemory"), state("SlowHighMemory"); got != StateResolved || slow != "" {
+		t.Fatalf("after the condition cleared: %s and %q", got, slow)
+	}
+	if a := e.Alerts(StateResolved)[0]; !a.ResolvedAt.Equal(t0.Add(3 * time.Minute)) {
+		t.Fatalf("resolved alert: %+v", a)
+	}
+	e.Evaluate(t0.Add(3*time.Minute + resolvedRetention))
+	if got := state("HighMemory"); got != StateResolved {
+		t.Fatalf("resolved alert dropped within the retention: %q", got)
+	}
+	e.Evaluate(t0.Add(4*time.Minute + resolvedRetention))
+	if got := e.Alerts(""); len(got) != 0 {
+		t.Fatalf("alerts after the retention: %+v", got)
+	}
+
+	// a condition holding again starts a new alert
+	store.StoreMetrics("web", "h1", nil, t0.Add(20*time.Minute), appGauge("pm2_memory_mb", map[string]float64{"api": 400}))
+	e.Evaluate(t0.Add(20 * time.Minute))
+	if got := e.Alerts("HighMemory"); len(got) != 0 {
+		t.Fatalf("state filter: %+v", got)
+	}
+	if got := e.Alerts(StatePending); len(got) != 2 || !got[0].ActiveAt.Equal(t0.Add(20*time.Minute)) {
+		t.Fatalf("new alerts: %+v", got)
+	}
+}
+
+// Invalid rules are rejected when the engine is built.
+func TestCompileRuleErrors(t *testing.T) {
+	for _, c := range []struct {
+		rules []config.AlertRule
+		err   string
+	}{
+		{[]config.AlertRule{{Kind: KindMetric, Metric: "up"}}, "without name"},
+		{[]config.AlertRule{{Name: "a", Kind: KindMetric}}, "metric is required"},
+		{[]config.AlertRule{{Name: "a", Kind: KindMetric, Metric: "up", Op: "~"}}, "unknown op"},
+		{[]config.AlertRule{{Name: "a", Kind: KindRestarts}}, "window is required"},
+		{[]config.AlertRule{{Name: "a", Kind: KindTargetDown}}, "window is required"},
+		{[]config.AlertRule{{Name: "a", Kind: KindStatus, Op: ">"}}, "only support == and !="},
+		{[]config.AlertRule{{Name: "a", Kind: KindLogMatch, Window: time.Minute, Pattern: "("}}, "pattern"},
+		{[]config.AlertRule{{Name: "a", Kind: "cpu"}}, "unknown kind"},
+		{[]config.AlertRule{{Name: "a", Kind: KindMetric, Metric: "up", Annotations: map[string]string{"x": "{{"}}}, "annotation"},
+		{[]config.AlertRule{{Name: "a", Kind: KindStatus}, {Name: "a", Kind: KindStatus}}, "duplicate"},
+	} {
+		_, err := NewEngine(config.AlertingConfig{Rules: c.rules}, Targets{Scraped: discovery.NewHealth()}, nil)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%+v: got %v, want %q", c.rules, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// internal/api/export.go
+package api
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/export"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+// startedWriter records whether any output has reached the client, after
+// which an error can no longer change the response status.
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (s *startedWriter) Write(p []byte) (int, error) {
+	s.started = true
+	return s.w.Write(p)
+}
+
+// exportHandler streams the metrics, processes or logs matching the query
+// as CSV, NDJSON or Parquet, gzip-compressed with compression=gzip. Rows are
+// sent as they are read, so a failure after the first cuts the output
+// short; it is then reported in the X-Export-Error trailer. The
+// X-Export-Rows trailer counts the rows sent.
+func exportHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
+		params := r.URL.Query()
+		req := export.Request{
+			Dataset:    mux.Vars(r)["dataset"],
+			Format:     params.Get("format"),
+			Metric:     params.Get("metric"),
+			Resolution: params.Get("resolution"),
+			Search:     params.Get("q"),
+			Query:      storage.Selector{Job: params.Get("job"), Target: params.Get("target"), App: params.Get("app"), Matchers: ms},
+		}
+		if v := params.Get("columns"); v != "" {
+			for _, c := range strings.Split(v, ",") {
+				req.Columns = append(req.Columns, strings.TrimSpace(c))
+			}
+		}
+		for name, t := range map[string]*time.Time{"start": &req.Query.Start, "end": &req.Query.End} {
+			if v := params.Get(name); v != "" {
+				ts, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid %s: %v", name, err), http.StatusBadRequest)
+					return
+				}
+				*t = ts
+			}
+		}
+		if v := params.Get("step"); v != "" {
+			step, err := parseStep(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Step = step
+		}
+		if req.Search != "" && req.Dataset != "logs" {
+			http.Error(w, "q only applies to the logs dataset", http.StatusBadRequest)
+			return
+		}
+		if err := req.Check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		out := &startedWriter{w: w}
+		var dst io.Writer = out
+		contentType, filename := req.ContentType(), req.Filename()
+		var gz *gzip.Writer
+		switch params.Get("compression") {
+		case "", "none":
+		case "gzip":
+			gz = gzip.NewWriter(out)
+			dst = gz
+			contentType, filename = "application/gzip", filename+".gz"
+		default:
+			http.Error(w, "compression must be gzip or none", http.StatusBadRequest)
+			return
+		}
+		flusher, _ := w.(http.Flusher)
+		flush := func() error {
+			if gz != nil {
+				if err := gz.Flush(); err != nil {
+					return err
+				}
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		w.Header().Set("Trailer", "X-Export-Rows, X-Export-Error")
+		n, err := export.Write(store, req, dst, flush)
+		if err == nil && gz != nil {
+			err = gz.Close()
+		}
+		if err != nil && !out.started {
+			w.Header().Del("Content-Disposition")
+			w.Header().Del("Trailer")
+			status := http.StatusInternalServerError
+			if errors.Is(err, storage.ErrBadQuery) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("X-Export-Rows", strconv.FormatInt(n, 10))
+		if err != nil {
+			w.Header().Set("X-Export-Error", err.Error())
+			log.Printf("export %s: %v after %d rows", req.Dataset, err, n)
+		}
+	}
+}
@@ -3,36 +3,99 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/aalish/pm2-full/internal/alerting"
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/labels"
+	"github.com/aalish/pm2-full/internal/notify"
 	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/gorilla/mux"
 )
 
 // docsHandler returns available endpoints and their parameter requirements
 func docsHandler(w http.ResponseWriter, r *http.Request) {
 	docs := map[string]interface{}{
-		"/docs":      map[string]interface{}{"method": "GET", "description": "lists available endpoints"},
-		"/query":     map[string]interface{}{"method": "GET", "params": []string{"job", "target", "metric", "start (RFC3339)", "end (RFC3339)"}},
-		"/processes": map[string]interface{}{"method": "GET", "params": []string{"job (optional)", "target (optional)"}},
-		"/logs":      map[string]interface{}{"method": "GET", "params": []string{"job (optional)", "target (optional)"}},
-		"/apps":      map[string]interface{}{"method": "GET", "params": []string{"job (optional)", "target (optional)"}},
+		"/docs":                     map[string]interface{}{"method": "GET", "description": "lists available endpoints; with tenants configured, a tenant's credentials reach only the data, alerts, silences and targets of its jobs, and the API's reach a tenant's with ?tenant=<name> on any endpoint"},
+		"/query":                    map[string]interface{}{"method": "GET", "params": []string{"job", "target", "metric", "start (RFC3339)", "end (RFC3339)", "step (optional, duration or seconds)", "resolution (optional: raw, 5m, 1h; default picks by range and step)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}, "description": "raw scrapes, or rollup records (resolution, series with min, max, avg, last, count) for long ranges or coarse steps"},
+		"/processes":                map[string]interface{}{"method": "GET", "params": []string{"job (optional)", "target (optional)", "start (RFC3339, optional)", "end (RFC3339, optional)", "at (RFC3339, optional)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}},
+		"/processes/timeline":       map[string]interface{}{"method": "GET", "params": []string{"job", "target", "app (optional)", "start (RFC3339, optional)", "end (RFC3339, optional)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}},
+		"/processes/diff":           map[string]interface{}{"method": "GET", "params": []string{"job", "target", "app (optional)", "from (RFC3339)", "to (RFC3339, optional)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}},
+		"/logs":                     map[string]interface{}{"method": "GET", "params": []string{"job (optional)", "target (optional)", "app (optional)", "start (RFC3339, optional)", "end (RFC3339, optional)", "direction (optional: backward from end, the default, or forward from start)", "limit (optional, default 100, max 5000; lines is accepted too)", "cursor (optional, X-Next-Cursor of the previous page or the cursor of any line)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}, "description": "log lines of all matching apps merged by timestamp; X-Next-Cursor is set when more follow"},
+		"/logs/search":              map[string]interface{}{"method": "GET", "params": []string{"q (terms, \"phrases\", prefix*, /regex/, AND, OR, NOT or -, parentheses)", "job (optional)", "target (optional)", "app (optional)", "start (RFC3339, optional)", "end (RFC3339, optional)", "direction (optional: backward, the default, or forward)", "limit (optional, default 100, max 1000)", "cursor (optional, next_cursor of the previous page)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}, "description": "full-text log search, newest first unless forward; highlights are byte ranges of line"},
+		"/logs/tail":                map[string]interface{}{"method": "GET", "params": []string{"job (optional)", "target (optional)", "app (optional)", "regex (optional, on the message)", "lines (optional, stored lines replayed first, default 15)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}, "description": "follows newly ingested log lines as Server-Sent Events, or JSON messages on a WebSocket upgrade; {\"dropped\": n} reports lines skipped for a slow client"},
+		"/target":                   map[string]interface{}{"method": "GET", "params": []string{"label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}, "description": "targets with any stored logs, metrics, processes or events"},
+		"/jobs":                     map[string]interface{}{"method": "GET", "params": []string{"target", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}},
+		"/apps":                     map[string]interface{}{"method": "GET", "params": []string{"job (optional)", "target (optional)", "start (RFC3339, optional)", "end (RFC3339, optional)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}, "description": "apps with stored logs or processes; with start or end, the apps in the process snapshots of that range"},
+		"/streams":                  map[string]interface{}{"method": "GET", "params": []string{"kind (optional: logs, metrics, metrics5m, metrics1h, processes, events)", "job (optional)", "target (optional)", "app (optional)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}, "description": "catalog of stored streams with their location in the data directory and latest labels"},
+		"/alerts":                   map[string]interface{}{"method": "GET", "params": []string{"state (optional: pending, firing, resolved)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}},
+		"/alerts/rules":             map[string]interface{}{"method": "GET", "description": "lists alert rules and their last evaluation"},
+		"/silences":                 map[string]interface{}{"method": "GET, POST, DELETE /silences/{id}", "description": "lists, creates (JSON: matchers, starts_at, ends_at or duration, created_by, comment) and deletes notification silences"},
+		"/targets":                  map[string]interface{}{"method": "GET", "params": []string{"job (optional)", "health (optional: up, degraded, down, unknown)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}},
+		"/retention/preview":        map[string]interface{}{"method": "GET", "description": "dry run: the segments the next retention round would delete (by age or size, with the rule that applied) and the processes/events files with records to prune"},
+		"/snapshots":                map[string]interface{}{"method": "GET, POST, DELETE /snapshots/{name}", "description": "lists, takes and deletes point-in-time snapshots of the data directory (in <directory>/snapshots, with a manifest of file sizes and SHA-256 checksums)"},
+		"/snapshots/{name}/archive": map[string]interface{}{"method": "GET", "description": "the snapshot as a tar archive, manifest.json first; restore it with collector restore"},
+		"/snapshots/{name}/verify":  map[string]interface{}{"method": "GET", "description": "checks the files of a snapshot against its manifest"},
+		"/export/{dataset}":         map[string]interface{}{"method": "GET", "params": []string{"dataset (path: metrics, processes or logs)", "format (optional: csv, the default, ndjson or parquet)", "columns (optional, comma-separated; label.<name> for one label; default all)", "compression (optional: gzip)", "job (optional)", "target (optional)", "app (optional, processes and logs)", "start (RFC3339, optional)", "end (RFC3339, optional)", "metric (optional, metrics)", "step (optional, metrics)", "resolution (optional, metrics: raw, 5m, 1h)", "q (optional, logs: search query)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}, "description": "streams rows oldest first as they are read; metrics columns: timestamp, job, target, resolution, metric, labels, value, min, max, avg, count, target_labels; processes: timestamp, job, target, name, pm_id, pid, status, restart_time, version, env_hash, target_labels; logs: timestamp, job, target, app, line, target_labels. X-Export-Rows and X-Export-Error trailers report the outcome"},
+		"/metrics":                  map[string]interface{}{"method": "GET", "description": "collector self metrics in Prometheus text format"},
+		"/ingest/metrics":           map[string]interface{}{"method": "POST", "params": []string{"job", "instance", "label (optional, repeatable: name=value)"}, "description": "push mode: Prometheus text body; X-PM2-Timestamp header (RFC3339) sets the collection time; 429 when over the series quota of the job's tenant"},
+		"/ingest/processes":         map[string]interface{}{"method": "POST", "params": []string{"job", "instance", "label (optional, repeatable: name=value)"}, "description": "push mode: /processes JSON body; X-PM2-Timestamp header (RFC3339) sets the collection time"},
+		"/ingest/logs":              map[string]interface{}{"method": "POST", "params": []string{"job", "instance", "label (optional, repeatable: name=value)"}, "description": "push mode: newline-delimited JSON {timestamp, line} or spooled {stream, seq, timestamp, line}; replies with the stored sequence number per stream; 429 once over the daily log quota of the job's tenant"},
+		"/events":                   map[string]interface{}{"method": "GET", "params": []string{"job (optional)", "target (optional)", "app (optional)", "type (optional, comma-separated)", "start (RFC3339, optional)", "end (RFC3339, optional)", "limit (optional)", "label (optional, repeatable: name=value, name!=value, name=~regex, name!~regex)"}},
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(docs)
 }
 
+// labelMatchers parses the repeatable "label" parameter (env=prod, env!=dev,
+// team=~"web|api", team!~ops) into matchers. On error it writes a 400 and
+// returns false.
+func labelMatchers(w http.ResponseWriter, r *http.Request) ([]labels.Matcher, bool) {
+	var ms []labels.Matcher
+	for _, v := range r.URL.Query()["label"] {
+		m, err := labels.ParseMatcher(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		ms = append(ms, m)
+	}
+	return ms, true
+}
+
 // queryHandler returns metrics matching query parameters
 func queryHandler(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
 		job := r.URL.Query().Get("job")
 		target := r.URL.Query().Get("target")
 		// metric := r.URL.Query().Get("metric")
 		start, _ := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
 		end, _ := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+		var step time.Duration
+		if v := r.URL.Query().Get("step"); v != "" {
+			var err error
+			if step, err = parseStep(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		resolution := r.URL.Query().Get("resolution")
 
-		data, err := store.QueryMetrics(storage.QueryParams{Job: job, Target: target, Start: start, End: end})
+		data, err := store.QueryMetrics(storage.MetricQuery{Selector: storage.Selector{Job: job, Target: target, Start: start, End: end, Matchers: ms}, Step: step, Resolution: resolution})
+		if errors.Is(err, storage.ErrBadQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -43,16 +106,32 @@ func queryHandler(store storage.Store) http.HandlerFunc {
 	}
 }
 
+// parseStep reads a query step as a duration ("5m") or in seconds ("300").
+func parseStep(v string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(v, 64); err == nil && secs >= 0 {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid step %q", v)
+	}
+	return d, nil
+}
+
 // queryHandler returns metrics matching query parameters
 func appsHandler(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
 		job := r.URL.Query().Get("job")
 		target := r.URL.Query().Get("target")
 		// metric := r.URL.Query().Get("metric")
 		start, _ := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
 		end, _ := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
 
-		data, err := store.QueryApps(storage.QueryParams{Job: job, Target: target, Start: start, End: end})
+		data, err := store.QueryApps(storage.AppQuery{Selector: storage.Selector{Job: job, Target: target, Start: start, End: end, Matchers: ms}})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -66,9 +145,13 @@ func appsHandler(store storage.Store) http.HandlerFunc {
 // queryHandler returns metrics matching query parameters
 func jobsHandler(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
 		target := r.URL.Query().Get("target")
 
-		data, err := store.ListJobsByTarget(storage.QueryParams{Target: target})
+		data, err := store.ListJobsByTarget(storage.JobQuery{Target: target, Matchers: ms})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -82,8 +165,12 @@ func jobsHandler(store storage.Store) http.HandlerFunc {
 // queryHandler returns metrics matching query parameters
 func targetHandler(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
 
-		data, err := store.ListAllTargets()
+		data, err := store.ListAllTargets(storage.TargetQuery{Matchers: ms})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -94,14 +181,23 @@ func targetHandler(store storage.Store) http.HandlerFunc {
 	}
 }
 
-// processesHandler returns process snapshots filtered by job and/or target
+// processesHandler returns process snapshots filtered by job and/or target.
+// Without a time range only the latest snapshot is returned; "at" returns the
+// snapshot that was in effect at that instant.
 func processesHandler(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
 		job := r.URL.Query().Get("job")
 		target := r.URL.Query().Get("target")
 		app := r.URL.Query().Get("app")
+		start, _ := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+		end, _ := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+		at, _ := time.Parse(time.RFC3339, r.URL.Query().Get("at"))
 
-		data, err := store.QueryProcesses(storage.ProcessQuery{Job: job, Target: target, App: app})
+		data, err := store.QueryProcesses(storage.ProcessQuery{Selector: storage.Selector{Job: job, Target: target, App: app, Start: start, End: end, Matchers: ms}, At: at})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -115,20 +211,465 @@ func processesHandler(store storage.Store) http.HandlerFunc {
 // logsHandler returns log lines filtered by job and/or target
 func logsHandler(store storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
+		q, ok := logPaging(w, r, "lines")
+		if !ok {
+			return
+		}
+		q.Job = r.URL.Query().Get("job")
+		q.Target = r.URL.Query().Get("target")
+		q.App = r.URL.Query().Get("app")
+		q.Matchers = ms
+
+		page, err := store.QueryLogs(q)
+		if errors.Is(err, storage.ErrBadQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if page.NextCursor != "" {
+			w.Header().Set("X-Next-Cursor", page.NextCursor)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page.Lines)
+	}
+}
+
+// logPaging parses the time range, direction, limit and cursor of a log
+// query; alias is an older name for limit.
+func logPaging(w http.ResponseWriter, r *http.Request, alias string) (storage.LogQuery, bool) {
+	var q storage.LogQuery
+	params := r.URL.Query()
+	for name, t := range map[string]*time.Time{"start": &q.Start, "end": &q.End} {
+		if v := params.Get(name); v != "" {
+			ts, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %v", name, err), http.StatusBadRequest)
+				return q, false
+			}
+			*t = ts
+		}
+	}
+	switch params.Get("direction") {
+	case "", "backward":
+	case "forward":
+		q.Forward = true
+	default:
+		http.Error(w, "direction must be forward or backward", http.StatusBadRequest)
+		return q, false
+	}
+	limit := params.Get("limit")
+	if limit == "" && alias != "" {
+		limit = params.Get(alias)
+	}
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return q, false
+		}
+		q.NumLines = n
+	}
+	q.Cursor = params.Get("cursor")
+	return q, true
+}
+
+// logSearchHandler returns log lines matching a full-text query, newest first
+// unless direction=forward
+func logSearchHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
+		q := r.URL.Query().Get("q")
+		if strings.TrimSpace(q) == "" {
+			http.Error(w, "q is required", http.StatusBadRequest)
+			return
+		}
+		lq, ok := logPaging(w, r, "")
+		if !ok {
+			return
+		}
+		sq := storage.SearchQuery{LogQuery: lq, Search: q}
+		sq.Job = r.URL.Query().Get("job")
+		sq.Target = r.URL.Query().Get("target")
+		sq.App = r.URL.Query().Get("app")
+		sq.Matchers = ms
+
+		data, err := store.SearchLogs(sq)
+		if errors.Is(err, storage.ErrBadQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}
+}
+
+// retentionPreviewHandler returns what retention would delete now, without
+// deleting it
+func retentionPreviewHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.PreviewRetention())
+	}
+}
+
+// snapshotsHandler lists the snapshots of the data directory
+func snapshotsHandler(snaps storage.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := snaps.Snapshots()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// createSnapshotHandler takes a snapshot and returns its manifest
+func createSnapshotHandler(snaps storage.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m, err := snaps.Snapshot()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(m)
+	}
+}
+
+// deleteSnapshotHandler removes a snapshot by name
+func deleteSnapshotHandler(snaps storage.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := snaps.DeleteSnapshot(mux.Vars(r)["name"])
+		if errors.Is(err, storage.ErrNoSnapshot) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verifySnapshotHandler checks the files of a snapshot against its manifest
+func verifySnapshotHandler(snaps storage.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := snaps.VerifySnapshot(mux.Vars(r)["name"])
+		if errors.Is(err, storage.ErrNoSnapshot) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// snapshotArchiveHandler streams a snapshot as a tar archive
+func snapshotArchiveHandler(snaps storage.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="pm2-snapshot-%s.tar"`, name))
+		err := snaps.WriteSnapshotArchive(name, w)
+		if errors.Is(err, storage.ErrNoSnapshot) {
+			// nothing has been written yet
+			w.Header().Del("Content-Disposition")
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			// the archive is cut short, which the reader notices
+			log.Printf("snapshot archive %s: %v", name, err)
+		}
+	}
+}
+
+// streamsHandler lists the cataloged streams matching kind, job, target,
+// app and labels
+func streamsHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
+		params := r.URL.Query()
+		q := storage.CatalogQuery{Kind: params.Get("kind"), Job: params.Get("job"), Target: params.Get("target"), App: params.Get("app"), Matchers: ms}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.Catalog(q))
+	}
+}
+
+// processTimelineHandler returns the per-process state history for a job/target
+func processTimelineHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
 		job := r.URL.Query().Get("job")
 		target := r.URL.Query().Get("target")
 		app := r.URL.Query().Get("app")
-		numLines, err1 := strconv.Atoi(r.URL.Query().Get("lines"))
 		start, _ := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
 		end, _ := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
 
-		lines, err := store.QueryLogs(storage.LogQuery{Job: job, Target: target, App: app, Start: start, End: end, NumLines: numLines})
-		if err != nil || err1 != nil {
+		data, err := store.QueryProcessTimeline(storage.ProcessQuery{Selector: storage.Selector{Job: job, Target: target, App: app, Start: start, End: end, Matchers: ms}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}
+}
+
+// processDiffHandler compares the process states in effect at two points in time
+func processDiffHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
+		job := r.URL.Query().Get("job")
+		target := r.URL.Query().Get("target")
+		app := r.URL.Query().Get("app")
+		from, err := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(w, "from must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		to, _ := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
+
+		data, err := store.DiffProcesses(storage.ProcessQuery{Selector: storage.Selector{Job: job, Target: target, App: app, Start: from, End: to, Matchers: ms}})
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(lines)
+		json.NewEncoder(w).Encode(data)
+	}
+}
+
+// eventsHandler returns process events (restarts, crash loops, status changes, ...)
+func eventsHandler(store storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
+		job := r.URL.Query().Get("job")
+		target := r.URL.Query().Get("target")
+		app := r.URL.Query().Get("app")
+		start, _ := time.Parse(time.RFC3339, r.URL.Query().Get("start"))
+		end, _ := time.Parse(time.RFC3339, r.URL.Query().Get("end"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		var types []string
+		for _, v := range r.URL.Query()["type"] {
+			for _, t := range strings.Split(v, ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					types = append(types, t)
+				}
+			}
+		}
+
+		data, err := store.QueryEvents(storage.EventQuery{Selector: storage.Selector{Job: job, Target: target, App: app, Start: start, End: end, Matchers: ms}, NumLines: limit, Types: types})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}
+}
+
+// alertsHandler returns active and recently resolved alerts
+func alertsHandler(engine *alerting.Engine, sc scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
+		state := r.URL.Query().Get("state")
+
+		data := []alerting.Alert{}
+		for _, a := range engine.Alerts(state) {
+			if sc.allows(a.Labels["job"]) && labels.MatchAll(ms, a.Labels) {
+				data = append(data, a)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}
+}
+
+// alertRulesHandler returns the configured alert rules and their health.
+// A tenant sees the rules of its jobs and of all jobs, counting only the
+// active alerts of its own.
+func alertRulesHandler(engine *alerting.Engine, sc scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := engine.Rules()
+		if sc.tenant != nil {
+			active := make(map[string]int)
+			for _, a := range engine.Alerts("") {
+				if a.State != alerting.StateResolved && sc.allows(a.Labels["job"]) {
+					active[a.Rule]++
+				}
+			}
+			own := data[:0]
+			for _, rs := range data {
+				if rs.Job == "" || sc.allows(rs.Job) {
+					rs.Active = active[rs.Name]
+					own = append(own, rs)
+				}
+			}
+			data = own
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}
+}
+
+// silenceInScope reports whether a silence is visible in sc: for a tenant,
+// those matching one of its jobs by name with job=.
+func silenceInScope(sil notify.Silence, sc scope) bool {
+	if sc.tenant == nil {
+		return true
+	}
+	for _, m := range sil.Matchers {
+		if m.Name == "job" && !m.IsRegex && sc.allows(m.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// silencesHandler lists active silences
+func silencesHandler(n *notify.Notifier, sc scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := []notify.Silence{}
+		for _, sil := range n.Silences().List() {
+			if silenceInScope(sil, sc) {
+				data = append(data, sil)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}
+}
+
+// createSilenceHandler adds a silence; "duration" may be given instead of ends_at.
+// A tenant's silences must match one of its jobs with job=.
+func createSilenceHandler(n *notify.Notifier, sc scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			notify.Silence
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sil := req.Silence
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil {
+				http.Error(w, "duration: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if sil.StartsAt.IsZero() {
+				sil.StartsAt = time.Now().UTC()
+			}
+			sil.EndsAt = sil.StartsAt.Add(d)
+		}
+		if !silenceInScope(sil, sc) {
+			http.Error(w, "silence must match one of your jobs with job=", http.StatusForbidden)
+			return
+		}
+
+		created, err := n.Silences().Add(sil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+// deleteSilenceHandler removes a silence by id
+func deleteSilenceHandler(n *notify.Notifier, sc scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if sc.tenant != nil {
+			visible := false
+			for _, sil := range n.Silences().List() {
+				visible = visible || (sil.ID == id && silenceInScope(sil, sc))
+			}
+			if !visible {
+				http.Error(w, "silence not found", http.StatusNotFound)
+				return
+			}
+		}
+		ok, err := n.Silences().Delete(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "silence not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// targetsHealthHandler returns the scrape health of every target
+func targetsHealthHandler(health *discovery.Health, sc scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
+		job := r.URL.Query().Get("job")
+		state := r.URL.Query().Get("health")
+
+		data := []discovery.TargetHealth{}
+		for _, th := range health.Targets() {
+			if (job == "" || th.Job == job) && sc.allows(th.Job) && (state == "" || th.Health == state) && labels.MatchAll(ms, th.Labels) {
+				data = append(data, th)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
 	}
 }
@@ -0,0 +1,335 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/aalish/pm2-full/internal/storage/storagetest"
+)
+
+var testCfg = config.APIConfig{BasicAuth: config.AuthCreds{Username: "admin", Password: "pw"}}
+
+func newHandler(t *testing.T, cfg config.APIConfig, svc Services) http.Handler {
+	t.Helper()
+	h, err := Handler(cfg, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// get requests path from h with the API credentials.
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.SetBasicAuth("admin", "pw")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// /logs pages through the lines with X-Next-Cursor, in both directions.
+func TestLogsPaging(t *testing.T) {
+	store := storagetest.Open(t)
+	t0 := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	for i, line := range []string{"one", "two", "three", "four", "five"} {
+		store.StoreLog("web", "h1", nil, t0.Add(time.Duration(i)*time.Second), "[api] "+line)
+	}
+	h := newHandler(t, testCfg, Services{Store: store})
+
+	pages := func(direction string) []string {
+		t.Helper()
+		var got []string
+		cursor := ""
+		for {
+			q := url.Values{"job": {"web"}, "limit": {"2"}, "direction": {direction}, "cursor": {cursor}}
+			rec := get(h, "/logs?"+q.Encode())
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/logs: %d %s", rec.Code, rec.Body)
+			}
+			var lines []storage.LogLine
+			if err := json.NewDecoder(rec.Body).Decode(&lines); err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range lines {
+				got = append(got, l.Line)
+			}
+			if cursor = rec.Header().Get("X-Next-Cursor"); cursor == "" {
+				return got
+			}
+		}
+	}
+	if got := pages("forward"); len(got) != 5 || got[0] != "one" || got[4] != "five" {
+		t.Fatalf("forward: %v", got)
+	}
+	if got := pages("backward"); len(got) != 5 || got[0] != "five" || got[4] != "one" {
+		t.Fatalf("backward: %v", got)
+	}
+
+	for _, bad := range []string{"direction=up", "limit=-1", "start=yesterday", "cursor=nonsense"} {
+		if rec := get(h, "/logs?"+bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("/logs?%s: got %d, want 400", bad, rec.Code)
+		}
+	}
+}
+
+// /export streams the rows, gzip-compressed on request, and counts them
+// in a trailer; bad requests fail before any output.
+func TestExportHandler(t *testing.T) {
+	store := storagetest.Open(t)
+	t0 := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	store.StoreLog("web", "h1", nil, t0, "[api] one")
+	store.StoreLog("web", "h1", nil, t0.Add(time.Second), "[api] two")
+	h := newHandler(t, testCfg, Services{Store: store})
+
+	rec := get(h, "/export/logs?job=web&columns=app,line&compression=gzip")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("export: %d %s", rec.Code, rec.Header())
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="logs.csv.gz"` {
+		t.Fatalf("content disposition: %s", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "app,line\napi,one\napi,two\n" {
+		t.Fatalf("export body: %q", body)
+	}
+	if got := rec.Result().Trailer.Get("X-Export-Rows"); got != "2" {
+		t.Fatalf("rows trailer: %q", got)
+	}
+
+	for _, path := range []string{
+		"/export/logs?columns=value",
+		"/export/metrics?q=error",
+		"/export/logs?compression=zstd",
+		"/export/logs?start=yesterday",
+	} {
+		if rec := get(h, path); rec.Code != http.StatusBadRequest || rec.Header().Get("Content-Disposition") != "" {
+			t.Errorf("%s: %d %s", path, rec.Code, rec.Body)
+		}
+	}
+}
+
+// Jobs, targets and apps whose names hold path separators or ".." are
+// stored under the data directory and listed under their own names.
+func TestPathLikeNames(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "data")
+	store, err := storage.Open(config.StorageConfig{Type: "disk", Directory: dir, FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const job, target = "../../etc", "a/b"
+	t0 := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	store.StoreLog(job, target, nil, t0, "[../app] hello")
+	store.StoreProcesses(job, target, nil, t0, []byte(`[{"name":"../app","pm_id":0,"status":"online"}]`))
+	store.StoreMetrics(job, target, nil, t0, nil)
+
+	h := newHandler(t, testCfg, Services{Store: store})
+	names := func(path string) []string {
+		t.Helper()
+		rec := get(h, path)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", path, rec.Code, rec.Body)
+		}
+		var raw []json.RawMessage
+		if err := json.NewDecoder(rec.Body).Decode(&raw); err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, r := range raw {
+			var s string
+			if json.Unmarshal(r, &s) != nil {
+				var app struct{ Name string }
+				json.Unmarshal(r, &app)
+				s = app.Name
+			}
+			out = append(out, s)
+		}
+		return out
+	}
+	if got := names("/target"); !slices.Equal(got, []string{target}) {
+		t.Errorf("/target: %v", got)
+	}
+	if got := names("/jobs?target=" + url.QueryEscape(target)); !slices.Equal(got, []string{job}) {
+		t.Errorf("/jobs: %v", got)
+	}
+	if got := names("/apps?job=" + url.QueryEscape(job) + "&target=" + url.QueryEscape(target)); !slices.Equal(got, []string{"../app"}) {
+		t.Errorf("/apps: %v", got)
+	}
+	if rec := get(h, "/logs?job="+url.QueryEscape(job)+"&app=../app"); !strings.Contains(rec.Body.String(), "hello") {
+		t.Errorf("/logs: %d %s", rec.Code, rec.Body)
+	}
+
+	// closing writes out what is still buffered
+	store.Close()
+	if entries, _ := os.ReadDir(parent); len(entries) != 1 || entries[0].Name() != "data" {
+		t.Fatalf("created beside the data directory: %v", entries)
+	}
+	// each stream is one entry of the data directory, named with its
+	// separators escaped; rollups may have been added beside the raw data
+	kinds := make(map[string]bool)
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.Name() == "catalog.json" {
+			continue
+		}
+		kind, rest, _ := strings.Cut(strings.TrimSuffix(e.Name(), ".jsonl"), "_")
+		if rest != "..%2F..%2Fetc_a%2Fb" && rest != "..%2F..%2Fetc_a%2Fb_..%2Fapp" {
+			t.Errorf("data directory entry %s", e.Name())
+		}
+		kinds[kind] = true
+	}
+	if !kinds["logs"] || !kinds["metrics"] || !kinds["processes"] {
+		t.Errorf("stream kinds stored: %v", kinds)
+	}
+}
+
+// /targets lists the scrape health of every target, filtered by job,
+// health and labels.
+func TestTargetsHealthHandler(t *testing.T) {
+	// an exporter serving metrics but not processes or logs
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "up 1\n")
+	}))
+	defer exporter.Close()
+	portOf := func(srv *httptest.Server) int {
+		u, _ := url.Parse(srv.URL)
+		port, _ := strconv.Atoi(u.Port())
+		return port
+	}
+	port := portOf(exporter)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedPort := portOf(closed)
+	closed.Close()
+
+	health := discovery.NewHealth()
+	s := discovery.NewScheduler(storagetest.Open(t), health, 0)
+	paths := config.Paths{Metrics: "/metrics", Processes: "/processes", Logs: "/logs"}
+	for _, job := range []config.Job{
+		{JobName: "web", Interval: 50 * time.Millisecond, Paths: paths, Labels: map[string]string{"env": "prod"}, Targets: []config.Target{{Host: "127.0.0.1", Port: port}}},
+		{JobName: "batch", Interval: 50 * time.Millisecond, Paths: paths, Targets: []config.Target{{Host: "127.0.0.1", Port: closedPort}}},
+	} {
+		if err := s.Start(job); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop(job.JobName)
+	}
+	h := newHandler(t, testCfg, Services{Store: storagetest.Open(t), Health: health})
+	list := func(query string) []discovery.TargetHealth {
+		t.Helper()
+		rec := get(h, "/targets"+query)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/targets%s: %d %s", query, rec.Code, rec.Body)
+		}
+		var out []discovery.TargetHealth
+		if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		ths := list("")
+		if len(ths) == 2 && ths[0].Health == discovery.HealthDown && ths[1].Health == discovery.HealthDegraded &&
+			ths[1].Endpoints[discovery.EndpointMetrics].Up && ths[1].Endpoints[discovery.EndpointProcesses].Failures > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("targets: %+v", ths)
+		}
+	}
+
+	web := list("?job=web")
+	if len(web) != 1 || web[0].Target != "127.0.0.1:"+strconv.Itoa(port) || web[0].Labels["env"] != "prod" {
+		t.Fatalf("web targets: %+v", web)
+	}
+	if m := web[0].Endpoints[discovery.EndpointMetrics]; m == nil || !m.Up || m.Samples != 1 || m.URL != exporter.URL+"/metrics" {
+		t.Errorf("metrics endpoint: %+v", m)
+	}
+	if p := web[0].Endpoints[discovery.EndpointProcesses]; p == nil || p.Up || p.LastError == "" {
+		t.Errorf("processes endpoint: %+v", p)
+	}
+	if got := list("?health=down"); len(got) != 1 || got[0].Job != "batch" {
+		t.Errorf("down targets: %+v", got)
+	}
+	if got := list("?label=env=prod"); len(got) != 1 || got[0].Job != "web" {
+		t.Errorf("env=prod targets: %+v", got)
+	}
+	if got := list("?health=up"); len(got) != 0 {
+		t.Errorf("up targets: %+v", got)
+	}
+}
+
+// /events filters by type, given as a list or repeated, and by time, and
+// returns the latest limit events.
+func TestEventsHandler(t *testing.T) {
+	store := storagetest.Open(t)
+	t0 := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	for i, snap := range []string{
+		`[{"name":"api","pm_id":0,"pid":100,"status":"online","restart_time":0}]`,
+		`[{"name":"api","pm_id":0,"pid":101,"status":"online","restart_time":1}]`,
+		`[{"name":"api","pm_id":0,"pid":101,"status":"stopped","restart_time":1},{"name":"cron","pm_id":1,"pid":300,"status":"online","restart_time":0}]`,
+	} {
+		store.StoreProcesses("web", "h1", nil, t0.Add(time.Duration(i)*time.Minute), []byte(snap))
+	}
+	h := newHandler(t, testCfg, Services{Store: store})
+	types := func(query string) []string {
+		t.Helper()
+		rec := get(h, "/events"+query)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/events%s: %d %s", query, rec.Code, rec.Body)
+		}
+		var evs []storage.Event
+		if err := json.NewDecoder(rec.Body).Decode(&evs); err != nil {
+			t.Fatal(err)
+		}
+		out := []string{}
+		for _, ev := range evs {
+			out = append(out, ev.Type)
+		}
+		return out
+	}
+	at := func(min int) string {
+		return url.QueryEscape(t0.Add(time.Duration(min) * time.Minute).Format(time.RFC3339))
+	}
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"restart", "pid_change", "status_change", "app_added"}},
+		{"?type=restart,app_added", []string{"restart", "app_added"}},
+		{"?type=restart&type=status_change", []string{"restart", "status_change"}},
+		{"?limit=1", []string{"app_added"}},
+		{"?start=" + at(2), []string{"status_change", "app_added"}},
+		{"?end=" + at(1), []string{"restart", "pid_change"}},
+		{"?app=cron", []string{"app_added"}},
+		{"?job=batch", []string{}},
+	} {
+		if got := types(c.query); !slices.Equal(got, c.want) {
+			t.Errorf("/events%s: got %v, want %v", c.query, got, c.want)
+		}
+	}
+}
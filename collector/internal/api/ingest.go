@@ -0,0 +1,244 @@
+// File: internal/api/ingest.go
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/labels"
+	"github.com/aalish/pm2-full/internal/tenant"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// TimestampHeader carries the time a pushed snapshot was collected, so data
+// replayed from an exporter's buffer keeps its original time.
+const TimestampHeader = "X-PM2-Timestamp"
+
+// pushSource identifies the exporter behind a push request: its job,
+// instance (used as the target) and labels.
+type pushSource struct {
+	job, target string
+	labels      map[string]string
+}
+
+// parsePushSource reads job, instance and repeatable label=name=value query
+// parameters. On error it writes a 400 or 403 and returns false.
+func parsePushSource(w http.ResponseWriter, r *http.Request, cfg config.IngestConfig) (pushSource, bool) {
+	q := r.URL.Query()
+	src := pushSource{job: q.Get("job"), target: q.Get("instance")}
+	if src.job == "" || src.target == "" || strings.ContainsAny(src.job+src.target, "/*?[") {
+		http.Error(w, "job and instance are required", http.StatusBadRequest)
+		return src, false
+	}
+	if len(cfg.Jobs) > 0 && !matchesAny(cfg.Jobs, src.job) {
+		http.Error(w, fmt.Sprintf("job %q may not push", src.job), http.StatusForbidden)
+		return src, false
+	}
+	src.labels = map[string]string{labels.JobLabel: src.job, labels.InstanceLabel: src.target}
+	for _, v := range q["label"] {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok || name == "" || strings.HasPrefix(name, "__") {
+			http.Error(w, fmt.Sprintf("label %q: expected name=value", v), http.StatusBadRequest)
+			return src, false
+		}
+		if name == labels.JobLabel || name == labels.InstanceLabel {
+			continue
+		}
+		src.labels[name] = value
+	}
+	return src, true
+}
+
+// pushTime returns the collection time of a push, defaulting to now.
+func pushTime(r *http.Request) (time.Time, error) {
+	v := r.Header.Get(TimestampHeader)
+	if v == "" {
+		return time.Now(), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// ingestMetricsHandler accepts a Prometheus text-format body from an exporter
+func ingestMetricsHandler(cfg config.IngestConfig, store discovery.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		src, ok := parsePushSource(w, r, cfg)
+		if !ok {
+			return
+		}
+		ts, err := pushTime(r)
+		if err != nil {
+			http.Error(w, TimestampHeader+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		parser := &expfmt.TextParser{}
+		mfs, err := parser.TextToMetricFamilies(http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if a, ok := store.(admitter); ok {
+			if err := a.AdmitMetrics(src.job, src.target, mfs); err != nil {
+				ingestError(w, err)
+				return
+			}
+		}
+		store.StoreMetrics(src.job, src.target, src.labels, ts, mfs)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ingestProcessesHandler accepts a /processes JSON payload from an exporter
+func ingestProcessesHandler(cfg config.IngestConfig, store discovery.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		src, ok := parsePushSource(w, r, cfg)
+		if !ok {
+			return
+		}
+		ts, err := pushTime(r)
+		if err != nil {
+			http.Error(w, TimestampHeader+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var procs []json.RawMessage
+		if err := json.Unmarshal(data, &procs); err != nil {
+			http.Error(w, "body must be a JSON array of processes", http.StatusBadRequest)
+			return
+		}
+		store.StoreProcesses(src.job, src.target, src.labels, ts, data)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ingestLogsHandler reads newline-delimited JSON log lines until the
+// exporter closes the request. Lines carrying a spool stream and sequence
+// number are stored in durable batches with replays skipped, and the reply
+// acknowledges the highest stored sequence number per stream; other lines
+// are stored as soon as they arrive.
+func ingestLogsHandler(cfg config.IngestConfig, store discovery.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		src, ok := parsePushSource(w, r, cfg)
+		if !ok {
+			return
+		}
+
+		n := 0
+		var batch []discovery.LogEntry
+		acks := make(map[string]uint64)
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			offsets, err := store.StoreLogEntries(src.job, src.target, src.labels, batch)
+			batch = batch[:0]
+			for stream, seq := range offsets {
+				acks[stream] = seq
+			}
+			return err
+		}
+
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var rec struct {
+				Stream    string `json:"stream"`
+				Seq       uint64 `json:"seq"`
+				Timestamp string `json:"timestamp"`
+				Line      string `json:"line"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				continue
+			}
+			ts, err := time.Parse(time.RFC3339Nano, rec.Timestamp)
+			if err != nil {
+				ts = time.Now()
+			}
+			n++
+			if rec.Stream == "" || rec.Seq == 0 {
+				if a, ok := store.(admitter); ok {
+					if err := a.AdmitLog(src.job, src.target, src.labels, ts, rec.Line); err != nil {
+						ingestError(w, err)
+						return
+					}
+					continue
+				}
+				store.StoreLog(src.job, src.target, src.labels, ts, rec.Line)
+				continue
+			}
+			batch = append(batch, discovery.LogEntry{Stream: rec.Stream, Seq: rec.Seq, Timestamp: ts, Line: rec.Line})
+			if len(batch) >= 1000 {
+				if err := flush(); err != nil {
+					ingestError(w, err)
+					return
+				}
+			}
+		}
+		if err := flush(); err != nil {
+			ingestError(w, err)
+			return
+		}
+		if err := scanner.Err(); err != nil && r.Context().Err() == nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"lines": n, "acks": acks})
+	}
+}
+
+// Pushable reports whether exporters may push job to /ingest: ingest is
+// enabled and cfg.Jobs allows it, or a tenant owns it and so may push it
+// with its own credentials.
+func Pushable(cfg config.IngestConfig, tenants *tenant.Set, job string) bool {
+	if !cfg.Enabled {
+		return false
+	}
+	if len(cfg.Jobs) == 0 || matchesAny(cfg.Jobs, job) {
+		return true
+	}
+	return tenants != nil && tenants.Owner(job) != nil
+}
+
+// matchesAny reports whether s matches one of the glob patterns.
+func matchesAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// admitter is implemented by ingest stores enforcing quotas (see
+// tenant.Limiter), which drop what does not fit; pushes are checked first
+// so the exporter is told with a 429.
+type admitter interface {
+	AdmitMetrics(job, target string, mfs map[string]*dto.MetricFamily) error
+	AdmitLog(job, target string, ls map[string]string, ts time.Time, line string) error
+}
+
+// ingestError writes err as a 429 if it is a quota refusal, else a 500.
+func ingestError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, tenant.ErrQuotaExceeded) {
+		status = http.StatusTooManyRequests
+	}
+	http.Error(w, err.Error(), status)
+}
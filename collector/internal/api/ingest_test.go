@@ -0,0 +1,139 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/aalish/pm2-full/internal/storage/storagetest"
+)
+
+// post sends body to path of h with the API credentials.
+func post(h http.Handler, path, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.SetBasicAuth("admin", "pw")
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func ingestHandler(t *testing.T, store storage.Backend) http.Handler {
+	t.Helper()
+	cfg := testCfg
+	cfg.Ingest = config.IngestConfig{Enabled: true, Jobs: []string{"web*"}, MaxBodyBytes: 1024}
+	return newHandler(t, cfg, Services{Store: store, Ingest: store})
+}
+
+// Pushed metrics and processes are stored under the job and instance, with
+// the pushed labels and the time of collection.
+func TestIngestMetricsAndProcesses(t *testing.T) {
+	store := storagetest.Open(t)
+	h := ingestHandler(t, store)
+	at := time.Now().UTC().Add(-10 * time.Minute).Truncate(time.Second)
+	header := http.Header{TimestampHeader: {at.Format(time.RFC3339Nano)}}
+
+	if rec := post(h, "/ingest/metrics?job=web&instance=h1&label=env=prod&label=job=other", "# TYPE up gauge\nup 1\n", header); rec.Code != http.StatusNoContent {
+		t.Fatalf("metrics push: %d %s", rec.Code, rec.Body)
+	}
+	if rec := post(h, "/ingest/processes?job=web&instance=h1", `[{"name":"api","pm_id":0,"status":"online"}]`, header); rec.Code != http.StatusNoContent {
+		t.Fatalf("processes push: %d %s", rec.Code, rec.Body)
+	}
+	recs, err := store.QueryMetrics(storage.MetricQuery{Selector: storage.Selector{Job: "web", Target: "h1"}})
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("stored metrics: %d, %v", len(recs), err)
+	}
+	var m struct {
+		Timestamp time.Time         `json:"timestamp"`
+		Labels    map[string]string `json:"labels"`
+	}
+	if err := json.Unmarshal(recs[0], &m); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Timestamp.Equal(at) || m.Labels["env"] != "prod" || m.Labels["job"] != "web" || m.Labels["instance"] != "h1" {
+		t.Fatalf("stored metrics: %s", recs[0])
+	}
+	if snaps, err := store.QueryProcesses(storage.ProcessQuery{Selector: storage.Selector{Job: "web", Target: "h1"}}); err != nil || len(snaps) != 1 {
+		t.Fatalf("stored processes: %d, %v", len(snaps), err)
+	}
+
+	for _, c := range []struct {
+		path, body string
+		header     http.Header
+		status     int
+	}{
+		{"/ingest/metrics?job=web", "up 1\n", nil, http.StatusBadRequest},
+		{"/ingest/metrics?job=batch&instance=h1", "up 1\n", nil, http.StatusForbidden},
+		{"/ingest/metrics?job=web&instance=h1&label=__x=1", "up 1\n", nil, http.StatusBadRequest},
+		{"/ingest/metrics?job=web&instance=h1", "up 1\n", http.Header{TimestampHeader: {"yesterday"}}, http.StatusBadRequest},
+		{"/ingest/metrics?job=web&instance=h1", "up{ 1\n", nil, http.StatusBadRequest},
+		{"/ingest/metrics?job=web&instance=h1", strings.Repeat("# padding\n", 200) + "up 1\n", nil, http.StatusBadRequest},
+		{"/ingest/processes?job=web&instance=h1", `{"name":"api"}`, nil, http.StatusBadRequest},
+	} {
+		if rec := post(h, c.path, c.body, c.header); rec.Code != c.status {
+			t.Errorf("%s: got %d, want %d: %s", c.path, rec.Code, c.status, rec.Body)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "/ingest/metrics?job=web&instance=h1", strings.NewReader("up 1\n"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("push without credentials: %d", rec.Code)
+	}
+}
+
+// Pushed log lines with a spool position are acknowledged and stored once,
+// however often they are replayed; others are stored as they come.
+func TestIngestLogs(t *testing.T) {
+	store := storagetest.Open(t)
+	h := ingestHandler(t, store)
+	ts := time.Now().UTC().Add(-time.Minute).Format(time.RFC3339Nano)
+	line := func(stream string, seq int, text string) string {
+		b, _ := json.Marshal(map[string]interface{}{"stream": stream, "seq": seq, "timestamp": ts, "line": text})
+		return string(b) + "\n"
+	}
+	push := func(body string) (lines int, acks map[string]uint64) {
+		t.Helper()
+		rec := post(h, "/ingest/logs?job=web&instance=h1", body, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("logs push: %d %s", rec.Code, rec.Body)
+		}
+		var reply struct {
+			Lines int               `json:"lines"`
+			Acks  map[string]uint64 `json:"acks"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.Lines, reply.Acks
+	}
+
+	n, acks := push(line("api-out.log", 1, "[api] one") + line("api-out.log", 2, "[api] two") + "not json\n" + line("", 0, "[api] plain"))
+	if n != 3 || len(acks) != 1 || acks["api-out.log"] != 2 {
+		t.Fatalf("first push: %d lines, acks %v", n, acks)
+	}
+	n, acks = push(line("api-out.log", 2, "[api] two") + line("api-out.log", 3, "[api] three"))
+	if n != 2 || acks["api-out.log"] != 3 {
+		t.Fatalf("replay: %d lines, acks %v", n, acks)
+	}
+	page, err := store.QueryLogs(storage.LogQuery{Selector: storage.Selector{Job: "web"}, Forward: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := make(map[string]int)
+	for _, l := range page.Lines {
+		count[l.Line]++
+	}
+	if len(page.Lines) != 4 || count["one"] != 1 || count["two"] != 1 || count["three"] != 1 || count["plain"] != 1 {
+		t.Fatalf("stored lines: %+v", page.Lines)
+	}
+}
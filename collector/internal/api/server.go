@@ -3,12 +3,41 @@ package api
 import (
 	"net/http"
 
+	"github.com/aalish/pm2-full/internal/alerting"
 	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/live"
+	"github.com/aalish/pm2-full/internal/notify"
 	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/aalish/pm2-full/internal/tenant"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func Start(cfg config.APIConfig, store storage.Store) error {
+// Services are the collector components exposed through the API.
+type Services struct {
+	Store     storage.Store
+	Alerts    *alerting.Engine
+	Notifier  *notify.Notifier
+	Health    *discovery.Health
+	Ingest    discovery.Store     // write path for pushed data, shared with the scrapers
+	Live      *live.Hub           // newly ingested log lines, for /logs/tail
+	Snapshots storage.Snapshotter // point-in-time copies of the data directory
+	Tenants   *tenant.Set         // teams whose jobs are kept apart, see tenants.go; may be nil
+}
+
+func Start(cfg config.APIConfig, svc Services) error {
+	h, err := Handler(cfg, svc)
+	if err != nil {
+		return err
+	}
+	return http.ListenAndServe(cfg.Listen, h)
+}
+
+// newRouter serves the API over svc for one scope: the collector's own
+// data, or that of a tenant.
+func newRouter(cfg config.APIConfig, svc Services, sc scope) *mux.Router {
+	store, alerts, notifier := svc.Store, svc.Alerts, svc.Notifier
 	r := mux.NewRouter()
 	// Documentation
 	r.HandleFunc("/docs", docsHandler).Methods("GET")
@@ -20,10 +49,14 @@ func Start(cfg config.APIConfig, store storage.Store) error {
 	p := r.PathPrefix("/processes").Subrouter()
 	p.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
 	p.HandleFunc("", processesHandler(store)).Methods("GET")
+	p.HandleFunc("/timeline", processTimelineHandler(store)).Methods("GET")
+	p.HandleFunc("/diff", processDiffHandler(store)).Methods("GET")
 	// Logs
 	l := r.PathPrefix("/logs").Subrouter()
 	l.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
 	l.HandleFunc("", logsHandler(store)).Methods("GET")
+	l.HandleFunc("/search", logSearchHandler(store)).Methods("GET")
+	l.HandleFunc("/tail", logTailHandler(store, svc.Live, sc)).Methods("GET")
 
 	a := r.PathPrefix("/apps").Subrouter()
 	a.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
@@ -37,6 +70,65 @@ func Start(cfg config.APIConfig, store storage.Store) error {
 	j.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
 	j.HandleFunc("", jobsHandler(store)).Methods("GET")
 
-	return http.ListenAndServe(cfg.Listen, r)
+	e := r.PathPrefix("/events").Subrouter()
+	e.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
+	e.HandleFunc("", eventsHandler(store)).Methods("GET")
+
+	al := r.PathPrefix("/alerts").Subrouter()
+	al.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
+	al.HandleFunc("", alertsHandler(alerts, sc)).Methods("GET")
+	al.HandleFunc("/rules", alertRulesHandler(alerts, sc)).Methods("GET")
+
+	si := r.PathPrefix("/silences").Subrouter()
+	si.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
+	si.HandleFunc("", silencesHandler(notifier, sc)).Methods("GET")
+	si.HandleFunc("", createSilenceHandler(notifier, sc)).Methods("POST")
+	si.HandleFunc("/{id}", deleteSilenceHandler(notifier, sc)).Methods("DELETE")
+
+	tg := r.PathPrefix("/targets").Subrouter()
+	tg.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
+	tg.HandleFunc("", targetsHealthHandler(svc.Health, sc)).Methods("GET")
+
+	rt := r.PathPrefix("/retention").Subrouter()
+	rt.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
+	rt.HandleFunc("/preview", retentionPreviewHandler(store)).Methods("GET")
+
+	sn := r.PathPrefix("/snapshots").Subrouter()
+	sn.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
+	sn.HandleFunc("", snapshotsHandler(svc.Snapshots)).Methods("GET")
+	sn.HandleFunc("", createSnapshotHandler(svc.Snapshots)).Methods("POST")
+	sn.HandleFunc("/{name}", deleteSnapshotHandler(svc.Snapshots)).Methods("DELETE")
+	sn.HandleFunc("/{name}/verify", verifySnapshotHandler(svc.Snapshots)).Methods("GET")
+	sn.HandleFunc("/{name}/archive", snapshotArchiveHandler(svc.Snapshots)).Methods("GET")
+
+	ex := r.PathPrefix("/export").Subrouter()
+	ex.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
+	ex.HandleFunc("/{dataset}", exportHandler(store)).Methods("GET")
+
+	st := r.PathPrefix("/streams").Subrouter()
+	st.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
+	st.HandleFunc("", streamsHandler(store)).Methods("GET")
+
+	// Collector self metrics in Prometheus text format
+	if sc.tenant == nil {
+		m := r.PathPrefix("/metrics").Subrouter()
+		m.Use(BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password))
+		m.Handle("", promhttp.Handler()).Methods("GET")
+	}
 
+	// Push endpoints for exporters that cannot be scraped
+	if ic := cfg.Ingest; ic.Enabled {
+		if ic.BasicAuth.Username == "" {
+			ic.BasicAuth = cfg.BasicAuth
+		}
+		if ic.MaxBodyBytes <= 0 {
+			ic.MaxBodyBytes = 16 << 20
+		}
+		in := r.PathPrefix("/ingest").Subrouter()
+		in.Use(BasicAuth(ic.BasicAuth.Username, ic.BasicAuth.Password))
+		in.HandleFunc("/metrics", ingestMetricsHandler(ic, svc.Ingest)).Methods("POST")
+		in.HandleFunc("/processes", ingestProcessesHandler(ic, svc.Ingest)).Methods("POST")
+		in.HandleFunc("/logs", ingestLogsHandler(ic, svc.Ingest)).Methods("POST")
+	}
+	return r
 }
@@ -0,0 +1,258 @@
+// internal/api/tail.go
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/live"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	tailQueue       = 1024 // lines buffered per subscriber before dropping
+	tailHeartbeat   = 15 * time.Second
+	tailWriteWait   = 10 * time.Second // a client slower than this is disconnected
+	defaultBackfill = 15
+	maxBackfill     = 5000
+	backfillPages   = 20 // pages of stored lines searched for regex matches
+)
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 16 * 1024}
+
+// tailSink writes a live tail to one client, as Server-Sent Events or over
+// a WebSocket.
+type tailSink interface {
+	line(l storage.LogLine) error
+	dropped(n uint64) error
+	ping() error
+	done() <-chan struct{} // closed when the client goes away
+	close()
+}
+
+// logTailHandler follows newly ingested log lines matching job, target, app,
+// labels and regex, after replaying the last lines stored (oldest first).
+// WebSocket upgrade requests are served over the socket, all others as
+// Server-Sent Events. Lines a slow client cannot keep up with are dropped
+// and reported to it.
+func logTailHandler(store storage.Store, hub *live.Hub, sc scope) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ms, ok := labelMatchers(w, r)
+		if !ok {
+			return
+		}
+		params := r.URL.Query()
+		f := live.Filter{Job: params.Get("job"), Target: params.Get("target"), App: params.Get("app"), Matchers: ms}
+		if sc.tenant != nil {
+			f.Scope = sc.allows
+		}
+		if v := params.Get("regex"); v != "" {
+			re, err := regexp.Compile(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid regex: %v", err), http.StatusBadRequest)
+				return
+			}
+			f.Regex = re
+		}
+		n := defaultBackfill
+		if v := params.Get("lines"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 0 {
+				http.Error(w, "lines must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+		}
+		if n > maxBackfill {
+			n = maxBackfill
+		}
+
+		// subscribe first so no line falls between the backfill and the tail
+		sub := hub.Subscribe(f, tailQueue)
+		defer hub.Unsubscribe(sub)
+		backfill, err := tailBackfill(store, f, n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var sink tailSink
+		if websocket.IsWebSocketUpgrade(r) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return // the upgrader has replied
+			}
+			sink = newWSSink(conn)
+		} else {
+			sink = newSSESink(w, r)
+		}
+		defer sink.close()
+		streamTail(sink, sub, backfill)
+	}
+}
+
+// tailBackfill returns the last n stored lines matching f, oldest first.
+func tailBackfill(store storage.Store, f live.Filter, n int) ([]storage.LogLine, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	q := storage.LogQuery{Selector: storage.Selector{Job: f.Job, Target: f.Target, App: f.App, Matchers: f.Matchers}, NumLines: n}
+	var out []storage.LogLine
+	for i := 0; i < backfillPages && len(out) < n; i++ {
+		page, err := store.QueryLogs(q)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range page.Lines {
+			if len(out) < n && (f.Regex == nil || f.Regex.MatchString(l.Line)) {
+				out = append(out, l)
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+// streamTail writes the backfill and then live lines until the client goes
+// away or falls behind. Live lines already in the backfill are skipped.
+func streamTail(sink tailSink, sub *live.Subscription, backfill []storage.LogLine) {
+	var last time.Time
+	seen := make(map[string]bool) // app and line of backfilled lines at last
+	for _, l := range backfill {
+		if err := sink.line(l); err != nil {
+			return
+		}
+		ts, _ := time.Parse(time.RFC3339Nano, l.Timestamp)
+		if !ts.Equal(last) {
+			last, seen = ts, make(map[string]bool)
+		}
+		seen[l.App+"\x00"+l.Line] = true
+	}
+
+	heartbeat := time.NewTicker(tailHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-sink.done():
+			return
+		case l := <-sub.C:
+			if !last.IsZero() {
+				ts, _ := time.Parse(time.RFC3339Nano, l.Timestamp)
+				if ts.Before(last) || (ts.Equal(last) && seen[l.App+"\x00"+l.Line]) {
+					continue
+				}
+			}
+			if n := sub.Dropped(); n > 0 {
+				if err = sink.dropped(n); err != nil {
+					return
+				}
+			}
+			err = sink.line(l)
+		case <-heartbeat.C:
+			if n := sub.Dropped(); n > 0 {
+				err = sink.dropped(n)
+			} else {
+				err = sink.ping()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sseSink sends each line as a message event, drop notices as "dropped"
+// events and heartbeats as comments.
+type sseSink struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+	r  *http.Request
+}
+
+func newSSESink(w http.ResponseWriter, r *http.Request) *sseSink {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	s := &sseSink{w: w, rc: http.NewResponseController(w), r: r}
+	s.write(": connected\n\n")
+	return s
+}
+
+func (s *sseSink) write(msg string) error {
+	s.rc.SetWriteDeadline(time.Now().Add(tailWriteWait))
+	if _, err := fmt.Fprint(s.w, msg); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+func (s *sseSink) line(l storage.LogLine) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return s.write("data: " + string(b) + "\n\n")
+}
+
+func (s *sseSink) dropped(n uint64) error {
+	return s.write(fmt.Sprintf("event: dropped\ndata: {\"dropped\":%d}\n\n", n))
+}
+
+func (s *sseSink) ping() error           { return s.write(": ping\n\n") }
+func (s *sseSink) done() <-chan struct{} { return s.r.Context().Done() }
+func (s *sseSink) close()                {}
+
+// wsSink sends each line as a JSON text message and drop notices as
+// {"dropped": n}. Anything the client sends is discarded.
+type wsSink struct {
+	conn   *websocket.Conn
+	closed chan struct{}
+}
+
+func newWSSink(conn *websocket.Conn) *wsSink {
+	s := &wsSink{conn: conn, closed: make(chan struct{})}
+	conn.SetReadLimit(4096)
+	go func() {
+		defer close(s.closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *wsSink) write(v interface{}) error {
+	s.conn.SetWriteDeadline(time.Now().Add(tailWriteWait))
+	return s.conn.WriteJSON(v)
+}
+
+func (s *wsSink) line(l storage.LogLine) error { return s.write(l) }
+
+func (s *wsSink) dropped(n uint64) error {
+	return s.write(map[string]uint64{"dropped": n})
+}
+
+func (s *wsSink) ping() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(tailWriteWait))
+}
+
+func (s *wsSink) done() <-chan struct{} { return s.closed }
+
+func (s *wsSink) close() {
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	s.conn.Close()
+}
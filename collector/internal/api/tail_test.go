@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/live"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/aalish/pm2-full/internal/storage/storagetest"
+	"github.com/gorilla/websocket"
+)
+
+// tailServer serves the API over a store whose new log lines reach the
+// returned store through a live hub.
+func tailServer(t *testing.T) (*httptest.Server, storage.Backend, func(line string)) {
+	t.Helper()
+	store := storagetest.Open(t)
+	hub := live.NewHub()
+	ingest := hub.WrapStore(store)
+	srv := httptest.NewServer(newHandler(t, testCfg, Services{Store: store, Live: hub}))
+	t.Cleanup(srv.Close)
+	return srv, store, func(line string) {
+		ingest.StoreLog("web", "h1", nil, time.Now().UTC(), "[api] "+line)
+	}
+}
+
+// /logs/tail as Server-Sent Events replays the last stored lines, oldest
+// first, then follows new ones.
+func TestTailSSE(t *testing.T) {
+	srv, store, publish := tailServer(t)
+	t0 := time.Now().UTC().Add(-time.Minute)
+	for i, line := range []string{"old", "recent", "latest"} {
+		store.StoreLog("web", "h1", nil, t0.Add(time.Duration(i)*time.Second), "[api] "+line)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/logs/tail?job=web&lines=2", nil)
+	req.SetBasicAuth("admin", "pw")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	events := make(chan string, 10)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+				var l storage.LogLine
+				json.Unmarshal([]byte(data), &l)
+				events <- l.Line
+			}
+		}
+		close(events)
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case l := <-events:
+			return l
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return ""
+		}
+	}
+	if a, b := next(), next(); a != "recent" || b != "latest" {
+		t.Fatalf("backfill: %q, %q", a, b)
+	}
+	publish("live")
+	if l := next(); l != "live" {
+		t.Fatalf("live line: %q", l)
+	}
+}
+
+// /logs/tail over a WebSocket sends the same lines as JSON messages.
+func TestTailWebSocket(t *testing.T) {
+	srv, store, publish := tailServer(t)
+	store.StoreLog("web", "h1", nil, time.Now().UTC().Add(-time.Minute), "[api] stored")
+
+	header := http.Header{}
+	req := &http.Request{Header: header}
+	req.SetBasicAuth("admin", "pw")
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/logs/tail?app=api&lines=1"
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read := func() string {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var l storage.LogLine
+		if err := conn.ReadJSON(&l); err != nil {
+			t.Fatal(err)
+		}
+		return l.Line
+	}
+	if l := read(); l != "stored" {
+		t.Fatalf("backfill: %q", l)
+	}
+	publish("live")
+	if l := read(); l != "live" {
+		t.Fatalf("live line: %q", l)
+	}
+}
+
+// Invalid parameters are refused before the stream starts.
+func TestTailRejectsBadParams(t *testing.T) {
+	h := newHandler(t, testCfg, Services{Store: storagetest.Open(t), Live: live.NewHub()})
+	for _, bad := range []string{"regex=(", "lines=-1", "label=env"} {
+		if rec := get(h, "/logs/tail?"+bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("/logs/tail?%s: got %d, want 400", bad, rec.Code)
+		}
+	}
+}
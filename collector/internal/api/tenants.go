@@ -0,0 +1,67 @@
+// internal/api/tenants.go
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/tenant"
+)
+
+// scope is whose data a router serves: the collector's own, with the
+// alerts, silences and targets of every job, or a tenant's, with only
+// those of its jobs.
+type scope struct {
+	tenant *tenant.Tenant
+}
+
+func (sc scope) allows(job string) bool {
+	return sc.tenant == nil || sc.tenant.Owns(job)
+}
+
+// Handler serves the API. With tenants, requests carrying a tenant's
+// credentials are served from its data alone and may push its jobs to
+// /ingest; the API's own credentials reach one tenant's data with
+// ?tenant=<name>, and otherwise the data of every job, read through
+// svc.Store, which should be the tenant.Set.
+func Handler(cfg config.APIConfig, svc Services) (http.Handler, error) {
+	root := newRouter(cfg, svc, scope{})
+	if svc.Tenants == nil || len(svc.Tenants.Tenants) == 0 {
+		return root, nil
+	}
+	unknown := BasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, fmt.Sprintf("no tenant %q", r.URL.Query().Get("tenant")), http.StatusNotFound)
+	}))
+	byUser := make(map[string]http.Handler)
+	byName := make(map[string]http.Handler)
+	for _, t := range svc.Tenants.Tenants {
+		if u := t.BasicAuth.Username; u == cfg.BasicAuth.Username || u == cfg.Ingest.BasicAuth.Username {
+			return nil, fmt.Errorf("tenant %q: basic_auth username %q is the API's", t.Name, u)
+		}
+		tsvc := svc
+		tsvc.Store, tsvc.Snapshots = t.Store, t.Store
+		tcfg := cfg
+		tcfg.BasicAuth = t.BasicAuth
+		tcfg.Ingest.BasicAuth, tcfg.Ingest.Jobs = t.BasicAuth, t.Jobs
+		byUser[t.BasicAuth.Username] = newRouter(tcfg, tsvc, scope{t})
+		acfg := cfg
+		acfg.Ingest.Enabled = false
+		byName[t.Name] = newRouter(acfg, tsvc, scope{t})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, _, ok := r.BasicAuth(); ok && byUser[u] != nil {
+			byUser[u].ServeHTTP(w, r)
+			return
+		}
+		if name := r.URL.Query().Get("tenant"); name != "" {
+			h := byName[name]
+			if h == nil {
+				h = unknown
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		root.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,302 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/alerting"
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/live"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/aalish/pm2-full/internal/storage/storagetest"
+	"github.com/aalish/pm2-full/internal/tenant"
+)
+
+// tenantCreds are the credentials of the tenants of tenantServer; the
+// API's own are admin/pw.
+var tenantCreds = map[string]string{"alpha": "alpha-pw", "beta": "beta-pw"}
+
+// tenantServer serves the API for two tenants, alpha owning the alpha-*
+// jobs and beta the beta-* jobs, with at most one series, and returns it
+// with the store the scheduler and exporters write to.
+func tenantServer(t *testing.T) (*httptest.Server, discovery.Store) {
+	t.Helper()
+	var cfgs []config.TenantConfig
+	for _, name := range []string{"alpha", "beta"} {
+		cfgs = append(cfgs, config.TenantConfig{Name: name, Jobs: []string{name + "-*"}, BasicAuth: config.AuthCreds{Username: name, Password: tenantCreds[name]}})
+	}
+	cfgs[1].Quotas.MaxSeries = 1
+	set, err := tenant.Open(cfgs, config.StorageConfig{Type: "disk", Directory: t.TempDir(), FlushInterval: 10 * time.Millisecond}, storagetest.Open(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { set.Close() })
+
+	// both jobs are scraped, from a port nothing listens on
+	closed := httptest.NewServer(http.NotFoundHandler())
+	port := closed.Listener.Addr().(*net.TCPAddr).Port
+	closed.Close()
+	health := discovery.NewHealth()
+	s := discovery.NewScheduler(set, health, 0)
+	for _, job := range []string{"alpha-web", "beta-web"} {
+		if err := s.Start(config.Job{JobName: job, Interval: time.Hour, Paths: config.Paths{Metrics: "/metrics"}, Targets: []config.Target{{Host: "127.0.0.1", Port: port}}}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Stop(job) })
+	}
+
+	// a stopped worker on either job fires an alert
+	t0 := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	for i, job := range []string{"alpha-web", "beta-web"} {
+		set.StoreLog(job, "h1", nil, t0.Add(time.Duration(i)*time.Second), "[api] "+job+" stored")
+		set.StoreProcesses(job, "h1", nil, t0, []byte(`[{"name":"worker","pm_id":0,"status":"stopped"}]`))
+	}
+	engine, err := alerting.NewEngine(config.AlertingConfig{Rules: []config.AlertRule{{Name: "down", Kind: "status", Status: "online"}}},
+		alerting.Targets{Scraped: health, Pushed: func(string) bool { return true }}, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Evaluate(time.Now().UTC())
+
+	hub := live.NewHub()
+	ingest := set.Limit(hub.WrapStore(set))
+	cfg := testCfg
+	cfg.Ingest = config.IngestConfig{Enabled: true, Jobs: []string{"none"}, MaxBodyBytes: 1024}
+	srv := httptest.NewServer(newHandler(t, cfg, Services{Store: set, Alerts: engine, Health: health, Ingest: ingest, Live: hub, Snapshots: set, Tenants: set}))
+	t.Cleanup(srv.Close)
+	return srv, ingest
+}
+
+// request sends body to path of srv as user, with the password of a
+// tenant or of the API.
+func request(t *testing.T, srv *httptest.Server, method, user, path, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, ok := tenantCreds[user]
+	if !ok {
+		pw = "pw"
+	}
+	req.SetBasicAuth(user, pw)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// A tenant's credentials read only the data, targets and alerts of its
+// jobs, whatever the job or tenant asked for; the API's reach a tenant
+// with ?tenant= and every job without it.
+func TestTenantIsolation(t *testing.T) {
+	srv, _ := tenantServer(t)
+
+	// the scheduler registers its targets in the background
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		_, body := request(t, srv, http.MethodGet, "admin", "/targets", "")
+		var ths []discovery.TargetHealth
+		json.Unmarshal([]byte(body), &ths)
+		if len(ths) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("targets: %s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	logs := func(user, query string) []string {
+		t.Helper()
+		code, body := request(t, srv, http.MethodGet, user, "/logs?"+query, "")
+		if code != http.StatusOK {
+			t.Fatalf("%s /logs?%s: %d %s", user, query, code, body)
+		}
+		var lines []storage.LogLine
+		if err := json.Unmarshal([]byte(body), &lines); err != nil {
+			t.Fatal(err)
+		}
+		out := []string{}
+		for _, l := range lines {
+			out = append(out, l.Line)
+		}
+		return out
+	}
+	// the jobs of the targets or alerts listed at path
+	jobs := func(user, path string) []string {
+		t.Helper()
+		code, body := request(t, srv, http.MethodGet, user, path, "")
+		if code != http.StatusOK {
+			t.Fatalf("%s %s: %d %s", user, path, code, body)
+		}
+		var items []struct {
+			Job    string            `json:"job"`
+			Labels map[string]string `json:"labels"`
+		}
+		if err := json.Unmarshal([]byte(body), &items); err != nil {
+			t.Fatal(err)
+		}
+		out := []string{}
+		for _, it := range items {
+			if it.Job == "" {
+				it.Job = it.Labels["job"]
+			}
+			out = append(out, it.Job)
+		}
+		slices.Sort(out)
+		return out
+	}
+
+	alpha := []string{"alpha-web stored"}
+	for _, c := range []struct {
+		user, query string
+		want        []string
+	}{
+		{"alpha", "", alpha},
+		{"alpha", "job=beta-web", []string{}},
+		{"alpha", "tenant=beta", alpha},
+		{"beta", "", []string{"beta-web stored"}},
+		{"admin", "tenant=beta", []string{"beta-web stored"}},
+		{"admin", "tenant=beta&job=alpha-web", []string{}},
+		{"admin", "", []string{"beta-web stored", "alpha-web stored"}},
+	} {
+		if got := logs(c.user, c.query); !slices.Equal(got, c.want) {
+			t.Errorf("%s /logs?%s: got %v, want %v", c.user, c.query, got, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		user, path string
+		want       []string
+	}{
+		{"alpha", "/targets", []string{"alpha-web"}},
+		{"alpha", "/targets?job=beta-web", []string{}},
+		{"admin", "/targets?tenant=beta", []string{"beta-web"}},
+		{"admin", "/targets", []string{"alpha-web", "beta-web"}},
+		{"alpha", "/alerts", []string{"alpha-web"}},
+		{"alpha", "/alerts?label=job=beta-web", []string{}},
+		{"admin", "/alerts?tenant=beta", []string{"beta-web"}},
+		{"admin", "/alerts", []string{"alpha-web", "beta-web"}},
+	} {
+		if got := jobs(c.user, c.path); !slices.Equal(got, c.want) {
+			t.Errorf("%s %s: got %v, want %v", c.user, c.path, got, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		user, path, want string
+	}{
+		{"alpha", "/export/logs?columns=job,line", "job,line\nalpha-web,alpha-web stored\n"},
+		{"alpha", "/export/logs?columns=job,line&job=beta-web", "job,line\n"},
+		{"admin", "/export/logs?columns=job,line&tenant=beta", "job,line\nbeta-web,beta-web stored\n"},
+	} {
+		if code, body := request(t, srv, http.MethodGet, c.user, c.path, ""); code != http.StatusOK || body != c.want {
+			t.Errorf("%s %s: %d %q, want %q", c.user, c.path, code, body, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		user, path string
+		status     int
+	}{
+		{"admin", "/logs?tenant=gamma", http.StatusNotFound},
+		{"alpha", "/metrics", http.StatusNotFound},
+	} {
+		if code, body := request(t, srv, http.MethodGet, c.user, c.path, ""); code != c.status {
+			t.Errorf("%s %s: got %d %s, want %d", c.user, c.path, code, body, c.status)
+		}
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/logs?job=beta-web", nil)
+	req.SetBasicAuth("alpha", tenantCreds["beta"])
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("alpha with the password of beta: %v, %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+// /logs/tail replays and follows only the lines of the tenant's jobs.
+func TestTenantTail(t *testing.T) {
+	srv, ingest := tenantServer(t)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/logs/tail?lines=10", nil)
+	req.SetBasicAuth("alpha", tenantCreds["alpha"])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("tail: %d", resp.StatusCode)
+	}
+	events := make(chan string, 10)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+				var l storage.LogLine
+				json.Unmarshal([]byte(data), &l)
+				events <- l.Job + " " + l.Line
+			}
+		}
+		close(events)
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case l := <-events:
+			return l
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return ""
+		}
+	}
+	if l := next(); l != "alpha-web alpha-web stored" {
+		t.Fatalf("backfill: %q", l)
+	}
+	for _, job := range []string{"beta-web", "alpha-web"} {
+		ingest.StoreLog(job, "h1", nil, time.Now().UTC(), "[api] live")
+	}
+	if l := next(); l != "alpha-web live" {
+		t.Fatalf("live line: %q", l)
+	}
+}
+
+// A tenant pushes only its own jobs, within its quotas.
+func TestTenantIngest(t *testing.T) {
+	srv, _ := tenantServer(t)
+	for _, c := range []struct {
+		user, path, body string
+		status           int
+	}{
+		{"alpha", "/ingest/metrics?job=alpha-web&instance=h2", "up 1\n", http.StatusNoContent},
+		{"alpha", "/ingest/metrics?job=beta-web&instance=h2", "up 1\n", http.StatusForbidden},
+		{"alpha", "/ingest/processes?job=beta-web&instance=h2", "[]", http.StatusForbidden},
+		{"alpha", "/ingest/logs?job=beta-web&instance=h2", `{"stream":"api-out.log","seq":1,"line":"x"}` + "\n", http.StatusForbidden},
+		{"admin", "/ingest/metrics?job=beta-web&instance=h2", "up 1\n", http.StatusForbidden},
+		{"beta", "/ingest/metrics?job=beta-web&instance=h2", "up 1\n", http.StatusNoContent},
+		{"beta", "/ingest/metrics?job=beta-web&instance=h3", "up 1\n", http.StatusTooManyRequests},
+		{"beta", "/ingest/metrics?job=beta-web&instance=h2", "up 1\nother 1\n", http.StatusTooManyRequests},
+	} {
+		if code, body := request(t, srv, http.MethodPost, c.user, c.path, c.body); code != c.status {
+			t.Errorf("%s %s: got %d %s, want %d", c.user, c.path, code, body, c.status)
+		}
+	}
+	if code, body := request(t, srv, http.MethodGet, "alpha", "/jobs?target=h2", ""); code != http.StatusOK || body != "[\"alpha-web\"]\n" {
+		t.Errorf("alpha's jobs of h2: %d %s", code, body)
+	}
+}
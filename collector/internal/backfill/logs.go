@@ -0,0 +1,195 @@
+// Package backfill reads data written before the collector knew about a
+// host, PM2 log files and Prometheus text or OpenMetrics dumps, for the
+// import command to push into the store.
+package backfill
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LogLine is one line of a PM2 log file. Seq is its line number, from 1.
+type LogLine struct {
+	Seq  uint64
+	Time time.Time
+	Line string // as written by PM2, prefixed with "[app] " like exporter lines
+}
+
+// maxUndated is how many lines without a timestamp are held back waiting
+// for one to date them.
+const maxUndated = 10000
+
+// PM2 prefixes lines with the time in log_date_format followed by ": "
+// when logs are timestamped; these are the usual formats. Times without a
+// zone are in the location given to ReadLogFile.
+var pm2TimeLayouts = []string{
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 Z07:00",
+	"2006-01-02 15:04:05 Z0700",
+	"2006-01-02 15:04:05",
+}
+
+// AppFromLogName derives the app name from a PM2 log file name:
+// <app>-out.log, <app>-error-3.log, <app>-out.log.2 or, rotated by
+// pm2-logrotate, <app>-out__2026-10-01_00-00-00.log.gz.
+func AppFromLogName(path string) string {
+	return appSuffix.ReplaceAllString(logName(path), "")
+}
+
+var appSuffix = regexp.MustCompile(`-(out|error|err)(-\d+)?$`)
+
+// logName strips the rotation suffixes from a log file name, leaving
+// <app>-out or <app>-error-3.
+func logName(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), ".gz")
+	name = strings.TrimRight(name, "0123456789")
+	name = strings.TrimSuffix(name, ".")
+	name = strings.TrimSuffix(name, ".log")
+	name, _, _ = strings.Cut(name, "__")
+	return name
+}
+
+// maxStreamKey is how much of the first line of a file keys its stream.
+const maxStreamKey = 4096
+
+// LogStream names the spool stream the lines of a file are stored under:
+// its log name without rotation suffixes and a hash of its first line.
+// Line numbers are its sequence numbers, so importing a file again only
+// stores the lines appended since, also once it has been renamed or
+// gzipped by pm2-logrotate or logrotate. Files of the same name whose
+// first lines are the same share a stream; PM2 timestamps keep them apart.
+func LogStream(path string) (string, error) {
+	r, err := Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	first, err := bufio.NewReaderSize(r, maxStreamKey).ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", err
+	}
+	sum := sha256.Sum256(bytes.TrimRight(first, "\r\n"))
+	return "import/" + logName(path) + "/" + hex.EncodeToString(sum[:8]), nil
+}
+
+// Open opens a file, decompressing it if it is gzipped.
+func Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(f, 64*1024)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return readCloser{zr, f}, nil
+	}
+	return readCloser{br, f}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ReadLogFile calls fn with each line of a PM2 log file, plain or gzipped,
+// prefixed with app. Lines are dated by their PM2 timestamp, or JSON
+// timestamp field with log_type json; lines without one, such as stack
+// traces, take the time of the line before or, at the start of the file,
+// of the first dated line. Files without timestamps are dated by their
+// modification time.
+func ReadLogFile(path, app string, loc *time.Location, fn func(LogLine) error) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	r, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var last time.Time
+	var undated []LogLine
+	release := func(ts time.Time) error {
+		for _, l := range undated {
+			l.Time = ts
+			if err := fn(l); err != nil {
+				return err
+			}
+		}
+		undated = undated[:0]
+		return nil
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	var seq uint64
+	for sc.Scan() {
+		seq++
+		text := strings.TrimRight(sc.Text(), "\r")
+		l := LogLine{Seq: seq, Line: "[" + app + "] " + text}
+		if ts, ok := lineTime(text, loc); ok {
+			last = ts
+			if err := release(ts); err != nil {
+				return err
+			}
+		}
+		if last.IsZero() {
+			undated = append(undated, l)
+			if len(undated) >= maxUndated {
+				if err := release(info.ModTime()); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		l.Time = last
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return release(info.ModTime())
+}
+
+// lineTime returns the time a PM2 log line was written, if it carries one.
+func lineTime(text string, loc *time.Location) (time.Time, bool) {
+	if strings.HasPrefix(text, "{") {
+		var rec struct {
+			Timestamp string `json:"timestamp"`
+		}
+		if json.Unmarshal([]byte(text), &rec) == nil && rec.Timestamp != "" {
+			return parseTime(rec.Timestamp, loc)
+		}
+	}
+	i := strings.Index(text, ": ")
+	if i < len("2006-01-02T15:04:05") || i > 40 {
+		return time.Time{}, false
+	}
+	return parseTime(text[:i], loc)
+}
+
+func parseTime(s string, loc *time.Location) (time.Time, bool) {
+	for _, layout := range pm2TimeLayouts {
+		if ts, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return ts, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,149 @@
+package backfill
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// App names come from the file names PM2 and pm2-logrotate write.
+func TestAppFromLogName(t *testing.T) {
+	for name, want := range map[string]string{
+		"/root/.pm2/logs/api-out.log":               "api",
+		"api-error-3.log":                           "api",
+		"my-app-err.log":                            "my-app",
+		"api-out.log.2":                             "api",
+		"worker-out__2026-10-01_00-00-00.log.gz":    "worker",
+		"billing-v2-error__2026-10-01_00-00-00.log": "billing-v2",
+		"plain.log":                                 "plain",
+	} {
+		if got := AppFromLogName(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+// A file keeps its stream as lines are appended to it and once it is
+// renamed and gzipped by pm2-logrotate; a file started anew gets another.
+func TestLogStream(t *testing.T) {
+	dir := t.TempDir()
+	stream := func(name string) string {
+		t.Helper()
+		s, err := LogStream(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	write := func(name, data string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("api-out.log", "2026-10-01T00:00:00: started\r\n")
+	first := stream("api-out.log")
+	if !strings.HasPrefix(first, "import/api-out/") {
+		t.Fatalf("stream: got %q", first)
+	}
+	write("api-out.log", "2026-10-01T00:00:00: started\n2026-10-01T00:00:01: listening\n")
+	if got := stream("api-out.log"); got != first {
+		t.Errorf("stream after appending: got %q, want %q", got, first)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("2026-10-01T00:00:00: started\n2026-10-01T00:00:01: listening\n"))
+	zw.Close()
+	write("api-out__2026-10-02_00-00-00.log.gz", buf.String())
+	if got := stream("api-out__2026-10-02_00-00-00.log.gz"); got != first {
+		t.Errorf("stream of the rotated file: got %q, want %q", got, first)
+	}
+	write("api-out.log", "2026-10-02T00:00:00: started\n")
+	if got := stream("api-out.log"); got == first {
+		t.Errorf("truncated file kept its stream %q", got)
+	}
+	write("api-error.log", "2026-10-01T00:00:00: started\n")
+	if got := stream("api-error.log"); got == first {
+		t.Errorf("error log shares the stream %q", got)
+	}
+}
+
+// readLines reads a log file into its lines.
+func readLines(t *testing.T, path string) []LogLine {
+	t.Helper()
+	var lines []LogLine
+	if err := ReadLogFile(path, "api", time.UTC, func(l LogLine) error {
+		lines = append(lines, l)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+// Lines are dated by their PM2 or JSON timestamp; undated lines take the
+// time of the line before, or at the start of the file of the first dated
+// line. Gzipped files read the same.
+func TestReadLogFile(t *testing.T) {
+	content := "preamble\r\n" +
+		"2026-10-01T10:00:00: started\n" +
+		"Error: boom\n" +
+		"    at main.js:1\n" +
+		"2026-10-01 10:00:05 +02:00: zoned\n" +
+		`{"message":"json","timestamp":"2026-10-01T10:00:09Z"}` + "\n"
+	t1 := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	want := []LogLine{
+		{1, t1, "[api] preamble"},
+		{2, t1, "[api] 2026-10-01T10:00:00: started"},
+		{3, t1, "[api] Error: boom"},
+		{4, t1, "[api]     at main.js:1"},
+		{5, time.Date(2026, 10, 1, 8, 0, 5, 0, time.UTC), "[api] 2026-10-01 10:00:05 +02:00: zoned"},
+		{6, t1.Add(9 * time.Second), `[api] {"message":"json","timestamp":"2026-10-01T10:00:09Z"}`},
+	}
+
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "api-out.log")
+	if err := os.WriteFile(plain, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write([]byte(content))
+	zw.Close()
+	gz := filepath.Join(dir, "api-out__2026-10-01_00-00-00.log.gz")
+	if err := os.WriteFile(gz, zipped.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{plain, gz} {
+		got := readLines(t, path)
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %d lines, want %d", path, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].Seq != want[i].Seq || !got[i].Time.Equal(want[i].Time) || got[i].Line != want[i].Line {
+				t.Errorf("%s line %d: got %+v, want %+v", path, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+// A file without timestamps is dated by its modification time.
+func TestReadLogFileUndated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-out.log")
+	if err := os.WriteFile(path, []byte("one\ntwo: not a time\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2026, 9, 30, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	got := readLines(t, path)
+	if len(got) != 2 || !got[0].Time.Equal(mtime) || !got[1].Time.Equal(mtime) || got[1].Line != "[api] two: not a time" {
+		t.Fatalf("undated lines: %+v", got)
+	}
+}
@@ -0,0 +1,178 @@
+package backfill
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Scrape is the metric families of a dump sampled at one time.
+type Scrape struct {
+	Time     time.Time
+	Families map[string]*dto.MetricFamily
+}
+
+// ReadDump parses a dump in the Prometheus text format or, if it ends with
+// "# EOF", OpenMetrics. Samples carrying a timestamp are grouped into one
+// scrape per timestamp, the others into a scrape at def. Scrapes are
+// returned oldest first, their samples without timestamps.
+func ReadDump(r io.Reader, def time.Time) ([]Scrape, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if isOpenMetrics(data) {
+		data = openMetricsToText(data)
+	}
+	parser := &expfmt.TextParser{}
+	mfs, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	byTime := make(map[int64]map[string]*dto.MetricFamily)
+	for name, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			ts := def
+			if m.TimestampMs != nil {
+				ts = time.UnixMilli(m.GetTimestampMs())
+				m.TimestampMs = nil
+			}
+			group := byTime[ts.UnixNano()]
+			if group == nil {
+				group = make(map[string]*dto.MetricFamily)
+				byTime[ts.UnixNano()] = group
+			}
+			g := group[name]
+			if g == nil {
+				g = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				group[name] = g
+			}
+			g.Metric = append(g.Metric, m)
+		}
+	}
+	out := make([]Scrape, 0, len(byTime))
+	for ns, group := range byTime {
+		out = append(out, Scrape{Time: time.Unix(0, ns), Families: group})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+func isOpenMetrics(data []byte) bool {
+	data = bytes.TrimRight(data, "\r\n\t ")
+	return bytes.HasSuffix(data, []byte("\n# EOF")) || bytes.Equal(data, []byte("# EOF"))
+}
+
+// openMetricsToText rewrites OpenMetrics as the Prometheus text format:
+// counters are named with their _total suffix and info and stateset
+// metrics become gauges, _created samples, units, exemplars and the EOF
+// marker are dropped, and timestamps are turned from seconds into
+// milliseconds. Gauge histograms become untyped samples.
+func openMetricsToText(data []byte) []byte {
+	lines := strings.Split(string(data), "\n")
+	types := make(map[string]string)
+	for _, l := range lines {
+		if f := strings.Fields(l); len(f) == 4 && f[0] == "#" && f[1] == "TYPE" {
+			types[f[2]] = f[3]
+		}
+	}
+	// rename maps the families whose samples carry a suffix to that name
+	rename := func(name string) string {
+		switch types[name] {
+		case "counter":
+			return name + "_total"
+		case "info":
+			return name + "_info"
+		}
+		return name
+	}
+	var b strings.Builder
+	for _, l := range lines {
+		l = strings.TrimRight(l, "\r")
+		if strings.HasPrefix(l, "#") {
+			f := strings.SplitN(l, " ", 4)
+			if len(f) < 3 || (f[1] != "TYPE" && f[1] != "HELP") {
+				continue // EOF, UNIT or a comment
+			}
+			if f[1] == "TYPE" {
+				switch types[f[2]] {
+				case "counter", "gauge", "summary", "histogram":
+					fmt.Fprintf(&b, "# TYPE %s %s\n", rename(f[2]), types[f[2]])
+				case "info", "stateset":
+					fmt.Fprintf(&b, "# TYPE %s gauge\n", rename(f[2]))
+				}
+				continue
+			}
+			f[2] = rename(f[2])
+			b.WriteString(strings.Join(f, " ") + "\n")
+			continue
+		}
+		if l == "" {
+			continue
+		}
+		series, rest := splitSample(l)
+		name, _, _ := strings.Cut(series, "{")
+		if base, ok := strings.CutSuffix(name, "_created"); ok {
+			if t := types[base]; t == "counter" || t == "summary" || t == "histogram" {
+				continue
+			}
+		}
+		if i := strings.Index(rest, " # "); i >= 0 {
+			rest = rest[:i] // exemplar
+		}
+		if f := strings.Fields(rest); len(f) == 2 {
+			if secs, err := strconv.ParseFloat(f[1], 64); err == nil {
+				rest = " " + f[0] + " " + strconv.FormatInt(int64(math.Round(secs*1000)), 10)
+			}
+		}
+		b.WriteString(series + rest + "\n")
+	}
+	return []byte(b.String())
+}
+
+// splitSample splits a sample line after its name and labels.
+func splitSample(l string) (series, rest string) {
+	i := strings.IndexAny(l, "{ ")
+	if i < 0 || l[i] == ' ' {
+		if i < 0 {
+			return l, ""
+		}
+		return l[:i], l[i:]
+	}
+	quoted := false
+	for j := i; j < len(l); j++ {
+		switch {
+		case l[j] == '\\' && quoted:
+			j++
+		case l[j] == '"':
+			quoted = !quoted
+		case l[j] == '}' && !quoted:
+			return l[:j+1], l[j+1:]
+		}
+	}
+	return l, ""
+}
+
+// WriteText writes metric families in the Prometheus text format, sorted by
+// name.
+func WriteText(w io.Writer, mfs map[string]*dto.MetricFamily) error {
+	names := make([]string, 0, len(mfs))
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := expfmt.MetricFamilyToText(w, mfs[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package backfill
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// value returns the value of the one sample of a family.
+func value(t *testing.T, mfs map[string]*dto.MetricFamily, name string) float64 {
+	t.Helper()
+	mf := mfs[name]
+	if mf == nil || len(mf.Metric) != 1 {
+		t.Fatalf("%s: %v", name, mf)
+	}
+	m := mf.Metric[0]
+	if m.TimestampMs != nil {
+		t.Fatalf("%s keeps its timestamp", name)
+	}
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	}
+	t.Fatalf("%s: no value", name)
+	return 0
+}
+
+// Samples of a text dump are grouped by timestamp, oldest first, and those
+// without one go to the default time.
+func TestReadDumpText(t *testing.T) {
+	def := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	dump := `# TYPE up gauge
+up 1 1759316400000
+up{job="b"} 0 1759316460000
+# TYPE requests_total counter
+requests_total 42
+`
+	scrapes, err := ReadDump(strings.NewReader(dump), def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scrapes) != 3 {
+		t.Fatalf("got %d scrapes", len(scrapes))
+	}
+	if !scrapes[0].Time.Equal(time.UnixMilli(1759316400000)) || value(t, scrapes[0].Families, "up") != 1 {
+		t.Errorf("first scrape: %+v", scrapes[0])
+	}
+	if !scrapes[1].Time.Equal(time.UnixMilli(1759316460000)) || value(t, scrapes[1].Families, "up") != 0 {
+		t.Errorf("second scrape: %+v", scrapes[1])
+	}
+	if !scrapes[2].Time.Equal(def) || value(t, scrapes[2].Families, "requests_total") != 42 || scrapes[2].Families["requests_total"].GetType() != dto.MetricType_COUNTER {
+		t.Errorf("default scrape: %+v", scrapes[2])
+	}
+	if _, err := ReadDump(strings.NewReader("up{ 1\n"), def); err == nil {
+		t.Error("bad dump parsed")
+	}
+}
+
+// OpenMetrics dumps are recognised by their EOF marker: counters keep
+// their _total suffix, _created samples, units and exemplars are dropped,
+// info metrics become gauges and timestamps are in seconds.
+func TestReadDumpOpenMetrics(t *testing.T) {
+	def := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	dump := `# TYPE requests counter
+# UNIT requests requests
+# HELP requests Requests served.
+requests_total{path="/a b}"} 7 1759316400.5 # {trace_id="x"} 1
+requests_created{path="/a b}"} 1759310000 1759316400.5
+# TYPE build info
+build_info{version="1.2"} 1
+# EOF
+`
+	scrapes, err := ReadDump(strings.NewReader(dump), def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scrapes) != 2 {
+		t.Fatalf("got %d scrapes", len(scrapes))
+	}
+	if s := scrapes[1]; !s.Time.Equal(def) || value(t, s.Families, "build_info") != 1 || s.Families["build_info"].GetType() != dto.MetricType_GAUGE {
+		t.Errorf("info scrape: %+v", s)
+	}
+	s, at := scrapes[0], time.UnixMilli(1759316400500)
+	if !s.Time.Equal(at) || value(t, s.Families, "requests_total") != 7 || len(s.Families) != 1 {
+		t.Fatalf("counter scrape at %s: %v", s.Time, s.Families)
+	}
+	mf := s.Families["requests_total"]
+	if mf.GetType() != dto.MetricType_COUNTER || mf.GetHelp() != "Requests served." || mf.Metric[0].Label[0].GetValue() != "/a b}" {
+		t.Errorf("counter: %v", mf)
+	}
+}
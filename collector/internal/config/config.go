@@ -1,32 +1,127 @@
 package config
 
 import (
+	"net"
+	"strconv"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Scrape  ScrapeConfig  `mapstructure:"scrape"`
-	Storage StorageConfig `mapstructure:"storage"`
-	API     APIConfig     `mapstructure:"api"`
+	Scrape   ScrapeConfig   `mapstructure:"scrape"`
+	Storage  StorageConfig  `mapstructure:"storage"`
+	API      APIConfig      `mapstructure:"api"`
+	Alerting AlertingConfig `mapstructure:"alerting"`
+	Notify   NotifyConfig   `mapstructure:"notify"`
+	Tenants  []TenantConfig `mapstructure:"tenants"`
 }
 
 type ScrapeConfig struct {
-	Jobs []Job `mapstructure:"jobs"`
+	Jobs          []Job `mapstructure:"jobs"`
+	MaxConcurrent int   `mapstructure:"max_concurrent"` // scrapes in flight across all jobs, 0 = unbounded
 }
 
 type Job struct {
-	JobName  string        `mapstructure:"job_name"`
-	Targets  []Target      `mapstructure:"targets"`
-	Paths    Paths         `mapstructure:"paths"`
-	Interval time.Duration `mapstructure:"interval"`
+	JobName       string        `mapstructure:"job_name"`
+	Targets       []Target      `mapstructure:"targets"`
+	Paths         Paths         `mapstructure:"paths"`
+	Interval      time.Duration `mapstructure:"interval"`
+	ScrapeTimeout time.Duration `mapstructure:"scrape_timeout"` // per request, defaults to 10s capped at interval
+
+	// Labels are attached to every target of the job; a target's own labels
+	// take precedence. RelabelConfigs run on each target's label set before
+	// it is scraped, MetricRelabelConfigs on every scraped series.
+	Labels               map[string]string `mapstructure:"labels"`
+	RelabelConfigs       []RelabelConfig   `mapstructure:"relabel_configs"`
+	MetricRelabelConfigs []RelabelConfig   `mapstructure:"metric_relabel_configs"`
+
+	// How targets are reached. A target's own settings take precedence;
+	// tls_config is taken as a whole, headers are merged.
+	HTTPClientConfig `mapstructure:",squash"`
+
+	// Discovered targets are merged with the static ones. BasicAuth applies
+	// to every target without credentials of its own, which includes all
+	// discovered targets.
+	FileSD    []FileSDConfig `mapstructure:"file_sd_configs"`
+	DNSSD     []DNSSDConfig  `mapstructure:"dns_sd_configs"`
+	HTTPSD    []HTTPSDConfig `mapstructure:"http_sd_configs"`
+	BasicAuth AuthCreds      `mapstructure:"basic_auth"`
+}
+
+// FileSDConfig reads targets from JSON or YAML files matching Files (globs).
+// Files are re-read when they change and every RefreshInterval.
+type FileSDConfig struct {
+	Files           []string      `mapstructure:"files"`
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+}
+
+// DNSSDConfig resolves Names every RefreshInterval. Type is SRV (default),
+// A or AAAA; A and AAAA records are scraped on Port. Server overrides the
+// system resolver with a host:port nameserver.
+type DNSSDConfig struct {
+	Names           []string      `mapstructure:"names"`
+	Type            string        `mapstructure:"type"`
+	Port            int           `mapstructure:"port"`
+	Server          string        `mapstructure:"server"`
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+}
+
+// HTTPSDConfig polls URL for a target list in the same format as file_sd.
+type HTTPSDConfig struct {
+	URL             string        `mapstructure:"url"`
+	BasicAuth       AuthCreds     `mapstructure:"basic_auth"`
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
 }
 
 type Target struct {
-	Host      string    `mapstructure:"host"`
-	Port      int       `mapstructure:"port"`
-	BasicAuth AuthCreds `mapstructure:"basic_auth"`
+	Host      string            `mapstructure:"host"`
+	Port      int               `mapstructure:"port"`
+	BasicAuth AuthCreds         `mapstructure:"basic_auth"`
+	Labels    map[string]string `mapstructure:"labels"`
+
+	HTTPClientConfig `mapstructure:",squash"`
+}
+
+// HTTPClientConfig configures the connection to an exporter, used alike for
+// metrics, processes and the log tail. Scheme defaults to http. A bearer
+// token file is re-read on every request so rotated tokens are picked up.
+// ProxyURL overrides the HTTP(S)_PROXY environment.
+type HTTPClientConfig struct {
+	Scheme          string            `mapstructure:"scheme"`
+	TLS             TLSConfig         `mapstructure:"tls_config"`
+	BearerToken     string            `mapstructure:"bearer_token"`
+	BearerTokenFile string            `mapstructure:"bearer_token_file"`
+	Headers         map[string]string `mapstructure:"headers"`
+	ProxyURL        string            `mapstructure:"proxy_url"`
+}
+
+// TLSConfig holds the CA used to verify exporters and an optional client
+// certificate for mutual TLS.
+type TLSConfig struct {
+	CAFile             string `mapstructure:"ca_file"`
+	CertFile           string `mapstructure:"cert_file"`
+	KeyFile            string `mapstructure:"key_file"`
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// Address is the host:port identity of a target, with IPv6 hosts bracketed.
+func (t Target) Address() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
+
+// RelabelConfig is one Prometheus-style relabel rule. Action is one of
+// replace (default), keep, drop, labelmap or hashmod. Regex is anchored and
+// defaults to "(.*)", Separator to ";" and Replacement to "$1".
+type RelabelConfig struct {
+	SourceLabels []string `mapstructure:"source_labels"`
+	Separator    string   `mapstructure:"separator"`
+	Regex        string   `mapstructure:"regex"`
+	TargetLabel  string   `mapstructure:"target_label"`
+	Replacement  string   `mapstructure:"replacement"`
+	Modulus      uint64   `mapstructure:"modulus"`
+	Action       string   `mapstructure:"action"`
 }
 
 type AuthCreds struct {
@@ -40,15 +135,208 @@ type Paths struct {
 	Logs      string `mapstructure:"logs"`
 }
 
+// StorageConfig configures the data directory. Records are buffered per
+// file and written at least every FlushInterval (and before every query),
+// and synced to disk every FsyncInterval; log lines acknowledged to
+// exporters are synced before the acknowledgement. At most MaxOpenFiles
+// file handles are kept open between writes.
+//
+// Logs and metrics are kept in segments of SegmentDuration per stream;
+// retention deletes whole segments once they end more than RetentionDays
+// ago (0 keeps them), and the oldest segments first while all segments
+// exceed MaxBytes or one job/target's exceed MaxTargetBytes (0 is no limit).
+// Segments are compressed once sealed unless Compression is "none".
+// Metrics are also rolled up into 5m and 1h summaries kept for their own
+// retention (see RollupConfig). Retention rules override these limits for
+// the data they select.
+//
+// Type selects the backend: disk (the default) as above, or sqlite, which
+// keeps everything in one database, <Directory>/pm2.db, written every
+// FlushInterval. Segments, compression, size limits and Match rules do not
+// apply to it.
 type StorageConfig struct {
-	Type          string `mapstructure:"type"`
-	Directory     string `mapstructure:"directory"`
-	RetentionDays int    `mapstructure:"retention_days"`
+	Type            string          `mapstructure:"type"` // disk (default) or sqlite
+	Directory       string          `mapstructure:"directory"`
+	RetentionDays   int             `mapstructure:"retention_days"`
+	SegmentDuration time.Duration   `mapstructure:"segment_duration"` // default 1h; must divide 24h
+	MaxBytes        int64           `mapstructure:"max_bytes"`
+	MaxTargetBytes  int64           `mapstructure:"max_target_bytes"`
+	Compression     string          `mapstructure:"compression"`    // gzip (default) or none
+	FlushInterval   time.Duration   `mapstructure:"flush_interval"` // default 200ms
+	FsyncInterval   time.Duration   `mapstructure:"fsync_interval"` // default 1s
+	MaxOpenFiles    int             `mapstructure:"max_open_files"` // default 256
+	Rollups         RollupConfig    `mapstructure:"rollups"`
+	Retention       []RetentionRule `mapstructure:"retention"`
+	LegacyStreams   []LegacyStream  `mapstructure:"legacy_streams"`
+}
+
+// LegacyStream names the job, target and, for logs, app of a stream the
+// disk backend stored before names were escaped, when its name cannot be
+// split into them unambiguously. Such streams are left in place, and not
+// listed, until they are named here; Name is the stream's directory or
+// file name in the data directory, without .jsonl.
+type LegacyStream struct {
+	Name   string `mapstructure:"name"`
+	Job    string `mapstructure:"job"`
+	Target string `mapstructure:"target"`
+	App    string `mapstructure:"app"`
+}
+
+// RetentionRule sets how long the data it selects is kept. Kind is logs,
+// metrics, metrics5m, metrics1h, processes or events (any if empty); Job,
+// Target and App are glob patterns (any if empty), and Match is a regular
+// expression selecting log lines. The first rule selecting a segment
+// applies: the segment is deleted once it ended more than MaxAge ago (0
+// keeps it), and the oldest segments a rule applies to are deleted while
+// together they exceed MaxBytes (0 is no limit). A rule with Match applies
+// to the lines it matches rather than to whole segments: when a segment's
+// lines fall to several rules, those of one rule are removed by rewriting
+// the segment without them, so a rule keeping errors for 30 days keeps
+// them however long the other lines of their stream are kept. Processes
+// and events honour only MaxAge. Data no rule selects keeps RetentionDays,
+// or its rollup retention.
+type RetentionRule struct {
+	Name     string        `mapstructure:"name"`
+	Kind     string        `mapstructure:"kind"`
+	Job      string        `mapstructure:"job"`
+	Target   string        `mapstructure:"target"`
+	App      string        `mapstructure:"app"`
+	Match    string        `mapstructure:"match"`
+	MaxAge   time.Duration `mapstructure:"max_age"`
+	MaxBytes int64         `mapstructure:"max_bytes"`
+}
+
+// RollupConfig controls the 5m and 1h metric rollups (min, max, avg, last
+// and count per series). Each resolution is deleted after its own number of
+// days; 0 keeps the default and a negative value keeps them forever.
+type RollupConfig struct {
+	Disabled        bool `mapstructure:"disabled"`
+	RetentionDays5m int  `mapstructure:"retention_days_5m"` // default 30
+	RetentionDays1h int  `mapstructure:"retention_days_1h"` // default 365
 }
 
 type APIConfig struct {
-	Listen    string    `mapstructure:"listen"`
-	BasicAuth AuthCreds `mapstructure:"basic_auth"`
+	Listen    string       `mapstructure:"listen"`
+	BasicAuth AuthCreds    `mapstructure:"basic_auth"`
+	Ingest    IngestConfig `mapstructure:"ingest"`
+}
+
+// IngestConfig enables the /ingest endpoints used by exporters in push mode,
+// for hosts the collector cannot reach. BasicAuth defaults to the API
+// credentials; Jobs limits the job names exporters may push as (glob
+// patterns, any if empty).
+type IngestConfig struct {
+	Enabled      bool      `mapstructure:"enabled"`
+	BasicAuth    AuthCreds `mapstructure:"basic_auth"`
+	Jobs         []string  `mapstructure:"jobs"`
+	MaxBodyBytes int64     `mapstructure:"max_body_bytes"` // per metrics/processes push, default 16MB
+}
+
+// TenantConfig is a team sharing the collector. It owns the jobs matching
+// Jobs (glob patterns; the first tenant matching a job owns it), whose data
+// is kept apart in <storage.directory>/tenants/<Name> with the storage
+// settings of the collector. BasicAuth reaches only that data, and the
+// alerts, silences and targets of those jobs, through the API and may push
+// those jobs to /ingest.
+type TenantConfig struct {
+	Name      string       `mapstructure:"name"`
+	Jobs      []string     `mapstructure:"jobs"`
+	BasicAuth AuthCreds    `mapstructure:"basic_auth"`
+	Quotas    TenantQuotas `mapstructure:"quotas"`
+}
+
+// TenantQuotas limit what a tenant stores; 0 is no limit. MaxSeries caps
+// the series of the latest scrape or push of each of its targets, summed
+// over them; scrapes that would exceed it are not stored. MaxLogBytesPerDay
+// caps the bytes of log lines stored per UTC day, after which lines are
+// refused until midnight; the day's bytes are saved and survive restarts.
+// RetentionDays replaces storage.retention_days.
+type TenantQuotas struct {
+	MaxSeries         int   `mapstructure:"max_series"`
+	MaxLogBytesPerDay int64 `mapstructure:"max_log_bytes_per_day"`
+	RetentionDays     int   `mapstructure:"retention_days"`
+}
+
+// AlertingConfig holds the alert rules and how often they are evaluated.
+type AlertingConfig struct {
+	Interval  time.Duration `mapstructure:"interval"`
+	StateFile string        `mapstructure:"state_file"`
+	Rules     []AlertRule   `mapstructure:"rules"`
+}
+
+// AlertRule describes one alert condition. Kind selects what is evaluated:
+//
+//	metric:      latest value of Metric compared against Threshold with Op
+//	restarts:    restart count increase over Window compared against Threshold
+//	status:      process status compared against Status with Op (== or !=)
+//	target_down: fires when a target has not been scraped, or pushed, for Window
+//	log_match:   lines matching Pattern within Window compared against Threshold
+type AlertRule struct {
+	Name        string            `mapstructure:"name"`
+	Kind        string            `mapstructure:"kind"`
+	Job         string            `mapstructure:"job"`
+	Target      string            `mapstructure:"target"`
+	App         string            `mapstructure:"app"`
+	Metric      string            `mapstructure:"metric"`
+	Status      string            `mapstructure:"status"`
+	Pattern     string            `mapstructure:"pattern"`
+	Op          string            `mapstructure:"op"`
+	Threshold   float64           `mapstructure:"threshold"`
+	Window      time.Duration     `mapstructure:"window"`
+	For         time.Duration     `mapstructure:"for"`
+	Labels      map[string]string `mapstructure:"labels"`
+	Annotations map[string]string `mapstructure:"annotations"`
+}
+
+// NotifyConfig controls how firing and resolved alerts are delivered.
+type NotifyConfig struct {
+	GroupBy        []string      `mapstructure:"group_by"`
+	GroupWait      time.Duration `mapstructure:"group_wait"`
+	GroupInterval  time.Duration `mapstructure:"group_interval"`
+	RepeatInterval time.Duration `mapstructure:"repeat_interval"`
+	SilencesFile   string        `mapstructure:"silences_file"`
+	StateFile      string        `mapstructure:"state_file"` // what each group was last sent, kept across restarts
+	Retry          RetryConfig   `mapstructure:"retry"`
+	Receivers      []Receiver    `mapstructure:"receivers"`
+}
+
+// RetryConfig bounds redelivery of a failed notification.
+type RetryConfig struct {
+	MaxAttempts    int           `mapstructure:"max_attempts"`
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+}
+
+// Receiver is one notification destination. Type is webhook, slack or email;
+// Match restricts it to alerts carrying all of the given labels.
+type Receiver struct {
+	Name    string            `mapstructure:"name"`
+	Type    string            `mapstructure:"type"`
+	Match   map[string]string `mapstructure:"match"`
+	Timeout time.Duration     `mapstructure:"timeout"`
+
+	// webhook and slack
+	URL          string            `mapstructure:"url"`
+	Headers      map[string]string `mapstructure:"headers"`
+	BodyTemplate string            `mapstructure:"body_template"`
+	HMACSecret   string            `mapstructure:"hmac_secret"`
+
+	// slack / mattermost
+	Channel      string `mapstructure:"channel"`
+	Username     string `mapstructure:"username"`
+	IconEmoji    string `mapstructure:"icon_emoji"`
+	TextTemplate string `mapstructure:"text_template"`
+
+	// email
+	SMTPHost           string   `mapstructure:"smtp_host"`
+	SMTPPort           int      `mapstructure:"smtp_port"`
+	SMTPUsername       string   `mapstructure:"smtp_username"`
+	SMTPPassword       string   `mapstructure:"smtp_password"`
+	StartTLS           bool     `mapstructure:"starttls"`
+	InsecureSkipVerify bool     `mapstructure:"insecure_skip_verify"`
+	From               string   `mapstructure:"from"`
+	To                 []string `mapstructure:"to"`
+	SubjectTemplate    string   `mapstructure:"subject_template"`
 }
 
 func Load(path string) (*Config, error) {
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const scrapeYAML = `
+scrape:
+  max_concurrent: 8
+  jobs:
+    - job_name: web
+      interval: 15s
+      scrape_timeout: 5s
+      scheme: https
+      bearer_token_file: /run/secrets/token
+      headers:
+        X-Env: prod
+      tls_config:
+        ca_file: /etc/pm2/ca.crt
+        server_name: exporter.internal
+      targets:
+        - host: "::1"
+          port: 9100
+          tls_config:
+            cert_file: /etc/pm2/client.crt
+            key_file: /etc/pm2/client.key
+            insecure_skip_verify: true
+          headers:
+            X-Team: web
+`
+
+// The client settings of a job and of its targets are read from the same
+// level as their other keys. Header names come back lower-cased, as all map
+// keys from viper do; they are canonicalised when set on a request.
+func TestLoadHTTPClientConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(scrapeYAML), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Scrape.MaxConcurrent != 8 || len(cfg.Scrape.Jobs) != 1 {
+		t.Fatalf("scrape: %+v", cfg.Scrape)
+	}
+	job := cfg.Scrape.Jobs[0]
+	if job.Interval != 15*time.Second || job.ScrapeTimeout != 5*time.Second {
+		t.Errorf("durations: %v, %v", job.Interval, job.ScrapeTimeout)
+	}
+	if job.Scheme != "https" || job.BearerTokenFile != "/run/secrets/token" || job.Headers["x-env"] != "prod" {
+		t.Errorf("job client: %+v", job.HTTPClientConfig)
+	}
+	if job.TLS != (TLSConfig{CAFile: "/etc/pm2/ca.crt", ServerName: "exporter.internal"}) {
+		t.Errorf("job tls_config: %+v", job.TLS)
+	}
+	tg := job.Targets[0]
+	if tg.TLS != (TLSConfig{CertFile: "/etc/pm2/client.crt", KeyFile: "/etc/pm2/client.key", InsecureSkipVerify: true}) {
+		t.Errorf("target tls_config: %+v", tg.TLS)
+	}
+	if tg.Scheme != "" || len(tg.Headers) != 1 || tg.Headers["x-team"] != "web" {
+		t.Errorf("target client: %+v", tg.HTTPClientConfig)
+	}
+	if got := tg.Address(); got != "[::1]:9100" {
+		t.Errorf("address: %s", got)
+	}
+}
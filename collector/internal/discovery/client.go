@@ -0,0 +1,191 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// targetClient sends requests to one exporter with the target's scheme, TLS
+// settings, proxy and credentials applied.
+type targetClient struct {
+	client *http.Client
+	cfg    config.HTTPClientConfig
+	auth   config.AuthCreds
+}
+
+// transports are shared between targets with identical TLS and proxy
+// settings so connections are pooled per configuration.
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[string]*http.Transport)
+)
+
+// newTargetClient builds the client for a target whose settings were
+// already merged with the job's.
+func newTargetClient(t config.Target) (*targetClient, error) {
+	switch t.Scheme {
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", t.Scheme)
+	}
+	tr, err := transportFor(t.TLS, t.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	// no overall timeout: log tails stream indefinitely, scrapes are bounded
+	// by a per-scrape context deadline instead
+	return &targetClient{client: &http.Client{Transport: tr}, cfg: t.HTTPClientConfig, auth: t.BasicAuth}, nil
+}
+
+func transportFor(tc config.TLSConfig, proxyURL string) (*http.Transport, error) {
+	key, _ := json.Marshal(struct {
+		TLS   config.TLSConfig
+		Proxy string
+	}{tc, proxyURL})
+
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if tr := transports[string(key)]; tr != nil {
+		return tr, nil
+	}
+
+	tlsCfg, err := tlsConfig(tc)
+	if err != nil {
+		return nil, err
+	}
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_url: %w", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	tr := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:       tlsCfg,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}
+	transports[string(key)] = tr
+	return tr, nil
+}
+
+// tlsConfig loads the CA bundle and client certificate. The client
+// certificate is re-read whenever a handshake asks for it, so renewed
+// certificates are used without a restart.
+func tlsConfig(tc config.TLSConfig) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: tc.ServerName, InsecureSkipVerify: tc.InsecureSkipVerify}
+	if tc.CAFile != "" {
+		pem, err := os.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s: no certificates found", tc.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if tc.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile); err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+	return cfg, nil
+}
+
+// get builds a GET request carrying the target's headers and credentials.
+func (c *targetClient) get(ctx context.Context, url string) (*http.Request, error) {
+	return c.newRequest(ctx, "GET", url, nil)
+}
+
+func (c *targetClient) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if c.auth.Username != "" {
+		req.SetBasicAuth(c.auth.Username, c.auth.Password)
+	}
+	token := c.cfg.BearerToken
+	if c.cfg.BearerTokenFile != "" {
+		b, err := os.ReadFile(c.cfg.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("bearer_token_file: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+func (c *targetClient) do(req *http.Request) (*http.Response, error) {
+	return c.client.Do(req)
+}
+
+// withJobDefaults fills a target's unset connection settings from its job.
+func withJobDefaults(job config.Job, t config.Target) config.Target {
+	if t.BasicAuth.Username == "" {
+		t.BasicAuth = job.BasicAuth
+	}
+	h, jh := &t.HTTPClientConfig, job.HTTPClientConfig
+	if h.Scheme == "" {
+		h.Scheme = jh.Scheme
+	}
+	if h.Scheme == "" {
+		h.Scheme = "http"
+	}
+	h.Scheme = strings.ToLower(h.Scheme)
+	if h.TLS == (config.TLSConfig{}) {
+		h.TLS = jh.TLS
+	}
+	if h.BearerToken == "" && h.BearerTokenFile == "" {
+		h.BearerToken, h.BearerTokenFile = jh.BearerToken, jh.BearerTokenFile
+	}
+	if len(jh.Headers) > 0 {
+		headers := make(map[string]string, len(jh.Headers)+len(h.Headers))
+		for k, v := range jh.Headers {
+			headers[k] = v
+		}
+		for k, v := range h.Headers {
+			headers[k] = v
+		}
+		h.Headers = headers
+	}
+	if h.ProxyURL == "" {
+		h.ProxyURL = jh.ProxyURL
+	}
+	return t
+}
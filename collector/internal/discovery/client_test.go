@@ -0,0 +1,226 @@
+package discovery
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// testCA issues certificates for the tests of one directory.
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // the CA certificate, PEM-encoded
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	ca := &testCA{dir: t.TempDir()}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	ca.cert, ca.key = ca.issue(t, tmpl, nil, nil)
+	ca.file, _ = ca.write(t, "ca", ca.cert, nil)
+	return ca
+}
+
+// issue signs tmpl with parent, or self-signs it when parent is nil.
+func (ca *testCA) issue(t *testing.T, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// write saves a certificate and, if given, its key as PEM files.
+func (ca *testCA) write(t *testing.T, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (certFile, keyFile string) {
+	t.Helper()
+	certFile = filepath.Join(ca.dir, name+".crt")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if key == nil {
+		return certFile, ""
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile = filepath.Join(ca.dir, name+".key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// leaf issues a server certificate for 127.0.0.1 or a client certificate.
+func (ca *testCA) leaf(t *testing.T, name string, serial int64, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	cert, key := ca.issue(t, tmpl, ca.cert, ca.key)
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+}
+
+// target returns the target of a test server, over https.
+func target(t *testing.T, srv *httptest.Server) config.Target {
+	t.Helper()
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return config.Target{Host: "127.0.0.1", Port: port, HTTPClientConfig: config.HTTPClientConfig{Scheme: "https"}}
+}
+
+// fetch requests / of a target through its client.
+func fetch(t *testing.T, tg config.Target) (*http.Response, error) {
+	t.Helper()
+	c, err := newTargetClient(tg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := c.get(context.Background(), baseURL(tg)+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+// Exporters are trusted through ca_file, and those that require a client
+// certificate accept the configured one.
+func TestTargetClientTLS(t *testing.T) {
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.leaf(t, "exporter", 2, x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := ca.leaf(t, "collector", 3, x509.ExtKeyUsageClientAuth)
+	x, _ := x509.ParseCertificate(client.Certificate[0])
+	certFile, keyFile := ca.write(t, "collector", x, client.PrivateKey.(*ecdsa.PrivateKey))
+
+	tg := target(t, srv)
+	if _, err := fetch(t, tg); err == nil {
+		t.Fatal("exporter certificate trusted without ca_file")
+	}
+	tg.TLS = config.TLSConfig{CAFile: ca.file}
+	if _, err := fetch(t, tg); err == nil {
+		t.Fatal("exporter accepted a scrape without a client certificate")
+	}
+	tg.TLS = config.TLSConfig{CAFile: ca.file, CertFile: certFile, KeyFile: keyFile}
+	if resp, err := fetch(t, tg); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("mutual TLS: %v", err)
+	}
+
+	for _, tc := range []config.TLSConfig{
+		{CertFile: certFile},
+		{CAFile: filepath.Join(ca.dir, "missing.crt")},
+		{CAFile: keyFile},
+		{CertFile: certFile, KeyFile: certFile},
+	} {
+		if _, err := tlsConfig(tc); err == nil {
+			t.Errorf("%+v accepted", tc)
+		}
+	}
+	if _, err := newTargetClient(config.Target{HTTPClientConfig: config.HTTPClientConfig{Scheme: "ftp"}}); err == nil {
+		t.Error("ftp scheme accepted")
+	}
+}
+
+// Requests carry the merged headers and the bearer token, re-read from its
+// file each time.
+func TestTargetClientCredentials(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r.Header.Clone() }))
+	defer srv.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	job := config.Job{HTTPClientConfig: config.HTTPClientConfig{
+		BearerTokenFile: tokenFile,
+		Headers:         map[string]string{"X-Env": "prod", "X-Team": "ops"},
+	}}
+	tg := target(t, srv)
+	tg.Scheme = ""
+	tg.Headers = map[string]string{"X-Team": "web"}
+	tg = withJobDefaults(job, tg)
+	if tg.Scheme != "http" {
+		t.Fatalf("default scheme: %q", tg.Scheme)
+	}
+
+	if _, err := fetch(t, tg); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("Authorization") != "Bearer first" || got.Get("X-Env") != "prod" || got.Get("X-Team") != "web" {
+		t.Fatalf("headers: %v", got)
+	}
+	if err := os.WriteFile(tokenFile, []byte("second"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetch(t, tg); err != nil || got.Get("Authorization") != "Bearer second" {
+		t.Fatalf("rotated token: %v, %v", got.Get("Authorization"), err)
+	}
+
+	// basic auth goes with the target's own settings
+	tg = withJobDefaults(config.Job{BasicAuth: config.AuthCreds{Username: "u", Password: "p"}}, target(t, srv))
+	tg.Scheme = "http"
+	if _, err := fetch(t, tg); err != nil {
+		t.Fatal(err)
+	}
+	if user, pass, ok := (&http.Request{Header: got}).BasicAuth(); !ok || user != "u" || pass != "p" {
+		t.Fatalf("basic auth: %q %q %v", user, pass, ok)
+	}
+}
@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// dnsProvider resolves SRV, A or AAAA records periodically. A name whose
+// lookup fails keeps its previous targets so a flaky resolver does not stop
+// scrapes.
+type dnsProvider struct {
+	cfg      config.DNSSDConfig
+	resolver *net.Resolver
+	cache    map[string][]config.Target // name -> last good lookup
+}
+
+func newDNSProvider(cfg config.DNSSDConfig) *dnsProvider {
+	cfg.RefreshInterval = refreshInterval(cfg.RefreshInterval, 30*time.Second)
+	cfg.Type = strings.ToUpper(cfg.Type)
+	if cfg.Type == "" {
+		cfg.Type = "SRV"
+	}
+	return &dnsProvider{cfg: cfg, resolver: newResolver(cfg.Server), cache: make(map[string][]config.Target)}
+}
+
+// newResolver returns the system resolver, or one that sends every query to
+// server (host:port) when set.
+func newResolver(server string) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func (p *dnsProvider) Name() string {
+	return fmt.Sprintf("dns_sd %s %s", p.cfg.Type, strings.Join(p.cfg.Names, ","))
+}
+
+func (p *dnsProvider) Run(ctx context.Context, ch chan<- []config.Target) {
+	ticker := time.NewTicker(p.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case ch <- p.refresh(ctx):
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *dnsProvider) refresh(ctx context.Context) []config.Target {
+	var out []config.Target
+	for _, name := range p.cfg.Names {
+		lctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		ts, err := p.lookup(lctx, name)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("%s: lookup %s: %v", p.Name(), name, err)
+			}
+			ts = p.cache[name]
+		} else {
+			p.cache[name] = ts
+		}
+		out = append(out, ts...)
+	}
+	return out
+}
+
+func (p *dnsProvider) lookup(ctx context.Context, name string) ([]config.Target, error) {
+	switch p.cfg.Type {
+	case "SRV":
+		_, srvs, err := p.resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]config.Target, 0, len(srvs))
+		for _, srv := range srvs {
+			out = append(out, config.Target{Host: strings.TrimSuffix(srv.Target, "."), Port: int(srv.Port)})
+		}
+		return out, nil
+	case "A", "AAAA":
+		if p.cfg.Port == 0 {
+			return nil, fmt.Errorf("port is required for %s records", p.cfg.Type)
+		}
+		network := "ip4"
+		if p.cfg.Type == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := p.resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]config.Target, 0, len(ips))
+		for _, ip := range ips {
+			out = append(out, config.Target{Host: ip.String(), Port: p.cfg.Port})
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", p.cfg.Type)
+	}
+}
@@ -0,0 +1,168 @@
+package discovery
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileProvider reads target groups from files matching a set of globs. The
+// containing directories are watched so edits, including editors that
+// replace the file by rename, are picked up immediately; a periodic refresh
+// covers filesystems without change notifications.
+type fileProvider struct {
+	cfg   config.FileSDConfig
+	cache map[string][]config.Target // path -> last good parse
+}
+
+func newFileProvider(cfg config.FileSDConfig) *fileProvider {
+	cfg.RefreshInterval = refreshInterval(cfg.RefreshInterval, 5*time.Minute)
+	files := make([]string, len(cfg.Files))
+	for i, f := range cfg.Files {
+		files[i] = filepath.Clean(f) // fsnotify reports cleaned paths
+	}
+	cfg.Files = files
+	return &fileProvider{cfg: cfg, cache: make(map[string][]config.Target)}
+}
+
+func (p *fileProvider) Name() string { return "file_sd " + strings.Join(p.cfg.Files, ",") }
+
+func (p *fileProvider) Run(ctx context.Context, ch chan<- []config.Target) {
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("%s: watch disabled: %v", p.Name(), err)
+	} else {
+		defer watcher.Close()
+		for _, dir := range p.dirs() {
+			if err := watcher.Add(dir); err != nil {
+				log.Printf("%s: watch %s: %v", p.Name(), dir, err)
+			}
+		}
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	ticker := time.NewTicker(p.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case ch <- p.refresh():
+		case <-ctx.Done():
+			return
+		}
+
+		if !p.wait(ctx, ticker.C, events, errs) {
+			return
+		}
+	}
+}
+
+// wait blocks until the next refresh is due or a matching file changes. It
+// returns false once ctx is cancelled.
+func (p *fileProvider) wait(ctx context.Context, tick <-chan time.Time, events <-chan fsnotify.Event, errs <-chan error) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-tick:
+			return true
+		case err := <-errs:
+			log.Printf("%s: watch error: %v", p.Name(), err)
+		case ev := <-events:
+			if !p.matches(ev.Name) {
+				continue
+			}
+			// Let the writer finish before reading; coalesce the burst of
+			// events a single save usually produces.
+			time.Sleep(100 * time.Millisecond)
+			drain(events)
+			return true
+		}
+	}
+}
+
+// refresh re-reads every matching file. A file that fails to parse keeps
+// its previous targets; a file that no longer exists drops them.
+func (p *fileProvider) refresh() []config.Target {
+	present := make(map[string]bool)
+	for _, pattern := range p.cfg.Files {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Printf("%s: bad pattern %q: %v", p.Name(), pattern, err)
+			continue
+		}
+		for _, path := range paths {
+			present[path] = true
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Printf("%s: read %s: %v", p.Name(), path, err)
+				continue
+			}
+			ext := strings.ToLower(filepath.Ext(path))
+			ts, err := parseTargetGroups(data, ext == ".yml" || ext == ".yaml")
+			if err != nil {
+				log.Printf("%s: parse %s: %v", p.Name(), path, err)
+				continue
+			}
+			p.cache[path] = ts
+		}
+	}
+	for path := range p.cache {
+		if !present[path] {
+			delete(p.cache, path)
+		}
+	}
+
+	paths := make([]string, 0, len(p.cache))
+	for path := range p.cache {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var out []config.Target
+	for _, path := range paths {
+		out = append(out, p.cache[path]...)
+	}
+	return out
+}
+
+// dirs returns the distinct directories holding the configured patterns.
+func (p *fileProvider) dirs() []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, pattern := range p.cfg.Files {
+		dir := filepath.Dir(pattern)
+		if !seen[dir] {
+			seen[dir] = true
+			out = append(out, dir)
+		}
+	}
+	return out
+}
+
+func (p *fileProvider) matches(path string) bool {
+	for _, pattern := range p.cfg.Files {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// drain discards pending events without blocking.
+func drain(events <-chan fsnotify.Event) {
+	for {
+		select {
+		case <-events:
+		default:
+			return
+		}
+	}
+}
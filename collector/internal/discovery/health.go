@@ -0,0 +1,340 @@
+package discovery
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Scrape endpoints tracked per target.
+const (
+	EndpointMetrics   = "metrics"
+	EndpointProcesses = "processes"
+	EndpointLogs      = "logs"
+)
+
+// Target health states reported by /targets.
+const (
+	HealthUnknown  = "unknown"
+	HealthUp       = "up"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+// rateWindow is how often the log lines-per-second figure is recomputed.
+const rateWindow = 10 * time.Second
+
+// EndpointHealth is the scrape state of one endpoint of a target.
+type EndpointHealth struct {
+	URL          string    `json:"url"`
+	LastScrape   time.Time `json:"last_scrape,omitzero"`
+	LastSuccess  time.Time `json:"last_success,omitzero"`
+	LastDuration float64   `json:"last_duration_seconds"`
+	Up           bool      `json:"up"`
+	LastError    string    `json:"last_error,omitempty"`
+	Samples      int       `json:"samples"`
+	Scrapes      uint64    `json:"scrapes_total"`
+	Failures     uint64    `json:"failures_total"`
+	Connected    bool      `json:"connected,omitempty"`         // logs only
+	LinesTotal   uint64    `json:"lines_total,omitempty"`       // logs only
+	LinesPerSec  float64   `json:"lines_per_second"`            // logs only
+	ConnectedAt  time.Time `json:"connected_at,omitzero"`       // logs only
+	Disconnects  uint64    `json:"disconnects_total,omitempty"` // logs only
+	windowStart  time.Time
+	windowLines  uint64
+}
+
+// TargetHealth summarises all endpoints of one job/target.
+type TargetHealth struct {
+	Job       string                     `json:"job"`
+	Target    string                     `json:"target"`
+	Labels    map[string]string          `json:"labels"`
+	Interval  string                     `json:"interval"`
+	Health    string                     `json:"health"`
+	Stale     bool                       `json:"stale"`
+	Skipped   uint64                     `json:"skipped_scrapes_total"`
+	Endpoints map[string]*EndpointHealth `json:"endpoints"`
+	interval  time.Duration
+}
+
+// Health records scrape outcomes for every target and exposes them to the
+// API and as Prometheus metrics.
+type Health struct {
+	mu      sync.Mutex
+	targets map[string]*TargetHealth // job + "/" + target
+}
+
+// NewHealth returns an empty health registry.
+func NewHealth() *Health {
+	return &Health{targets: make(map[string]*TargetHealth)}
+}
+
+// register makes a target visible before its first scrape.
+func (h *Health) register(job, target string, ls map[string]string, interval time.Duration, urls map[string]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := job + "/" + target
+	th := h.targets[k]
+	if th == nil {
+		th = &TargetHealth{Job: job, Target: target, Endpoints: make(map[string]*EndpointHealth)}
+		h.targets[k] = th
+	}
+	th.Labels = ls
+	th.interval = interval
+	th.Interval = interval.String()
+	for ep, u := range urls {
+		h.endpoint(th, ep).URL = u
+	}
+}
+
+// unregister forgets a target that is no longer scraped.
+func (h *Health) unregister(job, target string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.targets, job+"/"+target)
+}
+
+// target returns the entry for job/target, or nil if it is not registered:
+// a scrape finishing after its target was removed, or relabeled away, must
+// not bring it back. Caller must hold h.mu.
+func (h *Health) target(job, target string) *TargetHealth {
+	return h.targets[job+"/"+target]
+}
+
+// endpoint returns (creating if needed) one endpoint of th. Caller must hold h.mu.
+func (h *Health) endpoint(th *TargetHealth, ep string) *EndpointHealth {
+	eh := th.Endpoints[ep]
+	if eh == nil {
+		eh = &EndpointHealth{}
+		th.Endpoints[ep] = eh
+	}
+	return eh
+}
+
+// recordScrape stores the outcome of one metrics or processes scrape.
+func (h *Health) recordScrape(job, target, ep string, began time.Time, samples int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	th := h.target(job, target)
+	if th == nil {
+		return
+	}
+	eh := h.endpoint(th, ep)
+	eh.LastScrape = began
+	eh.LastDuration = time.Since(began).Seconds()
+	eh.Scrapes++
+	if err != nil {
+		eh.Up = false
+		eh.LastError = err.Error()
+		eh.Failures++
+		return
+	}
+	eh.Up = true
+	eh.LastError = ""
+	eh.LastSuccess = began
+	eh.Samples = samples
+}
+
+// recordSkipped counts a scrape that was skipped because the previous one
+// of the same target had not finished yet.
+func (h *Health) recordSkipped(job, target string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if th := h.target(job, target); th != nil {
+		th.Skipped++
+	}
+}
+
+// logConnected marks the log stream of a target as connected or not.
+func (h *Health) logConnected(job, target string, connected bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	th := h.target(job, target)
+	if th == nil {
+		return
+	}
+	eh := h.endpoint(th, EndpointLogs)
+	now := time.Now()
+	eh.LastScrape = now
+	if connected {
+		eh.Connected = true
+		eh.Up = true
+		eh.LastError = ""
+		eh.ConnectedAt = now
+		eh.LastSuccess = now
+		eh.windowStart = now
+		eh.windowLines = 0
+		return
+	}
+	if eh.Connected {
+		eh.Disconnects++
+	}
+	eh.Connected = false
+	eh.Up = false
+	eh.LinesPerSec = 0
+	if err != nil {
+		eh.LastError = err.Error()
+		eh.Failures++
+	}
+}
+
+// logLine counts one received log line and refreshes the line rate.
+func (h *Health) logLine(job, target string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	th := h.target(job, target)
+	if th == nil {
+		return
+	}
+	eh := h.endpoint(th, EndpointLogs)
+	now := time.Now()
+	eh.LinesTotal++
+	eh.windowLines++
+	eh.LastSuccess = now
+	if elapsed := now.Sub(eh.windowStart); elapsed >= rateWindow {
+		eh.LinesPerSec = float64(eh.windowLines) / elapsed.Seconds()
+		eh.windowStart = now
+		eh.windowLines = 0
+	}
+}
+
+// Targets returns a copy of the health of every target, ordered by job and target.
+func (h *Health) Targets() []TargetHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	out := make([]TargetHealth, 0, len(h.targets))
+	for _, th := range h.targets {
+		cp := *th
+		cp.Endpoints = make(map[string]*EndpointHealth, len(th.Endpoints))
+		for ep, eh := range th.Endpoints {
+			e := *eh
+			if ep == EndpointLogs && e.Connected && now.Sub(e.windowStart) >= 2*rateWindow {
+				// no line arrived for a while, so the last rate is out of date
+				e.LinesPerSec = float64(e.windowLines) / now.Sub(e.windowStart).Seconds()
+			}
+			cp.Endpoints[ep] = &e
+		}
+		cp.Health, cp.Stale = summarise(th, now)
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Job != out[j].Job {
+			return out[i].Job < out[j].Job
+		}
+		return out[i].Target < out[j].Target
+	})
+	return out
+}
+
+// summarise derives the overall health of a target. Data is stale when the
+// last successful metrics scrape is older than two intervals.
+func summarise(th *TargetHealth, now time.Time) (string, bool) {
+	stale := false
+	if m := th.Endpoints[EndpointMetrics]; m != nil && th.interval > 0 {
+		stale = m.LastSuccess.IsZero() || now.Sub(m.LastSuccess) > 2*th.interval
+	}
+	attempted, up := 0, 0
+	for _, eh := range th.Endpoints {
+		if eh.LastScrape.IsZero() {
+			continue
+		}
+		attempted++
+		if eh.Up {
+			up++
+		}
+	}
+	switch {
+	case attempted == 0:
+		return HealthUnknown, stale
+	case up == attempted && !stale:
+		return HealthUp, stale
+	case up == 0:
+		return HealthDown, stale
+	}
+	return HealthDegraded, stale
+}
+
+var (
+	upDesc = prometheus.NewDesc("pm2_collector_up",
+		"Whether the last scrape of the endpoint succeeded (1) or failed (0).",
+		[]string{"job", "target", "endpoint"}, nil)
+	durationDesc = prometheus.NewDesc("pm2_collector_scrape_duration_seconds",
+		"Duration of the last scrape of the endpoint.",
+		[]string{"job", "target", "endpoint"}, nil)
+	samplesDesc = prometheus.NewDesc("pm2_collector_scrape_samples",
+		"Samples (series or processes) returned by the last successful scrape.",
+		[]string{"job", "target", "endpoint"}, nil)
+	lastScrapeDesc = prometheus.NewDesc("pm2_collector_last_scrape_timestamp_seconds",
+		"Unix time of the last scrape attempt.",
+		[]string{"job", "target", "endpoint"}, nil)
+	lastSuccessDesc = prometheus.NewDesc("pm2_collector_last_success_timestamp_seconds",
+		"Unix time of the last successful scrape or received log line.",
+		[]string{"job", "target", "endpoint"}, nil)
+	scrapesDesc = prometheus.NewDesc("pm2_collector_scrapes_total",
+		"Scrape attempts of the endpoint.",
+		[]string{"job", "target", "endpoint"}, nil)
+	failuresDesc = prometheus.NewDesc("pm2_collector_scrape_failures_total",
+		"Failed scrapes or log stream connection errors of the endpoint.",
+		[]string{"job", "target", "endpoint"}, nil)
+	logConnectedDesc = prometheus.NewDesc("pm2_collector_log_stream_connected",
+		"Whether the log stream of the target is connected.",
+		[]string{"job", "target"}, nil)
+	logLinesDesc = prometheus.NewDesc("pm2_collector_log_lines_total",
+		"Log lines received from the target.",
+		[]string{"job", "target"}, nil)
+	logRateDesc = prometheus.NewDesc("pm2_collector_log_lines_per_second",
+		"Recent log line rate of the target.",
+		[]string{"job", "target"}, nil)
+	skippedDesc = prometheus.NewDesc("pm2_collector_scrapes_skipped_total",
+		"Scrapes skipped because the previous scrape of the target overran the interval.",
+		[]string{"job", "target"}, nil)
+	targetStaleDesc = prometheus.NewDesc("pm2_collector_target_stale",
+		"Whether the stored metrics of the target are stale.",
+		[]string{"job", "target"}, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (h *Health) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{upDesc, durationDesc, samplesDesc, lastScrapeDesc, lastSuccessDesc,
+		scrapesDesc, failuresDesc, logConnectedDesc, logLinesDesc, logRateDesc, skippedDesc, targetStaleDesc} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (h *Health) Collect(ch chan<- prometheus.Metric) {
+	for _, th := range h.Targets() {
+		ch <- prometheus.MustNewConstMetric(targetStaleDesc, prometheus.GaugeValue, boolValue(th.Stale), th.Job, th.Target)
+		ch <- prometheus.MustNewConstMetric(skippedDesc, prometheus.CounterValue, float64(th.Skipped), th.Job, th.Target)
+		for ep, eh := range th.Endpoints {
+			lv := []string{th.Job, th.Target, ep}
+			ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, boolValue(eh.Up), lv...)
+			ch <- prometheus.MustNewConstMetric(failuresDesc, prometheus.CounterValue, float64(eh.Failures), lv...)
+			if !eh.LastScrape.IsZero() {
+				ch <- prometheus.MustNewConstMetric(lastScrapeDesc, prometheus.GaugeValue, float64(eh.LastScrape.UnixNano())/1e9, lv...)
+			}
+			if !eh.LastSuccess.IsZero() {
+				ch <- prometheus.MustNewConstMetric(lastSuccessDesc, prometheus.GaugeValue, float64(eh.LastSuccess.UnixNano())/1e9, lv...)
+			}
+			if ep == EndpointLogs {
+				ch <- prometheus.MustNewConstMetric(logConnectedDesc, prometheus.GaugeValue, boolValue(eh.Connected), th.Job, th.Target)
+				ch <- prometheus.MustNewConstMetric(logLinesDesc, prometheus.CounterValue, float64(eh.LinesTotal), th.Job, th.Target)
+				ch <- prometheus.MustNewConstMetric(logRateDesc, prometheus.GaugeValue, eh.LinesPerSec, th.Job, th.Target)
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(durationDesc, prometheus.GaugeValue, eh.LastDuration, lv...)
+			ch <- prometheus.MustNewConstMetric(samplesDesc, prometheus.GaugeValue, float64(eh.Samples), lv...)
+			ch <- prometheus.MustNewConstMetric(scrapesDesc, prometheus.CounterValue, float64(eh.Scrapes), lv...)
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
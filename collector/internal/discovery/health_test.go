@@ -0,0 +1,154 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// A scrape or log line arriving after its target was removed does not
+// bring the target back.
+func TestHealthForgetsRemovedTargets(t *testing.T) {
+	h := NewHealth()
+	h.register("web", "h1:9100", nil, time.Minute, nil)
+	h.recordScrape("web", "h1:9100", EndpointMetrics, time.Now(), 3, nil)
+	if got := h.Targets(); len(got) != 1 || got[0].Health != HealthUp {
+		t.Fatalf("registered target: %+v", got)
+	}
+
+	h.unregister("web", "h1:9100")
+	h.recordScrape("web", "h1:9100", EndpointProcesses, time.Now(), 0, errors.New("late"))
+	h.recordSkipped("web", "h1:9100")
+	h.logConnected("web", "h1:9100", true, nil)
+	h.logLine("web", "h1:9100")
+	if got := h.Targets(); len(got) != 0 {
+		t.Fatalf("removed target came back: %+v", got)
+	}
+}
+
+// A target is up when every endpoint it was scraped on succeeded, down when
+// none did and degraded otherwise; metrics older than two intervals are
+// stale and keep it from being up.
+func TestSummarise(t *testing.T) {
+	now := time.Now()
+	ok := func(ago time.Duration) *EndpointHealth {
+		return &EndpointHealth{LastScrape: now.Add(-ago), LastSuccess: now.Add(-ago), Up: true}
+	}
+	failed := &EndpointHealth{LastScrape: now, Up: false}
+	for _, c := range []struct {
+		name      string
+		endpoints map[string]*EndpointHealth
+		health    string
+		stale     bool
+	}{
+		{"not scraped yet", map[string]*EndpointHealth{EndpointMetrics: {}}, HealthUnknown, true},
+		{"all up", map[string]*EndpointHealth{EndpointMetrics: ok(time.Second), EndpointLogs: ok(time.Second)}, HealthUp, false},
+		{"one failing", map[string]*EndpointHealth{EndpointMetrics: ok(time.Second), EndpointProcesses: failed}, HealthDegraded, false},
+		{"all failing", map[string]*EndpointHealth{EndpointMetrics: failed, EndpointProcesses: failed}, HealthDown, true},
+		{"stale metrics", map[string]*EndpointHealth{EndpointMetrics: ok(3 * time.Minute), EndpointProcesses: ok(time.Second)}, HealthDegraded, true},
+		{"within two intervals", map[string]*EndpointHealth{EndpointMetrics: ok(90 * time.Second)}, HealthUp, false},
+		{"logs only", map[string]*EndpointHealth{EndpointLogs: ok(time.Hour)}, HealthUp, false},
+	} {
+		health, stale := summarise(&TargetHealth{interval: time.Minute, Endpoints: c.endpoints}, now)
+		if health != c.health || stale != c.stale {
+			t.Errorf("%s: got %s, stale %v, want %s, stale %v", c.name, health, stale, c.health, c.stale)
+		}
+	}
+}
+
+// Scrape outcomes and the log stream state are exported per target and
+// endpoint, and listed as JSON for /targets.
+func TestHealthSeries(t *testing.T) {
+	h := NewHealth()
+	h.register("web", "h1:9100", map[string]string{"env": "prod"}, time.Minute, map[string]string{
+		EndpointMetrics:   "http://h1:9100/metrics",
+		EndpointProcesses: "http://h1:9100/processes",
+	})
+	h.recordScrape("web", "h1:9100", EndpointMetrics, time.Now(), 12, nil)
+	h.recordScrape("web", "h1:9100", EndpointProcesses, time.Now(), 0, errors.New("connection refused"))
+	h.recordScrape("web", "h1:9100", EndpointProcesses, time.Now(), 0, errors.New("connection refused"))
+	h.recordSkipped("web", "h1:9100")
+	h.logConnected("web", "h1:9100", true, nil)
+	h.logLine("web", "h1:9100")
+	h.logLine("web", "h1:9100")
+	h.logConnected("web", "h1:9100", false, errors.New("EOF"))
+
+	want := `
+# HELP pm2_collector_up Whether the last scrape of the endpoint succeeded (1) or failed (0).
+# TYPE pm2_collector_up gauge
+pm2_collector_up{endpoint="logs",job="web",target="h1:9100"} 0
+pm2_collector_up{endpoint="metrics",job="web",target="h1:9100"} 1
+pm2_collector_up{endpoint="processes",job="web",target="h1:9100"} 0
+# HELP pm2_collector_scrape_failures_total Failed scrapes or log stream connection errors of the endpoint.
+# TYPE pm2_collector_scrape_failures_total counter
+pm2_collector_scrape_failures_total{endpoint="logs",job="web",target="h1:9100"} 1
+pm2_collector_scrape_failures_total{endpoint="metrics",job="web",target="h1:9100"} 0
+pm2_collector_scrape_failures_total{endpoint="processes",job="web",target="h1:9100"} 2
+# HELP pm2_collector_scrape_samples Samples (series or processes) returned by the last successful scrape.
+# TYPE pm2_collector_scrape_samples gauge
+pm2_collector_scrape_samples{endpoint="metrics",job="web",target="h1:9100"} 12
+pm2_collector_scrape_samples{endpoint="processes",job="web",target="h1:9100"} 0
+# HELP pm2_collector_scrapes_total Scrape attempts of the endpoint.
+# TYPE pm2_collector_scrapes_total counter
+pm2_collector_scrapes_total{endpoint="metrics",job="web",target="h1:9100"} 1
+pm2_collector_scrapes_total{endpoint="processes",job="web",target="h1:9100"} 2
+# HELP pm2_collector_log_stream_connected Whether the log stream of the target is connected.
+# TYPE pm2_collector_log_stream_connected gauge
+pm2_collector_log_stream_connected{job="web",target="h1:9100"} 0
+# HELP pm2_collector_log_lines_total Log lines received from the target.
+# TYPE pm2_collector_log_lines_total counter
+pm2_collector_log_lines_total{job="web",target="h1:9100"} 2
+# HELP pm2_collector_scrapes_skipped_total Scrapes skipped because the previous scrape of the target overran the interval.
+# TYPE pm2_collector_scrapes_skipped_total counter
+pm2_collector_scrapes_skipped_total{job="web",target="h1:9100"} 1
+# HELP pm2_collector_target_stale Whether the stored metrics of the target are stale.
+# TYPE pm2_collector_target_stale gauge
+pm2_collector_target_stale{job="web",target="h1:9100"} 0
+`
+	if err := testutil.CollectAndCompare(h, strings.NewReader(want),
+		"pm2_collector_up", "pm2_collector_scrape_failures_total", "pm2_collector_scrape_samples", "pm2_collector_scrapes_total",
+		"pm2_collector_log_stream_connected", "pm2_collector_log_lines_total", "pm2_collector_scrapes_skipped_total", "pm2_collector_target_stale"); err != nil {
+		t.Error(err)
+	}
+
+	data, err := json.Marshal(h.Targets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []struct {
+		Job       string            `json:"job"`
+		Target    string            `json:"target"`
+		Labels    map[string]string `json:"labels"`
+		Interval  string            `json:"interval"`
+		Health    string            `json:"health"`
+		Stale     *bool             `json:"stale"`
+		Skipped   uint64            `json:"skipped_scrapes_total"`
+		Endpoints map[string]struct {
+			URL         string `json:"url"`
+			Up          bool   `json:"up"`
+			LastError   string `json:"last_error"`
+			Scrapes     uint64 `json:"scrapes_total"`
+			Failures    uint64 `json:"failures_total"`
+			LinesTotal  uint64 `json:"lines_total"`
+			Disconnects uint64 `json:"disconnects_total"`
+		} `json:"endpoints"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Job != "web" || got[0].Labels["env"] != "prod" || got[0].Interval != "1m0s" ||
+		got[0].Health != HealthDegraded || got[0].Stale == nil || *got[0].Stale || got[0].Skipped != 1 {
+		t.Fatalf("/targets entry: %s", data)
+	}
+	eps := got[0].Endpoints
+	if p := eps[EndpointProcesses]; p.URL != "http://h1:9100/processes" || p.Up || p.LastError != "connection refused" || p.Scrapes != 2 || p.Failures != 2 {
+		t.Errorf("processes endpoint: %s", data)
+	}
+	if l := eps[EndpointLogs]; l.LinesTotal != 2 || l.Disconnects != 1 || l.LastError != "EOF" {
+		t.Errorf("logs endpoint: %s", data)
+	}
+}
@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// httpProvider polls an endpoint that returns target groups as JSON, in the
+// same format as file_sd. On failure the previous list is kept.
+type httpProvider struct {
+	cfg  config.HTTPSDConfig
+	last []config.Target
+}
+
+func newHTTPProvider(cfg config.HTTPSDConfig) *httpProvider {
+	cfg.RefreshInterval = refreshInterval(cfg.RefreshInterval, time.Minute)
+	return &httpProvider{cfg: cfg}
+}
+
+func (p *httpProvider) Name() string { return "http_sd " + p.cfg.URL }
+
+func (p *httpProvider) Run(ctx context.Context, ch chan<- []config.Target) {
+	ticker := time.NewTicker(p.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		if ts, err := p.fetch(ctx); err == nil {
+			p.last = ts
+		} else if ctx.Err() == nil {
+			log.Printf("%s: %v", p.Name(), err)
+		}
+		select {
+		case ch <- p.last:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *httpProvider) fetch(ctx context.Context) ([]config.Target, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", p.cfg.URL, nil)
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.BasicAuth.Username != "" {
+		req.SetBasicAuth(p.cfg.BasicAuth.Username, p.cfg.BasicAuth.Password)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseTargetGroups(data, false)
+}
@@ -0,0 +1,58 @@
+package discovery
+
+import (
+	"sort"
+
+	"github.com/aalish/pm2-full/internal/labels"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// relabelMetrics applies metric relabel rules to every series. Each series
+// is seen as its labels plus __name__; series dropped by a rule are removed,
+// and a rewritten __name__ moves the series to that family.
+func relabelMetrics(mfs map[string]*dto.MetricFamily, r labels.Relabeler) map[string]*dto.MetricFamily {
+	if len(r) == 0 {
+		return mfs
+	}
+	out := make(map[string]*dto.MetricFamily, len(mfs))
+	for name, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			ls := make(map[string]string, len(m.GetLabel())+1)
+			for _, lp := range m.GetLabel() {
+				ls[lp.GetName()] = lp.GetValue()
+			}
+			ls[labels.MetricNameLabel] = name
+			ls, ok := r.Process(ls)
+			if !ok {
+				continue
+			}
+			newName := ls[labels.MetricNameLabel]
+			if newName == "" {
+				continue
+			}
+			delete(ls, labels.MetricNameLabel)
+
+			m.Label = m.Label[:0]
+			for _, k := range sortedKeys(ls) {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(k), Value: proto.String(ls[k])})
+			}
+			dst := out[newName]
+			if dst == nil {
+				dst = &dto.MetricFamily{Name: proto.String(newName), Help: mf.Help, Type: mf.Type, Unit: mf.Unit}
+				out[newName] = dst
+			}
+			dst.Metric = append(dst.Metric, m)
+		}
+	}
+	return out
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
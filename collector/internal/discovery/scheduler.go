@@ -0,0 +1,272 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/labels"
+)
+
+// Scheduler runs one scrape loop and one log tail per target. Scrapes start
+// at a stable per-target offset within the interval so targets of a job do
+// not all fire at once, and a global semaphore bounds concurrent scrapes.
+type Scheduler struct {
+	store  Store
+	health *Health
+	sem    chan struct{}
+
+	mu        sync.Mutex
+	loops     map[string]*targetLoop        // job/host:port -> loop
+	discovery map[string]context.CancelFunc // job -> running providers
+}
+
+// targetLoop is the running state of one scraped target. target.Labels
+// holds the final label set after relabeling.
+type targetLoop struct {
+	job           config.Job
+	target        config.Target
+	client        *targetClient
+	metricRelabel labels.Relabeler
+	cancel        context.CancelFunc
+	running       atomic.Bool
+}
+
+// NewScheduler creates a scheduler that allows at most maxConcurrent scrapes
+// in flight across all jobs (unbounded if maxConcurrent <= 0).
+func NewScheduler(store Store, health *Health, maxConcurrent int) *Scheduler {
+	s := &Scheduler{
+		store:     store,
+		health:    health,
+		loops:     make(map[string]*targetLoop),
+		discovery: make(map[string]context.CancelFunc),
+	}
+	if maxConcurrent > 0 {
+		s.sem = make(chan struct{}, maxConcurrent)
+	}
+	return s
+}
+
+// Start begins scraping every static target of the job and runs its
+// discovery providers, which add and remove targets as they change. It fails
+// only if the job's relabel rules are invalid.
+func (s *Scheduler) Start(job config.Job) error {
+	if _, err := labels.Compile(job.RelabelConfigs); err != nil {
+		return fmt.Errorf("job %s: relabel_configs: %w", job.JobName, err)
+	}
+	if _, err := labels.Compile(job.MetricRelabelConfigs); err != nil {
+		return fmt.Errorf("job %s: metric_relabel_configs: %w", job.JobName, err)
+	}
+	s.Sync(job)
+	providers := Providers(job)
+	if len(providers) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	if prev := s.discovery[job.JobName]; prev != nil {
+		prev()
+	}
+	s.discovery[job.JobName] = cancel
+	s.mu.Unlock()
+	go s.discover(ctx, job, providers)
+	return nil
+}
+
+// Sync makes the running loops of job.JobName match job.Targets exactly:
+// new targets are started, vanished ones stopped, unchanged ones left alone.
+// Targets are relabeled first; those dropped by a rule are not scraped.
+func (s *Scheduler) Sync(job config.Job) {
+	job = withDefaults(job)
+	targetRelabel, err := labels.Compile(job.RelabelConfigs)
+	if err != nil {
+		log.Printf("job %s: relabel_configs: %v", job.JobName, err)
+		return
+	}
+	metricRelabel, err := labels.Compile(job.MetricRelabelConfigs)
+	if err != nil {
+		log.Printf("job %s: metric_relabel_configs: %v", job.JobName, err)
+		return
+	}
+
+	want := make(map[string]config.Target, len(job.Targets))
+	for _, t := range job.Targets {
+		if t, ok := relabelTarget(job, withJobDefaults(job, t), targetRelabel); ok {
+			want[loopKey(job.JobName, t)] = t
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, l := range s.loops {
+		if l.job.JobName != job.JobName {
+			continue
+		}
+		if t, ok := want[k]; ok && reflect.DeepEqual(t, l.target) {
+			delete(want, k)
+			continue
+		}
+		l.cancel()
+		delete(s.loops, k)
+		if _, ok := want[k]; !ok {
+			s.health.unregister(job.JobName, l.target.Address())
+		}
+	}
+	for k, t := range want {
+		c, err := newTargetClient(t)
+		if err != nil {
+			log.Printf("job %s: target %s: %v", job.JobName, t.Address(), err)
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		l := &targetLoop{job: job, target: t, client: c, metricRelabel: metricRelabel, cancel: cancel}
+		s.loops[k] = l
+		s.register(job, t)
+		go tailLoop(ctx, job, t, c, s.store, s.health)
+		go s.scrapeLoop(ctx, l)
+	}
+}
+
+// Stop cancels the job's discovery and every one of its loops.
+func (s *Scheduler) Stop(jobName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancel := s.discovery[jobName]; cancel != nil {
+		cancel()
+		delete(s.discovery, jobName)
+	}
+	for k, l := range s.loops {
+		if l.job.JobName == jobName {
+			l.cancel()
+			delete(s.loops, k)
+			s.health.unregister(jobName, l.target.Address())
+		}
+	}
+}
+
+// relabelTarget applies the job's target relabel rules. A rewritten
+// __address__ or __scheme__ changes where the target is scraped; the returned
+// target carries the final, public label set.
+func relabelTarget(job config.Job, t config.Target, r labels.Relabeler) (config.Target, bool) {
+	ls, ok := r.Process(labels.ForTarget(job, t))
+	if !ok {
+		return t, false
+	}
+	if addr := ls[labels.AddressLabel]; addr != t.Address() {
+		nt, err := parseHostPort(addr)
+		if err != nil {
+			log.Printf("job %s: relabeled address: %v", job.JobName, err)
+			return t, false
+		}
+		t.Host, t.Port = nt.Host, nt.Port
+	}
+	if scheme := ls[labels.SchemeLabel]; scheme != "" {
+		t.Scheme = scheme
+	}
+	t.Labels = labels.Finalize(ls)
+	return t, true
+}
+
+// register makes a target visible in the health registry before its first scrape.
+func (s *Scheduler) register(job config.Job, t config.Target) {
+	base := baseURL(t)
+	s.health.register(job.JobName, t.Address(), t.Labels, job.Interval, map[string]string{
+		EndpointMetrics:   base + job.Paths.Metrics,
+		EndpointProcesses: base + job.Paths.Processes,
+		EndpointLogs:      base + job.Paths.Logs,
+	})
+}
+
+// scrapeLoop waits for the target's offset, then scrapes every interval. A
+// tick that arrives while the previous scrape is still running is skipped
+// and counted rather than queued.
+func (s *Scheduler) scrapeLoop(ctx context.Context, l *targetLoop) {
+	job := l.job
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(offset(job.JobName, l.target, job.Interval)):
+	}
+
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	for {
+		if l.running.CompareAndSwap(false, true) {
+			go func() {
+				defer l.running.Store(false)
+				if !s.acquire(ctx) {
+					return
+				}
+				defer s.release()
+				scrapeTarget(ctx, job, l.target, l.client, l.metricRelabel, s.store, s.health)
+			}()
+		} else {
+			s.health.recordSkipped(job.JobName, l.target.Address())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) acquire(ctx context.Context) bool {
+	if s.sem == nil {
+		return true
+	}
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *Scheduler) release() {
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+// offset spreads targets across the interval by hashing their identity, so a
+// target keeps the same phase across restarts.
+func offset(job string, t config.Target, interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(loopKey(job, t)))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// baseURL is the scheme and authority of a target.
+func baseURL(t config.Target) string {
+	return t.Scheme + "://" + t.Address()
+}
+
+func loopKey(job string, t config.Target) string {
+	return job + "/" + t.Address()
+}
+
+// withDefaults fills in the interval and scrape timeout when unset. The
+// timeout never exceeds the interval.
+func withDefaults(job config.Job) config.Job {
+	if job.Interval <= 0 {
+		job.Interval = 15 * time.Second
+	}
+	if job.ScrapeTimeout <= 0 {
+		job.ScrapeTimeout = 10 * time.Second
+	}
+	if job.ScrapeTimeout > job.Interval {
+		job.ScrapeTimeout = job.Interval
+	}
+	return job
+}
@@ -0,0 +1,113 @@
+package discovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// Offsets are stable, within the interval and spread across targets.
+func TestOffset(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+	for port := 9100; port < 9110; port++ {
+		tg := config.Target{Host: "h1", Port: port}
+		o := offset("web", tg, time.Minute)
+		if o < 0 || o >= time.Minute || o != offset("web", tg, time.Minute) {
+			t.Fatalf("offset of %s: %s", tg.Address(), o)
+		}
+		seen[o] = true
+	}
+	if len(seen) < 5 {
+		t.Fatalf("offsets not spread: %v", seen)
+	}
+	if o := offset("web", config.Target{Host: "h1", Port: 9100}, 0); o != 0 {
+		t.Fatalf("offset without an interval: %s", o)
+	}
+}
+
+// The scrape timeout defaults to 10s and never exceeds the interval.
+func TestWithDefaults(t *testing.T) {
+	for _, c := range []struct{ interval, timeout, wantInterval, wantTimeout time.Duration }{
+		{0, 0, 15 * time.Second, 10 * time.Second},
+		{time.Minute, 0, time.Minute, 10 * time.Second},
+		{5 * time.Second, 0, 5 * time.Second, 5 * time.Second},
+		{time.Minute, 30 * time.Second, time.Minute, 30 * time.Second},
+	} {
+		job := withDefaults(config.Job{Interval: c.interval, ScrapeTimeout: c.timeout})
+		if job.Interval != c.wantInterval || job.ScrapeTimeout != c.wantTimeout {
+			t.Errorf("%s/%s: got %s/%s", c.interval, c.timeout, job.Interval, job.ScrapeTimeout)
+		}
+	}
+}
+
+// No more scrapes than the limit run at once, and a tick that arrives while
+// the target's previous scrape runs is skipped and counted.
+func TestSchedulerLimitsConcurrentScrapes(t *testing.T) {
+	var inFlight, most atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/logs" {
+			http.NotFound(w, r)
+			return
+		}
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		time.Sleep(40 * time.Millisecond)
+		if r.URL.Path == "/processes" {
+			w.Write([]byte("[]"))
+			return
+		}
+		w.Write([]byte("up 1\n"))
+	})
+	job := config.Job{JobName: "web", Interval: 60 * time.Millisecond, Paths: config.Paths{Metrics: "/metrics", Processes: "/processes", Logs: "/logs"}}
+	for range 4 {
+		srv := httptest.NewServer(handler)
+		t.Cleanup(srv.Close)
+		u, _ := url.Parse(srv.URL)
+		port, _ := strconv.Atoi(u.Port())
+		job.Targets = append(job.Targets, config.Target{Host: "127.0.0.1", Port: port})
+	}
+
+	h := NewHealth()
+	s := NewScheduler(nopStore{}, h, 2)
+	if err := s.Start(job); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	s.Stop("web")
+	for deadline := time.Now().Add(5 * time.Second); inFlight.Load() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("scrapes still running")
+		}
+	}
+	if got := most.Load(); got != 2 {
+		t.Fatalf("at most %d scrapes ran at once, want 2", got)
+	}
+
+	// Stop forgets the targets; scrape again without a limit to count skips
+	h = NewHealth()
+	s = NewScheduler(nopStore{}, h, 0)
+	s.Sync(job)
+	defer s.Stop("web")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		skipped := 0
+		for _, th := range h.Targets() {
+			if th.Skipped > 0 {
+				skipped++
+			}
+		}
+		if skipped == len(job.Targets) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("skipped scrapes: %+v", h.Targets())
+		}
+	}
+}
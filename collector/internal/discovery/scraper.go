@@ -2,121 +2,191 @@ package discovery
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"reflect"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/labels"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 )
 
-// Store is the interface your discovery layer uses to hand off data.
+// Store is the interface your discovery layer uses to hand off data. target
+// is the host:port of the exporter, ls its labels after relabeling and ts
+// the time the data was collected.
 type Store interface {
-	StoreMetrics(job, target string, mfs map[string]*dto.MetricFamily)
-	StoreProcesses(job, target string, data []byte)
-	StoreLog(job, target, line string)
+	StoreMetrics(job, target string, ls map[string]string, ts time.Time, mfs map[string]*dto.MetricFamily)
+	StoreProcesses(job, target string, ls map[string]string, ts time.Time, data []byte)
+	StoreLog(job, target string, ls map[string]string, ts time.Time, line string)
+
+	// StoreLogEntries durably appends spooled log lines, skipping any already
+	// stored, and returns the highest stored sequence number per stream.
+	// Exporters only drop lines from their spool once they are acknowledged.
+	StoreLogEntries(job, target string, ls map[string]string, entries []LogEntry) (map[string]uint64, error)
+	// LogOffsets returns the highest stored sequence number per stream.
+	LogOffsets(job, target string) map[string]uint64
 }
 
-// Start kicks off:
-//  1. One continuous tail‐goroutine per target (reconnecting on error).
-//  2. A ticker loop that scrapes metrics and processes every job.Interval.
-func Start(job config.Job, store Store) {
-	// log.Printf("Starting job %q with interval %s", job.JobName, job.Interval)
-
-	// 1) Launch exactly one tail‐goroutine per target:
-	for _, t := range job.Targets {
-		go func(target config.Target) {
-			base := fmt.Sprintf("http://%s:%d", target.Host, target.Port)
-			url := base + job.Paths.Logs
-
-			for {
-				// log.Printf("Attempting to tail logs from %s", url)
-				if err := tail(url, target, store, job.JobName); err != nil {
-					log.Printf("tail error for %s: %v", target.Host, err)
-					time.Sleep(5 * time.Second)
-					continue
-				}
-				log.Printf("tail ended for %s, reconnecting...", url)
-			}
-		}(t)
-	}
+// LogEntry is one log line with its position in an exporter's log spool.
+// Stream names the source log file; Seq increases by one per line within it.
+type LogEntry struct {
+	Stream    string    `json:"stream"`
+	Seq       uint64    `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	Line      string    `json:"line"`
+}
 
-	// 2) Start a ticker that only scrapes metrics & processes on each tick:
-	ticker := time.NewTicker(job.Interval)
-	defer ticker.Stop()
+// httpClient is used for discovery requests, which are not sent to exporters.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
 
-	// initial scrape
-	scrapeMetricsAndProcesses(job, store)
+// scrapeTarget fetches /metrics and /processes for one target once, each
+// bounded by the job's scrape timeout. Scraped series pass through the job's
+// metric relabel rules before they are stored.
+func scrapeTarget(ctx context.Context, job config.Job, t config.Target, c *targetClient, metricRelabel labels.Relabeler, store Store, health *Health) {
+	base := baseURL(t)
+	id := t.Address()
+
+	// 1) metrics
+	began := time.Now()
+	sctx, cancel := context.WithTimeout(ctx, job.ScrapeTimeout)
+	mf, err := fetchMetrics(sctx, c, base+job.Paths.Metrics)
+	cancel()
+	if ctx.Err() != nil {
+		return // target stopped
+	}
+	if err == nil {
+		mf = relabelMetrics(mf, metricRelabel)
+		store.StoreMetrics(job.JobName, id, t.Labels, time.Now(), mf)
+	} else {
+		log.Printf("metrics fetch error for %s: %v", id, err)
+	}
+	health.recordScrape(job.JobName, id, EndpointMetrics, began, countSeries(mf), err)
 
-	for range ticker.C {
-		// log.Printf("Running scrape for job %q", job.JobName)
-		scrapeMetricsAndProcesses(job, store)
+	// 2) processes JSON
+	began = time.Now()
+	sctx, cancel = context.WithTimeout(ctx, job.ScrapeTimeout)
+	data, err := fetchJSON(sctx, c, base+job.Paths.Processes)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		store.StoreProcesses(job.JobName, id, t.Labels, time.Now(), data)
+	} else {
+		log.Printf("process fetch error for %s: %v", id, err)
 	}
+	health.recordScrape(job.JobName, id, EndpointProcesses, began, countProcesses(data), err)
 }
 
-// scrapeMetricsAndProcesses fetches /metrics and /processes for each target once.
-func scrapeMetricsAndProcesses(job config.Job, store Store) {
-	for _, t := range job.Targets {
-		base := fmt.Sprintf("http://%s:%d", t.Host, t.Port)
-
-		// 1) metrics
-		if mf, err := fetchMetrics(base+job.Paths.Metrics, t.BasicAuth); err == nil {
-			// log.Printf("Fetched metrics from %s", base+job.Paths.Metrics)
-			store.StoreMetrics(job.JobName, t.Host, mf)
-		} else {
-			log.Printf("metrics fetch error for %s: %v", t.Host, err)
+// tailLoop keeps one log stream open for the target until ctx is cancelled,
+// reconnecting after errors.
+func tailLoop(ctx context.Context, job config.Job, t config.Target, c *targetClient, store Store, health *Health) {
+	url := baseURL(t) + job.Paths.Logs
+	for ctx.Err() == nil {
+		err := tail(ctx, c, url, t, store, job.JobName, health)
+		if ctx.Err() != nil {
+			return
 		}
-
-		// 2) processes JSON
-		if data, err := fetchJSON(base + job.Paths.Processes); err == nil {
-			// log.Printf("Fetched processes JSON from %s", base+job.Paths.Processes)
-			store.StoreProcesses(job.JobName, t.Host, data)
-		} else {
-			log.Printf("process fetch error for %s: %v", t.Host, err)
+		health.logConnected(job.JobName, t.Address(), false, err)
+		if err != nil {
+			log.Printf("tail error for %s: %v", t.Address(), err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+			continue
 		}
+		log.Printf("tail ended for %s, reconnecting...", url)
+	}
+}
+
+// countSeries returns the number of series across all metric families.
+func countSeries(mfs map[string]*dto.MetricFamily) int {
+	n := 0
+	for _, mf := range mfs {
+		n += len(mf.GetMetric())
+	}
+	return n
+}
+
+// countProcesses returns the number of entries in a /processes payload.
+func countProcesses(data []byte) int {
+	var procs []json.RawMessage
+	if err := json.Unmarshal(data, &procs); err != nil {
+		return 0
 	}
+	return len(procs)
 }
 
 // fetchMetrics scrapes Prometheus-style text format and parses it.
-func fetchMetrics(url string, auth config.AuthCreds) (map[string]*dto.MetricFamily, error) {
-	req, _ := http.NewRequest("GET", url, nil)
-	if auth.Username != "" {
-		req.SetBasicAuth(auth.Username, auth.Password)
+func fetchMetrics(ctx context.Context, c *targetClient, url string) (map[string]*dto.MetricFamily, error) {
+	req, err := c.get(ctx, url)
+	if err != nil {
+		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %s", resp.Status)
+	}
 
 	parser := &expfmt.TextParser{}
 	return parser.TextToMetricFamilies(resp.Body)
 }
 
 // fetchJSON fetches a JSON endpoint into a raw byte slice.
-func fetchJSON(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+func fetchJSON(ctx context.Context, c *targetClient, url string) ([]byte, error) {
+	req, err := c.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %s", resp.Status)
+	}
 	return io.ReadAll(resp.Body)
 }
 
 // tail connects to a Server-Sent Events (SSE) or text-stream log endpoint and
-// scans new lines, handing each one to StoreLog immediately.
-func tail(url string, t config.Target, store Store, jobName string) error {
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Accept", "text/event-stream")
-	if t.BasicAuth.Username != "" {
-		req.SetBasicAuth(t.BasicAuth.Username, t.BasicAuth.Password)
+// scans new lines, handing each one to StoreLog immediately. Exporters with a
+// log spool answer with sequenced entries instead, see tailEntries.
+func tail(ctx context.Context, c *targetClient, url string, t config.Target, store Store, jobName string, health *Health) error {
+	id := t.Address()
+	req, err := c.get(ctx, resumeURL(url, store.LogOffsets(jobName, id)))
+	if err != nil {
+		return err
 	}
+	req.Header.Set("Accept", "application/x-ndjson, text/event-stream")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("HTTP request error: %w", err)
 	}
@@ -126,13 +196,18 @@ func tail(url string, t config.Target, store Store, jobName string) error {
 		return fmt.Errorf("bad status: %s", resp.Status)
 	}
 	// log.Printf("Connected to %s, scanning logs...", url)
+	health.logConnected(jobName, id, true, nil)
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-ndjson") {
+		return tailEntries(ctx, c, url, resp.Body, t, store, jobName, health)
+	}
 
 	reader := bufio.NewReader(resp.Body)
 	for {
 		line, err := reader.ReadString('\n')
 		if len(line) > 0 {
 			raw := strings.TrimRight(line, "\r\n")
-			store.StoreLog(jobName, t.Host, raw)
+			store.StoreLog(jobName, id, t.Labels, time.Now(), raw)
+			health.logLine(jobName, id)
 		}
 		if err != nil {
 			if err == io.EOF {
@@ -143,3 +218,133 @@ func tail(url string, t config.Target, store Store, jobName string) error {
 		}
 	}
 }
+
+// resumeURL asks the exporter to replay each stream from after the last
+// stored line: after=<stream>:<seq>, repeated.
+func resumeURL(rawURL string, offsets map[string]uint64) string {
+	if len(offsets) == 0 {
+		return rawURL
+	}
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	streams := make([]string, 0, len(offsets))
+	for s := range offsets {
+		streams = append(streams, s)
+	}
+	sort.Strings(streams)
+	for _, s := range streams {
+		q.Add("after", fmt.Sprintf("%s:%d", s, offsets[s]))
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// tailEntries stores sequenced log entries in batches of up to 500 lines or
+// one second. Once a batch is durably stored the new offsets are posted to
+// <logs path>/ack so the exporter can drop those lines from its spool.
+func tailEntries(ctx context.Context, c *targetClient, url string, body io.Reader, t config.Target, store Store, jobName string, health *Health) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	id := t.Address()
+
+	entries := make(chan LogEntry, 1024)
+	done := make(chan error, 1)
+	go func() {
+		sc := bufio.NewScanner(body)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			var e LogEntry
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil || e.Stream == "" {
+				continue
+			}
+			select {
+			case entries <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		done <- sc.Err()
+	}()
+
+	var batch []LogEntry
+	acked := make(map[string]uint64)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		offsets, err := store.StoreLogEntries(jobName, id, t.Labels, batch)
+		batch = batch[:0]
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(offsets, acked) {
+			if err := ackLogs(ctx, c, url+"/ack", offsets); err != nil {
+				log.Printf("log ack to %s failed: %v", id, err)
+			} else {
+				acked = offsets
+			}
+		}
+		return nil
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-entries:
+			batch = append(batch, e)
+			health.logLine(jobName, id)
+			if len(batch) >= 500 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		case err := <-done:
+			for len(entries) > 0 {
+				batch = append(batch, <-entries)
+				health.logLine(jobName, id)
+			}
+			if ferr := flush(); ferr != nil {
+				return ferr
+			}
+			if err != nil {
+				return fmt.Errorf("scanner error: %w", err)
+			}
+			log.Printf("EOF reached for %s", url)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ackLogs tells the exporter which lines are stored.
+func ackLogs(ctx context.Context, c *targetClient, url string, offsets map[string]uint64) error {
+	body, err := json.Marshal(offsets)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := c.newRequest(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+	return nil
+}
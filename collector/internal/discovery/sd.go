@@ -0,0 +1,176 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/labels"
+	"gopkg.in/yaml.v3"
+)
+
+// Provider discovers targets for a job. Run sends the complete current list
+// on ch after every refresh and returns once ctx is cancelled.
+type Provider interface {
+	Name() string
+	Run(ctx context.Context, ch chan<- []config.Target)
+}
+
+// Providers builds the discovery providers configured on a job.
+func Providers(job config.Job) []Provider {
+	var ps []Provider
+	for _, c := range job.FileSD {
+		ps = append(ps, newFileProvider(c))
+	}
+	for _, c := range job.DNSSD {
+		ps = append(ps, newDNSProvider(c))
+	}
+	for _, c := range job.HTTPSD {
+		ps = append(ps, newHTTPProvider(c))
+	}
+	return ps
+}
+
+// targetGroup is one entry of a file_sd / http_sd document.
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// parseTargetGroups decodes a list of target groups from JSON, or from YAML
+// when asYAML is set, into host:port targets carrying their group's labels.
+func parseTargetGroups(data []byte, asYAML bool) ([]config.Target, error) {
+	var groups []targetGroup
+	var err error
+	if asYAML {
+		err = yaml.Unmarshal(data, &groups)
+	} else {
+		err = json.Unmarshal(data, &groups)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []config.Target
+	for _, g := range groups {
+		for _, addr := range g.Targets {
+			t, err := parseHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			t.Labels = g.Labels
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+func parseHostPort(addr string) (config.Target, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return config.Target{}, fmt.Errorf("target %q: %w", addr, err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return config.Target{}, fmt.Errorf("target %q: invalid port", addr)
+	}
+	return config.Target{Host: host, Port: p}, nil
+}
+
+// refreshInterval returns d, or def when d is unset.
+func refreshInterval(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// discover merges the static targets of job with the latest list from every
+// provider and syncs the scheduler whenever the merged set changes.
+func (s *Scheduler) discover(ctx context.Context, job config.Job, providers []Provider) {
+	type update struct {
+		idx     int
+		targets []config.Target
+	}
+	updates := make(chan update)
+	for i, p := range providers {
+		ch := make(chan []config.Target)
+		go p.Run(ctx, ch)
+		go func(i int, ch <-chan []config.Target) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ts := <-ch:
+					select {
+					case updates <- update{i, ts}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(i, ch)
+	}
+
+	latest := make([][]config.Target, len(providers))
+	current := targetKeys(job.Targets)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case u := <-updates:
+			latest[u.idx] = u.targets
+		}
+		merged := mergeTargets(job, latest)
+		keys := targetKeys(merged)
+		if keys == current {
+			continue
+		}
+		log.Printf("discovery: job %s now has %d targets", job.JobName, len(merged))
+		current = keys
+		j := job
+		j.Targets = merged
+		s.Sync(j)
+	}
+}
+
+// mergeTargets returns the static targets followed by every discovered one
+// not already present.
+func mergeTargets(job config.Job, discovered [][]config.Target) []config.Target {
+	seen := make(map[string]bool)
+	var out []config.Target
+	for _, t := range job.Targets {
+		k := t.Address()
+		if !seen[k] {
+			seen[k] = true
+			out = append(out, t)
+		}
+	}
+	for _, ts := range discovered {
+		for _, t := range ts {
+			k := t.Address()
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// targetKeys is a stable fingerprint of a target list and its labels.
+func targetKeys(ts []config.Target) string {
+	keys := make([]string, 0, len(ts))
+	for _, t := range ts {
+		keys = append(keys, t.Address()+labels.String(t.Labels))
+	}
+	sort.Strings(keys)
+	b, _ := json.Marshal(keys)
+	return string(b)
+}
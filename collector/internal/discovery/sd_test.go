@@ -0,0 +1,279 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// nopStore drops everything the scrapers hand it.
+type nopStore struct{}
+
+func (nopStore) StoreMetrics(string, string, map[string]string, time.Time, map[string]*dto.MetricFamily) {
+}
+func (nopStore) StoreProcesses(string, string, map[string]string, time.Time, []byte) {}
+func (nopStore) StoreLog(string, string, map[string]string, time.Time, string)       {}
+func (nopStore) StoreLogEntries(string, string, map[string]string, []LogEntry) (map[string]uint64, error) {
+	return nil, nil
+}
+func (nopStore) LogOffsets(string, string) map[string]uint64 { return nil }
+
+// closedPort returns a local port nothing listens on, so scrapes of the
+// targets under test fail fast.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+// waitTargets waits until health lists exactly want, as job/target.
+func waitTargets(t *testing.T, h *Health, want ...string) {
+	t.Helper()
+	slices.Sort(want)
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		got = got[:0]
+		for _, th := range h.Targets() {
+			got = append(got, th.Job+"/"+th.Target)
+		}
+		if slices.Equal(got, want) {
+			return
+		}
+	}
+	t.Fatalf("targets: got %v, want %v", got, want)
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSD(t *testing.T) {
+	port := closedPort(t)
+	path := filepath.Join(t.TempDir(), "targets.json")
+	writeFile(t, path, `[{"targets":["127.0.0.1:`+strconv.Itoa(port)+`","127.0.0.2:`+strconv.Itoa(port)+`"],"labels":{"env":"test"}}]`)
+
+	h := NewHealth()
+	s := NewScheduler(nopStore{}, h, 0)
+	job := config.Job{JobName: "files", Interval: time.Hour, FileSD: []config.FileSDConfig{{Files: []string{filepath.Join(filepath.Dir(path), "*.json")}}}}
+	if err := s.Start(job); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop("files")
+	waitTargets(t, h, "files/127.0.0.1:"+strconv.Itoa(port), "files/127.0.0.2:"+strconv.Itoa(port))
+	for _, th := range h.Targets() {
+		if th.Labels["env"] != "test" {
+			t.Errorf("%s: labels %v", th.Target, th.Labels)
+		}
+	}
+
+	// edits are picked up and removed targets are forgotten
+	writeFile(t, path, `[{"targets":["127.0.0.3:`+strconv.Itoa(port)+`"]}]`)
+	waitTargets(t, h, "files/127.0.0.3:"+strconv.Itoa(port))
+}
+
+func TestDNSSD(t *testing.T) {
+	port := closedPort(t)
+	server := dnsStandIn(t, map[string][]dnsRecord{
+		"a.pm2.test.":   {{ip: net.IPv4(127, 0, 0, 1)}, {ip: net.IPv4(127, 0, 0, 2)}},
+		"srv.pm2.test.": {{target: "localhost.", port: uint16(port)}},
+	})
+
+	h := NewHealth()
+	s := NewScheduler(nopStore{}, h, 0)
+	job := config.Job{JobName: "dns", Interval: time.Hour, DNSSD: []config.DNSSDConfig{
+		{Names: []string{"a.pm2.test"}, Type: "A", Port: port, Server: server},
+		{Names: []string{"srv.pm2.test"}, Server: server},
+	}}
+	if err := s.Start(job); err != nil {
+		t.Fatal(err)
+	}
+	waitTargets(t, h, "dns/127.0.0.1:"+strconv.Itoa(port), "dns/127.0.0.2:"+strconv.Itoa(port), "dns/localhost:"+strconv.Itoa(port))
+
+	s.Stop("dns")
+	waitTargets(t, h)
+}
+
+func TestHTTPSD(t *testing.T) {
+	port := strconv.Itoa(closedPort(t))
+	var (
+		mu       sync.Mutex
+		status   = http.StatusOK
+		body     = `[{"targets":["127.0.0.1:` + port + `","127.0.0.2:` + port + `"],"labels":{"env":"test"}}]`
+		requests atomic.Int32
+	)
+	// serve replies with status and body from now on, and waits for two
+	// more polls so the reply is known to have been seen
+	serve := func(st int, b string) {
+		t.Helper()
+		mu.Lock()
+		status, body = st, b
+		mu.Unlock()
+		for n := requests.Load() + 2; requests.Load() < n; time.Sleep(5 * time.Millisecond) {
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "sd" || pass != "pw" || r.Header.Get("Accept") != "application/json" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+		requests.Add(1)
+	}))
+	defer srv.Close()
+
+	h := NewHealth()
+	s := NewScheduler(nopStore{}, h, 0)
+	job := config.Job{JobName: "http", Interval: time.Hour, HTTPSD: []config.HTTPSDConfig{
+		{URL: srv.URL, BasicAuth: config.AuthCreds{Username: "sd", Password: "pw"}, RefreshInterval: 10 * time.Millisecond},
+	}}
+	if err := s.Start(job); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop("http")
+	waitTargets(t, h, "http/127.0.0.1:"+port, "http/127.0.0.2:"+port)
+	for _, th := range h.Targets() {
+		if th.Labels["env"] != "test" {
+			t.Errorf("%s: labels %v", th.Target, th.Labels)
+		}
+	}
+
+	// failed polls and malformed lists keep the previous targets
+	serve(http.StatusInternalServerError, "")
+	waitTargets(t, h, "http/127.0.0.1:"+port, "http/127.0.0.2:"+port)
+	serve(http.StatusOK, `{"targets":`)
+	waitTargets(t, h, "http/127.0.0.1:"+port, "http/127.0.0.2:"+port)
+
+	// a new list replaces the targets, forgetting those no longer in it
+	serve(http.StatusOK, `[{"targets":["127.0.0.3:`+port+`"]}]`)
+	waitTargets(t, h, "http/127.0.0.3:"+port)
+	serve(http.StatusOK, `[]`)
+	waitTargets(t, h)
+}
+
+// dnsRecord is an A record (ip) or an SRV record (target and port).
+type dnsRecord struct {
+	ip     net.IP
+	target string
+	port   uint16
+}
+
+// dnsStandIn answers A and SRV queries over UDP for the names in records,
+// and NXDOMAIN for any other, and returns its address.
+func dnsStandIn(t *testing.T, records map[string][]dnsRecord) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := dnsAnswer(buf[:n], records); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+const (
+	dnsTypeA   = 1
+	dnsTypeSRV = 33
+)
+
+func dnsAnswer(req []byte, records map[string][]dnsRecord) []byte {
+	if len(req) < 12 {
+		return nil
+	}
+	// the question: labels up to the root, then type and class
+	var name strings.Builder
+	i := 12
+	for i < len(req) && req[i] != 0 {
+		l := int(req[i])
+		if i+1+l > len(req) {
+			return nil
+		}
+		name.Write(req[i+1 : i+1+l])
+		name.WriteByte('.')
+		i += 1 + l
+	}
+	if i+5 > len(req) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(req[i+1:])
+	question := req[12 : i+5]
+
+	var answers [][]byte
+	for _, rec := range records[strings.ToLower(name.String())] {
+		var rdata []byte
+		switch {
+		case qtype == dnsTypeA && rec.ip != nil:
+			rdata = rec.ip.To4()
+		case qtype == dnsTypeSRV && rec.target != "":
+			rdata = binary.BigEndian.AppendUint16(rdata, 0) // priority
+			rdata = binary.BigEndian.AppendUint16(rdata, 0) // weight
+			rdata = binary.BigEndian.AppendUint16(rdata, rec.port)
+			for _, l := range strings.Split(strings.TrimSuffix(rec.target, "."), ".") {
+				rdata = append(append(rdata, byte(len(l))), l...)
+			}
+			rdata = append(rdata, 0)
+		default:
+			continue
+		}
+		a := []byte{0xc0, 12} // the name, pointing at the question
+		a = binary.BigEndian.AppendUint16(a, qtype)
+		a = binary.BigEndian.AppendUint16(a, 1) // IN
+		a = binary.BigEndian.AppendUint32(a, 60)
+		a = binary.BigEndian.AppendUint16(a, uint16(len(rdata)))
+		answers = append(answers, append(a, rdata...))
+	}
+
+	flags := uint16(0x8180) // response, recursion desired and available
+	if _, ok := records[strings.ToLower(name.String())]; !ok {
+		flags |= 3 // NXDOMAIN
+	}
+	resp := append([]byte{}, req[:2]...) // id
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+	resp = binary.BigEndian.AppendUint32(resp, 0) // authority and additional
+	resp = append(resp, question...)
+	for _, a := range answers {
+		resp = append(resp, a...)
+	}
+	return resp
+}
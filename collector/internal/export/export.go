@@ -0,0 +1,349 @@
+// Package export streams stored metrics series, process history and logs
+// as CSV, NDJSON or Parquet with a chosen set of columns. Rows are written
+// as they are read from storage and pushed to the client every few
+// thousand, so an export of any size runs in bounded memory.
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/storage"
+)
+
+// ErrBadRequest is wrapped by the errors Check returns.
+var ErrBadRequest = errors.New("bad export request")
+
+// Request describes one export.
+type Request struct {
+	Dataset    string        // metrics, processes or logs
+	Format     string        // csv (default), ndjson or parquet
+	Columns    []string      // default: every column of the dataset
+	Metric     string        // metrics: only samples of this name
+	Step       time.Duration // metrics: the wanted spacing of points, picks the resolution
+	Resolution string        // metrics: raw, 5m, 1h, or auto (default)
+	Search     string        // logs: only lines matching this query (see package search)
+	Query      storage.Selector
+}
+
+type columnType int
+
+const (
+	textColumn columnType = iota
+	floatColumn
+	intColumn
+	timeColumn
+)
+
+type column struct {
+	name string
+	typ  columnType
+}
+
+// labelPrefix selects one label as a column: label.<name> takes it from the
+// series labels, or the target labels when the series has none such.
+const labelPrefix = "label."
+
+// datasets lists the columns of each dataset in their default order.
+// Metrics rows are one sample of a raw scrape, whose value is set, or one
+// series of a rollup bucket, whose value is the last in the bucket.
+var datasets = map[string][]column{
+	"metrics": {
+		{"timestamp", timeColumn}, {"job", textColumn}, {"target", textColumn}, {"resolution", textColumn},
+		{"metric", textColumn}, {"labels", textColumn}, {"value", floatColumn},
+		{"min", floatColumn}, {"max", floatColumn}, {"avg", floatColumn}, {"count", intColumn},
+		{"target_labels", textColumn},
+	},
+	"processes": {
+		{"timestamp", timeColumn}, {"job", textColumn}, {"target", textColumn}, {"name", textColumn},
+		{"pm_id", intColumn}, {"pid", intColumn}, {"status", textColumn}, {"restart_time", intColumn},
+		{"version", textColumn}, {"env_hash", textColumn}, {"target_labels", textColumn},
+	},
+	"logs": {
+		{"timestamp", timeColumn}, {"job", textColumn}, {"target", textColumn}, {"app", textColumn},
+		{"line", textColumn}, {"target_labels", textColumn},
+	},
+}
+
+// formats maps each format to its content type and file extension.
+var formats = map[string][2]string{
+	"csv":     {"text/csv; charset=utf-8", "csv"},
+	"ndjson":  {"application/x-ndjson", "ndjson"},
+	"parquet": {"application/vnd.apache.parquet", "parquet"},
+}
+
+// Check fills in the defaults of r and validates it.
+func (r *Request) Check() error {
+	cols, ok := datasets[r.Dataset]
+	if !ok {
+		return fmt.Errorf("%w: unknown dataset %q (want metrics, processes or logs)", ErrBadRequest, r.Dataset)
+	}
+	if r.Format == "" {
+		r.Format = "csv"
+	}
+	if _, ok := formats[r.Format]; !ok {
+		return fmt.Errorf("%w: unknown format %q (want csv, ndjson or parquet)", ErrBadRequest, r.Format)
+	}
+	if len(r.Columns) == 0 {
+		for _, c := range cols {
+			r.Columns = append(r.Columns, c.name)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, name := range r.Columns {
+		if _, err := r.column(name); err != nil {
+			return err
+		}
+		if seen[name] {
+			return fmt.Errorf("%w: column %q given twice", ErrBadRequest, name)
+		}
+		seen[name] = true
+	}
+	if r.Metric != "" && r.Dataset != "metrics" {
+		return fmt.Errorf("%w: metric only applies to the metrics dataset", ErrBadRequest)
+	}
+	return nil
+}
+
+func (r *Request) column(name string) (column, error) {
+	if l, ok := strings.CutPrefix(name, labelPrefix); ok && l != "" {
+		return column{name, textColumn}, nil
+	}
+	for _, c := range datasets[r.Dataset] {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return column{}, fmt.Errorf("%w: %s has no column %q", ErrBadRequest, r.Dataset, name)
+}
+
+// ContentType returns the content type of a checked request's output.
+func (r *Request) ContentType() string { return formats[r.Format][0] }
+
+// Filename returns a file name for a checked request's output.
+func (r *Request) Filename() string { return r.Dataset + "." + formats[r.Format][1] }
+
+// row is one exported row: its fields by column name, and the labels that
+// label.<name> columns look up.
+type row struct {
+	fields       map[string]interface{}
+	series, tgts map[string]string
+}
+
+func (rw *row) get(name string) interface{} {
+	if l, ok := strings.CutPrefix(name, labelPrefix); ok {
+		if v, ok := rw.series[l]; ok {
+			return v
+		}
+		if v, ok := rw.tgts[l]; ok {
+			return v
+		}
+		return nil
+	}
+	return rw.fields[name]
+}
+
+// flushRows is how many rows are written between flushes.
+const flushRows = 5000
+
+// Write runs a checked request against store, writing the rows to w and
+// calling flush, if not nil, every flushRows rows so a client receives the
+// output as it is produced. It returns the number of rows written. Output
+// may have been written when it fails.
+func Write(store storage.Store, r Request, w io.Writer, flush func() error) (int64, error) {
+	cols := make([]column, len(r.Columns))
+	for i, name := range r.Columns {
+		cols[i], _ = r.column(name)
+	}
+	enc, err := newEncoder(r.Format, w, cols)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	vals := make([]interface{}, len(cols))
+	emit := func(rw *row) error {
+		for i, c := range cols {
+			vals[i] = rw.get(c.name)
+		}
+		if err := enc.write(vals); err != nil {
+			return err
+		}
+		n++
+		if n%flushRows == 0 {
+			if err := enc.flush(); err != nil {
+				return err
+			}
+			if flush != nil {
+				return flush()
+			}
+		}
+		return nil
+	}
+	switch r.Dataset {
+	case "metrics":
+		err = metricRows(store, r, emit)
+	case "processes":
+		err = processRows(store, r, emit)
+	case "logs":
+		err = logRows(store, r, emit)
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, enc.close()
+}
+
+// labelsJSON renders labels as a JSON object, or "" when empty.
+func labelsJSON(ls map[string]string) string {
+	if len(ls) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(ls) // sorts the keys
+	return string(b)
+}
+
+// labelsText is labelsJSON with no labels exported as a null.
+func labelsText(ls map[string]string) interface{} {
+	if s := labelsJSON(ls); s != "" {
+		return s
+	}
+	return nil
+}
+
+func parseTime(s string) interface{} {
+	ts, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil
+	}
+	return ts
+}
+
+// metricRows emits one row per sample of each raw scrape, or per series of
+// each rollup bucket, in timestamp order and then by metric and labels.
+func metricRows(store storage.Store, r Request, emit func(*row) error) error {
+	q := storage.MetricQuery{Selector: r.Query, Step: r.Step, Resolution: r.Resolution}
+	return store.ScanMetrics(q, func(job, target string, raw json.RawMessage) error {
+		var rec struct {
+			Timestamp  string                 `json:"timestamp"`
+			Resolution string                 `json:"resolution"`
+			Labels     map[string]string      `json:"labels"`
+			Series     []storage.RollupSeries `json:"series"`
+		}
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return nil // skipped like unreadable records in queries
+		}
+		type sample struct {
+			name, labels string
+			fields       map[string]interface{}
+			series       map[string]string
+		}
+		var samples []sample
+		if rec.Resolution != "" {
+			for _, s := range rec.Series {
+				samples = append(samples, sample{s.Name, labelsJSON(s.Labels), map[string]interface{}{
+					"value": s.Last, "min": s.Min, "max": s.Max, "avg": s.Avg, "count": s.Count,
+				}, s.Labels})
+			}
+		} else {
+			rec.Resolution = "raw"
+			_, mfs, err := storage.DecodeMetricsRecord(raw)
+			if err != nil {
+				return nil
+			}
+			for _, s := range storage.Samples(mfs) {
+				samples = append(samples, sample{s.Name, labelsJSON(s.Labels), map[string]interface{}{
+					"value": s.Value,
+				}, s.Labels})
+			}
+		}
+		sort.Slice(samples, func(i, j int) bool {
+			if samples[i].name != samples[j].name {
+				return samples[i].name < samples[j].name
+			}
+			return samples[i].labels < samples[j].labels
+		})
+		ts := parseTime(rec.Timestamp)
+		tl := labelsText(rec.Labels)
+		for _, s := range samples {
+			if r.Metric != "" && s.name != r.Metric {
+				continue
+			}
+			s.fields["timestamp"] = ts
+			s.fields["job"] = job
+			s.fields["target"] = target
+			s.fields["resolution"] = rec.Resolution
+			s.fields["metric"] = s.name
+			s.fields["labels"] = labelsText(s.series)
+			s.fields["target_labels"] = tl
+			if err := emit(&row{fields: s.fields, series: s.series, tgts: rec.Labels}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// processRows emits one row per process of each snapshot within the range,
+// target by target. Without a start the whole history is exported; the
+// history of one target is read at once, as process queries do.
+func processRows(store storage.Store, r Request, emit func(*row) error) error {
+	q := r.Query
+	if q.Start.IsZero() {
+		q.Start = time.Unix(0, 0)
+	}
+	for _, e := range store.Catalog(storage.CatalogQuery{Kind: "processes", Job: q.Job, Target: q.Target, Matchers: q.Matchers}) {
+		if e.App != "" {
+			continue // the same snapshots, listed per app
+		}
+		tq := storage.ProcessQuery{Selector: q}
+		tq.Job, tq.Target, tq.App = e.Job, e.Target, ""
+		snaps, err := store.QueryProcesses(tq)
+		if err != nil {
+			return err
+		}
+		for _, raw := range snaps {
+			var head struct {
+				Labels map[string]string `json:"labels"`
+			}
+			json.Unmarshal(raw, &head)
+			ts, states, err := storage.ParseProcessSnapshot(raw)
+			if err != nil || ts.Before(q.Start) {
+				continue // unreadable, or in effect before the range
+			}
+			tl := labelsText(head.Labels)
+			for _, p := range states {
+				if q.App != "" && p.Name != q.App {
+					continue
+				}
+				fields := map[string]interface{}{
+					"timestamp": ts, "job": e.Job, "target": e.Target, "name": p.Name,
+					"pm_id": int64(p.PMID), "pid": int64(p.PID), "status": p.Status,
+					"restart_time": int64(p.RestartCount), "version": p.Version, "env_hash": p.EnvHash,
+					"target_labels": tl,
+				}
+				if err := emit(&row{fields: fields, tgts: head.Labels}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// logRows emits the matching log lines oldest first, those matching the
+// search if the request has one.
+func logRows(store storage.Store, r Request, emit func(*row) error) error {
+	q := storage.SearchQuery{LogQuery: storage.LogQuery{Selector: r.Query, Forward: true}, Search: r.Search}
+	return store.ScanLogs(q, func(l storage.LogLine) error {
+		fields := map[string]interface{}{
+			"timestamp": parseTime(l.Timestamp), "job": l.Job, "target": l.Target,
+			"app": l.App, "line": l.Line, "target_labels": labelsText(l.Labels),
+		}
+		return emit(&row{fields: fields, tgts: l.Labels})
+	})
+}
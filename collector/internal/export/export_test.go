@@ -0,0 +1,189 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/aalish/pm2-full/internal/storage/storagetest"
+	"github.com/parquet-go/parquet-go"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// seededStore opens a disk backend holding two log lines, a scrape and a
+// process snapshot of target h1 of job web, labelled env=prod; t0 is the
+// time of the first line.
+func seededStore(t *testing.T) (storage.Backend, time.Time) {
+	t.Helper()
+	s := storagetest.Open(t)
+	t0 := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	prod := map[string]string{"env": "prod"}
+	s.StoreLog("web", "h1", prod, t0, `[api] started, "ok"`)
+	s.StoreLog("web", "h1", prod, t0.Add(time.Second), "[worker] done")
+	s.StoreMetrics("web", "h1", prod, t0, map[string]*dto.MetricFamily{"pm2_up": {
+		Name: proto.String("pm2_up"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{Label: []*dto.LabelPair{{Name: proto.String("app"), Value: proto.String("api")}}, Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+			{Label: []*dto.LabelPair{{Name: proto.String("app"), Value: proto.String("worker")}}, Gauge: &dto.Gauge{Value: proto.Float64(0)}},
+		},
+	}})
+	s.StoreProcesses("web", "h1", prod, t0, []byte(`[{"name":"api","pm_id":0,"pid":100,"status":"online","restart_time":2}]`))
+	return s, t0
+}
+
+// export runs a request, which must pass Check.
+func export(t *testing.T, s storage.Store, r Request) ([]byte, int64) {
+	t.Helper()
+	if err := r.Check(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	n, err := Write(s, r, &buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), n
+}
+
+// Check fills in the defaults and rejects unknown datasets, formats and
+// columns.
+func TestCheck(t *testing.T) {
+	r := Request{Dataset: "logs"}
+	if err := r.Check(); err != nil || r.Format != "csv" || !slices.Equal(r.Columns, []string{"timestamp", "job", "target", "app", "line", "target_labels"}) {
+		t.Fatalf("defaults: %+v, %v", r, err)
+	}
+	if r.ContentType() != "text/csv; charset=utf-8" || r.Filename() != "logs.csv" {
+		t.Fatalf("content type %q, file name %q", r.ContentType(), r.Filename())
+	}
+	for _, r := range []Request{
+		{Dataset: "traces"},
+		{Dataset: "logs", Format: "xml"},
+		{Dataset: "logs", Columns: []string{"value"}},
+		{Dataset: "logs", Columns: []string{"line", "line"}},
+		{Dataset: "logs", Columns: []string{"label."}},
+		{Dataset: "processes", Metric: "pm2_up"},
+	} {
+		if err := r.Check(); !errors.Is(err, ErrBadRequest) {
+			t.Errorf("%+v: %v", r, err)
+		}
+	}
+}
+
+// The formats hold the same rows: CSV with a header and empty missing
+// values, NDJSON with nulls, and Parquet with typed optional columns.
+func TestFormats(t *testing.T) {
+	s, t0 := seededStore(t)
+	cols := []string{"timestamp", "app", "line", "label.env", "label.zone"}
+	ts0, ts1 := t0.Format(time.RFC3339Nano), t0.Add(time.Second).Format(time.RFC3339Nano)
+
+	out, n := export(t, s, Request{Dataset: "logs", Columns: cols})
+	records, err := csv.NewReader(bytes.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{cols, {ts0, "api", `started, "ok"`, "prod", ""}, {ts1, "worker", "done", "prod", ""}}
+	if n != 2 || len(records) != len(want) {
+		t.Fatalf("csv: %d rows: %q", n, out)
+	}
+	for i := range want {
+		if !slices.Equal(records[i], want[i]) {
+			t.Fatalf("csv record %d: got %q, want %q", i, records[i], want[i])
+		}
+	}
+
+	out, _ = export(t, s, Request{Dataset: "logs", Format: "ndjson", Columns: cols})
+	wantJSON := `{"timestamp":"` + ts0 + `","app":"api","line":"started, \"ok\"","label.env":"prod","label.zone":null}` + "\n" +
+		`{"timestamp":"` + ts1 + `","app":"worker","line":"done","label.env":"prod","label.zone":null}` + "\n"
+	if string(out) != wantJSON {
+		t.Fatalf("ndjson:\n%s\nwant:\n%s", out, wantJSON)
+	}
+
+	out, _ = export(t, s, Request{Dataset: "logs", Format: "parquet", Columns: cols})
+	rd := parquet.NewReader(bytes.NewReader(out))
+	defer rd.Close()
+	if rd.NumRows() != 2 {
+		t.Fatalf("parquet rows: %d", rd.NumRows())
+	}
+	rows := make([]parquet.Row, 2)
+	if n, err := rd.ReadRows(rows); n != 2 || (err != nil && err != io.EOF) {
+		t.Fatalf("parquet read: %d, %v", n, err)
+	}
+	value := func(row parquet.Row, name string) parquet.Value {
+		t.Helper()
+		leaf, ok := rd.Schema().Lookup(name)
+		if !ok {
+			t.Fatalf("parquet has no column %s", name)
+		}
+		return row[leaf.ColumnIndex]
+	}
+	for i, line := range []string{`started, "ok"`, "done"} {
+		if got := value(rows[i], "timestamp").Int64(); got != t0.Add(time.Duration(i)*time.Second).UnixNano() {
+			t.Errorf("parquet row %d: timestamp %d", i, got)
+		}
+		if got := value(rows[i], "line").String(); got != line {
+			t.Errorf("parquet row %d: line %q", i, got)
+		}
+		if got := value(rows[i], "label.env").String(); got != "prod" {
+			t.Errorf("parquet row %d: label.env %q", i, got)
+		}
+		if !value(rows[i], "label.zone").IsNull() {
+			t.Errorf("parquet row %d: label.zone is set", i)
+		}
+	}
+}
+
+// decodeNDJSON decodes the rows of an NDJSON export.
+func decodeNDJSON(t *testing.T, out []byte) []map[string]interface{} {
+	t.Helper()
+	var rows []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		var row map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Metrics export one row per sample, ordered by metric and labels, and
+// processes one row per process of each snapshot.
+func TestDatasets(t *testing.T) {
+	s, _ := seededStore(t)
+	out, n := export(t, s, Request{Dataset: "metrics", Format: "ndjson", Metric: "pm2_up", Columns: []string{"resolution", "label.app", "label.env", "value", "count"}})
+	rows := decodeNDJSON(t, out)
+	if n != 2 || len(rows) != 2 {
+		t.Fatalf("metrics: %d rows: %s", n, out)
+	}
+	for i, want := range []map[string]interface{}{
+		{"resolution": "raw", "label.app": "api", "label.env": "prod", "value": 1.0, "count": nil},
+		{"resolution": "raw", "label.app": "worker", "label.env": "prod", "value": 0.0, "count": nil},
+	} {
+		for k, v := range want {
+			if rows[i][k] != v {
+				t.Errorf("metrics row %d: %s is %v, want %v", i, k, rows[i][k], v)
+			}
+		}
+	}
+
+	out, n = export(t, s, Request{Dataset: "processes", Format: "ndjson", Columns: []string{"job", "name", "pid", "status", "restart_time", "target_labels"}})
+	rows = decodeNDJSON(t, out)
+	want := map[string]interface{}{"job": "web", "name": "api", "pid": 100.0, "status": "online", "restart_time": 2.0, "target_labels": `{"env":"prod"}`}
+	if n != 1 || len(rows) != 1 {
+		t.Fatalf("processes: %d rows: %s", n, out)
+	}
+	for k, v := range want {
+		if rows[0][k] != v {
+			t.Errorf("processes: %s is %v, want %v", k, rows[0][k], v)
+		}
+	}
+}
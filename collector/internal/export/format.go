@@ -0,0 +1,210 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// encoder writes rows in one format. Values are nil, string, float64,
+// int64 or time.Time, in the order of the columns it was created with.
+type encoder interface {
+	write(vals []interface{}) error
+	flush() error // passes the buffered rows on to the writer
+	close() error // flushes and ends the output
+}
+
+func newEncoder(format string, w io.Writer, cols []column) (encoder, error) {
+	switch format {
+	case "ndjson":
+		return newNDJSONEncoder(w, cols), nil
+	case "parquet":
+		return newParquetEncoder(w, cols), nil
+	default:
+		return newCSVEncoder(w, cols)
+	}
+}
+
+// --- csv ---
+
+// csvEncoder writes a header row and then one record per row. Times are
+// RFC 3339 in UTC and missing values empty.
+type csvEncoder struct {
+	w      *csv.Writer
+	record []string
+}
+
+func newCSVEncoder(w io.Writer, cols []column) (*csvEncoder, error) {
+	e := &csvEncoder{w: csv.NewWriter(w), record: make([]string, len(cols))}
+	for i, c := range cols {
+		e.record[i] = c.name
+	}
+	return e, e.w.Write(e.record)
+}
+
+func (e *csvEncoder) write(vals []interface{}) error {
+	for i, v := range vals {
+		switch v := v.(type) {
+		case nil:
+			e.record[i] = ""
+		case string:
+			e.record[i] = v
+		case float64:
+			e.record[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		case int64:
+			e.record[i] = strconv.FormatInt(v, 10)
+		case time.Time:
+			e.record[i] = v.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return e.w.Write(e.record)
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvEncoder) close() error { return e.flush() }
+
+// --- ndjson ---
+
+// ndjsonEncoder writes one JSON object per row with the columns as keys,
+// in column order. Times are RFC 3339 strings in UTC, and missing values
+// and floats JSON cannot hold (NaN, ±Inf) are null.
+type ndjsonEncoder struct {
+	w    *bufio.Writer
+	keys [][]byte
+	buf  []byte
+}
+
+func newNDJSONEncoder(w io.Writer, cols []column) *ndjsonEncoder {
+	e := &ndjsonEncoder{w: bufio.NewWriterSize(w, 64*1024)}
+	for _, c := range cols {
+		k, _ := json.Marshal(c.name)
+		e.keys = append(e.keys, append(k, ':'))
+	}
+	return e
+}
+
+func (e *ndjsonEncoder) write(vals []interface{}) error {
+	b := append(e.buf[:0], '{')
+	for i, v := range vals {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, e.keys[i]...)
+		switch v := v.(type) {
+		case string:
+			s, _ := json.Marshal(v)
+			b = append(b, s...)
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				b = append(b, "null"...)
+			} else {
+				b = strconv.AppendFloat(b, v, 'g', -1, 64)
+			}
+		case int64:
+			b = strconv.AppendInt(b, v, 10)
+		case time.Time:
+			b = append(b, '"')
+			b = v.UTC().AppendFormat(b, time.RFC3339Nano)
+			b = append(b, '"')
+		default:
+			b = append(b, "null"...)
+		}
+	}
+	b = append(b, '}', '\n')
+	e.buf = b
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *ndjsonEncoder) flush() error { return e.w.Flush() }
+
+func (e *ndjsonEncoder) close() error { return e.w.Flush() }
+
+// --- parquet ---
+
+// parquetRowGroup is how many rows make a row group, which the writer
+// holds in memory until it is complete.
+const parquetRowGroup = 50000
+
+// parquetEncoder writes a Snappy-compressed Parquet file with one optional
+// column per exported column: strings, doubles, 64-bit integers and
+// nanosecond timestamps. Parquet stores the columns sorted by name.
+type parquetEncoder struct {
+	w     *parquet.Writer
+	index []int // of each value's column in the schema
+	row   parquet.Row
+	rows  int
+}
+
+func newParquetEncoder(w io.Writer, cols []column) *parquetEncoder {
+	group := make(parquet.Group, len(cols))
+	for _, c := range cols {
+		var node parquet.Node
+		switch c.typ {
+		case floatColumn:
+			node = parquet.Leaf(parquet.DoubleType)
+		case intColumn:
+			node = parquet.Int(64)
+		case timeColumn:
+			node = parquet.Timestamp(parquet.Nanosecond)
+		default:
+			node = parquet.String()
+		}
+		group[c.name] = parquet.Optional(node)
+	}
+	schema := parquet.NewSchema("export", group)
+	e := &parquetEncoder{
+		w:     parquet.NewWriter(w, schema, parquet.Compression(&parquet.Snappy)),
+		index: make([]int, len(cols)),
+		row:   make(parquet.Row, len(cols)),
+	}
+	for i, c := range cols {
+		leaf, _ := schema.Lookup(c.name)
+		e.index[i] = leaf.ColumnIndex
+	}
+	return e
+}
+
+func (e *parquetEncoder) write(vals []interface{}) error {
+	for i, v := range vals {
+		col := e.index[i]
+		var pv parquet.Value
+		switch v := v.(type) {
+		case string:
+			pv = parquet.ValueOf(v)
+		case float64:
+			pv = parquet.ValueOf(v)
+		case int64:
+			pv = parquet.ValueOf(v)
+		case time.Time:
+			pv = parquet.ValueOf(v.UnixNano())
+		default:
+			e.row[col] = parquet.NullValue().Level(0, 0, col)
+			continue
+		}
+		e.row[col] = pv.Level(0, 1, col)
+	}
+	if _, err := e.w.WriteRows([]parquet.Row{e.row}); err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%parquetRowGroup == 0 {
+		return e.w.Flush()
+	}
+	return nil
+}
+
+// flush does nothing: only complete row groups are written out.
+func (e *parquetEncoder) flush() error { return nil }
+
+func (e *parquetEncoder) close() error { return e.w.Close() }
@@ -0,0 +1,238 @@
+// Package labels holds target label sets, Prometheus-style relabeling and the
+// label matchers used to filter API queries.
+package labels
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// Reserved label names. Labels starting with "__" are internal: they can be
+// used by relabel rules but are removed before a label set is stored.
+const (
+	AddressLabel    = "__address__"
+	SchemeLabel     = "__scheme__"
+	MetricNameLabel = "__name__"
+	JobLabel        = "job"
+	InstanceLabel   = "instance"
+)
+
+// ForTarget returns the label set of a target before relabeling: the job's
+// labels, overridden by the target's own, plus job, __address__ and
+// __scheme__.
+func ForTarget(job config.Job, t config.Target) map[string]string {
+	ls := make(map[string]string, len(job.Labels)+len(t.Labels)+3)
+	for k, v := range job.Labels {
+		ls[k] = v
+	}
+	for k, v := range t.Labels {
+		ls[k] = v
+	}
+	ls[JobLabel] = job.JobName
+	ls[AddressLabel] = t.Address()
+	ls[SchemeLabel] = t.Scheme
+	return ls
+}
+
+// Finalize sets instance to the address when no rule set it and strips the
+// internal labels.
+func Finalize(ls map[string]string) map[string]string {
+	out := make(map[string]string, len(ls))
+	for k, v := range ls {
+		if !strings.HasPrefix(k, "__") {
+			out[k] = v
+		}
+	}
+	if out[InstanceLabel] == "" && ls[AddressLabel] != "" {
+		out[InstanceLabel] = ls[AddressLabel]
+	}
+	return out
+}
+
+// String renders a label set as {a="1", b="2"} with sorted names.
+func String(ls map[string]string) string {
+	keys := make([]string, 0, len(ls))
+	for k := range ls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%q", k, ls[k])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// --- relabeling ---
+
+// Relabeler applies a compiled list of relabel rules in order.
+type Relabeler []rule
+
+type rule struct {
+	cfg   config.RelabelConfig
+	regex *regexp.Regexp
+}
+
+// Compile validates relabel rules and fills in their defaults.
+func Compile(cfgs []config.RelabelConfig) (Relabeler, error) {
+	out := make(Relabeler, 0, len(cfgs))
+	for i, c := range cfgs {
+		c.Action = strings.ToLower(c.Action)
+		if c.Action == "" {
+			c.Action = "replace"
+		}
+		if c.Separator == "" {
+			c.Separator = ";"
+		}
+		if c.Regex == "" {
+			c.Regex = "(.*)"
+		}
+		if c.Replacement == "" {
+			c.Replacement = "$1"
+		}
+		re, err := regexp.Compile("^(?:" + c.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: regex: %w", i, err)
+		}
+		switch c.Action {
+		case "replace":
+			if c.TargetLabel == "" {
+				return nil, fmt.Errorf("relabel rule %d: replace requires target_label", i)
+			}
+		case "hashmod":
+			if c.TargetLabel == "" || c.Modulus == 0 {
+				return nil, fmt.Errorf("relabel rule %d: hashmod requires target_label and modulus", i)
+			}
+		case "keep", "drop", "labelmap":
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unknown action %q", i, c.Action)
+		}
+		out = append(out, rule{cfg: c, regex: re})
+	}
+	return out, nil
+}
+
+// Process applies the rules to a copy of ls. It returns false when a keep or
+// drop rule discarded the label set.
+func (r Relabeler) Process(ls map[string]string) (map[string]string, bool) {
+	out := make(map[string]string, len(ls))
+	for k, v := range ls {
+		out[k] = v
+	}
+	for _, rl := range r {
+		if !rl.apply(out) {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+func (rl rule) apply(ls map[string]string) bool {
+	c := rl.cfg
+	vals := make([]string, len(c.SourceLabels))
+	for i, name := range c.SourceLabels {
+		vals[i] = ls[name]
+	}
+	val := strings.Join(vals, c.Separator)
+
+	switch c.Action {
+	case "keep":
+		return rl.regex.MatchString(val)
+	case "drop":
+		return !rl.regex.MatchString(val)
+	case "replace":
+		idx := rl.regex.FindStringSubmatchIndex(val)
+		if idx == nil {
+			return true
+		}
+		target := string(rl.regex.ExpandString(nil, c.TargetLabel, val, idx))
+		res := string(rl.regex.ExpandString(nil, c.Replacement, val, idx))
+		if target == "" {
+			return true
+		}
+		if res == "" {
+			delete(ls, target)
+		} else {
+			ls[target] = res
+		}
+	case "hashmod":
+		sum := md5.Sum([]byte(val))
+		ls[c.TargetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % c.Modulus)
+	case "labelmap":
+		mapped := make(map[string]string)
+		for k, v := range ls {
+			if rl.regex.MatchString(k) {
+				mapped[rl.regex.ReplaceAllString(k, c.Replacement)] = v
+			}
+		}
+		for k, v := range mapped {
+			ls[k] = v
+		}
+	}
+	return true
+}
+
+// --- query matchers ---
+
+// Matcher selects label sets by one label: name=value, name!=value,
+// name=~regex or name!~regex. Regexes are anchored. A missing label has the
+// empty value.
+type Matcher struct {
+	Name  string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// ParseMatcher parses one matcher expression such as env=prod or
+// team=~"web|api".
+func ParseMatcher(s string) (Matcher, error) {
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		i := strings.Index(s, op)
+		if i <= 0 {
+			continue
+		}
+		m := Matcher{Name: strings.TrimSpace(s[:i]), Op: op, Value: strings.Trim(strings.TrimSpace(s[i+len(op):]), `"`)}
+		if op == "=~" || op == "!~" {
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return Matcher{}, fmt.Errorf("label matcher %q: %w", s, err)
+			}
+			m.re = re
+		}
+		return m, nil
+	}
+	return Matcher{}, fmt.Errorf("label matcher %q: expected name=value, name!=value, name=~regex or name!~regex", s)
+}
+
+// Matches reports whether ls satisfies the matcher.
+func (m Matcher) Matches(ls map[string]string) bool {
+	v := ls[m.Name]
+	switch m.Op {
+	case "=":
+		return v == m.Value
+	case "!=":
+		return v != m.Value
+	case "=~":
+		return m.re.MatchString(v)
+	case "!~":
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+// MatchAll reports whether ls satisfies every matcher.
+func MatchAll(ms []Matcher, ls map[string]string) bool {
+	for _, m := range ms {
+		if !m.Matches(ls) {
+			return false
+		}
+	}
+	return true
+}
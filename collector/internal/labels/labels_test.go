@@ -0,0 +1,131 @@
+package labels
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// A target's labels override its job's; relabeling can rewrite where it is
+// scraped, and the internal labels are stripped at the end.
+func TestTargetLabels(t *testing.T) {
+	job := config.Job{JobName: "web", Labels: map[string]string{"env": "prod", "team": "ops"}}
+	tg := config.Target{Host: "h1", Port: 9100, Labels: map[string]string{"team": "web"}, HTTPClientConfig: config.HTTPClientConfig{Scheme: "http"}}
+	ls := ForTarget(job, tg)
+	want := map[string]string{"env": "prod", "team": "web", "job": "web", "__address__": "h1:9100", "__scheme__": "http"}
+	if !maps.Equal(ls, want) {
+		t.Fatalf("target labels: got %v, want %v", ls, want)
+	}
+	if got := Finalize(ls); !maps.Equal(got, map[string]string{"env": "prod", "team": "web", "job": "web", "instance": "h1:9100"}) {
+		t.Fatalf("final labels: %v", got)
+	}
+	if got := Finalize(map[string]string{"instance": "api-1", "__address__": "h1:9100"}); !maps.Equal(got, map[string]string{"instance": "api-1"}) {
+		t.Fatalf("instance set by a rule: %v", got)
+	}
+	if got := String(map[string]string{"b": "2", "a": `"1"`}); got != `{a="\"1\"", b="2"}` {
+		t.Fatalf("string: %s", got)
+	}
+}
+
+// Each relabel action rewrites, keeps or drops label sets like Prometheus.
+func TestRelabel(t *testing.T) {
+	in := map[string]string{"__address__": "h1:9100", "__meta_zone": "eu", "env": "prod", "job": "web"}
+	for _, c := range []struct {
+		name  string
+		rules []config.RelabelConfig
+		want  map[string]string // nil when dropped
+	}{
+		{"replace", []config.RelabelConfig{{SourceLabels: []string{"__address__"}, Regex: "([^:]+):.*", TargetLabel: "host"}},
+			map[string]string{"host": "h1"}},
+		{"replace joins sources", []config.RelabelConfig{{SourceLabels: []string{"env", "job"}, Separator: "/", TargetLabel: "id", Replacement: "x-$1"}},
+			map[string]string{"id": "x-prod/web"}},
+		{"replace deletes on empty result", []config.RelabelConfig{{SourceLabels: []string{"missing"}, TargetLabel: "env"}},
+			map[string]string{"env": ""}},
+		{"replace skips without a match", []config.RelabelConfig{{SourceLabels: []string{"env"}, Regex: "dev", TargetLabel: "env", Replacement: "x"}},
+			map[string]string{}},
+		{"keep", []config.RelabelConfig{{Action: "keep", SourceLabels: []string{"env"}, Regex: "prod|staging"}},
+			map[string]string{}},
+		{"keep drops", []config.RelabelConfig{{Action: "Keep", SourceLabels: []string{"env"}, Regex: "staging"}}, nil},
+		{"drop", []config.RelabelConfig{{Action: "drop", SourceLabels: []string{"__meta_zone"}, Regex: "eu"}}, nil},
+		{"labelmap", []config.RelabelConfig{{Action: "labelmap", Regex: "__meta_(.+)"}},
+			map[string]string{"zone": "eu"}},
+		{"hashmod", []config.RelabelConfig{{Action: "hashmod", SourceLabels: []string{"__address__"}, Modulus: 1, TargetLabel: "shard"}},
+			map[string]string{"shard": "0"}},
+	} {
+		r, err := Compile(c.rules)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		got, ok := r.Process(in)
+		if c.want == nil {
+			if ok {
+				t.Errorf("%s: kept %v", c.name, got)
+			}
+			continue
+		}
+		want := maps.Clone(in)
+		for k, v := range c.want {
+			if v == "" {
+				delete(want, k)
+			} else {
+				want[k] = v
+			}
+		}
+		if !ok || !maps.Equal(got, want) {
+			t.Errorf("%s: got %v, %v, want %v", c.name, got, ok, want)
+		}
+	}
+	if in["host"] != "" || len(in) != 4 {
+		t.Fatalf("input changed: %v", in)
+	}
+
+	for _, rules := range [][]config.RelabelConfig{
+		{{Regex: "("}},
+		{{SourceLabels: []string{"a"}}},
+		{{Action: "hashmod", TargetLabel: "shard"}},
+		{{Action: "rename"}},
+	} {
+		if _, err := Compile(rules); err == nil {
+			t.Errorf("%+v compiled", rules)
+		}
+	}
+}
+
+// Matchers compare one label, a missing one as empty, with anchored
+// regexes.
+func TestMatchers(t *testing.T) {
+	ls := map[string]string{"env": "prod", "team": "web-api"}
+	for _, c := range []struct {
+		expr  string
+		match bool
+	}{
+		{"env=prod", true},
+		{"env = prod", true},
+		{"env!=prod", false},
+		{`team=~"web|api"`, false},
+		{"team=~web-.*", true},
+		{"team!~web", true},
+		{"zone=", true},
+		{"zone!=", false},
+	} {
+		m, err := ParseMatcher(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if got := m.Matches(ls); got != c.match {
+			t.Errorf("%s: got %v", c.expr, got)
+		}
+	}
+	for _, expr := range []string{"env", "=prod", "env=~("} {
+		if _, err := ParseMatcher(expr); err == nil {
+			t.Errorf("%s parsed", expr)
+		}
+	}
+	env, _ := ParseMatcher("env=prod")
+	team, _ := ParseMatcher("team=web")
+	if !MatchAll(nil, ls) || !MatchAll([]Matcher{env}, ls) || MatchAll([]Matcher{env, team}, ls) {
+		t.Error("MatchAll")
+	}
+}
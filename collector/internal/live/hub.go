@@ -0,0 +1,164 @@
+// internal/live/hub.go
+package live
+
+import (
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/labels"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Hub fans newly ingested log lines out to live subscribers. Publishing
+// never blocks ingestion: every subscriber has a bounded queue, and lines
+// that do not fit are dropped for that subscriber and counted so it can be
+// told how many it missed.
+type Hub struct {
+	mu      sync.RWMutex
+	subs    map[*Subscription]struct{}
+	dropped atomic.Uint64 // lines dropped for all subscribers
+}
+
+// Filter selects the lines a subscriber receives. Empty fields match
+// everything; Regex is matched against the message without its app prefix.
+// Scope, if set, further limits the jobs, such as to those of a tenant.
+type Filter struct {
+	Job      string
+	Target   string
+	App      string
+	Regex    *regexp.Regexp
+	Matchers []labels.Matcher
+	Scope    func(job string) bool
+}
+
+func (f Filter) match(job, target, app, msg string, ls map[string]string) bool {
+	if (f.Job != "" && f.Job != job) || (f.Target != "" && f.Target != target) || (f.App != "" && f.App != app) {
+		return false
+	}
+	if f.Scope != nil && !f.Scope(job) {
+		return false
+	}
+	if f.Regex != nil && !f.Regex.MatchString(msg) {
+		return false
+	}
+	return labels.MatchAll(f.Matchers, ls)
+}
+
+// Subscription is one live subscriber. Lines arrive on C in ingestion
+// order; Dropped returns and resets the count of lines that did not fit.
+type Subscription struct {
+	C       <-chan storage.LogLine
+	ch      chan storage.LogLine
+	filter  Filter
+	dropped atomic.Uint64
+}
+
+// Dropped returns the number of lines dropped since the last call.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Swap(0)
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe registers a subscriber that buffers up to queue lines.
+// Callers must Unsubscribe when done.
+func (h *Hub) Subscribe(f Filter, queue int) *Subscription {
+	if queue <= 0 {
+		queue = 1
+	}
+	ch := make(chan storage.LogLine, queue)
+	s := &Subscription{C: ch, ch: ch, filter: f}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+}
+
+// publish hands one stored line to every matching subscriber.
+func (h *Hub) publish(job, target string, ls map[string]string, ts time.Time, line string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	app, msg := storage.SplitAppPrefix(line)
+	var l *storage.LogLine
+	for s := range h.subs {
+		if !s.filter.match(job, target, app, msg, ls) {
+			continue
+		}
+		if l == nil {
+			l = &storage.LogLine{Timestamp: ts.UTC().Format(time.RFC3339Nano), Job: job, Target: target, App: app, Line: msg, Labels: ls}
+		}
+		select {
+		case s.ch <- *l:
+		default:
+			s.dropped.Add(1)
+			h.dropped.Add(1)
+		}
+	}
+}
+
+var (
+	subscribersDesc = prometheus.NewDesc("pm2_collector_tail_subscribers",
+		"Number of clients following /logs/tail.", nil, nil)
+	droppedDesc = prometheus.NewDesc("pm2_collector_tail_dropped_lines_total",
+		"Log lines not delivered to a /logs/tail client because its queue was full.", nil, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (h *Hub) Describe(ch chan<- *prometheus.Desc) {
+	ch <- subscribersDesc
+	ch <- droppedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (h *Hub) Collect(ch chan<- prometheus.Metric) {
+	h.mu.RLock()
+	n := len(h.subs)
+	h.mu.RUnlock()
+	ch <- prometheus.MustNewConstMetric(subscribersDesc, prometheus.GaugeValue, float64(n))
+	ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(h.dropped.Load()))
+}
+
+// WrapStore returns a discovery.Store that also publishes ingested log
+// lines to the hub once they are stored.
+func (h *Hub) WrapStore(next discovery.Store) discovery.Store {
+	return publishingStore{Store: next, hub: h}
+}
+
+type publishingStore struct {
+	discovery.Store
+	hub *Hub
+}
+
+func (s publishingStore) StoreLog(job, target string, ls map[string]string, ts time.Time, line string) {
+	s.Store.StoreLog(job, target, ls, ts, line)
+	s.hub.publish(job, target, ls, ts, line)
+}
+
+// StoreLogEntries publishes only the lines that were newly stored, so lines
+// replayed by an exporter are not shown twice.
+func (s publishingStore) StoreLogEntries(job, target string, ls map[string]string, entries []discovery.LogEntry) (map[string]uint64, error) {
+	prev := s.Store.LogOffsets(job, target)
+	acks, err := s.Store.StoreLogEntries(job, target, ls, entries)
+	for _, e := range entries {
+		if e.Seq > prev[e.Stream] && e.Seq <= acks[e.Stream] {
+			prev[e.Stream] = e.Seq
+			s.hub.publish(job, target, ls, e.Timestamp, e.Line)
+		}
+	}
+	return acks, err
+}
@@ -0,0 +1,110 @@
+package live
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/labels"
+	"github.com/aalish/pm2-full/internal/storage/storagetest"
+)
+
+// received drains the lines queued for a subscription.
+func received(s *Subscription) []string {
+	var out []string
+	for {
+		select {
+		case l := <-s.C:
+			out = append(out, l.App+": "+l.Line)
+		default:
+			return out
+		}
+	}
+}
+
+// Subscribers receive the stored lines their filter selects, with the app
+// prefix split off.
+func TestHubFilters(t *testing.T) {
+	h := NewHub()
+	store := h.WrapStore(storagetest.Open(t))
+	m, err := labels.ParseMatcher("env=prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := h.Subscribe(Filter{}, 10)
+	api := h.Subscribe(Filter{Job: "web", App: "api"}, 10)
+	errs := h.Subscribe(Filter{Regex: regexp.MustCompile("^ERROR")}, 10)
+	prod := h.Subscribe(Filter{Matchers: []labels.Matcher{m}}, 10)
+	scoped := h.Subscribe(Filter{Scope: func(job string) bool { return job == "batch" }}, 10)
+
+	now := time.Now().UTC()
+	store.StoreLog("web", "h1", map[string]string{"env": "prod"}, now, "[api] ERROR failed")
+	store.StoreLog("web", "h1", nil, now, "[worker] started")
+	store.StoreLog("batch", "h2", nil, now, "[api] done")
+
+	for _, c := range []struct {
+		name string
+		sub  *Subscription
+		want []string
+	}{
+		{"all", all, []string{"api: ERROR failed", "worker: started", "api: done"}},
+		{"job and app", api, []string{"api: ERROR failed"}},
+		{"regex", errs, []string{"api: ERROR failed"}},
+		{"labels", prod, []string{"api: ERROR failed"}},
+		{"scope", scoped, []string{"api: done"}},
+	} {
+		if got := received(c.sub); !slices.Equal(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// Lines that do not fit a subscriber's queue are dropped and counted.
+func TestHubDropsForSlowSubscriber(t *testing.T) {
+	h := NewHub()
+	store := h.WrapStore(storagetest.Open(t))
+	sub := h.Subscribe(Filter{}, 2)
+	now := time.Now().UTC()
+	for _, line := range []string{"a", "b", "c", "d", "e"} {
+		store.StoreLog("web", "h1", nil, now, "[api] "+line)
+	}
+	if got := received(sub); !slices.Equal(got, []string{"api: a", "api: b"}) {
+		t.Fatalf("queued lines: %v", got)
+	}
+	if n := sub.Dropped(); n != 3 {
+		t.Fatalf("dropped: got %d, want 3", n)
+	}
+	if n := sub.Dropped(); n != 0 {
+		t.Fatalf("dropped after reading the count: %d", n)
+	}
+	h.Unsubscribe(sub)
+	store.StoreLog("web", "h1", nil, now, "[api] f")
+	if got := received(sub); len(got) != 0 {
+		t.Fatalf("lines after unsubscribing: %v", got)
+	}
+}
+
+// Entries an exporter replays are published only the first time they are
+// stored.
+func TestHubSkipsReplayedEntries(t *testing.T) {
+	h := NewHub()
+	store := h.WrapStore(storagetest.Open(t))
+	sub := h.Subscribe(Filter{}, 10)
+	now := time.Now().UTC()
+	first := []discovery.LogEntry{
+		{Stream: "out", Seq: 1, Timestamp: now, Line: "[api] one"},
+		{Stream: "out", Seq: 2, Timestamp: now, Line: "[api] two"},
+	}
+	if _, err := store.StoreLogEntries("web", "h1", nil, first); err != nil {
+		t.Fatal(err)
+	}
+	replay := append(first[1:], discovery.LogEntry{Stream: "out", Seq: 3, Timestamp: now, Line: "[api] three"})
+	if _, err := store.StoreLogEntries("web", "h1", nil, replay); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(sub); !slices.Equal(got, []string{"api: one", "api: two", "api: three"}) {
+		t.Fatalf("published: %v", got)
+	}
+}
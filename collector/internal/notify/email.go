@@ -0,0 +1,166 @@
+// internal/notify/email.go
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/alerting"
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// email delivers notifications over SMTP.
+type email struct {
+	cfg     config.Receiver
+	subject *template.Template
+	body    *template.Template
+}
+
+func newEmail(rc config.Receiver) (*email, error) {
+	if rc.SMTPHost == "" || rc.From == "" || len(rc.To) == 0 {
+		return nil, fmt.Errorf("receiver %q: smtp_host, from and to are required", rc.Name)
+	}
+	if rc.SMTPPort == 0 {
+		rc.SMTPPort = 25
+	}
+	subj, err := parseTemplate(rc.Name+"-subject", rc.SubjectTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("receiver %q: subject_template: %w", rc.Name, err)
+	}
+	body, err := parseTemplate(rc.Name+"-body", rc.BodyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("receiver %q: body_template: %w", rc.Name, err)
+	}
+	return &email{cfg: rc, subject: subj, body: body}, nil
+}
+
+func (e *email) Send(n Notification) error {
+	subject := summary(n)
+	if e.subject != nil {
+		b, err := render(e.subject, n)
+		if err != nil {
+			return permanentError{err}
+		}
+		subject = string(b)
+	}
+	var body []byte
+	if e.body != nil {
+		b, err := render(e.body, n)
+		if err != nil {
+			return permanentError{err}
+		}
+		body = b
+	} else {
+		var buf bytes.Buffer
+		for _, a := range n.Alerts {
+			buf.WriteString(describe(a))
+			buf.WriteString("\n")
+		}
+		body = buf.Bytes()
+	}
+	return e.deliver(e.message(subject, body))
+}
+
+// message builds an RFC 5322 message with CRLF line endings.
+func (e *email) message(subject string, body []byte) []byte {
+	var msg bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&msg, "%s: %s\r\n", k, v) }
+	header("From", e.cfg.From)
+	header("To", strings.Join(e.cfg.To, ", "))
+	header("Subject", strings.ReplaceAll(strings.ReplaceAll(subject, "\r", ""), "\n", " "))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n", "\r\n"))
+	return msg.Bytes()
+}
+
+// deliver runs one SMTP transaction. Permanent (5xx) replies are not retried.
+func (e *email) deliver(msg []byte) error {
+	addr := net.JoinHostPort(e.cfg.SMTPHost, strconv.Itoa(e.cfg.SMTPPort))
+	conn, err := net.DialTimeout("tcp", addr, e.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(e.cfg.Timeout))
+	c, err := smtp.NewClient(conn, e.cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		return classifySMTP(err)
+	}
+	if e.cfg.StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return permanentError{fmt.Errorf("%s does not support STARTTLS", addr)}
+		}
+		tc := &tls.Config{ServerName: e.cfg.SMTPHost, InsecureSkipVerify: e.cfg.InsecureSkipVerify}
+		if err := c.StartTLS(tc); err != nil {
+			return err
+		}
+	}
+	if e.cfg.SMTPUsername != "" {
+		auth := smtp.PlainAuth("", e.cfg.SMTPUsername, e.cfg.SMTPPassword, e.cfg.SMTPHost)
+		if err := c.Auth(auth); err != nil {
+			return classifySMTP(err)
+		}
+	}
+	if err := c.Mail(e.cfg.From); err != nil {
+		return classifySMTP(err)
+	}
+	for _, rcpt := range e.cfg.To {
+		if err := c.Rcpt(rcpt); err != nil {
+			return classifySMTP(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return classifySMTP(err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return classifySMTP(err)
+	}
+	return c.Quit()
+}
+
+// classifySMTP marks 5xx replies as permanent failures.
+func classifySMTP(err error) error {
+	if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+		return permanentError{err}
+	}
+	return err
+}
+
+// describe renders one alert as plain text lines, used by email bodies.
+func describe(a alerting.Alert) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s [%s] value=%g since %s\n", a.Rule, strings.ToUpper(a.State), a.Value, a.ActiveAt.UTC().Format("2006-01-02 15:04:05 MST"))
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "  %s = %s\n", k, a.Labels[k])
+	}
+	for k, v := range a.Annotations {
+		fmt.Fprintf(&b, "  %s: %s\n", k, v)
+	}
+	return b.String()
+}
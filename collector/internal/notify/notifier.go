@@ -0,0 +1,369 @@
+// internal/notify/notifier.go
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/alerting"
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// Notification is what every receiver is given: one group of alerts that
+// share the configured group_by labels.
+type Notification struct {
+	Receiver     string            `json:"receiver"`
+	Status       string            `json:"status"` // firing if any alert fires, else resolved
+	GroupKey     string            `json:"group_key"`
+	GroupLabels  map[string]string `json:"group_labels"`
+	CommonLabels map[string]string `json:"common_labels"`
+	Alerts       []alerting.Alert  `json:"alerts"`
+}
+
+// Firing returns the firing alerts of the notification.
+func (n Notification) Firing() []alerting.Alert {
+	return n.filter(alerting.StateFiring)
+}
+
+// Resolved returns the resolved alerts of the notification.
+func (n Notification) Resolved() []alerting.Alert {
+	return n.filter(alerting.StateResolved)
+}
+
+func (n Notification) filter(state string) []alerting.Alert {
+	var out []alerting.Alert
+	for _, a := range n.Alerts {
+		if a.State == state {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// sender delivers a notification to one destination.
+type sender interface {
+	Send(n Notification) error
+}
+
+// permanentError marks a failure that retrying cannot fix (e.g. HTTP 4xx).
+type permanentError struct{ err error }
+
+func (p permanentError) Error() string { return p.err.Error() }
+func (p permanentError) Unwrap() error { return p.err }
+
+// receiver pairs a configured destination with its sender.
+type receiver struct {
+	cfg    config.Receiver
+	sender sender
+}
+
+// group tracks what was last delivered for one receiver and label group.
+type group struct {
+	created    time.Time
+	lastSent   time.Time
+	lastFP     string          // firing alert keys at the last delivery
+	sentFiring map[string]bool // alerts delivered as firing and not yet as resolved
+	sending    bool            // a delivery is in flight
+}
+
+// Notifier groups alerts, applies silences and delivers them to receivers
+// with group_wait/group_interval/repeat_interval timing and retries.
+type Notifier struct {
+	cfg       config.NotifyConfig
+	receivers []receiver
+	silences  *Silences
+
+	mu     sync.Mutex
+	groups map[string]*group // receiver + group key -> state
+
+	inflight sync.WaitGroup
+}
+
+// New validates the receivers and loads persisted silences and group state.
+func New(cfg config.NotifyConfig) (*Notifier, error) {
+	if cfg.GroupWait < 0 {
+		cfg.GroupWait = 0
+	}
+	if cfg.GroupInterval <= 0 {
+		cfg.GroupInterval = 5 * time.Minute
+	}
+	if cfg.RepeatInterval <= 0 {
+		cfg.RepeatInterval = 4 * time.Hour
+	}
+	if cfg.Retry.MaxAttempts <= 0 {
+		cfg.Retry.MaxAttempts = 5
+	}
+	if cfg.Retry.InitialBackoff <= 0 {
+		cfg.Retry.InitialBackoff = time.Second
+	}
+	if cfg.Retry.MaxBackoff <= 0 {
+		cfg.Retry.MaxBackoff = time.Minute
+	}
+
+	groups, err := loadGroups(cfg.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	n := &Notifier{cfg: cfg, groups: groups}
+	for _, rc := range cfg.Receivers {
+		s, err := newSender(rc)
+		if err != nil {
+			return nil, err
+		}
+		n.receivers = append(n.receivers, receiver{cfg: rc, sender: s})
+	}
+	sil, err := LoadSilences(cfg.SilencesFile)
+	if err != nil {
+		return nil, err
+	}
+	n.silences = sil
+	return n, nil
+}
+
+// newSender builds the sender for a receiver type.
+func newSender(rc config.Receiver) (sender, error) {
+	if rc.Name == "" {
+		return nil, fmt.Errorf("receiver without name")
+	}
+	if rc.Timeout <= 0 {
+		rc.Timeout = 10 * time.Second
+	}
+	switch rc.Type {
+	case "webhook":
+		return newWebhook(rc)
+	case "slack", "mattermost":
+		return newSlack(rc)
+	case "email":
+		return newEmail(rc)
+	}
+	return nil, fmt.Errorf("receiver %q: unknown type %q", rc.Name, rc.Type)
+}
+
+// Silences returns the silence registry used by the notifier.
+func (n *Notifier) Silences() *Silences {
+	return n.silences
+}
+
+// Process is called after each alert evaluation with all current alerts and
+// starts delivery for every group that is due.
+func (n *Notifier) Process(now time.Time, alerts []alerting.Alert) {
+	n.silences.Expire(now)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	seen := make(map[string]bool)
+	changed := false
+	for _, r := range n.receivers {
+		grouped := make(map[string][]alerting.Alert)
+		for _, a := range alerts {
+			if a.State == alerting.StatePending || !labelsMatch(r.cfg.Match, a.Labels) {
+				continue
+			}
+			if n.silences.Silenced(a.Labels, now) {
+				continue
+			}
+			gk := groupKey(n.cfg.GroupBy, a.Labels)
+			grouped[gk] = append(grouped[gk], a)
+		}
+
+		for gk, members := range grouped {
+			k := r.cfg.Name + "\xff" + gk
+			seen[k] = true
+			g := n.groups[k]
+			if g == nil {
+				g = &group{created: now, sentFiring: make(map[string]bool)}
+				n.groups[k] = g
+				changed = true
+			}
+			if notif, ok := n.due(g, r.cfg.Name, gk, members, now); ok {
+				g.sending = true
+				n.inflight.Add(1)
+				go func() {
+					defer n.inflight.Done()
+					n.sent(g, notif, now, n.deliver(r, notif))
+				}()
+			}
+		}
+	}
+
+	// forget groups whose alerts are gone or silenced
+	for k := range n.groups {
+		if !seen[k] {
+			delete(n.groups, k)
+			changed = true
+		}
+	}
+	if changed {
+		if err := n.saveGroups(); err != nil {
+			log.Printf("notify: saving state: %v", err)
+		}
+	}
+}
+
+// due decides whether a group should be delivered now and, if so, builds the
+// notification. It is not due while an earlier delivery is in flight.
+// Caller must hold n.mu.
+func (n *Notifier) due(g *group, recv, gk string, members []alerting.Alert, now time.Time) (Notification, bool) {
+	if g.sending {
+		return Notification{}, false
+	}
+	var firing, resolved []alerting.Alert
+	for _, a := range members {
+		switch {
+		case a.State == alerting.StateFiring:
+			firing = append(firing, a)
+		case a.State == alerting.StateResolved && g.sentFiring[a.Key()]:
+			resolved = append(resolved, a)
+		}
+	}
+	if len(firing) == 0 && len(resolved) == 0 {
+		return Notification{}, false
+	}
+
+	fp := alertsFP(firing)
+	var send bool
+	switch {
+	case g.lastSent.IsZero():
+		send = now.Sub(g.created) >= n.cfg.GroupWait
+	case fp != g.lastFP || len(resolved) > 0:
+		send = now.Sub(g.lastSent) >= n.cfg.GroupInterval
+	default:
+		send = len(firing) > 0 && now.Sub(g.lastSent) >= n.cfg.RepeatInterval
+	}
+	if !send {
+		return Notification{}, false
+	}
+
+	all := append(append([]alerting.Alert{}, firing...), resolved...)
+	status := alerting.StateFiring
+	if len(firing) == 0 {
+		status = alerting.StateResolved
+	}
+	return Notification{
+		Receiver:     recv,
+		Status:       status,
+		GroupKey:     gk,
+		GroupLabels:  groupLabels(n.cfg.GroupBy, all[0].Labels),
+		CommonLabels: commonLabels(all),
+		Alerts:       all,
+	}, true
+}
+
+// sent records the outcome of delivering notif to g, built at now. Only a
+// delivery that succeeded counts: after a failed one the group is due
+// again, and its resolved alerts are still to be delivered.
+func (n *Notifier) sent(g *group, notif Notification, now time.Time, ok bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	g.sending = false
+	if !ok {
+		return
+	}
+	g.lastSent = now
+	g.lastFP = alertsFP(notif.Firing())
+	for _, a := range notif.Firing() {
+		g.sentFiring[a.Key()] = true
+	}
+	for _, a := range notif.Resolved() {
+		delete(g.sentFiring, a.Key())
+	}
+	if err := n.saveGroups(); err != nil {
+		log.Printf("notify: saving state: %v", err)
+	}
+}
+
+// Wait blocks until the deliveries in flight have succeeded or been given
+// up.
+func (n *Notifier) Wait() {
+	n.inflight.Wait()
+}
+
+// deliver sends a notification, retrying transient failures with
+// exponential backoff, and reports whether it was delivered.
+func (n *Notifier) deliver(r receiver, notif Notification) bool {
+	backoff := n.cfg.Retry.InitialBackoff
+	var err error
+	for attempt := 1; attempt <= n.cfg.Retry.MaxAttempts; attempt++ {
+		if err = r.sender.Send(notif); err == nil {
+			return true
+		}
+		var perm permanentError
+		if errors.As(err, &perm) {
+			break
+		}
+		if attempt == n.cfg.Retry.MaxAttempts {
+			break
+		}
+		log.Printf("notify: %s attempt %d failed: %v (retrying in %s)", r.cfg.Name, attempt, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > n.cfg.Retry.MaxBackoff {
+			backoff = n.cfg.Retry.MaxBackoff
+		}
+	}
+	log.Printf("notify: giving up on %s for group %q: %v", r.cfg.Name, notif.GroupKey, err)
+	return false
+}
+
+// labelsMatch reports whether labels contain every matcher pair.
+func labelsMatch(match, labels map[string]string) bool {
+	for k, v := range match {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// groupKey renders the group_by label values of an alert; an empty group_by
+// puts every alert of a receiver into one group.
+func groupKey(by []string, labels map[string]string) string {
+	parts := make([]string, 0, len(by))
+	for _, k := range by {
+		parts = append(parts, k+"="+labels[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+func groupLabels(by []string, labels map[string]string) map[string]string {
+	out := make(map[string]string, len(by))
+	for _, k := range by {
+		out[k] = labels[k]
+	}
+	return out
+}
+
+// commonLabels returns the labels shared with the same value by all alerts.
+func commonLabels(alerts []alerting.Alert) map[string]string {
+	out := make(map[string]string)
+	if len(alerts) == 0 {
+		return out
+	}
+	for k, v := range alerts[0].Labels {
+		out[k] = v
+	}
+	for _, a := range alerts[1:] {
+		for k, v := range out {
+			if a.Labels[k] != v {
+				delete(out, k)
+			}
+		}
+	}
+	return out
+}
+
+// alertsFP fingerprints a set of alerts by their sorted keys.
+func alertsFP(alerts []alerting.Alert) string {
+	keys := make([]string, 0, len(alerts))
+	for _, a := range alerts {
+		keys = append(keys, a.Key())
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\n")
+}
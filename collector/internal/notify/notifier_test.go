@@ -0,0 +1,379 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/alerting"
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// webhookStandIn records the notifications posted to it. Its first fail
+// requests are answered with status.
+type webhookStandIn struct {
+	*httptest.Server
+	secret string
+
+	mu       sync.Mutex
+	fail     int
+	status   int
+	attempts int
+	got      chan Notification
+	bad      []string // requests whose signature did not verify
+}
+
+func newWebhookStandIn(t *testing.T, secret string) *webhookStandIn {
+	s := &webhookStandIn{secret: secret, got: make(chan Notification, 16)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.attempts++
+		if s.secret != "" {
+			want := "sha256=" + Sign(s.secret, r.Header.Get(TimestampHeader), body)
+			if r.Header.Get(SignatureHeader) != want {
+				s.bad = append(s.bad, r.Header.Get(SignatureHeader))
+			}
+		}
+		if s.fail > 0 {
+			s.fail--
+			s.mu.Unlock()
+			w.WriteHeader(s.status)
+			return
+		}
+		s.mu.Unlock()
+		var n Notification
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Errorf("webhook body: %v", err)
+		}
+		s.got <- n
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *webhookStandIn) next(t *testing.T) Notification {
+	t.Helper()
+	select {
+	case n := <-s.got:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification delivered")
+		return Notification{}
+	}
+}
+
+func (s *webhookStandIn) none(t *testing.T) {
+	t.Helper()
+	select {
+	case n := <-s.got:
+		t.Fatalf("unexpected notification: %+v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func testNotifyConfig(t *testing.T, receivers ...config.Receiver) config.NotifyConfig {
+	dir := t.TempDir()
+	return config.NotifyConfig{
+		GroupBy:        []string{"job"},
+		GroupWait:      10 * time.Second,
+		GroupInterval:  time.Minute,
+		RepeatInterval: time.Hour,
+		SilencesFile:   filepath.Join(dir, "silences.json"),
+		StateFile:      filepath.Join(dir, "notify_state.json"),
+		Retry:          config.RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		Receivers:      receivers,
+	}
+}
+
+func alert(rule, job, state string) alerting.Alert {
+	return alerting.Alert{Rule: rule, Labels: map[string]string{"job": job, "target": "h1"}, State: state}
+}
+
+var t0 = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+func TestGroupingAndTiming(t *testing.T) {
+	wh := newWebhookStandIn(t, "")
+	n, err := New(testNotifyConfig(t, config.Receiver{Name: "wh", Type: "webhook", URL: wh.URL}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Wait)
+	firing := []alerting.Alert{alert("A", "web", alerting.StateFiring), alert("B", "web", alerting.StateFiring), alert("A", "db", alerting.StateFiring)}
+
+	n.Process(t0, firing)
+	wh.none(t) // group_wait
+
+	n.Process(t0.Add(10*time.Second), firing)
+	byJob := make(map[string]Notification)
+	for i := 0; i < 2; i++ {
+		got := wh.next(t)
+		byJob[got.GroupLabels["job"]] = got
+	}
+	n.Wait()
+	if len(byJob["web"].Alerts) != 2 || len(byJob["db"].Alerts) != 1 {
+		t.Fatalf("grouped by job: web %d alerts, db %d alerts", len(byJob["web"].Alerts), len(byJob["db"].Alerts))
+	}
+	if byJob["web"].Status != alerting.StateFiring || byJob["web"].CommonLabels["job"] != "web" {
+		t.Fatalf("web notification: %+v", byJob["web"])
+	}
+
+	// unchanged groups repeat only after repeat_interval
+	n.Process(t0.Add(30*time.Minute), firing)
+	wh.none(t)
+	n.Process(t0.Add(10*time.Second+time.Hour), firing)
+	wh.next(t)
+	wh.next(t)
+	n.Wait()
+
+	// a changed group waits for group_interval
+	changed := []alerting.Alert{alert("A", "web", alerting.StateFiring), alert("B", "web", alerting.StateResolved), alert("A", "db", alerting.StateFiring)}
+	n.Process(t0.Add(20*time.Second+time.Hour), changed)
+	wh.none(t)
+	n.Process(t0.Add(10*time.Second+time.Hour+time.Minute), changed)
+	got := wh.next(t)
+	if got.GroupLabels["job"] != "web" || len(got.Firing()) != 1 || len(got.Resolved()) != 1 {
+		t.Fatalf("after resolving B: %+v", got)
+	}
+	wh.none(t)
+}
+
+func TestSilences(t *testing.T) {
+	wh := newWebhookStandIn(t, "")
+	cfg := testNotifyConfig(t, config.Receiver{Name: "wh", Type: "webhook", URL: wh.URL})
+	cfg.GroupWait = 0
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Wait)
+	if _, err := n.Silences().Add(Silence{Matchers: []*Matcher{{Name: "job", Value: "web"}}, StartsAt: t0, EndsAt: t0.Add(30 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	alerts := []alerting.Alert{alert("A", "web", alerting.StateFiring), alert("A", "db", alerting.StateFiring)}
+	n.Process(t0, alerts)
+	if got := wh.next(t); got.GroupLabels["job"] != "db" {
+		t.Fatalf("delivered group %q, want db only", got.GroupLabels["job"])
+	}
+	wh.none(t)
+
+	// the silence expires
+	n.Process(t0.Add(30*time.Minute), alerts)
+	if got := wh.next(t); got.GroupLabels["job"] != "web" {
+		t.Fatalf("delivered group %q after the silence ended, want web", got.GroupLabels["job"])
+	}
+	if len(n.Silences().List()) != 0 {
+		t.Fatal("expired silence kept")
+	}
+}
+
+func TestRetriesAndSignature(t *testing.T) {
+	wh := newWebhookStandIn(t, "s3cret")
+	wh.fail, wh.status = 2, http.StatusServiceUnavailable
+	cfg := testNotifyConfig(t, config.Receiver{Name: "wh", Type: "webhook", URL: wh.URL, HMACSecret: "s3cret"})
+	cfg.GroupWait = 0
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Wait)
+	n.Process(t0, []alerting.Alert{alert("A", "web", alerting.StateFiring)})
+	wh.next(t)
+	wh.mu.Lock()
+	if wh.attempts != 3 {
+		t.Errorf("attempts: got %d, want 3", wh.attempts)
+	}
+	if len(wh.bad) > 0 {
+		t.Errorf("signatures that did not verify: %v", wh.bad)
+	}
+	// client errors are not retried
+	wh.attempts, wh.fail, wh.status = 0, 5, http.StatusBadRequest
+	wh.mu.Unlock()
+	n.Process(t0, []alerting.Alert{alert("A", "db", alerting.StateFiring)})
+	time.Sleep(100 * time.Millisecond)
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.attempts != 1 {
+		t.Errorf("attempts after a 400: got %d, want 1", wh.attempts)
+	}
+}
+
+// Alerts delivered as firing before a restart are delivered as resolved
+// after it.
+func TestResolvedAfterRestart(t *testing.T) {
+	wh := newWebhookStandIn(t, "")
+	cfg := testNotifyConfig(t, config.Receiver{Name: "wh", Type: "webhook", URL: wh.URL})
+	cfg.GroupWait = 0
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Wait)
+	n.Process(t0, []alerting.Alert{alert("A", "web", alerting.StateFiring)})
+	wh.next(t)
+	n.Wait()
+
+	n, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Wait)
+	n.Process(t0.Add(time.Minute), []alerting.Alert{alert("A", "web", alerting.StateFiring)})
+	wh.none(t) // neither repeated early
+	n.Process(t0.Add(2*time.Minute), []alerting.Alert{alert("A", "web", alerting.StateResolved)})
+	if got := wh.next(t); got.Status != alerting.StateResolved || len(got.Resolved()) != 1 {
+		t.Fatalf("after restart: %+v", got)
+	}
+}
+
+// A group whose delivery failed is delivered again on the next evaluation,
+// and so are the resolved alerts it held.
+func TestFailedDeliveryNotRecorded(t *testing.T) {
+	wh := newWebhookStandIn(t, "")
+	cfg := testNotifyConfig(t, config.Receiver{Name: "wh", Type: "webhook", URL: wh.URL})
+	cfg.GroupWait = 0
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Wait)
+	firing := []alerting.Alert{alert("A", "web", alerting.StateFiring)}
+	n.Process(t0, firing)
+	wh.next(t)
+	n.Wait()
+
+	resolved := []alerting.Alert{alert("A", "web", alerting.StateResolved)}
+	wh.mu.Lock()
+	wh.fail, wh.status = cfg.Retry.MaxAttempts, http.StatusServiceUnavailable
+	wh.mu.Unlock()
+	n.Process(t0.Add(time.Minute), resolved)
+	n.Wait()
+	wh.none(t)
+
+	n.Process(t0.Add(2*time.Minute), resolved)
+	if got := wh.next(t); got.Status != alerting.StateResolved || len(got.Resolved()) != 1 {
+		t.Fatalf("resolve notice after a failed delivery: %+v", got)
+	}
+	n.Wait()
+	n.Process(t0.Add(3*time.Minute), resolved)
+	wh.none(t)
+}
+
+func TestSlack(t *testing.T) {
+	got := make(chan slackPayload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m slackPayload
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			t.Errorf("slack body: %v", err)
+		}
+		got <- m
+	}))
+	defer srv.Close()
+	cfg := testNotifyConfig(t, config.Receiver{Name: "sl", Type: "slack", URL: srv.URL, Channel: "#ops"})
+	cfg.GroupWait = 0
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Wait)
+	n.Process(t0, []alerting.Alert{alert("HighMemory", "web", alerting.StateFiring)})
+	select {
+	case m := <-got:
+		if m.Channel != "#ops" || len(m.Attachments) != 1 || m.Attachments[0].Title != "HighMemory (firing)" {
+			t.Fatalf("slack message: %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no slack message")
+	}
+}
+
+// smtpStandIn accepts one SMTP transaction per connection and records the
+// messages.
+func smtpStandIn(t *testing.T) (host string, port int, msgs chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	msgs = make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, msgs)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return "127.0.0.1", addr.Port, msgs
+}
+
+func serveSMTP(conn net.Conn, msgs chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+	reply("220 stand-in ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 stand-in")
+		case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"), strings.HasPrefix(cmd, "RSET"), strings.HasPrefix(cmd, "NOOP"):
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			msgs <- msg.String()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestEmail(t *testing.T) {
+	host, port, msgs := smtpStandIn(t)
+	cfg := testNotifyConfig(t, config.Receiver{Name: "mail", Type: "email", SMTPHost: host, SMTPPort: port,
+		From: "collector@example.com", To: []string{"oncall@example.com"}, SubjectTemplate: "[{{ .Status }}] {{ .GroupLabels.job }}"})
+	cfg.GroupWait = 0
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Wait)
+	n.Process(t0, []alerting.Alert{alert("HighMemory", "web", alerting.StateFiring)})
+	select {
+	case msg := <-msgs:
+		if !strings.Contains(msg, "Subject: [firing] web\r\n") || !strings.Contains(msg, "To: oncall@example.com") || !strings.Contains(msg, "HighMemory [FIRING]") {
+			t.Fatalf("message:\n%s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email delivered")
+	}
+}
@@ -0,0 +1,210 @@
+// internal/notify/silences.go
+package notify
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Matcher selects alerts by one label. Value is a regular expression
+// anchored to the whole label value when IsRegex is set.
+type Matcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"is_regex,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (m *Matcher) matches(labels map[string]string) bool {
+	if m.IsRegex {
+		return m.re.MatchString(labels[m.Name])
+	}
+	return labels[m.Name] == m.Value
+}
+
+// Silence mutes notifications for alerts matching all of its matchers
+// between StartsAt and EndsAt.
+type Silence struct {
+	ID        string     `json:"id"`
+	Matchers  []*Matcher `json:"matchers"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    time.Time  `json:"ends_at"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	Comment   string     `json:"comment,omitempty"`
+}
+
+// Active reports whether the silence applies at now.
+func (s *Silence) Active(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+func (s *Silence) compile() error {
+	if len(s.Matchers) == 0 {
+		return fmt.Errorf("silence needs at least one matcher")
+	}
+	for _, m := range s.Matchers {
+		if m.Name == "" {
+			return fmt.Errorf("matcher without label name")
+		}
+		if m.IsRegex {
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return fmt.Errorf("matcher %q: %w", m.Name, err)
+			}
+			m.re = re
+		}
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return fmt.Errorf("silence must end after it starts")
+	}
+	return nil
+}
+
+// Silences is a persisted set of silences. Expired silences are dropped.
+type Silences struct {
+	path string
+
+	mu       sync.Mutex
+	silences map[string]*Silence
+}
+
+// LoadSilences reads the silences stored at path; an empty path keeps them in
+// memory only.
+func LoadSilences(path string) (*Silences, error) {
+	s := &Silences{path: path, silences: make(map[string]*Silence)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	var list []*Silence
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("silences %s: %w", path, err)
+	}
+	for _, sil := range list {
+		if err := sil.compile(); err != nil {
+			continue
+		}
+		s.silences[sil.ID] = sil
+	}
+	return s, nil
+}
+
+// Add validates and stores a new silence, assigning its ID. A zero StartsAt
+// means now.
+func (s *Silences) Add(sil Silence) (Silence, error) {
+	if sil.StartsAt.IsZero() {
+		sil.StartsAt = time.Now().UTC()
+	}
+	if err := sil.compile(); err != nil {
+		return Silence{}, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Silence{}, err
+	}
+	sil.ID = hex.EncodeToString(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.silences[sil.ID] = &sil
+	return sil, s.save()
+}
+
+// Delete removes a silence; it reports false if the ID is unknown.
+func (s *Silences) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.silences[id]; !ok {
+		return false, nil
+	}
+	delete(s.silences, id)
+	return true, s.save()
+}
+
+// List returns all stored silences ordered by end time.
+func (s *Silences) List() []Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Silence, 0, len(s.silences))
+	for _, sil := range s.silences {
+		out = append(out, *sil)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].EndsAt.Before(out[j].EndsAt) })
+	return out
+}
+
+// Silenced reports whether any active silence matches labels.
+func (s *Silences) Silenced(labels map[string]string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sil := range s.silences {
+		if !sil.Active(now) {
+			continue
+		}
+		all := true
+		for _, m := range sil.Matchers {
+			if !m.matches(labels) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+// Expire drops silences that ended before now.
+func (s *Silences) Expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for id, sil := range s.silences {
+		if !now.Before(sil.EndsAt) {
+			delete(s.silences, id)
+			changed = true
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// save writes the silences atomically. Caller must hold s.mu.
+func (s *Silences) save() error {
+	if s.path == "" {
+		return nil
+	}
+	list := make([]*Silence, 0, len(s.silences))
+	for _, sil := range s.silences {
+		list = append(list, sil)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,114 @@
+// internal/notify/slack.go
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"text/template"
+
+	"github.com/aalish/pm2-full/internal/alerting"
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// slack posts Slack incoming-webhook payloads. Mattermost accepts the same
+// format, so both receiver types use it.
+type slack struct {
+	cfg    config.Receiver
+	text   *template.Template
+	client *http.Client
+}
+
+type slackPayload struct {
+	Channel     string            `json:"channel,omitempty"`
+	Username    string            `json:"username,omitempty"`
+	IconEmoji   string            `json:"icon_emoji,omitempty"`
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Title  string       `json:"title"`
+	Text   string       `json:"text,omitempty"`
+	Fields []slackField `json:"fields,omitempty"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func newSlack(rc config.Receiver) (*slack, error) {
+	if rc.URL == "" {
+		return nil, fmt.Errorf("receiver %q: url is required", rc.Name)
+	}
+	t, err := parseTemplate(rc.Name, rc.TextTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("receiver %q: text_template: %w", rc.Name, err)
+	}
+	return &slack{cfg: rc, text: t, client: &http.Client{Timeout: rc.Timeout}}, nil
+}
+
+func (s *slack) Send(n Notification) error {
+	p := slackPayload{
+		Channel:   s.cfg.Channel,
+		Username:  s.cfg.Username,
+		IconEmoji: s.cfg.IconEmoji,
+		Text:      summary(n),
+	}
+	if s.text != nil {
+		b, err := render(s.text, n)
+		if err != nil {
+			return permanentError{err}
+		}
+		p.Text = string(b)
+	}
+	for _, a := range n.Alerts {
+		p.Attachments = append(p.Attachments, attachment(a))
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return permanentError{err}
+	}
+	return postJSON(s.client, s.cfg.URL, s.cfg.Headers, body, s.cfg.HMACSecret)
+}
+
+// summary is the default one-line text of a notification.
+func summary(n Notification) string {
+	firing, resolved := len(n.Firing()), len(n.Resolved())
+	name := n.CommonLabels["alertname"]
+	if name == "" {
+		name = n.GroupKey
+	}
+	if firing == 0 {
+		return fmt.Sprintf("[RESOLVED] %s (%d)", name, resolved)
+	}
+	if resolved == 0 {
+		return fmt.Sprintf("[FIRING:%d] %s", firing, name)
+	}
+	return fmt.Sprintf("[FIRING:%d, RESOLVED:%d] %s", firing, resolved, name)
+}
+
+func attachment(a alerting.Alert) slackAttachment {
+	color := "danger"
+	if a.State == alerting.StateResolved {
+		color = "good"
+	}
+	att := slackAttachment{Color: color, Title: fmt.Sprintf("%s (%s)", a.Rule, a.State), Text: a.Annotations["summary"]}
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "alertname" {
+			continue
+		}
+		att.Fields = append(att.Fields, slackField{Title: k, Value: a.Labels[k], Short: true})
+	}
+	return att
+}
@@ -0,0 +1,81 @@
+// internal/notify/state.go
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// groupState is how a group is persisted, so that alerts delivered as
+// firing before a restart are still delivered as resolved after it, and
+// repeats keep their timing. Alert keys are not valid UTF-8, so they are
+// kept as bytes.
+type groupState struct {
+	Receiver   string    `json:"receiver"`
+	GroupKey   string    `json:"group_key"`
+	Created    time.Time `json:"created"`
+	LastSent   time.Time `json:"last_sent,omitzero"`
+	LastFP     []byte    `json:"last_fp,omitempty"`
+	SentFiring [][]byte  `json:"sent_firing,omitempty"`
+}
+
+// loadGroups reads the groups stored at path; an empty path keeps them in
+// memory only.
+func loadGroups(path string) (map[string]*group, error) {
+	groups := make(map[string]*group)
+	if path == "" {
+		return groups, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return groups, nil
+		}
+		return nil, err
+	}
+	var states []groupState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("notify state %s: %w", path, err)
+	}
+	for _, st := range states {
+		g := &group{created: st.Created, lastSent: st.LastSent, lastFP: string(st.LastFP), sentFiring: make(map[string]bool)}
+		for _, key := range st.SentFiring {
+			g.sentFiring[string(key)] = true
+		}
+		groups[st.Receiver+"\xff"+st.GroupKey] = g
+	}
+	return groups, nil
+}
+
+// saveGroups writes the groups atomically. Caller must hold n.mu.
+func (n *Notifier) saveGroups() error {
+	path := n.cfg.StateFile
+	if path == "" {
+		return nil
+	}
+	states := make([]groupState, 0, len(n.groups))
+	for k, g := range n.groups {
+		recv, gk, _ := strings.Cut(k, "\xff")
+		st := groupState{Receiver: recv, GroupKey: gk, Created: g.created, LastSent: g.lastSent, LastFP: []byte(g.lastFP)}
+		for key := range g.sentFiring {
+			st.SentFiring = append(st.SentFiring, []byte(key))
+		}
+		states = append(states, st)
+	}
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,127 @@
+// internal/notify/webhook.go
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the request body, keyed with
+// the receiver's hmac_secret, as "sha256=<hex>".
+const SignatureHeader = "X-PM2-Signature"
+
+// TimestampHeader carries the unix time the request was signed at.
+const TimestampHeader = "X-PM2-Timestamp"
+
+// templateFuncs are available in every body, text and subject template.
+var templateFuncs = template.FuncMap{
+	"join":    strings.Join,
+	"upper":   strings.ToUpper,
+	"toJSON":  func(v interface{}) (string, error) { b, err := json.Marshal(v); return string(b), err },
+	"rfc3339": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+}
+
+// parseTemplate compiles an optional user template.
+func parseTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// render executes t with the notification as its data.
+func render(t *template.Template, n Notification) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, n); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// postJSON sends body to url and classifies failures: 4xx other than 429 is
+// permanent, everything else may be retried.
+func postJSON(client *http.Client, url string, headers map[string]string, body []byte, secret string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(SignatureHeader, "sha256="+Sign(secret, ts, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("POST %s: %s", url, resp.Status)
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>". Receivers verify
+// a request by recomputing it from the timestamp header and raw body.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhook posts the notification as JSON, or the rendered body_template.
+type webhook struct {
+	cfg    config.Receiver
+	body   *template.Template
+	client *http.Client
+}
+
+func newWebhook(rc config.Receiver) (*webhook, error) {
+	if rc.URL == "" {
+		return nil, fmt.Errorf("receiver %q: url is required", rc.Name)
+	}
+	t, err := parseTemplate(rc.Name, rc.BodyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("receiver %q: body_template: %w", rc.Name, err)
+	}
+	return &webhook{cfg: rc, body: t, client: &http.Client{Timeout: rc.Timeout}}, nil
+}
+
+func (w *webhook) Send(n Notification) error {
+	var body []byte
+	var err error
+	if w.body != nil {
+		body, err = render(w.body, n)
+	} else {
+		body, err = json.Marshal(n)
+	}
+	if err != nil {
+		return permanentError{err}
+	}
+	return postJSON(w.client, w.cfg.URL, w.cfg.Headers, body, w.cfg.HMACSecret)
+}
@@ -0,0 +1,559 @@
+// Package search tokenizes log lines for the full-text index and parses and
+// evaluates log search queries.
+//
+// A query is a list of clauses that must all match. Clauses are words
+// (matched as whole terms, case-insensitively), prefixes (word*), phrases
+// ("connection reset" or a word such as req-42ab that splits into several
+// terms), regular expressions (/timeout after \d+ms/, matched against the
+// raw line), parenthesised groups, and combinations with AND, OR and NOT
+// (or a leading -). OR binds looser than AND. A slash-delimited clause
+// that does not end at a space or ) is a word, so paths can be searched.
+package search
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxTermLen is the longest term that is indexed; longer words in lines are
+// skipped and longer query words fall back to scanning.
+const MaxTermLen = 128
+
+// Token is one term of a line and its byte range in it.
+type Token struct {
+	Term       string
+	Start, End int
+}
+
+// Tokenize splits s into lower-cased terms of letters, digits and
+// underscores.
+func Tokenize(s string) []Token {
+	var out []Token
+	start := -1
+	for i, r := range s {
+		word := r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			out = append(out, Token{strings.ToLower(s[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		out = append(out, Token{strings.ToLower(s[start:]), start, len(s)})
+	}
+	return out
+}
+
+// Terms returns the distinct indexable terms of s.
+func Terms(s string) []string {
+	toks := Tokenize(s)
+	seen := make(map[string]bool, len(toks))
+	out := make([]string, 0, len(toks))
+	for _, t := range toks {
+		if len(t.Term) > MaxTermLen || seen[t.Term] {
+			continue
+		}
+		seen[t.Term] = true
+		out = append(out, t.Term)
+	}
+	return out
+}
+
+// Postings looks up index entries: the sorted record numbers holding a term,
+// or holding any term with a prefix.
+type Postings interface {
+	Term(term string) []uint32
+	Prefix(prefix string) []uint32
+}
+
+// Query is a parsed search query.
+type Query struct {
+	root node
+	text string
+}
+
+func (q *Query) String() string { return q.text }
+
+// Candidates returns the sorted record numbers that may match according to
+// the index. all is true when the query cannot be narrowed by the index
+// (regular expressions, negations) and every record must be checked.
+func (q *Query) Candidates(p Postings) (ids []uint32, all bool) {
+	return q.root.candidates(p)
+}
+
+// Match reports whether line matches and returns the byte ranges of the
+// parts that made it match, sorted and merged.
+func (q *Query) Match(line string) (bool, [][2]int) {
+	ok, hl := q.root.match(line, Tokenize(line))
+	if !ok {
+		return false, nil
+	}
+	return true, mergeRanges(hl)
+}
+
+type node interface {
+	candidates(p Postings) ([]uint32, bool)
+	match(line string, toks []Token) (bool, [][2]int)
+}
+
+type termNode struct {
+	term   string
+	prefix bool
+}
+
+func (n termNode) candidates(p Postings) ([]uint32, bool) {
+	if len(n.term) > MaxTermLen {
+		return nil, true
+	}
+	if n.prefix {
+		return p.Prefix(n.term), false
+	}
+	return p.Term(n.term), false
+}
+
+func (n termNode) match(line string, toks []Token) (bool, [][2]int) {
+	var hl [][2]int
+	for _, t := range toks {
+		if t.Term == n.term || (n.prefix && strings.HasPrefix(t.Term, n.term)) {
+			hl = append(hl, [2]int{t.Start, t.End})
+		}
+	}
+	return len(hl) > 0, hl
+}
+
+type phraseNode struct{ terms []string }
+
+func (n phraseNode) candidates(p Postings) ([]uint32, bool) {
+	var ids []uint32
+	for i, t := range n.terms {
+		got, all := termNode{term: t}.candidates(p)
+		if all {
+			return nil, true
+		}
+		if i == 0 {
+			ids = got
+		} else {
+			ids = intersect(ids, got)
+		}
+	}
+	return ids, false
+}
+
+func (n phraseNode) match(line string, toks []Token) (bool, [][2]int) {
+	var hl [][2]int
+	for i := 0; i+len(n.terms) <= len(toks); i++ {
+		j := 0
+		for j < len(n.terms) && toks[i+j].Term == n.terms[j] {
+			j++
+		}
+		if j == len(n.terms) {
+			hl = append(hl, [2]int{toks[i].Start, toks[i+j-1].End})
+		}
+	}
+	return len(hl) > 0, hl
+}
+
+type regexNode struct{ re *regexp.Regexp }
+
+func (n regexNode) candidates(Postings) ([]uint32, bool) { return nil, true }
+
+func (n regexNode) match(line string, _ []Token) (bool, [][2]int) {
+	var hl [][2]int
+	for _, m := range n.re.FindAllStringIndex(line, -1) {
+		hl = append(hl, [2]int{m[0], m[1]})
+	}
+	return len(hl) > 0, hl
+}
+
+type notNode struct{ n node }
+
+func (n notNode) candidates(Postings) ([]uint32, bool) { return nil, true }
+
+func (n notNode) match(line string, toks []Token) (bool, [][2]int) {
+	ok, _ := n.n.match(line, toks)
+	return !ok, nil
+}
+
+type andNode struct{ ns []node }
+
+func (n andNode) candidates(p Postings) ([]uint32, bool) {
+	var ids []uint32
+	narrowed := false
+	for _, c := range n.ns {
+		got, all := c.candidates(p)
+		if all {
+			continue
+		}
+		if !narrowed {
+			ids, narrowed = got, true
+		} else {
+			ids = intersect(ids, got)
+		}
+	}
+	return ids, !narrowed
+}
+
+func (n andNode) match(line string, toks []Token) (bool, [][2]int) {
+	var hl [][2]int
+	for _, c := range n.ns {
+		ok, h := c.match(line, toks)
+		if !ok {
+			return false, nil
+		}
+		hl = append(hl, h...)
+	}
+	return true, hl
+}
+
+type orNode struct{ ns []node }
+
+func (n orNode) candidates(p Postings) ([]uint32, bool) {
+	var ids []uint32
+	for _, c := range n.ns {
+		got, all := c.candidates(p)
+		if all {
+			return nil, true
+		}
+		ids = union(ids, got)
+	}
+	return ids, false
+}
+
+func (n orNode) match(line string, toks []Token) (bool, [][2]int) {
+	matched := false
+	var hl [][2]int
+	for _, c := range n.ns {
+		if ok, h := c.match(line, toks); ok {
+			matched = true
+			hl = append(hl, h...)
+		}
+	}
+	return matched, hl
+}
+
+// intersect returns the ids in both sorted lists.
+func intersect(a, b []uint32) []uint32 {
+	var out []uint32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// union returns the ids in either sorted list.
+func union(a, b []uint32) []uint32 {
+	out := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		case a[i] > b[j]:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	return append(out, b[j:]...)
+}
+
+// Union merges sorted lists of ids, for Postings.Prefix implementations.
+func Union(lists ...[]uint32) []uint32 {
+	var out []uint32
+	for _, l := range lists {
+		out = append(out, l...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	n := 0
+	for i, id := range out {
+		if i == 0 || id != out[n-1] {
+			out[n] = id
+			n++
+		}
+	}
+	return out[:n]
+}
+
+func mergeRanges(rs [][2]int) [][2]int {
+	if len(rs) == 0 {
+		return [][2]int{}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i][0] < rs[j][0] })
+	out := rs[:1]
+	for _, r := range rs[1:] {
+		last := &out[len(out)-1]
+		if r[0] <= last[1] {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// ErrEmpty is returned by Parse for a query without clauses.
+var ErrEmpty = errors.New("empty search query")
+
+// Parse parses a search query.
+func Parse(s string) (*Query, error) {
+	p := &parser{src: s}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	if len(p.items) == 0 {
+		return nil, ErrEmpty
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.items) {
+		return nil, fmt.Errorf("unexpected %q in search query", p.items[p.pos].text)
+	}
+	return &Query{root: root, text: s}, nil
+}
+
+type itemKind int
+
+const (
+	itemWord itemKind = iota
+	itemPhrase
+	itemRegex
+	itemLParen
+	itemRParen
+	itemAnd
+	itemOr
+	itemNot
+)
+
+type item struct {
+	kind itemKind
+	text string
+}
+
+type parser struct {
+	src   string
+	items []item
+	pos   int
+}
+
+func (p *parser) lex() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			p.items = append(p.items, item{itemLParen, "("})
+			i++
+		case c == ')':
+			p.items = append(p.items, item{itemRParen, ")"})
+			i++
+		case c == '-' && i+1 < len(s) && s[i+1] != ' ' && (i == 0 || s[i-1] == ' ' || s[i-1] == '('):
+			p.items = append(p.items, item{itemNot, "-"})
+			i++
+		case c == '"':
+			text, n, err := quoted(s[i:], c)
+			if err != nil {
+				return err
+			}
+			p.items = append(p.items, item{itemPhrase, text})
+			i += n
+		case c == '/' && isRegex(s[i:]):
+			text, n, _ := quoted(s[i:], c)
+			p.items = append(p.items, item{itemRegex, text})
+			i += n
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n()\"", rune(s[j])) {
+				_, size := utf8.DecodeRuneInString(s[j:])
+				j += size
+			}
+			w := s[i:j]
+			switch w {
+			case "AND":
+				p.items = append(p.items, item{itemAnd, w})
+			case "OR":
+				p.items = append(p.items, item{itemOr, w})
+			case "NOT":
+				p.items = append(p.items, item{itemNot, w})
+			default:
+				p.items = append(p.items, item{itemWord, w})
+			}
+			i = j
+		}
+	}
+	return nil
+}
+
+// isRegex reports whether s starts with a /regex/ that ends a clause, so
+// that paths such as /api/users are read as words.
+func isRegex(s string) bool {
+	_, n, err := quoted(s, '/')
+	return err == nil && n > 2 && (n == len(s) || strings.ContainsRune(" \t\n)", rune(s[n])))
+}
+
+// quoted reads a "phrase" or /regex/ at the start of s, where a backslash
+// escapes the delimiter, and returns its content and length.
+func quoted(s string, delim byte) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == delim:
+			b.WriteByte(delim)
+			i++
+		case s[i] == delim:
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated %c in search query", delim)
+}
+
+func (p *parser) peek() (item, bool) {
+	if p.pos >= len(p.items) {
+		return item{}, false
+	}
+	return p.items[p.pos], true
+}
+
+func (p *parser) parseOr() (node, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	ns := []node{first}
+	for {
+		it, ok := p.peek()
+		if !ok || it.kind != itemOr {
+			break
+		}
+		p.pos++
+		n, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	if len(ns) == 1 {
+		return first, nil
+	}
+	return orNode{ns}, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	var ns []node
+	for {
+		it, ok := p.peek()
+		if !ok || it.kind == itemOr || it.kind == itemRParen {
+			break
+		}
+		if it.kind == itemAnd {
+			p.pos++
+			continue
+		}
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	switch len(ns) {
+	case 0:
+		return nil, errors.New("search query has an empty clause")
+	case 1:
+		return ns[0], nil
+	}
+	return andNode{ns}, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	it, _ := p.peek()
+	if it.kind == itemNot {
+		p.pos++
+		if _, ok := p.peek(); !ok {
+			return nil, fmt.Errorf("%s needs a clause in search query", it.text)
+		}
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	it, _ := p.peek()
+	p.pos++
+	switch it.kind {
+	case itemLParen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if end, ok := p.peek(); !ok || end.kind != itemRParen {
+			return nil, errors.New("missing ) in search query")
+		}
+		p.pos++
+		return n, nil
+	case itemRegex:
+		re, err := regexp.Compile(it.text)
+		if err != nil {
+			return nil, fmt.Errorf("search query regex: %w", err)
+		}
+		return regexNode{re}, nil
+	case itemPhrase:
+		return wordsNode(it.text, false)
+	case itemWord:
+		if w, ok := strings.CutSuffix(it.text, "*"); ok {
+			return wordsNode(w, true)
+		}
+		return wordsNode(it.text, false)
+	}
+	return nil, fmt.Errorf("unexpected %q in search query", it.text)
+}
+
+// wordsNode matches the terms of text: one term directly, several as a
+// phrase. A prefix applies to single terms only.
+func wordsNode(text string, prefix bool) (node, error) {
+	toks := Tokenize(text)
+	switch {
+	case len(toks) == 0:
+		return nil, fmt.Errorf("%q has no searchable terms", text)
+	case len(toks) == 1:
+		return termNode{term: toks[0].Term, prefix: prefix}, nil
+	case prefix:
+		return nil, fmt.Errorf("prefix %q must be a single term", text+"*")
+	}
+	terms := make([]string, len(toks))
+	for i, t := range toks {
+		terms[i] = t.Term
+	}
+	return phraseNode{terms}, nil
+}
@@ -0,0 +1,125 @@
+package search
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Lines split into lower-cased terms with their byte ranges.
+func TestTokenize(t *testing.T) {
+	got := Tokenize("GET /api/Users_2 -> 200 ÉTÉ")
+	want := []Token{{"get", 0, 3}, {"api", 5, 8}, {"users_2", 9, 16}, {"200", 20, 23}, {"été", 24, 29}}
+	if !slices.Equal(got, want) {
+		t.Fatalf("tokens: got %v, want %v", got, want)
+	}
+	if got := Terms("a b a " + strings.Repeat("x", MaxTermLen+1)); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("terms: %v", got)
+	}
+}
+
+// Queries match lines by words, prefixes, phrases, regular expressions and
+// their combinations, and highlight what matched.
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		query, line string
+		match       bool
+		hl          string // the highlighted ranges
+	}{
+		{"error", "Fatal ERROR here", true, "[6 11]"},
+		{"error", "errors here", false, ""},
+		{"err*", "errors and err", true, "[0 6] [11 14]"},
+		{`"connection reset"`, "tcp connection reset by peer", true, "[4 20]"},
+		{`"connection reset"`, "reset connection", false, ""},
+		{"req-42ab", "done req-42ab", true, "[5 13]"},
+		{`/timeout after \d+ms/`, "timeout after 30ms", true, "[0 18]"},
+		{"/api/users", "GET /api/users", true, "[5 14]"},
+		{"error timeout", "error: timeout", true, "[0 5] [7 14]"},
+		{"error AND timeout", "error only", false, ""},
+		{"error OR timeout", "a timeout", true, "[2 9]"},
+		{"error -debug", "error in debug", false, ""},
+		{"error NOT debug", "error in prod", true, "[0 5]"},
+		{"(error OR warn) db", "warn from db", true, "[0 4] [10 12]"},
+		{"error OR warn db", "error alone", true, "[0 5]"},
+	} {
+		q, err := Parse(c.query)
+		if err != nil {
+			t.Errorf("%s: %v", c.query, err)
+			continue
+		}
+		ok, hl := q.Match(c.line)
+		var got []string
+		for _, r := range hl {
+			got = append(got, fmt.Sprint(r[0], r[1]))
+		}
+		if ok != c.match || (ok && "["+strings.Join(got, "] [")+"]" != c.hl) {
+			t.Errorf("%s on %q: got %v %v, want %v %s", c.query, c.line, ok, hl, c.match, c.hl)
+		}
+	}
+}
+
+// Malformed queries are rejected.
+func TestParseErrors(t *testing.T) {
+	if _, err := Parse("  "); err != ErrEmpty {
+		t.Errorf("empty query: %v", err)
+	}
+	for _, q := range []string{`"open`, "(error", "error)", "error OR", "NOT", "/[/", "req-4*", "---", "AND"} {
+		if _, err := Parse(q); err == nil {
+			t.Errorf("%s parsed", q)
+		}
+	}
+}
+
+// postings is an index over fixed lines, numbered from 0.
+type postings []string
+
+func (p postings) Term(term string) []uint32 {
+	return p.find(func(t string) bool { return t == term })
+}
+
+func (p postings) Prefix(prefix string) []uint32 {
+	return p.find(func(t string) bool { return strings.HasPrefix(t, prefix) })
+}
+
+func (p postings) find(ok func(term string) bool) []uint32 {
+	var ids []uint32
+	for i, line := range p {
+		if slices.ContainsFunc(Terms(line), ok) {
+			ids = append(ids, uint32(i))
+		}
+	}
+	return ids
+}
+
+// The index narrows a query to the lines that hold its terms, except for
+// regular expressions and negations alone.
+func TestCandidates(t *testing.T) {
+	idx := postings{"error in db", "warn in db", "error in api", "timeout"}
+	for _, c := range []struct {
+		query string
+		ids   []uint32
+		all   bool
+	}{
+		{"error", []uint32{0, 2}, false},
+		{"error db", []uint32{0}, false},
+		{"error OR warn", []uint32{0, 1, 2}, false},
+		{"err* -api", []uint32{0, 2}, false},
+		{`"in db"`, []uint32{0, 1}, false},
+		{"/time.*/", nil, true},
+		{"-error", nil, true},
+		{"error OR /x/", nil, true},
+	} {
+		q, err := Parse(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, all := q.Candidates(idx)
+		if all != c.all || !slices.Equal(ids, c.ids) {
+			t.Errorf("%s: got %v %v, want %v %v", c.query, ids, all, c.ids, c.all)
+		}
+	}
+	if got := Union([]uint32{1, 5}, []uint32{2, 5}, nil, []uint32{0}); !slices.Equal(got, []uint32{0, 1, 2, 5}) {
+		t.Errorf("union: %v", got)
+	}
+}
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+var backendTypes = []string{"disk", "sqlite"}
+
+// forEachBackend runs fn as a subtest per backend type. open opens the
+// backend on the same directory every time it is called.
+func forEachBackend(t *testing.T, fn func(t *testing.T, open func() Backend)) {
+	for _, typ := range backendTypes {
+		t.Run(typ, func(t *testing.T) {
+			cfg := testStorageConfig(typ, t.TempDir())
+			fn(t, func() Backend {
+				t.Helper()
+				b, err := Open(cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b
+			})
+		})
+	}
+}
+
+func testStorageConfig(typ, dir string) config.StorageConfig {
+	return config.StorageConfig{Type: typ, Directory: dir, FlushInterval: 10 * time.Millisecond, FsyncInterval: 10 * time.Millisecond}
+}
@@ -0,0 +1,526 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/labels"
+)
+
+// Every stream is stored as <kind>_<job>_<target>, and log streams as
+// <kind>_<job>_<target>_<app>, with each name escaped by escapeName: "_"
+// only ever separates the parts, and no name can reach outside the data
+// directory or act as a glob pattern. The catalog (catalog.json) lists
+// every stream with its unescaped names, location and newest target
+// labels, and answers the inventory queries without reading the streams.
+// It is kept as streams are written and reconciled with the data directory
+// on startup and after retention.
+
+const catalogFile = "catalog.json"
+
+// escapeName escapes the bytes of a job, target or app name outside
+// [A-Za-z0-9.:@+=,~-] as %XX.
+func escapeName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if safeNameByte(c) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func safeNameByte(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte(".:@+=,~-", c) >= 0
+}
+
+// unescapeName reverses escapeName. Malformed escapes are kept as they are.
+func unescapeName(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// streamName names the stream directory, or the file without its .jsonl
+// extension, of one kind of record of a job/target and, for logs, app.
+func streamName(kind string, parts ...string) string {
+	name := kind
+	for _, p := range parts {
+		name += "_" + escapeName(p)
+	}
+	return name
+}
+
+// parseStream splits a stream directory or flat file name into its kind,
+// job, target and, for logs, app.
+func parseStream(stream string) (kind, job, target, app string) {
+	kind, rest, _ := strings.Cut(strings.TrimSuffix(stream, ".jsonl"), "_")
+	n := 2
+	if kind == "logs" {
+		n = 3
+	}
+	parts := strings.SplitN(rest, "_", n)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return kind, unescapeName(parts[0]), unescapeName(parts[1]), unescapeName(parts[2])
+}
+
+// CatalogQuery selects the streams of a kind, job, target and app, empty
+// for all, whose latest labels match all of Matchers.
+type CatalogQuery struct {
+	Kind     string
+	Job      string
+	Target   string
+	App      string
+	Matchers []labels.Matcher
+}
+
+// TargetQuery selects the targets of the streams whose latest labels match
+// all of Matchers.
+type TargetQuery struct {
+	Matchers []labels.Matcher
+}
+
+// JobQuery selects the jobs of the streams of Target, all if empty, whose
+// latest labels match all of Matchers.
+type JobQuery struct {
+	Target   string
+	Matchers []labels.Matcher
+}
+
+// CatalogEntry is one stream: a kind of record of a job/target, and of an
+// app for logs. Processes files are also listed once per app they held.
+type CatalogEntry struct {
+	Kind   string            `json:"kind"`
+	Job    string            `json:"job"`
+	Target string            `json:"target"`
+	App    string            `json:"app,omitempty"`
+	Path   string            `json:"path"` // relative to the data directory, or the sqlite table
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (e *CatalogEntry) key() string {
+	return e.Kind + "\x00" + e.Job + "\x00" + e.Target + "\x00" + e.App
+}
+
+// catalog holds the entries in memory and saves them whenever one is added
+// or its labels change.
+type catalog struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*CatalogEntry
+}
+
+func (c *catalog) load() (existed bool, err error) {
+	c.entries = make(map[string]*CatalogEntry)
+	b, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	var entries []*CatalogEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return true, fmt.Errorf("storage: read %s: %w", c.path, err)
+	}
+	for _, e := range entries {
+		c.entries[e.key()] = e
+	}
+	return true, nil
+}
+
+// saveLocked writes the catalog to a temporary file and renames it over
+// the old one, so a crash leaves either catalog intact.
+func (c *catalog) saveLocked() error {
+	entries := make([]*CatalogEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key() < entries[j].key() })
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// add records that a stream was written with labels ls and reports
+// whether the catalog changed.
+func (c *catalog) add(e CatalogEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[e.key()]; ok && old.Path == e.Path && labelsEqual(old.Labels, e.Labels) {
+		return false
+	}
+	c.entries[e.key()] = &e
+	return true
+}
+
+// save writes the catalog, reporting failures to stderr.
+func (c *catalog) save() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.saveLocked(); err != nil {
+		fmt.Fprintf(os.Stderr, "storage: save catalog: %v\n", err)
+	}
+}
+
+// prune drops the entries whose stream is gone from dir. flush writes the
+// buffered records first, with the catalog locked: a stream is cataloged
+// after its first record is buffered, so every cataloged stream exists.
+func (c *catalog) prune(dir string, flush func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flush()
+	changed := false
+	for k, e := range c.entries {
+		if _, err := os.Stat(filepath.Join(dir, e.Path)); os.IsNotExist(err) {
+			delete(c.entries, k)
+			changed = true
+		}
+	}
+	if changed {
+		if err := c.saveLocked(); err != nil {
+			fmt.Fprintf(os.Stderr, "storage: save catalog: %v\n", err)
+		}
+	}
+}
+
+// find returns the entries selected by f, sorted by kind, job, target and app.
+func (c *catalog) find(f func(e *CatalogEntry) bool) []CatalogEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []CatalogEntry
+	for _, e := range c.entries {
+		if f(e) {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].key() < out[j].key() })
+	return out
+}
+
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// streamEntry returns the catalog entry of a stream directory or flat file.
+func streamEntry(stream string, ls map[string]string) CatalogEntry {
+	kind, job, target, app := parseStream(stream)
+	return CatalogEntry{Kind: kind, Job: job, Target: target, App: app, Path: stream, Labels: ls}
+}
+
+// processEntries returns the catalog entries of the apps of a processes file.
+func processEntries(file string, states []ProcessState, ls map[string]string) []CatalogEntry {
+	_, job, target, _ := parseStream(file)
+	out := make([]CatalogEntry, 0, len(states))
+	for _, s := range states {
+		out = append(out, CatalogEntry{Kind: "processes", Job: job, Target: target, App: s.Name, Path: file, Labels: ls})
+	}
+	return out
+}
+
+// noteStream catalogs a stream after a write, saving the catalog if that
+// changed it.
+func (d *DiskStorage) noteStream(stream string, ls map[string]string, more ...CatalogEntry) {
+	changed := d.catalog.add(streamEntry(stream, ls))
+	for _, e := range more {
+		changed = d.catalog.add(e) || changed
+	}
+	if changed {
+		d.catalog.save()
+	}
+}
+
+// openCatalog loads the catalog and reconciles it with the data directory.
+// Without a catalog the data predates escaped names, and streams whose
+// names need escaping are renamed first.
+func (d *DiskStorage) openCatalog() error {
+	d.catalog = &catalog{path: filepath.Join(d.dir, catalogFile)}
+	existed, err := d.catalog.load()
+	if err != nil {
+		return err
+	}
+	if err := d.migrateStreamNames(!existed); err != nil {
+		return err
+	}
+	d.catalog.prune(d.dir, d.writers.flush)
+	for _, kind := range segmentKinds {
+		dirs, err := streamDirs(filepath.Join(d.dir, kind+"_*"))
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			stream := filepath.Base(dir)
+			if isLegacyStream(stream) {
+				continue
+			}
+			var ls map[string]string
+			if seg, ok := newestSegment(dir); ok {
+				if line, err := d.segmentLastLine(seg); err == nil {
+					ls = recordLabels(line)
+				}
+			}
+			d.catalog.add(streamEntry(stream, ls))
+		}
+	}
+	for _, fn := range d.recordFiles() {
+		if isLegacyStream(filepath.Base(fn)) {
+			continue
+		}
+		line, err := lastLine(fn)
+		if err != nil {
+			continue
+		}
+		ls := recordLabels(line)
+		d.catalog.add(streamEntry(filepath.Base(fn), ls))
+		if isProcessFile(fn) {
+			if _, states, err := ParseProcessSnapshot(line); err == nil {
+				for _, e := range processEntries(filepath.Base(fn), states, ls) {
+					d.catalog.add(e)
+				}
+			}
+		}
+	}
+	// the saved catalog also marks the names as escaped for the next start
+	d.catalog.mu.Lock()
+	defer d.catalog.mu.Unlock()
+	return d.catalog.saveLocked()
+}
+
+// migrateStreamNames renames the streams written before names were
+// escaped, whose job, target or app may hold underscores: all of them on
+// the first start with a catalog, and afterwards those still holding more
+// underscores than an escaped name can. A name that cannot be split with
+// certainty is only renamed once storage.legacy_streams names its parts;
+// until then it is left in place, unlisted, with an error. Log offsets
+// checkpointed in renamed streams follow them.
+func (d *DiskStorage) migrateStreamNames(all bool) error {
+	moved := make(map[string]string)
+	defer func() {
+		if len(moved) == 0 {
+			return
+		}
+		for _, offs := range d.logOffsets {
+			for stream, o := range offs {
+				dir, seg := filepath.Split(o.File)
+				if to, ok := moved[filepath.Clean(dir)]; ok {
+					o.File = filepath.Join(to, seg)
+					offs[stream] = o
+				}
+			}
+		}
+		if err := d.saveLogOffsetsLocked(); err != nil {
+			fmt.Fprintf(os.Stderr, "storage: checkpoint log offsets: %v\n", err)
+		}
+	}()
+	var names []string
+	for _, kind := range segmentKinds {
+		dirs, err := streamDirs(filepath.Join(d.dir, kind+"_*"))
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			names = append(names, filepath.Base(dir))
+		}
+	}
+	for _, fn := range d.recordFiles() {
+		names = append(names, filepath.Base(fn))
+	}
+	for _, name := range names {
+		if !all && !isLegacyStream(name) {
+			continue
+		}
+		base := strings.TrimSuffix(name, ".jsonl")
+		kind, rest, _ := strings.Cut(base, "_")
+		parts, named := d.legacyStreams[base]
+		if !named {
+			var sure bool
+			parts, sure = splitLegacyStream(kind, rest)
+			if parts == nil {
+				continue
+			}
+			if !sure {
+				fmt.Fprintf(os.Stderr, "storage: error: left %s in place, unlisted: its job, target and app cannot be told apart; name them under storage.legacy_streams to migrate it\n", name)
+				continue
+			}
+		}
+		to := streamName(kind, parts...) + strings.TrimPrefix(name, base)
+		if to == name {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(d.dir, to)); err == nil {
+			fmt.Fprintf(os.Stderr, "storage: not renaming %s: %s already exists\n", name, to)
+			continue
+		}
+		if err := os.Rename(filepath.Join(d.dir, name), filepath.Join(d.dir, to)); err != nil {
+			return err
+		}
+		moved[name] = to
+		fmt.Fprintf(os.Stderr, "storage: renamed %s to %s\n", name, to)
+	}
+	return nil
+}
+
+// isLegacyStream reports whether a stream directory or file name holds more
+// underscores than an escaped name of its kind: it was stored before names
+// were escaped and not migrated yet.
+func isLegacyStream(name string) bool {
+	kind, rest, _ := strings.Cut(strings.TrimSuffix(name, ".jsonl"), "_")
+	n := 2
+	if kind == "logs" {
+		n = 3
+	}
+	return strings.Count(rest, "_") >= n
+}
+
+// legacyStreamNames checks the configured names of legacy streams.
+func legacyStreamNames(streams []config.LegacyStream) (map[string][]string, error) {
+	out := make(map[string][]string, len(streams))
+	for _, ls := range streams {
+		kind, _, _ := strings.Cut(ls.Name, "_")
+		if !slices.Contains(recordKinds, kind) || ls.Job == "" || ls.Target == "" || (kind == "logs") != (ls.App != "") {
+			return nil, fmt.Errorf("storage: legacy_streams %q: want a <kind>_... name with job, target and, for logs only, app", ls.Name)
+		}
+		parts := []string{ls.Job, ls.Target}
+		if kind == "logs" {
+			parts = append(parts, ls.App)
+		}
+		out[strings.TrimSuffix(ls.Name, ".jsonl")] = parts
+	}
+	return out, nil
+}
+
+// splitLegacyStream splits the name of a stream from before escaping into
+// job, target and, for logs, app. Targets are usually host:port and hold no
+// underscore, so a single part with a colon where the target can be is
+// taken as the target; otherwise the name is split at its first
+// underscores as it always was, but not sure.
+func splitLegacyStream(kind, rest string) (parts []string, sure bool) {
+	n := 2
+	if kind == "logs" {
+		n = 3
+	}
+	tokens := strings.Split(rest, "_")
+	if len(tokens) < n {
+		return nil, false
+	}
+	if len(tokens) == n {
+		return tokens, true
+	}
+	last := len(tokens) - 1 // the target's index for processes and events
+	if n == 3 {
+		last = len(tokens) - 2
+	}
+	k := -1
+	for i := n - 2; i <= last; i++ {
+		if n == 2 && i != last {
+			continue
+		}
+		if strings.Contains(tokens[i], ":") {
+			if k >= 0 {
+				k = -1
+				break
+			}
+			k = i
+		}
+	}
+	if k <= 0 {
+		return strings.SplitN(rest, "_", n), false
+	}
+	parts = []string{strings.Join(tokens[:k], "_"), tokens[k]}
+	if n == 3 {
+		parts = append(parts, strings.Join(tokens[k+1:], "_"))
+	}
+	return parts, true
+}
+
+// Catalog returns the streams of the matching kind, job, target and app
+// whose newest labels match q.Matchers. Empty fields match everything.
+func (d *DiskStorage) Catalog(q CatalogQuery) []CatalogEntry {
+	out := d.catalog.find(func(e *CatalogEntry) bool {
+		return (q.Kind == "" || q.Kind == e.Kind) && (q.Job == "" || q.Job == e.Job) &&
+			(q.Target == "" || q.Target == e.Target) && (q.App == "" || q.App == e.App) &&
+			labels.MatchAll(q.Matchers, e.Labels)
+	})
+	if out == nil {
+		out = []CatalogEntry{}
+	}
+	return out
+}
+
+// catalogNames returns the distinct non-empty values of one field of the
+// entries, sorted, as JSON.
+func catalogNames(entries []CatalogEntry, field func(e *CatalogEntry) string, wrap func(string) interface{}) []json.RawMessage {
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range entries {
+		if v := field(&e); v != "" && !seen[v] {
+			seen[v] = true
+			names = append(names, v)
+		}
+	}
+	sort.Strings(names)
+	out := make([]json.RawMessage, 0, len(names))
+	for _, n := range names {
+		if b, err := json.Marshal(wrap(n)); err == nil {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// catalogTargets, catalogJobs and catalogApps answer /target, /jobs and
+// /apps from catalog entries.
+func catalogTargets(entries []CatalogEntry) []json.RawMessage {
+	return catalogNames(entries, func(e *CatalogEntry) string { return e.Target }, func(t string) interface{} { return t })
+}
+
+func catalogJobs(entries []CatalogEntry) []json.RawMessage {
+	return catalogNames(entries, func(e *CatalogEntry) string { return e.Job }, func(j string) interface{} { return j })
+}
+
+func catalogApps(entries []CatalogEntry) []json.RawMessage {
+	return catalogNames(entries, func(e *CatalogEntry) string { return e.App }, appName)
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// writeLegacyStream creates a stream directory as versions before name
+// escaping wrote it, holding one record.
+func writeLegacyStream(t *testing.T, dir, stream, record string) {
+	t.Helper()
+	start := time.Now().UTC().Add(-time.Hour).Truncate(time.Hour)
+	path := filepath.Join(dir, stream, segmentName(start, time.Hour))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(record+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func catalogStreams(s Store) map[string]CatalogEntry {
+	out := make(map[string]CatalogEntry)
+	for _, e := range s.Catalog(CatalogQuery{}) {
+		out[e.Path] = e
+	}
+	return out
+}
+
+// Legacy names are migrated only when their parts are certain or named in
+// the configuration; others stay in place and out of the catalog.
+func TestMigrateLegacyStreamNames(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339Nano)
+	writeLegacyStream(t, dir, "metrics_my_job_h1:9100", `{"timestamp":"`+ts+`","metrics":{}}`)
+	writeLegacyStream(t, dir, "logs_my_job_web_1_api", `{"timestamp":"`+ts+`","app":"api","line":"hello"}`)
+
+	cfg := testStorageConfig("disk", dir)
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := catalogStreams(s)
+	if e, ok := got["metrics_my%5Fjob_h1:9100"]; !ok || e.Job != "my_job" || e.Target != "h1:9100" {
+		t.Errorf("certain legacy name: catalog %v", got)
+	}
+	for path, e := range got {
+		if e.Kind == "logs" {
+			t.Errorf("ambiguous legacy name listed as %s: %+v", path, e)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "logs_my_job_web_1_api")); err != nil {
+		t.Errorf("ambiguous legacy stream moved: %v", err)
+	}
+	s.Close()
+
+	// named in the configuration, it is migrated on the next start
+	cfg.LegacyStreams = []config.LegacyStream{{Name: "logs_my_job_web_1_api", Job: "my_job", Target: "web_1", App: "api"}}
+	s, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	e, ok := catalogStreams(s)["logs_my%5Fjob_web%5F1_api"]
+	if !ok || e.Job != "my_job" || e.Target != "web_1" || e.App != "api" {
+		t.Fatalf("named legacy stream: catalog %v", catalogStreams(s))
+	}
+	page, err := s.QueryLogs(LogQuery{Selector: Selector{Job: "my_job", Target: "web_1", App: "api", Start: time.Now().Add(-2 * time.Hour), End: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Lines) != 1 {
+		t.Fatalf("logs of the migrated stream: %+v", page)
+	}
+}
+
+func TestLegacyStreamNamesChecked(t *testing.T) {
+	for _, ls := range []config.LegacyStream{
+		{Name: "logs_a_b_c_d", Job: "a_b", Target: "c"},            // no app
+		{Name: "metrics_a_b_c", Job: "a_b", Target: "c", App: "x"}, // app on metrics
+		{Name: "bogus_a_b_c", Job: "a_b", Target: "c"},             // unknown kind
+		{Name: "processes_a_b_c", Target: "c"},                     // no job
+	} {
+		if _, err := legacyStreamNames([]config.LegacyStream{ls}); err == nil {
+			t.Errorf("%+v accepted", ls)
+		}
+	}
+}
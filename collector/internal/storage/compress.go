@@ -0,0 +1,542 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Sealed segments are compressed into path+".gz": a series of gzip members
+// ("blocks") of about blockBytes of records each, followed by a gzip member
+// holding the block index and a trailer with the index's offset. Queries
+// decompress only the blocks whose time range overlaps theirs. gunzip reads
+// the file as is, printing the records and then the index.
+//
+// To compress, the segment's plain file is renamed to a sealing file, so
+// records that arrive late start a new plain file, and the sealing files
+// are appended as new blocks to a copy of the compressed file, which then
+// replaces it. The index lists the sealing files it includes, so readers
+// and the next compaction skip those left behind by a crash.
+const (
+	compressedSuffix = ".gz"
+	sealingSuffix    = ".sealing"
+	blockBytes       = 1 << 20
+	// sealAfter is how long after its period ends a segment is compressed,
+	// leaving time for records that arrive late.
+	sealAfter = 5 * time.Minute
+	// indexMagic ends every compressed segment, after the index offset.
+	indexMagic = "PM2IDX01"
+)
+
+// blockIndex locates one compressed block and the records in it.
+type blockIndex struct {
+	Off   int64     `json:"off"`
+	Len   int64     `json:"len"`
+	Start time.Time `json:"start"` // earliest record
+	End   time.Time `json:"end"`   // latest record
+	Lines int       `json:"lines"`
+	Raw   int64     `json:"raw"` // uncompressed bytes
+}
+
+type segmentIndex struct {
+	Blocks []blockIndex `json:"blocks"`
+	Sealed []string     `json:"sealed"` // sealing files (base names) already included
+}
+
+func (ix segmentIndex) includes(sealing string) bool {
+	for _, s := range ix.Sealed {
+		if s == filepath.Base(sealing) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressStats counts the work of compaction.
+type compressStats struct {
+	segments atomic.Uint64
+	in       atomic.Uint64 // uncompressed bytes
+	out      atomic.Uint64 // compressed bytes
+}
+
+// readIndex returns the index of a compressed segment and where its blocks end.
+func readIndex(f *os.File) (segmentIndex, int64, error) {
+	var ix segmentIndex
+	info, err := f.Stat()
+	if err != nil {
+		return ix, 0, err
+	}
+	size := info.Size()
+	trailer := make([]byte, 8+len(indexMagic))
+	if size < int64(len(trailer)) {
+		return ix, 0, errors.New("compressed segment too short")
+	}
+	if _, err := f.ReadAt(trailer, size-int64(len(trailer))); err != nil {
+		return ix, 0, err
+	}
+	if string(trailer[8:]) != indexMagic {
+		return ix, 0, errors.New("compressed segment has no index")
+	}
+	off := int64(binary.BigEndian.Uint64(trailer[:8]))
+	if off < 0 || off > size-int64(len(trailer)) {
+		return ix, 0, errors.New("compressed segment index out of range")
+	}
+	zr, err := gzip.NewReader(io.NewSectionReader(f, off, size-int64(len(trailer))-off))
+	if err != nil {
+		return ix, 0, err
+	}
+	if err := json.NewDecoder(zr).Decode(&ix); err != nil {
+		return ix, 0, err
+	}
+	return ix, off, nil
+}
+
+// blockWriter packs records into compressed blocks.
+type blockWriter struct {
+	w      io.Writer
+	off    int64
+	raw    bytes.Buffer
+	cur    blockIndex
+	blocks []blockIndex
+}
+
+func (bw *blockWriter) add(line []byte) error {
+	var head struct {
+		Timestamp string `json:"timestamp"`
+	}
+	if json.Unmarshal(line, &head) == nil {
+		if ts, err := time.Parse(time.RFC3339Nano, head.Timestamp); err == nil {
+			if bw.cur.Start.IsZero() || ts.Before(bw.cur.Start) {
+				bw.cur.Start = ts
+			}
+			if ts.After(bw.cur.End) {
+				bw.cur.End = ts
+			}
+		}
+	}
+	bw.raw.Write(line)
+	bw.raw.WriteByte('\n')
+	bw.cur.Lines++
+	if bw.raw.Len() >= blockBytes {
+		return bw.flush()
+	}
+	return nil
+}
+
+// flush writes the pending records as one gzip member.
+func (bw *blockWriter) flush() error {
+	if bw.raw.Len() == 0 {
+		return nil
+	}
+	n, err := writeMember(bw.w, bw.raw.Bytes())
+	if err != nil {
+		return err
+	}
+	bw.cur.Off, bw.cur.Len, bw.cur.Raw = bw.off, n, int64(bw.raw.Len())
+	bw.blocks = append(bw.blocks, bw.cur)
+	bw.off += n
+	bw.raw.Reset()
+	bw.cur = blockIndex{}
+	return nil
+}
+
+// writeMember gzips data as one member and returns its compressed size.
+func writeMember(w io.Writer, data []byte) (int64, error) {
+	cw := &countWriter{w: w}
+	zw := gzip.NewWriter(cw)
+	if _, err := zw.Write(data); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// compactSegments compresses the segments that ended more than sealAfter
+// ago and still have uncompressed records.
+func (d *DiskStorage) compactSegments(now time.Time) {
+	for _, kind := range segmentKinds {
+		segs, err := segmentsIn(filepath.Join(d.dir, kind+"_*"), time.Time{}, time.Time{})
+		if err != nil {
+			continue
+		}
+		for _, seg := range segs {
+			if !seg.end.Add(sealAfter).Before(now) || (!seg.plain && len(seg.sealing) == 0) {
+				continue
+			}
+			if err := d.compactSegment(seg); err != nil {
+				fmt.Fprintf(os.Stderr, "storage: compress %s: %v\n", seg.path, err)
+			}
+		}
+	}
+}
+
+// compactSegment appends the segment's uncompressed records to its
+// compressed file as new blocks.
+func (d *DiskStorage) compactSegment(seg segment) error {
+	if seg.plain {
+		sealing := fmt.Sprintf("%s.%d%s", seg.path, time.Now().UnixNano(), sealingSuffix)
+		d.sealMu.Lock()
+		err := d.writers.rename(seg.path, sealing)
+		d.sealMu.Unlock()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			seg.sealing = append(seg.sealing, sealing)
+		}
+	}
+
+	gzPath := seg.path + compressedSuffix
+	var (
+		old     segmentIndex
+		oldData io.Reader = bytes.NewReader(nil)
+		oldEnd  int64
+	)
+	if f, err := os.Open(gzPath); err == nil {
+		defer f.Close()
+		if old, oldEnd, err = readIndex(f); err != nil {
+			return fmt.Errorf("%s: %w", gzPath, err)
+		}
+		oldData = io.NewSectionReader(f, 0, oldEnd)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var pending, sealed []string
+	for _, fn := range seg.sealing {
+		if !old.includes(fn) {
+			pending = append(pending, fn)
+		}
+		sealed = append(sealed, filepath.Base(fn))
+	}
+	if len(pending) == 0 {
+		removeFiles(seg.sealing) // left behind by an interrupted compaction
+		return nil
+	}
+
+	tmp := gzPath + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+	bufOut := bufio.NewWriterSize(out, 256*1024)
+	if _, err := io.Copy(bufOut, oldData); err != nil {
+		out.Close()
+		return err
+	}
+	bw := &blockWriter{w: bufOut, off: oldEnd}
+	for _, fn := range pending {
+		if err := forEachLine(fn, bw.add); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := bw.flush(); err != nil {
+		out.Close()
+		return err
+	}
+
+	tail, err := finishCompressed(out, bufOut, bw.off, segmentIndex{Blocks: append(old.Blocks, bw.blocks...), Sealed: sealed})
+	if err != nil {
+		return err
+	}
+
+	d.sealMu.Lock()
+	err = os.Rename(tmp, gzPath)
+	if err == nil {
+		removeFiles(seg.sealing)
+	}
+	d.sealMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var raw, packed int64
+	for _, b := range bw.blocks {
+		raw += b.Raw
+		packed += b.Len
+	}
+	if strings.HasPrefix(seg.stream, "logs_") {
+		d.releaseIndex(seg.path) // sealed: save the index and free its memory
+	}
+	d.compression.segments.Add(1)
+	d.compression.in.Add(uint64(raw))
+	d.compression.out.Add(uint64(packed + tail))
+	return nil
+}
+
+// finishCompressed writes the index and trailer of a compressed segment
+// after its blocks, which end at blocksEnd, then syncs and closes the
+// file. It returns the bytes written after the blocks.
+func finishCompressed(out *os.File, bufOut *bufio.Writer, blocksEnd int64, ix segmentIndex) (int64, error) {
+	data, err := json.Marshal(ix)
+	if err != nil {
+		out.Close()
+		return 0, err
+	}
+	n, err := writeMember(bufOut, data)
+	if err != nil {
+		out.Close()
+		return 0, err
+	}
+	trailer := binary.BigEndian.AppendUint64(nil, uint64(blocksEnd))
+	trailer = append(trailer, indexMagic...)
+	if _, err := bufOut.Write(trailer); err != nil {
+		out.Close()
+		return 0, err
+	}
+	if err := bufOut.Flush(); err != nil {
+		out.Close()
+		return 0, err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return 0, err
+	}
+	return n + int64(len(trailer)), out.Close()
+}
+
+// filterCompressed writes the records of a compressed segment that keep
+// accepts to a temporary file next to it, in new blocks, and returns its
+// path.
+func filterCompressed(gzPath string, keep func(raw []byte) bool) (string, error) {
+	f, err := os.Open(gzPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	ix, _, err := readIndex(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", gzPath, err)
+	}
+	tmp := gzPath + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	bufOut := bufio.NewWriterSize(out, 256*1024)
+	bw := &blockWriter{w: bufOut}
+	add := func(line []byte) error {
+		if !keep(line) {
+			return nil
+		}
+		return bw.add(line)
+	}
+	for _, b := range ix.Blocks {
+		zr, err := blockOpener(f, b)()
+		if err == nil {
+			err = eachLine(zr, add)
+		}
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+	err = bw.flush()
+	if err != nil {
+		out.Close()
+	} else {
+		_, err = finishCompressed(out, bufOut, bw.off, segmentIndex{Blocks: bw.blocks, Sealed: ix.Sealed})
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+func removeFiles(paths []string) {
+	for _, fn := range paths {
+		os.Remove(fn)
+	}
+}
+
+// forEachLine calls fn with every non-empty line of a file.
+func forEachLine(fn string, each func([]byte) error) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return eachLine(f, each)
+}
+
+// eachLine calls each with every non-empty line read from r.
+func eachLine(r io.Reader, each func([]byte) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		if err := each(sc.Bytes()); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// openSegment returns the records of a segment that may fall in
+// [start, end]: its compressed blocks overlapping the range, then sealing
+// files not compressed yet, then the plain file. Callers hold d.sealMu for
+// reading so compaction does not move records while they are read.
+func (d *DiskStorage) openSegment(seg segment, start, end time.Time) (io.ReadCloser, error) {
+	r := &segmentReader{}
+	var ix segmentIndex
+	if seg.compressed {
+		f, err := os.Open(seg.path + compressedSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			r.closers = append(r.closers, f)
+			if ix, _, err = readIndex(f); err != nil {
+				r.Close()
+				return nil, fmt.Errorf("%s: %w", f.Name(), err)
+			}
+			for _, b := range ix.Blocks {
+				if (!start.IsZero() && b.End.Before(start)) || (!end.IsZero() && b.Start.After(end)) {
+					continue
+				}
+				r.parts = append(r.parts, blockOpener(f, b))
+			}
+		}
+	}
+	for _, fn := range seg.sealing {
+		if !ix.includes(fn) {
+			r.parts = append(r.parts, r.fileOpener(fn))
+		}
+	}
+	if seg.plain {
+		r.parts = append(r.parts, r.fileOpener(seg.path))
+	}
+	return r, nil
+}
+
+func blockOpener(f *os.File, b blockIndex) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		zr, err := gzip.NewReader(io.NewSectionReader(f, b.Off, b.Len))
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+		return zr, nil
+	}
+}
+
+func (r *segmentReader) fileOpener(fn string) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		f, err := os.Open(fn)
+		if os.IsNotExist(err) {
+			return bytes.NewReader(nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.closers = append(r.closers, f)
+		return f, nil
+	}
+}
+
+// segmentReader reads the parts of a segment one after another, opening
+// each on first use.
+type segmentReader struct {
+	parts   []func() (io.Reader, error)
+	cur     io.Reader
+	closers []io.Closer
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			next, err := r.parts[0]()
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.parts = next, r.parts[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *segmentReader) Close() error {
+	for _, c := range r.closers {
+		c.Close()
+	}
+	return nil
+}
+
+// segmentLastLine returns the final record of a segment.
+func (d *DiskStorage) segmentLastLine(seg segment) ([]byte, error) {
+	if seg.plain {
+		if line, err := lastLine(seg.path); err == nil {
+			return line, nil
+		}
+	}
+	for i := len(seg.sealing) - 1; i >= 0; i-- {
+		if line, err := lastLine(seg.sealing[i]); err == nil {
+			return line, nil
+		}
+	}
+	if !seg.compressed {
+		return nil, io.EOF
+	}
+	f, err := os.Open(seg.path + compressedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ix, _, err := readIndex(f)
+	if err != nil || len(ix.Blocks) == 0 {
+		return nil, io.EOF
+	}
+	zr, err := blockOpener(f, ix.Blocks[len(ix.Blocks)-1])()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\n")
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+	return data, nil
+}
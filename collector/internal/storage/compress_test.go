@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// A compacted segment reads back the same records, is indexed by block,
+// stays readable with plain gunzip, and takes records that arrive after it
+// was sealed as a new block.
+func TestCompressedSegmentRoundTrip(t *testing.T) {
+	cfg := testStorageConfig("disk", t.TempDir())
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now().UTC().Add(-3 * time.Hour).Truncate(time.Hour)
+	var want []string
+	for i := range 5 {
+		line := "line " + string(rune('a'+i))
+		d.StoreLog("web", "h1", nil, t0.Add(time.Duration(i)*time.Minute), "[api] "+line)
+		want = append(want, line)
+	}
+	d.StoreMetrics("web", "h1", nil, t0, gaugeFamily("pm2_up", 1))
+	d.Close()
+
+	// reopening compresses the sealed segments in the background
+	reopen := func() {
+		t.Helper()
+		if d, err = New(cfg); err != nil {
+			t.Fatal(err)
+		}
+		compressed := func(stream string) bool {
+			segs := listSegments(filepath.Join(d.dir, stream))
+			return len(segs) == 1 && segs[0].compressed && !segs[0].plain && len(segs[0].sealing) == 0
+		}
+		for deadline := time.Now().Add(5 * time.Second); !compressed(streamName("logs", "web", "h1", "api")) || !compressed(streamName("metrics", "web", "h1")); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("segments not compressed after reopening")
+			}
+		}
+	}
+	reopen()
+	defer func() { d.Close() }()
+	seg := filepath.Join(d.dir, streamName("logs", "web", "h1", "api"), segmentName(t0, time.Hour))
+	f, err := os.Open(seg + compressedSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ix, _, err := readIndex(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ix.Blocks) != 1 || ix.Blocks[0].Lines != 5 || !ix.Blocks[0].Start.Equal(t0) || !ix.Blocks[0].End.Equal(t0.Add(4*time.Minute)) {
+		t.Fatalf("index: %+v", ix)
+	}
+
+	// gunzip sees the records, then the index
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := bufio.NewScanner(zr)
+	lines := 0
+	for sc.Scan() {
+		lines++
+	}
+	if lines != 6 {
+		t.Fatalf("gunzip lines: got %d, want 5 records and the index", lines)
+	}
+
+	logs := func(q LogQuery) []string {
+		t.Helper()
+		q.Job, q.Forward = "web", true
+		page, err := d.QueryLogs(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return logLines(page.Lines)
+	}
+	if got := logs(LogQuery{}); !slices.Equal(got, want) {
+		t.Fatalf("compressed lines: got %v, want %v", got, want)
+	}
+	if recs, err := d.QueryMetrics(MetricQuery{Selector: Selector{Job: "web"}}); err != nil || len(recs) != 1 {
+		t.Fatalf("compressed metrics: %d, %v", len(recs), err)
+	}
+
+	d.StoreLog("web", "h1", nil, t0.Add(50*time.Minute), "[api] late")
+	d.Close()
+	reopen()
+	f2, err := os.Open(seg + compressedSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	if ix, _, err = readIndex(f2); err != nil || len(ix.Blocks) != 2 || ix.Blocks[1].Lines != 1 {
+		t.Fatalf("index after the late record: %+v, %v", ix, err)
+	}
+	if got := logs(LogQuery{Selector: Selector{Start: t0.Add(45 * time.Minute)}}); !slices.Equal(got, []string{"late"}) {
+		t.Fatalf("lines of the late block: %v", got)
+	}
+	if got := logs(LogQuery{}); !slices.Equal(got, append(want, "late")) {
+		t.Fatalf("lines after the late record: %v", got)
+	}
+}
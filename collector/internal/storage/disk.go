@@ -14,49 +14,84 @@ import (
 	"sync"
 	"time"
 
+	"github.com/aalish/pm2-full/internal/config"
 	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/labels"
 	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 )
 
-// QueryParams defines common parameters for all queries.
-// App is the optional application name for logs.
-type QueryParams struct {
+// Selector picks the records a query reads: those of the job, target and
+// app, empty for all, within [Start, End], open where zero, whose target
+// labels match all of Matchers. The query types of each kind of record
+// embed it; see MetricQuery, ProcessQuery, EventQuery, LogQuery and
+// SearchQuery.
+type Selector struct {
 	Job      string
 	Target   string
-	App      string    // for logs: if empty, will fetch all apps
+	App      string
 	Start    time.Time // inclusive
 	End      time.Time // inclusive
-	NumLines int
+	Matchers []labels.Matcher
 }
+
 type logRecord struct {
-	Timestamp string `json:"timestamp"`
-	App       string `json:"app"`
-	Line      string `json:"line"`
+	Timestamp string            `json:"timestamp"`
+	App       string            `json:"app"`
+	Line      string            `json:"line"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Stream    string            `json:"stream,omitempty"` // exporter spool stream, for acknowledged delivery
+	Seq       uint64            `json:"seq,omitempty"`
 }
 
-// aliases for clarity
-type ProcessQuery = QueryParams
-type LogQuery = QueryParams
-type AppQuery = QueryParams
-type TargetQuery = QueryParams
-type JobQuery = QueryParams
-
 // Store is the read/query interface.
 type Store interface {
-	QueryMetrics(q QueryParams) ([]json.RawMessage, error)
+	QueryMetrics(q MetricQuery) ([]json.RawMessage, error)
+	ScanMetrics(q MetricQuery, fn func(job, target string, rec json.RawMessage) error) error
 	QueryProcesses(q ProcessQuery) ([]json.RawMessage, error)
-	QueryLogs(q LogQuery) ([]logRecord, error)
+	QueryProcessTimeline(q ProcessQuery) ([]ProcessTimeline, error)
+	DiffProcesses(q ProcessQuery) (ProcessDiff, error)
+	QueryEvents(q EventQuery) ([]Event, error)
+	QueryLogs(q LogQuery) (LogPage, error)
+	SearchLogs(q SearchQuery) (LogSearchResult, error)
+	ScanLogs(q SearchQuery, fn func(l LogLine) error) error
+	PreviewRetention() RetentionReport
 	QueryApps(q AppQuery) ([]json.RawMessage, error)
-	ListAllTargets() ([]json.RawMessage, error)
+	ListAllTargets(q TargetQuery) ([]json.RawMessage, error)
 	ListJobsByTarget(q JobQuery) ([]json.RawMessage, error)
+	Catalog(q CatalogQuery) []CatalogEntry
 }
 
 // DiskStorage implements both the discovery.Store (write) and storage.Store (read).
+// Records are appended through per-file writers (see writer.go); mu guards
+// the process-change state and offMu the log delivery offsets.
 type DiskStorage struct {
-	dir           string
-	retentionDays int
-	mu            sync.Mutex
+	dir            string
+	retentionDays  int
+	segLength      time.Duration // period covered by one log or metric segment
+	maxBytes       int64
+	maxTargetBytes int64
+	compress       bool          // compress sealed segments
+	rollups        []rollupLevel // metric rollup resolutions, finest first; nil when disabled
+	late           lateScrapes
+	rules          []retentionRule
+	retention      retentionState
+	sealMu         sync.RWMutex // held for writing while compaction moves records between files
+	compression    compressStats
+	indexMu        sync.Mutex
+	indexes        map[string]*logIndex // log segment -> its search index, while in use
+	writers        *writerPool
+	catalog        *catalog            // the streams stored, see catalog.go
+	legacyStreams  map[string][]string // legacy stream name -> its job, target and app, as configured
+	stop           chan struct{}       // closed by Close to end the flusher and retention
+	done           sync.WaitGroup
+	mu             sync.Mutex
+	procLast       map[string][]ProcessState // processes file -> states of newest snapshot
+	events         eventDetector
+	offMu          sync.Mutex
+	logOffsets     map[string]map[string]streamOffset // job/target -> stream -> newest stored line
+	reconciled     map[string]bool                    // job/target offsets checked against the log files
 }
 
 // compile‐time assertions
@@ -65,100 +100,138 @@ var (
 	_ Store           = (*DiskStorage)(nil)
 )
 
-// New prepares the root directory and spins up retention cleanup.
-func New(dir string, retentionDays int) (*DiskStorage, error) {
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return nil, err
-	}
-	ds := &DiskStorage{dir: dir, retentionDays: retentionDays}
-	go ds.startRetention()
-	return ds, nil
+// Backend is a storage backend as the collector uses it.
+type Backend interface {
+	Store
+	discovery.Store
+	prometheus.Collector
+	Snapshotter
+	Close() error
 }
 
-// --- target and jobs query implementation ---
-
-// queryTarget returns all unique <target> values (as JSON) from filenames matching
-// “logs_<job>_<target>_<app>.jsonl” in d.dir.
-func (d *DiskStorage) queryTarget() ([]json.RawMessage, error) {
-	// Pattern: logs_<job>_<target>_<app>.jsonl  (one “*” for job, one for target, one for app)
-	pattern := filepath.Join(d.dir, "logs_*_*_*.jsonl")
-	matches, err := filepath.Glob(pattern)
-	if err != nil {
-		return nil, err
-	}
-
-	seen := make(map[string]struct{})
-	for _, fn := range matches {
-		base := filepath.Base(fn) // e.g. "logs_myJob_myTarget_my_app_name.jsonl"
-		core := strings.TrimSuffix(strings.TrimPrefix(base, "logs_"), ".jsonl")
-		// Now core == "myJob_myTarget_my_app_name"
-		parts := strings.SplitN(core, "_", 3)
-		// Expect exactly three parts: [job, target, appRest]
-		if len(parts) < 3 {
-			continue
+// Open opens the backend cfg.Type selects: disk (the default) or sqlite.
+func Open(cfg config.StorageConfig) (Backend, error) {
+	switch cfg.Type {
+	case "", "disk":
+		ds, err := New(cfg)
+		if err != nil {
+			return nil, err
 		}
-		target := parts[1]
-		seen[target] = struct{}{}
-	}
-
-	var result []json.RawMessage
-	for t := range seen {
-		b, err := json.Marshal(t)
+		return ds, nil
+	case "sqlite":
+		s, err := NewSQLite(cfg)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		result = append(result, json.RawMessage(b))
+		return s, nil
 	}
-	return result, nil
+	return nil, fmt.Errorf("storage: unknown type %q (want disk or sqlite)", cfg.Type)
 }
 
-// queryJobByTarget returns all unique <job> values (as JSON) for files matching
-// “logs_<job>_<target>_<app>.jsonl” in d.dir. It takes a target string to filter.
-// Even if <app> contains underscores, SplitN(..., "_", 3) ensures correct job/target/appRest.
-func (d *DiskStorage) queryJobByTarget(target string) ([]json.RawMessage, error) {
-	// Pattern: logs_*_<target>_*.jsonl
-	pattern := filepath.Join(d.dir, "logs_*_"+target+"_*.jsonl")
-	matches, err := filepath.Glob(pattern)
+// New prepares the root directory, moves log and metric files from before
+// segmenting into segments, repairs files torn by a crash and spins up the
+// background flusher and retention cleanup.
+func New(cfg config.StorageConfig) (*DiskStorage, error) {
+	dir := cfg.Directory
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	segLength := cfg.SegmentDuration
+	if segLength <= 0 {
+		segLength = time.Hour
+	}
+	if segLength < time.Minute || (24*time.Hour)%segLength != 0 {
+		return nil, fmt.Errorf("storage: segment_duration %s must be at least 1m and divide 24h", segLength)
+	}
+	switch cfg.Compression {
+	case "", "gzip", "none":
+	default:
+		return nil, fmt.Errorf("storage: unknown compression %q (want gzip or none)", cfg.Compression)
+	}
+	rules, err := compileRetentionRules(cfg.Retention)
 	if err != nil {
 		return nil, err
 	}
-
-	seen := make(map[string]struct{})
-	for _, fn := range matches {
-		base := filepath.Base(fn) // e.g. "logs_myJob_myTarget_my_app_name.jsonl"
-		core := strings.TrimSuffix(strings.TrimPrefix(base, "logs_"), ".jsonl")
-		// Now core == "myJob_myTarget_my_app_name"
-		parts := strings.SplitN(core, "_", 3)
-		// Expect exactly three parts: [job, target, appRest]
-		if len(parts) < 3 {
-			continue
-		}
-		// parts[1] is guaranteed to equal the passed-in target (due to the glob),
-		// so we only need to extract parts[0] as the job name.
-		job := parts[0]
-		seen[job] = struct{}{}
+	ds := &DiskStorage{dir: dir, retentionDays: cfg.RetentionDays, segLength: segLength, maxBytes: cfg.MaxBytes, maxTargetBytes: cfg.MaxTargetBytes, compress: cfg.Compression != "none", rollups: newRollupLevels(cfg.Rollups), rules: rules, retention: retentionState{splits: make(map[string]lineSplit)}, indexes: make(map[string]*logIndex), procLast: make(map[string][]ProcessState), events: newEventDetector(), reconciled: make(map[string]bool), stop: make(chan struct{})}
+	if ds.legacyStreams, err = legacyStreamNames(cfg.LegacyStreams); err != nil {
+		return nil, err
 	}
-
-	var result []json.RawMessage
-	for j := range seen {
-		b, err := json.Marshal(j)
-		if err != nil {
-			continue
-		}
-		result = append(result, json.RawMessage(b))
+	ds.writers = newWriterPool(cfg.FlushInterval, cfg.FsyncInterval, cfg.MaxOpenFiles)
+	if err := ds.writers.recoverTornTails(dir); err != nil {
+		return nil, err
+	}
+	if err := ds.loadLogOffsets(); err != nil {
+		return nil, err
 	}
-	return result, nil
+	if err := ds.migrateFlatFiles(); err != nil {
+		return nil, err
+	}
+	if err := ds.openCatalog(); err != nil {
+		return nil, err
+	}
+	restarts, err := recentRestarts(ds)
+	if err != nil {
+		return nil, err
+	}
+	ds.events.seed(restarts)
+	ds.done.Add(2)
+	go func() {
+		defer ds.done.Done()
+		ds.writers.run(ds.stop)
+	}()
+	go ds.startRetention()
+	return ds, nil
+}
+
+// Close stops the background work, writes and syncs all buffered records
+// and saves the search indexes.
+func (d *DiskStorage) Close() error {
+	close(d.stop)
+	d.done.Wait()
+	err := d.writers.Close()
+	d.releaseIdleIndexes(true)
+	return err
+}
+
+// --- target and jobs query implementation ---
+
+// queryTarget returns all unique targets (as JSON) of the cataloged streams
+// whose latest labels match ms, whether they hold logs, metrics or processes.
+func (d *DiskStorage) queryTarget(ms []labels.Matcher) ([]json.RawMessage, error) {
+	return catalogTargets(d.Catalog(CatalogQuery{Matchers: ms})), nil
+}
+
+// queryJobByTarget returns all unique jobs (as JSON) of the cataloged
+// streams of target whose latest labels match ms.
+func (d *DiskStorage) queryJobByTarget(target string, ms []labels.Matcher) ([]json.RawMessage, error) {
+	return catalogJobs(d.Catalog(CatalogQuery{Target: target, Matchers: ms})), nil
 }
 
 // --- discovery.Store implementation ---
 
-// StoreMetrics base64‐encodes each MetricFamily proto and appends to metrics_<job>_<target>.jsonl
-func (d *DiskStorage) StoreMetrics(job, target string, mfs map[string]*dto.MetricFamily) {
+// StoreMetrics base64‐encodes each MetricFamily proto and appends to the
+// metrics_<job>_<target> segment covering ts
+func (d *DiskStorage) StoreMetrics(job, target string, ls map[string]string, ts time.Time, mfs map[string]*dto.MetricFamily) {
+	line, err := encodeMetrics(ts, ls, mfs)
+	if err != nil {
+		return
+	}
+	stream := streamName("metrics", job, target)
+	d.writers.append(d.segmentPath(stream, ts), line)
+	d.noteStream(stream, ls)
+	d.late.note(d.rollups, job, target, ts, time.Now())
+}
+
+// encodeMetrics returns the stored record of one scrape, each MetricFamily
+// as a base64-encoded proto.
+func encodeMetrics(ts time.Time, ls map[string]string, mfs map[string]*dto.MetricFamily) ([]byte, error) {
 	rec := struct {
 		Timestamp string            `json:"timestamp"`
+		Labels    map[string]string `json:"labels,omitempty"`
 		Metrics   map[string]string `json:"metrics"`
 	}{
-		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Timestamp: ts.UTC().Format(time.RFC3339Nano),
+		Labels:    ls,
 		Metrics:   make(map[string]string, len(mfs)),
 	}
 	for name, mf := range mfs {
@@ -168,346 +241,383 @@ func (d *DiskStorage) StoreMetrics(job, target string, mfs map[string]*dto.Metri
 			fmt.Fprintf(os.Stderr, "StoreMetrics: proto.Marshal error for %q: %v\n", name, err)
 		}
 	}
-	d.appendJSONLine("metrics", job, target, rec)
+	return json.Marshal(rec)
 }
 
-// StoreProcesses dumps the raw JSON from /processes into processes_<job>_<target>.jsonl
-func (d *DiskStorage) StoreProcesses(job, target string, data []byte) {
-	rec := struct {
-		Timestamp string          `json:"timestamp"`
-		Data      json.RawMessage `json:"data"`
+// StoreProcesses appends the raw JSON from /processes to processes_<job>_<target>.jsonl,
+// but only when a tracked field (status, pid, restarts, version, env) changed
+// since the previous snapshot. Changes are also recorded as events.
+func (d *DiskStorage) StoreProcesses(job, target string, ls map[string]string, ts time.Time, data []byte) {
+	states, err := parseProcessStates(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "StoreProcesses: parse %s/%s: %v\n", job, target, err)
+		return
+	}
+	fn := filepath.Join(d.dir, streamName("processes", job, target)+".jsonl")
+	now := ts.UTC()
+
+	d.mu.Lock()
+	prev, hadPrev := d.lastStates(fn)
+	if hadPrev && statesEqual(prev, states) {
+		d.mu.Unlock()
+		return
+	}
+	d.procLast[fn] = states
+	var events []Event
+	if hadPrev {
+		events = d.events.detect(job, target, ls, prev, states, now)
+	}
+	d.mu.Unlock()
+
+	d.appendJSONLine("processes", job, target, ls, processRecord(now, ls, data), processEntries(filepath.Base(fn), states, ls)...)
+	for _, ev := range events {
+		d.appendJSONLine("events", job, target, ls, ev)
+	}
+}
+
+// processRecord is the stored record of one /processes snapshot.
+func processRecord(ts time.Time, ls map[string]string, data []byte) interface{} {
+	return struct {
+		Timestamp string            `json:"timestamp"`
+		Labels    map[string]string `json:"labels,omitempty"`
+		Data      json.RawMessage   `json:"data"`
 	}{
-		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Timestamp: ts.UTC().Format(time.RFC3339Nano),
+		Labels:    ls,
 		Data:      json.RawMessage(data),
 	}
-	d.overwriteJSONLine("processes", job, target, rec)
 }
 
-// StoreLog strips "[app]" prefix, records app name, and appends to logs_<job>_<target>_<app>.jsonl
-func (d *DiskStorage) StoreLog(job, target, line string) {
-	app := ""
-	msg := line
+// SplitAppPrefix splits an exporter log line "[app] message" into its parts.
+// Lines without a prefix are returned with an empty app.
+func SplitAppPrefix(line string) (app, msg string) {
+	msg = line
 	if strings.HasPrefix(line, "[") {
 		if idx := strings.Index(line, "]"); idx > 0 {
 			app = line[1:idx]
 			msg = strings.TrimSpace(line[idx+1:])
 		}
 	}
-	rec := struct {
-		Timestamp string `json:"timestamp"`
-		App       string `json:"app"`
-		Line      string `json:"line"`
-	}{
-		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	return app, msg
+}
+
+// StoreLog strips "[app]" prefix, records app name, and appends to the
+// logs_<job>_<target>_<app> segment covering ts
+func (d *DiskStorage) StoreLog(job, target string, ls map[string]string, ts time.Time, line string) {
+	app, msg := SplitAppPrefix(line)
+	rec := logRecord{
+		Timestamp: ts.UTC().Format(time.RFC3339Nano),
 		App:       app,
 		Line:      msg,
+		Labels:    ls,
 	}
-	d.appendLogLine(job, target, app, rec)
+	d.appendLogLine(job, target, app, ts, rec)
 }
 
-// helper for metrics & processes
-func (d *DiskStorage) appendJSONLine(kind, job, target string, v interface{}) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	fn := filepath.Join(d.dir, fmt.Sprintf("%s_%s_%s.jsonl", kind, job, target))
-	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "appendJSONLine: open %s: %v\n", fn, err)
-		return
-	}
-	defer f.Close()
+// logStream names the stream directory of one app's logs.
+func logStream(job, target, app string) string {
+	return streamName("logs", job, target, app)
+}
 
+// helper for processes & events; more are catalog entries besides the file's
+func (d *DiskStorage) appendJSONLine(kind, job, target string, ls map[string]string, v interface{}, more ...CatalogEntry) {
 	line, err := json.Marshal(v)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "appendJSONLine: marshal: %v\n", err)
 		return
 	}
-	f.Write(line)
-	f.Write([]byte("\n"))
+	file := streamName(kind, job, target) + ".jsonl"
+	d.writers.append(filepath.Join(d.dir, file), line)
+	d.noteStream(file, ls, more...)
 }
 
-// helper for metrics & processes (overwrite mode)
-func (d *DiskStorage) overwriteJSONLine(kind, job, target string, v interface{}) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	fn := filepath.Join(d.dir, fmt.Sprintf("%s_%s_%s.jsonl", kind, job, target))
-	// Use O_TRUNC instead of O_APPEND to clear the file on open
-	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
-	if err != nil {
-		// fmt.Fprintf(os.Stderr, "overwriteJSONLine: open %s: %v\n", fn, err)
-		return
-	}
-	defer f.Close()
-
-	line, err := json.Marshal(v)
+// specialized helper for logs (includes app in the stream name); the line
+// is indexed for search once the writer has kept it
+func (d *DiskStorage) appendLogLine(job, target, app string, ts time.Time, rec logRecord) {
+	line, err := json.Marshal(rec)
 	if err != nil {
-		// fmt.Fprintf(os.Stderr, "overwriteJSONLine: marshal: %v\n", err)
-		return
-	}
-	if _, err := f.Write(line); err != nil {
-		// fmt.Fprintf(os.Stderr, "overwriteJSONLine: write: %v\n", err)
 		return
 	}
-	if _, err := f.Write([]byte("\n")); err != nil {
-		// fmt.Fprintf(os.Stderr, "overwriteJSONLine: write newline: %v\n", err)
+	stream := logStream(job, target, app)
+	path := d.segmentPath(stream, ts)
+	ix := d.lockIndex(path)
+	if d.writers.append(path, line) {
+		ix.add(rec.Line)
 	}
+	ix.mu.Unlock()
+	d.noteStream(stream, rec.Labels)
 }
 
-// specialized helper for logs (includes app in filename)
-func (d *DiskStorage) appendLogLine(job, target, app string, v interface{}) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// --- storage.Store implementation ---
 
-	fn := filepath.Join(d.dir, fmt.Sprintf("logs_%s_%s_%s.jsonl", job, target, app))
-	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+// QueryMetrics returns the raw scrapes, or the rollups picked by
+// metricsKind, of the matching job and target within [q.Start, q.End].
+func (d *DiskStorage) QueryMetrics(q MetricQuery) ([]json.RawMessage, error) {
+	results := []json.RawMessage{}
+	err := d.ScanMetrics(q, func(_, _ string, rec json.RawMessage) error {
+		results = append(results, rec)
+		return nil
+	})
 	if err != nil {
-		// fmt.Fprintf(os.Stderr, "appendLogLine: open %s: %v\n", fn, err)
-		return
+		return nil, err
 	}
-	defer f.Close()
+	return results, nil
+}
 
-	line, err := json.Marshal(v)
+// ScanMetrics calls fn with each record QueryMetrics would return, in the
+// same order, and the job and target it was stored for. It stops at the
+// first error fn returns.
+func (d *DiskStorage) ScanMetrics(q MetricQuery, fn func(job, target string, rec json.RawMessage) error) error {
+	kind, err := d.metricsKind(q, time.Now())
 	if err != nil {
-		// fmt.Fprintf(os.Stderr, "appendLogLine: marshal: %v\n", err)
-		return
+		return err
 	}
-	f.Write(line)
-	f.Write([]byte("\n"))
+	return d.scanJSONLines(kind, q.Job, q.Target, q.Start, q.End, q.Matchers, fn)
 }
-
-// --- storage.Store implementation ---
-
-func (d *DiskStorage) QueryMetrics(q QueryParams) ([]json.RawMessage, error) {
-	return d.queryJSONLines("metrics", q.Job, q.Target, q.Start, q.End)
-}
-func (d *DiskStorage) QueryApps(q QueryParams) ([]json.RawMessage, error) {
-	return d.queryAppLines("processes", q.Job, q.Target, q.Start, q.End)
+func (d *DiskStorage) QueryApps(q AppQuery) ([]json.RawMessage, error) {
+	return d.queryProcessApps(q)
 }
 func (d *DiskStorage) QueryProcesses(q ProcessQuery) ([]json.RawMessage, error) {
-	return d.queryJSONLines("processes", q.Job, q.Target, q.Start, q.End)
+	snaps, err := d.queryProcessSnapshots(q)
+	if err != nil {
+		return nil, err
+	}
+	return rawSnapshots(appSnapshots(snaps, q.App)), nil
 }
 
-func (d *DiskStorage) ListAllTargets() ([]json.RawMessage, error) {
-	return d.queryTarget()
+func (d *DiskStorage) ListAllTargets(q TargetQuery) ([]json.RawMessage, error) {
+	return d.queryTarget(q.Matchers)
 }
 
 func (d *DiskStorage) ListJobsByTarget(q JobQuery) ([]json.RawMessage, error) {
-	return d.queryJobByTarget(q.Target)
+	return d.queryJobByTarget(q.Target, q.Matchers)
 }
 
-func (d *DiskStorage) QueryLogs(q LogQuery) ([]logRecord, error) {
-	var records []logRecord
-
-	// Determine file‐matching pattern
-	var pattern string
-	if q.App == "" {
-		pattern = fmt.Sprintf("logs_%s_%s_*.jsonl", q.Job, q.Target)
-	} else {
-		pattern = fmt.Sprintf("logs_%s_%s_%s.jsonl", q.Job, q.Target, q.App)
-	}
-
-	// 1) Glob for matching files
-	matches, err := filepath.Glob(filepath.Join(d.dir, pattern))
+// shared JSON-lines reader for metrics. Empty job or target match every
+// stream; lines from several streams are merged in timestamp order. Only
+// segments overlapping [start, end] are read, one period at a time, so
+// memory is bounded by the records of one period whatever the range.
+func (d *DiskStorage) scanJSONLines(kind, job, target string, start, end time.Time, ms []labels.Matcher, fn func(job, target string, line json.RawMessage) error) error {
+	d.writers.flush() // make buffered records visible
+	pattern := filepath.Join(d.dir, fmt.Sprintf("%s_%s_%s", kind, globPart(job), globPart(target)))
+	d.sealMu.RLock()
+	segs, err := segmentsIn(pattern, start, end)
+	d.sealMu.RUnlock()
 	if err != nil {
-		return nil, err
-	}
-	if len(matches) == 0 {
-		return []logRecord{}, nil
+		return err
+	}
+	sort.SliceStable(segs, func(i, j int) bool { return segs[i].start.Before(segs[j].start) })
+	for len(segs) > 0 {
+		from := segs[0].start
+		n, until := nextPeriod(segs)
+		segs = segs[n:]
+		lo, hi := from, until.Add(-time.Nanosecond)
+		if start.After(lo) {
+			lo = start
+		}
+		if !end.IsZero() && end.Before(hi) {
+			hi = end
+		}
+		found, err := d.readPeriod(pattern, lo, hi, ms)
+		if err != nil {
+			return err
+		}
+		for _, tl := range found {
+			if err := fn(tl.job, tl.target, tl.line); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	// 2) Sort file names lexicographically so "oldest" come first
-	sort.Strings(matches)
+// timedLine is one record read from a stream.
+type timedLine struct {
+	ts          time.Time
+	job, target string
+	line        json.RawMessage
+}
 
-	// If NumLines <= 0, return empty slice (or you can choose to return all lines)
-	N := q.NumLines
-	if N <= 0 {
-		return []logRecord{}, nil
+// readPeriod returns the matching lines within [lo, hi] of the streams of
+// pattern, sorted by timestamp. Segments are listed again under sealMu,
+// as compaction may have moved their records since the caller listed them.
+func (d *DiskStorage) readPeriod(pattern string, lo, hi time.Time, ms []labels.Matcher) ([]timedLine, error) {
+	d.sealMu.RLock()
+	defer d.sealMu.RUnlock()
+	segs, err := segmentsIn(pattern, lo, hi)
+	if err != nil {
+		return nil, err
 	}
-
-	// 3) Create a circular buffer to hold the last N raw JSON lines
-	buffer := make([][]byte, N)
-	startIdx := 0
-	count := 0
-
-	// 4) Iterate each file in order, streaming line by line
-	for _, fn := range matches {
-		f, err := os.Open(fn)
+	var found []timedLine
+	for _, seg := range segs {
+		_, job, target, _ := parseStream(seg.stream)
+		f, err := d.openSegment(seg, lo, hi)
 		if err != nil {
-			// skip if file doesn’t exist; but abort on other errors
-			if os.IsNotExist(err) {
-				continue
-			}
 			return nil, err
 		}
-
 		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
 		for scanner.Scan() {
-			raw := append([]byte(nil), scanner.Bytes()...) // copy bytes
-
-			if count < N {
-				buffer[count] = raw
-				count++
-			} else {
-				// overwrite the oldest slot
-				buffer[startIdx] = raw
-				startIdx = (startIdx + 1) % N
+			line := scanner.Bytes()
+			var head struct {
+				Timestamp string            `json:"timestamp"`
+				Labels    map[string]string `json:"labels"`
+			}
+			if err := json.Unmarshal(line, &head); err != nil {
+				continue
+			}
+			ts, err := time.Parse(time.RFC3339Nano, head.Timestamp)
+			if err != nil {
+				continue
+			}
+			if !labels.MatchAll(ms, head.Labels) {
+				continue
+			}
+			if !ts.Before(lo) && !ts.After(hi) {
+				found = append(found, timedLine{ts, job, target, append([]byte(nil), line...)})
 			}
 		}
 		f.Close()
-		if err := scanner.Err(); err != nil {
+		if err := scanner.Err(); err != nil && err != io.EOF {
 			return nil, err
 		}
 	}
+	if len(segs) > 1 {
+		sort.SliceStable(found, func(i, j int) bool { return found[i].ts.Before(found[j].ts) })
+	}
+	return found, nil
+}
 
-	// 5) Now “count” holds how many total lines we saw (capped at N), and
-	//    startIdx points at where the oldest buffered line sits.
-	//    We need to read them in chronological order:
-	for i := 0; i < count; i++ {
-		idx := (startIdx + i) % N
-		raw := buffer[idx]
-
-		// Parse the JSONL line into an intermediate struct
-		var recJSON struct {
-			Timestamp string `json:"timestamp"`
-			App       string `json:"app"`
-			Line      string `json:"line"`
-		}
-		if err := json.Unmarshal(raw, &recJSON); err != nil {
-			// skip any invalid JSON
-			continue
-		}
+// --- labels ---
 
-		records = append(records, logRecord{
-			Timestamp: recJSON.Timestamp,
-			App:       recJSON.App,
-			Line:      recJSON.Line,
-		})
+// globPart turns an empty job, target or app into a wildcard, and escapes
+// any other.
+func globPart(s string) string {
+	if s == "" {
+		return "*"
 	}
-
-	return records, nil
+	return escapeName(s)
 }
 
-// shared JSON-lines reader for metrics & processes, returns only names
-func (d *DiskStorage) queryAppLines(kind, job, target string, start, end time.Time) ([]json.RawMessage, error) {
-	fn := filepath.Join(d.dir, fmt.Sprintf("%s_%s_%s.jsonl", kind, job, target))
-	// fmt.Println(fn)
-	f, err := os.Open(fn)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, err
+// recordLabels returns the target labels stored with one JSONL record.
+func recordLabels(line []byte) map[string]string {
+	var head struct {
+		Labels map[string]string `json:"labels"`
 	}
-	defer f.Close()
-
-	var results []json.RawMessage
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Bytes()
+	json.Unmarshal(line, &head)
+	return head.Labels
+}
 
-		// 1) peek at the timestamp
-		var head struct {
-			Timestamp string `json:"timestamp"`
-		}
-		if err := json.Unmarshal(line, &head); err != nil {
-			continue
-		}
-		ts, err := time.Parse(time.RFC3339Nano, head.Timestamp)
-		if err != nil {
-			continue
-		}
-		if (start.IsZero() || !ts.Before(start)) && (end.IsZero() || !ts.After(end)) {
-			// 2) now extract just the .data[].name fields
-			var payload struct {
-				Data []struct {
-					Name string `json:"name"`
-				} `json:"data"`
-			}
-			if err := json.Unmarshal(line, &payload); err != nil {
-				continue
-			}
-			for _, d := range payload.Data {
-				// marshal each name into {"name":"..."}
-				nm, err := json.Marshal(struct {
-					Name string `json:"name"`
-				}{Name: d.Name})
-				if err != nil {
-					continue
-				}
-				results = append(results, json.RawMessage(nm))
-			}
-		}
+// streamMatches reports whether the newest record of a stream directory
+// carries labels matching ms. Streams always match when ms is empty.
+func (d *DiskStorage) streamMatches(dir string, ms []labels.Matcher) bool {
+	if len(ms) == 0 {
+		return true
 	}
-	if err := scanner.Err(); err != nil && err != io.EOF {
-		return nil, err
+	d.sealMu.RLock()
+	defer d.sealMu.RUnlock()
+	seg, ok := newestSegment(dir)
+	if !ok {
+		return false
 	}
-	return results, nil
+	line, err := d.segmentLastLine(seg)
+	if err != nil {
+		return false
+	}
+	return labels.MatchAll(ms, recordLabels(line))
 }
 
-// shared JSON-lines reader for metrics & processes
-func (d *DiskStorage) queryJSONLines(kind, job, target string, start, end time.Time) ([]json.RawMessage, error) {
-	fn := filepath.Join(d.dir, fmt.Sprintf("%s_%s_%s.jsonl", kind, job, target))
+// lastLine returns the final non-empty line of a file, reading backwards in
+// chunks so large streams are not scanned from the start.
+func lastLine(fn string) ([]byte, error) {
 	f, err := os.Open(fn)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
 		return nil, err
 	}
 	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
 
-	var results []json.RawMessage
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		var head struct {
-			Timestamp string `json:"timestamp"`
+	const chunk = 64 * 1024
+	var tail []byte
+	for off := fi.Size(); off > 0; {
+		n := int64(chunk)
+		if off < n {
+			n = off
 		}
-		if err := json.Unmarshal(line, &head); err != nil {
-			continue
+		off -= n
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+			return nil, err
 		}
-		ts, err := time.Parse(time.RFC3339Nano, head.Timestamp)
-		if err != nil {
-			continue
+		tail = append(buf, tail...)
+		trimmed := strings.TrimRight(string(tail), "\n")
+		if i := strings.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return []byte(trimmed[i+1:]), nil
 		}
-		if (start.IsZero() || !ts.Before(start)) && (end.IsZero() || !ts.After(end)) {
-			results = append(results, append([]byte(nil), line...))
+		if off == 0 {
+			return []byte(trimmed), nil
 		}
 	}
-	if err := scanner.Err(); err != nil && err != io.EOF {
-		return nil, err
-	}
-	return results, nil
+	return nil, io.EOF
 }
 
 // --- retention ---
 
+// retentionInterval is how often expired and excess segments are deleted.
+const retentionInterval = time.Minute
+
+// startRetention deletes log and metric segments and compresses sealed
+// ones every retentionInterval, and prunes the process and event files,
+// which are rewritten, once a day, until Close.
 func (d *DiskStorage) startRetention() {
-	t := time.NewTicker(24 * time.Hour)
+	defer d.done.Done()
+	d.rollupMetrics(time.Now())
+	d.enforceSegmentRetention(time.Now())
+	if d.compress {
+		d.compactSegments(time.Now())
+	}
+	t := time.NewTicker(retentionInterval)
 	defer t.Stop()
-	for range t.C {
-		d.pruneOld()
+	lastPrune := time.Now()
+	for {
+		var now time.Time
+		select {
+		case <-d.stop:
+			d.rollupLate(time.Now())
+			return
+		case now = <-t.C:
+		}
+		d.rollupMetrics(now)
+		d.enforceSegmentRetention(now)
+		if d.compress {
+			d.compactSegments(now)
+		}
+		d.releaseIdleIndexes(false)
+		if now.Sub(lastPrune) >= 24*time.Hour {
+			lastPrune = now
+			d.pruneOld()
+		}
 	}
 }
 
+// pruneOld drops process and event records older than the retention period
+// of their file.
 func (d *DiskStorage) pruneOld() {
-	cutoff := time.Now().UTC().Add(-time.Duration(d.retentionDays) * 24 * time.Hour)
-	kinds := []string{"metrics", "processes", "logs"}
-
-	for _, kind := range kinds {
-		pat := fmt.Sprintf("%s_*.jsonl", kind)
-		matches, _ := filepath.Glob(filepath.Join(d.dir, pat))
-		for _, fn := range matches {
-			d.mu.Lock()
-			data, err := os.ReadFile(fn)
-			if err != nil {
-				d.mu.Unlock()
-				continue
-			}
+	now := time.Now().UTC()
+	for _, fn := range d.recordFiles() {
+		cutoff, _, ok := d.recordCutoff(fn, now)
+		if !ok {
+			continue
+		}
+		err := d.writers.rewrite(fn, func(data []byte) []byte {
 			lines := strings.Split(string(data), "\n")
 			var kept []string
+			// process history is change-based: the newest snapshot before the
+			// cutoff is still the state in effect, so it must survive pruning
+			var baseline string
 			for _, l := range lines {
 				if strings.TrimSpace(l) == "" {
 					continue
@@ -524,14 +634,20 @@ func (d *DiskStorage) pruneOld() {
 				}
 				if ts.After(cutoff) {
 					kept = append(kept, l)
+				} else if isProcessFile(fn) {
+					baseline = l
 				}
 			}
-			if len(kept) > 0 {
-				_ = os.WriteFile(fn, []byte(strings.Join(kept, "\n")+"\n"), 0o644)
-			} else {
-				_ = os.Remove(fn)
+			if baseline != "" {
+				kept = append([]string{baseline}, kept...)
+			}
+			if len(kept) == 0 {
+				return nil
 			}
-			d.mu.Unlock()
+			return []byte(strings.Join(kept, "\n") + "\n")
+		})
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "retention: %s: %v\n", fn, err)
 		}
 	}
 }
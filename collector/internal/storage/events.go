@@ -0,0 +1,238 @@
+// internal/storage/events.go
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/labels"
+)
+
+// Event types derived from consecutive process snapshots.
+const (
+	EventRestart      = "restart"
+	EventCrashLoop    = "crash_loop"
+	EventStatusChange = "status_change"
+	EventPIDChange    = "pid_change"
+	EventAppAdded     = "app_added"
+	EventAppRemoved   = "app_removed"
+)
+
+// A process that restarts CrashLoopRestarts times within CrashLoopWindow is
+// reported as crash looping.
+var (
+	CrashLoopRestarts = 3
+	CrashLoopWindow   = 5 * time.Minute
+)
+
+// EventQuery selects events, of Types only if any are given.
+type EventQuery struct {
+	Selector
+	Types    []string
+	NumLines int // only the latest NumLines, all if 0
+}
+
+// Event is a typed change detected between two process snapshots.
+type Event struct {
+	Timestamp string                 `json:"timestamp"`
+	Type      string                 `json:"type"`
+	Job       string                 `json:"job"`
+	Target    string                 `json:"target"`
+	Labels    map[string]string      `json:"labels,omitempty"`
+	App       string                 `json:"app"`
+	PMID      int                    `json:"pm_id"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// eventDetector derives events from consecutive snapshots, remembering the
+// recent restarts of every process to report crash loops.
+type eventDetector struct {
+	restarts map[string][]time.Time // process -> recent restart times
+	looping  map[string]bool        // process -> crash loop already reported
+}
+
+func newEventDetector() eventDetector {
+	return eventDetector{restarts: make(map[string][]time.Time), looping: make(map[string]bool)}
+}
+
+// detect compares the previous and current states of a stream and returns
+// the resulting events. Callers serialize calls.
+func (d *eventDetector) detect(job, target string, ls map[string]string, prev, cur []ProcessState, now time.Time) []Event {
+	ts := now.Format(time.RFC3339Nano)
+	newEvent := func(typ string, p ProcessState, msg string, details map[string]interface{}) Event {
+		return Event{Timestamp: ts, Type: typ, Job: job, Target: target, Labels: ls, App: p.Name, PMID: p.PMID, Message: msg, Details: details}
+	}
+
+	old := make(map[string]ProcessState, len(prev))
+	for _, p := range prev {
+		old[p.key()] = p
+	}
+
+	var events []Event
+	for _, p := range cur {
+		o, ok := old[p.key()]
+		if !ok {
+			events = append(events, newEvent(EventAppAdded, p, fmt.Sprintf("%s appeared with status %s", p.Name, p.Status), nil))
+			continue
+		}
+		delete(old, p.key())
+
+		if p.RestartCount > o.RestartCount {
+			events = append(events, newEvent(EventRestart, p,
+				fmt.Sprintf("%s restarted (%d -> %d)", p.Name, o.RestartCount, p.RestartCount),
+				map[string]interface{}{"from": o.RestartCount, "to": p.RestartCount}))
+			if ev, ok := d.trackRestarts(job, target, p, p.RestartCount-o.RestartCount, now); ok {
+				ev.Timestamp, ev.Labels = ts, ls
+				events = append(events, ev)
+			}
+		}
+		if p.Status != o.Status {
+			events = append(events, newEvent(EventStatusChange, p,
+				fmt.Sprintf("%s changed status %s -> %s", p.Name, o.Status, p.Status),
+				map[string]interface{}{"from": o.Status, "to": p.Status}))
+		}
+		if p.PID != o.PID && p.PID != 0 && o.PID != 0 {
+			events = append(events, newEvent(EventPIDChange, p,
+				fmt.Sprintf("%s pid changed %d -> %d", p.Name, o.PID, p.PID),
+				map[string]interface{}{"from": o.PID, "to": p.PID}))
+		}
+	}
+	for _, p := range prev {
+		if _, gone := old[p.key()]; gone {
+			events = append(events, newEvent(EventAppRemoved, p, fmt.Sprintf("%s was removed", p.Name), nil))
+		}
+	}
+	return events
+}
+
+// seed replays the stored restart events of the last crash loop window, so
+// a loop under way when the collector restarted is still noticed and one
+// already reported is not reported again.
+func (d *eventDetector) seed(events []Event) {
+	for _, ev := range events {
+		if ev.Type != EventRestart {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339Nano, ev.Timestamp)
+		if err != nil {
+			continue
+		}
+		from, _ := ev.Details["from"].(float64)
+		to, _ := ev.Details["to"].(float64)
+		if n := int(to - from); n > 0 {
+			d.trackRestarts(ev.Job, ev.Target, ProcessState{Name: ev.App, PMID: ev.PMID}, n, ts)
+		}
+	}
+}
+
+// recentRestarts returns the restart events of the last crash loop window,
+// oldest first, for seeding an eventDetector.
+func recentRestarts(s Store) ([]Event, error) {
+	return s.QueryEvents(EventQuery{Selector: Selector{Start: time.Now().Add(-CrashLoopWindow)}, Types: []string{EventRestart}})
+}
+
+// trackRestarts records n restarts of p and returns a crash loop event the
+// first time the restart rate crosses the threshold.
+func (d *eventDetector) trackRestarts(job, target string, p ProcessState, n int, now time.Time) (Event, bool) {
+	k := job + "/" + target + "/" + p.key()
+	times := d.restarts[k]
+	for i := 0; i < n; i++ {
+		times = append(times, now)
+	}
+	cutoff := now.Add(-CrashLoopWindow)
+	for len(times) > 0 && times[0].Before(cutoff) {
+		times = times[1:]
+	}
+	d.restarts[k] = times
+
+	if len(times) < CrashLoopRestarts {
+		d.looping[k] = false
+		return Event{}, false
+	}
+	if d.looping[k] {
+		return Event{}, false
+	}
+	d.looping[k] = true
+	return Event{
+		Type:    EventCrashLoop,
+		Job:     job,
+		Target:  target,
+		App:     p.Name,
+		PMID:    p.PMID,
+		Message: fmt.Sprintf("%s restarted %d times in %s", p.Name, len(times), CrashLoopWindow),
+		Details: map[string]interface{}{"restarts": len(times), "window": CrashLoopWindow.String()},
+	}, true
+}
+
+// QueryEvents returns events matching the job/target/app, time range and types,
+// ordered by timestamp. Empty job or target match all.
+func (d *DiskStorage) QueryEvents(q EventQuery) ([]Event, error) {
+	d.writers.flush() // make buffered records visible
+	matches, err := filepath.Glob(filepath.Join(d.dir, fmt.Sprintf("events_%s_%s.jsonl", globPart(q.Job), globPart(q.Target))))
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]bool, len(q.Types))
+	for _, t := range q.Types {
+		types[t] = true
+	}
+
+	type timedEvent struct {
+		ts time.Time
+		ev Event
+	}
+	var found []timedEvent
+	for _, fn := range matches {
+		f, err := os.Open(fn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var ev Event
+			if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+				continue
+			}
+			if q.App != "" && ev.App != q.App {
+				continue
+			}
+			if len(types) > 0 && !types[ev.Type] {
+				continue
+			}
+			if !labels.MatchAll(q.Matchers, ev.Labels) {
+				continue
+			}
+			ts, err := time.Parse(time.RFC3339Nano, ev.Timestamp)
+			if err != nil {
+				continue
+			}
+			if (q.Start.IsZero() || !ts.Before(q.Start)) && (q.End.IsZero() || !ts.After(q.End)) {
+				found = append(found, timedEvent{ts, ev})
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].ts.Before(found[j].ts) })
+	events := make([]Event, 0, len(found))
+	for _, te := range found {
+		events = append(events, te.ev)
+	}
+	if q.NumLines > 0 && len(events) > q.NumLines {
+		events = events[len(events)-q.NumLines:]
+	}
+	return events, nil
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func procsJSON(restarts int) []byte {
+	return []byte(fmt.Sprintf(`[{"name":"api","pm_id":0,"pid":100,"status":"online","restart_time":%d}]`, restarts))
+}
+
+func countEvents(t *testing.T, s Store, typ string) int {
+	t.Helper()
+	evs, err := s.QueryEvents(EventQuery{Types: []string{typ}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(evs)
+}
+
+// A crash loop under way when the collector restarts is still detected,
+// and one already reported is not reported again.
+func TestCrashLoopSurvivesReopen(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Backend) {
+		now := time.Now().UTC().Add(-time.Minute)
+		s := open()
+		s.StoreProcesses("web", "h1", nil, now, procsJSON(0))
+		s.StoreProcesses("web", "h1", nil, now.Add(time.Second), procsJSON(1))
+		s.StoreProcesses("web", "h1", nil, now.Add(2*time.Second), procsJSON(2))
+		if n := countEvents(t, s, EventCrashLoop); n != 0 {
+			t.Fatalf("crash loops before the threshold: %d", n)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		s = open()
+		s.StoreProcesses("web", "h1", nil, now.Add(3*time.Second), procsJSON(3))
+		if n := countEvents(t, s, EventCrashLoop); n != 1 {
+			t.Fatalf("crash loops after reopening: got %d, want 1", n)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		s = open()
+		defer s.Close()
+		s.StoreProcesses("web", "h1", nil, now.Add(4*time.Second), procsJSON(4))
+		if n := countEvents(t, s, EventCrashLoop); n != 1 {
+			t.Fatalf("crash loop reported again after reopening: got %d, want 1", n)
+		}
+	})
+}
+
+// Consecutive snapshots yield an event for every restart, status and pid
+// change, and for apps that appear or go away; the first snapshot and
+// unchanged ones yield none.
+func TestEventsFromSnapshots(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Backend) {
+		s := open()
+		defer s.Close()
+		t0 := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+		snaps := []string{
+			`[{"name":"api","pm_id":0,"pid":100,"status":"online","restart_time":0},{"name":"worker","pm_id":1,"pid":200,"status":"online","restart_time":0}]`,
+			`[{"name":"api","pm_id":0,"pid":100,"status":"online","restart_time":0},{"name":"worker","pm_id":1,"pid":200,"status":"online","restart_time":0}]`,
+			`[{"name":"api","pm_id":0,"pid":101,"status":"online","restart_time":2},{"name":"worker","pm_id":1,"pid":200,"status":"stopped","restart_time":0}]`,
+			`[{"name":"api","pm_id":0,"pid":101,"status":"online","restart_time":2},{"name":"cron","pm_id":2,"pid":300,"status":"online","restart_time":0}]`,
+		}
+		for i, snap := range snaps {
+			s.StoreProcesses("web", "h1", map[string]string{"env": "prod"}, t0.Add(time.Duration(i)*time.Minute), []byte(snap))
+		}
+
+		evs, err := s.QueryEvents(EventQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, ev := range evs {
+			got = append(got, fmt.Sprintf("%s %s %s", ev.Timestamp[11:16], ev.Type, ev.App))
+		}
+		at := func(min int) string { return t0.Add(time.Duration(min) * time.Minute).Format("15:04") }
+		want := []string{
+			at(2) + " restart api", at(2) + " pid_change api", at(2) + " status_change worker",
+			at(3) + " app_added cron", at(3) + " app_removed worker",
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("events:\n%v\nwant\n%v", got, want)
+		}
+		if ev := evs[0]; ev.Job != "web" || ev.Target != "h1" || ev.Labels["env"] != "prod" || ev.Details["from"] != float64(0) || ev.Details["to"] != float64(2) {
+			t.Errorf("restart event: %+v", ev)
+		}
+		if ev := evs[2]; ev.PMID != 1 || ev.Details["from"] != "online" || ev.Details["to"] != "stopped" {
+			t.Errorf("status change event: %+v", ev)
+		}
+
+		for _, c := range []struct {
+			q    EventQuery
+			want int
+		}{
+			{EventQuery{Types: []string{EventAppAdded, EventAppRemoved}}, 2},
+			{EventQuery{Selector: Selector{App: "api"}}, 2},
+			{EventQuery{NumLines: 2}, 2},
+			{EventQuery{Selector: Selector{Start: t0.Add(3 * time.Minute)}}, 2},
+			{EventQuery{Selector: Selector{End: t0.Add(2 * time.Minute)}}, 3},
+			{EventQuery{Selector: Selector{Job: "batch"}}, 0},
+		} {
+			evs, err := s.QueryEvents(c.q)
+			if err != nil || len(evs) != c.want {
+				t.Errorf("%+v: %d events, %v, want %d", c.q, len(evs), err, c.want)
+			}
+		}
+		if evs, _ := s.QueryEvents(EventQuery{NumLines: 2}); evs[0].Type != EventAppAdded {
+			t.Errorf("latest two: %+v", evs)
+		}
+	})
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/discovery"
+)
+
+// logOffsetsFile checkpoints, per job/target and exporter log stream, the
+// newest line stored, so lines an exporter replays are not stored twice.
+const logOffsetsFile = "log_offsets.json"
+
+// streamOffset is the checkpoint of one stream. File and Size record the
+// segment the stream's newest line was written to and how large it was then:
+// lines written after the checkpoint but before a crash are found by
+// scanning only the part of File past Size and the segments after it.
+type streamOffset struct {
+	Seq  uint64 `json:"seq"`
+	File string `json:"file"`
+	Size int64  `json:"size"`
+}
+
+func offsetKey(job, target string) string { return job + "/" + target }
+
+func (d *DiskStorage) loadLogOffsets() error {
+	d.logOffsets = make(map[string]map[string]streamOffset)
+	data, err := os.ReadFile(filepath.Join(d.dir, logOffsetsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &d.logOffsets); err != nil {
+		return fmt.Errorf("%s: %w", logOffsetsFile, err)
+	}
+	return nil
+}
+
+// saveLogOffsetsLocked writes the checkpoint atomically. Callers hold d.offMu.
+func (d *DiskStorage) saveLogOffsetsLocked() error {
+	data, err := json.Marshal(d.logOffsets)
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(d.dir, logOffsetsFile)
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// streamOffsetsLocked returns the offsets of a job/target, first bringing
+// them up to date with lines stored after the last checkpoint.
+func (d *DiskStorage) streamOffsetsLocked(job, target string) map[string]streamOffset {
+	key := offsetKey(job, target)
+	offs := d.logOffsets[key]
+	if offs == nil {
+		offs = make(map[string]streamOffset)
+		d.logOffsets[key] = offs
+	}
+	if d.reconciled[key] {
+		return offs
+	}
+	d.reconciled[key] = true
+	d.sealMu.RLock()
+	defer d.sealMu.RUnlock()
+	for stream, o := range offs {
+		fn := filepath.Join(d.dir, o.File)
+		d.writers.flushFile(fn)
+		for _, seg := range segmentsFrom(fn) {
+			var seq uint64
+			var size int64
+			if seg.path == fn && seg.plain && !seg.compressed && len(seg.sealing) == 0 {
+				// still only appended to: the checkpoint covers the part up to Size
+				seq, size = scanStream(fn, o.Size, stream)
+			} else {
+				d.writers.flushFile(seg.path)
+				r, err := d.openSegment(seg, time.Time{}, time.Time{})
+				if err != nil {
+					continue
+				}
+				seq = scanSeq(r, stream)
+				r.Close()
+				if info, err := os.Stat(seg.path); err == nil {
+					size = info.Size()
+				}
+			}
+			if seq > o.Seq {
+				o.Seq, o.File, o.Size = seq, filepath.Join(seg.stream, filepath.Base(seg.path)), size
+				offs[stream] = o
+			}
+		}
+	}
+	return offs
+}
+
+// segmentsFrom returns the segment fn belongs to and those of its stream
+// that start after it.
+func segmentsFrom(fn string) []segment {
+	start, _, ok := parseSegmentName(filepath.Base(fn))
+	if !ok {
+		return nil
+	}
+	var out []segment
+	for _, seg := range listSegments(filepath.Dir(fn)) {
+		if !seg.start.Before(start) {
+			out = append(out, seg)
+		}
+	}
+	return out
+}
+
+// scanStream returns the highest sequence number of stream in fn after byte
+// offset from (or the whole file if it has since been rewritten smaller),
+// and the file's size.
+func scanStream(fn string, from int64, stream string) (seq uint64, size int64) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0
+	}
+	if info.Size() >= from {
+		f.Seek(from, io.SeekStart)
+	}
+	return scanSeq(f, stream), info.Size()
+}
+
+// scanSeq returns the highest sequence number of stream among the records of r.
+func scanSeq(r io.Reader, stream string) (seq uint64) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		var rec struct {
+			Stream string `json:"stream"`
+			Seq    uint64 `json:"seq"`
+		}
+		if json.Unmarshal(sc.Bytes(), &rec) == nil && rec.Stream == stream && rec.Seq > seq {
+			seq = rec.Seq
+		}
+	}
+	return seq
+}
+
+// LogOffsets returns the highest stored sequence number per stream.
+func (d *DiskStorage) LogOffsets(job, target string) map[string]uint64 {
+	d.offMu.Lock()
+	defer d.offMu.Unlock()
+	out := make(map[string]uint64)
+	for stream, o := range d.streamOffsetsLocked(job, target) {
+		out[stream] = o.Seq
+	}
+	return out
+}
+
+// StoreLogEntries appends the entries not stored yet to their app's log
+// segments, syncs the files to disk and then checkpoints the new offsets. Only
+// after that are the offsets returned, so an acknowledged line survives a
+// crash; a crash before the checkpoint at worst stores a batch twice.
+func (d *DiskStorage) StoreLogEntries(job, target string, ls map[string]string, entries []discovery.LogEntry) (map[string]uint64, error) {
+	d.offMu.Lock()
+	defer d.offMu.Unlock()
+
+	offs := d.streamOffsetsLocked(job, target)
+	type pending struct {
+		lines   [][]byte
+		msgs    []string // for the search index
+		streams map[string]uint64
+	}
+	files := make(map[string]*pending)
+	var order []string
+	last := make(map[string]uint64)
+	for _, e := range entries {
+		if e.Seq <= offs[e.Stream].Seq || e.Seq <= last[e.Stream] {
+			continue // already stored, or repeated within the batch
+		}
+		last[e.Stream] = e.Seq
+		app, msg := SplitAppPrefix(e.Line)
+		line, err := json.Marshal(logRecord{
+			Timestamp: e.Timestamp.UTC().Format(time.RFC3339Nano),
+			App:       app,
+			Line:      msg,
+			Labels:    ls,
+			Stream:    e.Stream,
+			Seq:       e.Seq,
+		})
+		if err != nil {
+			continue
+		}
+		seg := d.segmentPath(logStream(job, target, app), e.Timestamp)
+		name, _ := filepath.Rel(d.dir, seg)
+		p := files[name]
+		if p == nil {
+			p = &pending{streams: make(map[string]uint64)}
+			files[name] = p
+			order = append(order, name)
+		}
+		p.lines = append(p.lines, line)
+		p.msgs = append(p.msgs, msg)
+		p.streams[e.Stream] = e.Seq
+	}
+
+	for _, name := range order {
+		p := files[name]
+		path := filepath.Join(d.dir, name)
+		ix := d.lockIndex(path)
+		size, err := d.writers.appendSync(path, p.lines)
+		if err == nil {
+			for _, m := range p.msgs {
+				ix.add(m)
+			}
+		} else {
+			ix.loaded = false // reindex from what reached the file
+		}
+		ix.mu.Unlock()
+		if err != nil {
+			return d.offsetsLocked(offs), fmt.Errorf("store logs: %w", err)
+		}
+		d.noteStream(filepath.Dir(name), ls)
+		for stream, seq := range p.streams {
+			offs[stream] = streamOffset{Seq: seq, File: name, Size: size}
+		}
+		if err := d.saveLogOffsetsLocked(); err != nil {
+			return nil, fmt.Errorf("checkpoint log offsets: %w", err)
+		}
+	}
+	return d.offsetsLocked(offs), nil
+}
+
+func (d *DiskStorage) offsetsLocked(offs map[string]streamOffset) map[string]uint64 {
+	out := make(map[string]uint64, len(offs))
+	for stream, o := range offs {
+		out[stream] = o.Seq
+	}
+	return out
+}
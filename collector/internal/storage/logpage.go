@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/labels"
+	"github.com/aalish/pm2-full/internal/search"
+)
+
+// Log queries page through the records of every matching stream merged by
+// timestamp, newest first by default or oldest first when forward. A page
+// ends with a cursor, the position of its last record, and the next page
+// continues strictly after it in the same order. Records with equal
+// timestamps are ordered by segment and position, so paging neither skips
+// nor repeats them.
+
+const (
+	defaultLogLimit = 100
+	maxLogLimit     = 5000
+)
+
+// LogQuery selects one page of log records.
+type LogQuery struct {
+	Selector
+	NumLines int    // the page size
+	Cursor   string // continue after the record it names
+	Forward  bool   // oldest first from Start instead of newest first from End
+}
+
+// LogLine is one stored log record returned by QueryLogs.
+type LogLine struct {
+	Timestamp string            `json:"timestamp"`
+	Job       string            `json:"job"`
+	Target    string            `json:"target"`
+	App       string            `json:"app"`
+	Line      string            `json:"line"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Cursor    string            `json:"cursor,omitempty"` // continues the query after this record
+
+	ts  time.Time
+	key string // segment and ordinal, orders records with equal timestamps
+}
+
+// LogPage is one page of QueryLogs. NextCursor is set when more records
+// follow in the same direction.
+type LogPage struct {
+	Lines      []LogLine
+	NextCursor string
+}
+
+// logCursor is the position of a record.
+type logCursor struct {
+	TS  time.Time `json:"t"`
+	Key string    `json:"k"`
+}
+
+func (c logCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (logCursor, error) {
+	var c logCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil || c.TS.IsZero() {
+		return c, fmt.Errorf("%w: invalid cursor", ErrBadQuery)
+	}
+	return c, nil
+}
+
+// logStreamPattern matches the log streams selected by a query.
+func logStreamPattern(q Selector) string {
+	return fmt.Sprintf("logs_%s_%s_%s", globPart(q.Job), globPart(q.Target), globPart(q.App))
+}
+
+// logPager collects one page of log records from segments visited in page
+// order, keeping only the records that can still make the page.
+type logPager struct {
+	q       LogQuery
+	forward bool
+	after   *logCursor
+	limit   int
+	found   []LogMatch
+}
+
+func newLogPager(q LogQuery, defaultLimit, maxLimit int) (*logPager, error) {
+	p := &logPager{q: q, forward: q.Forward, limit: q.NumLines}
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		p.after = &c
+	}
+	if p.limit <= 0 {
+		p.limit = defaultLimit
+	}
+	if p.limit > maxLimit {
+		p.limit = maxLimit
+	}
+	return p, nil
+}
+
+// bounds returns the time range left to read, narrowed by the cursor.
+func (p *logPager) bounds() (start, end time.Time) {
+	start, end = p.q.Start, p.q.End
+	if c := p.after; c != nil {
+		if p.forward && (start.IsZero() || c.TS.After(start)) {
+			start = c.TS
+		}
+		if !p.forward && (end.IsZero() || c.TS.Before(end)) {
+			end = c.TS
+		}
+	}
+	return start, end
+}
+
+// less reports whether a comes before b in page order.
+func (p *logPager) less(a, b *LogLine) bool {
+	if !a.ts.Equal(b.ts) {
+		return a.ts.Before(b.ts) == p.forward
+	}
+	return a.key != b.key && (a.key < b.key) == p.forward
+}
+
+// record decodes record ord of seg and reports whether it lies within the
+// query's range and labels and after its cursor.
+func (p *logPager) record(seg segment, ord uint32, raw []byte) (LogMatch, bool) {
+	var rec logRecord
+	if json.Unmarshal(raw, &rec) != nil {
+		return LogMatch{}, false
+	}
+	ts, err := time.Parse(time.RFC3339Nano, rec.Timestamp)
+	if err != nil {
+		return LogMatch{}, false
+	}
+	if (!p.q.Start.IsZero() && ts.Before(p.q.Start)) || (!p.q.End.IsZero() && ts.After(p.q.End)) {
+		return LogMatch{}, false
+	}
+	if !labels.MatchAll(p.q.Matchers, rec.Labels) {
+		return LogMatch{}, false
+	}
+	_, job, target, _ := parseStream(seg.stream)
+	m := LogMatch{LogLine: LogLine{Timestamp: rec.Timestamp, Job: job, Target: target, App: rec.App, Line: rec.Line,
+		Labels: rec.Labels, ts: ts, key: fmt.Sprintf("%s/%s#%010d", seg.stream, filepath.Base(seg.path), ord)}}
+	if c := p.after; c != nil && !p.less(&LogLine{ts: c.TS, key: c.Key}, &m.LogLine) {
+		return LogMatch{}, false
+	}
+	return m, true
+}
+
+// add keeps m, trimming the records past the page once there are many. A
+// pager without a limit, scanning, keeps every record.
+func (p *logPager) add(m LogMatch) {
+	p.found = append(p.found, m)
+	if p.limit > 0 && len(p.found) > 4*(p.limit+1) {
+		p.trim()
+	}
+}
+
+// trim sorts the records in page order and drops all but one past the page.
+func (p *logPager) trim() {
+	sort.Slice(p.found, func(i, j int) bool { return p.less(&p.found[i].LogLine, &p.found[j].LogLine) })
+	if len(p.found) > p.limit+1 {
+		p.found = p.found[:p.limit+1]
+	}
+}
+
+// full reports whether the page is complete before next, the following
+// segment in page order: no record of it or later ones could displace any.
+func (p *logPager) full(next segment) bool {
+	final := 0
+	for _, m := range p.found {
+		if (p.forward && m.ts.Before(next.start)) || (!p.forward && !m.ts.Before(next.end)) {
+			final++
+		}
+	}
+	return final >= p.limit
+}
+
+// pageLogs visits the log segments selected by q in page order, calling
+// scan to add their records to the pager until the page is complete, and
+// returns the page and the cursor of the next one.
+func (d *DiskStorage) pageLogs(p *logPager, scan func(seg segment) error) ([]LogMatch, string, error) {
+	d.writers.flush() // make buffered records visible
+	d.sealMu.RLock()
+	defer d.sealMu.RUnlock()
+	start, end := p.bounds()
+	segs, err := segmentsIn(filepath.Join(d.dir, logStreamPattern(p.q.Selector)), start, end)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		if p.forward {
+			if !segs[i].start.Equal(segs[j].start) {
+				return segs[i].start.Before(segs[j].start)
+			}
+			return segs[i].path < segs[j].path
+		}
+		if !segs[i].end.Equal(segs[j].end) {
+			return segs[i].end.After(segs[j].end)
+		}
+		return segs[i].path > segs[j].path
+	})
+
+	more := false
+	for i, seg := range segs {
+		if err := scan(seg); err != nil {
+			return nil, "", err
+		}
+		p.trim()
+		if i+1 < len(segs) && p.full(segs[i+1]) {
+			more = true // later segments may hold more records
+			break
+		}
+	}
+
+	found, next := p.page(more)
+	return found, next, nil
+}
+
+// page returns the records of the page, each with its cursor, and the
+// cursor of the next page if more records may follow. Callers have trimmed
+// the records.
+func (p *logPager) page(more bool) ([]LogMatch, string) {
+	found, next := p.found, ""
+	if len(found) > p.limit {
+		found, more = found[:p.limit], true
+	}
+	if more && len(found) > 0 {
+		last := found[len(found)-1]
+		next = logCursor{TS: last.ts, Key: last.key}.encode()
+	}
+	for i := range found {
+		found[i].Cursor = logCursor{TS: found[i].ts, Key: found[i].key}.encode()
+	}
+	return found, next
+}
+
+// QueryLogs returns a page of the log records of the matching job, target
+// and app within [q.Start, q.End], merged across streams by timestamp:
+// newest first from q.End, or oldest first from q.Start when q.Forward.
+// q.NumLines caps the page (default 100, at most 5000) and q.Cursor
+// continues after the record it names.
+func (d *DiskStorage) QueryLogs(q LogQuery) (LogPage, error) {
+	p, err := newLogPager(q, defaultLogLimit, maxLogLimit)
+	if err != nil {
+		return LogPage{}, err
+	}
+	all := func(lo, hi uint32) bool { return true }
+	found, next, err := d.pageLogs(p, func(seg segment) error {
+		_, err := d.readRecords(seg, all, func(ord uint32, raw []byte) error {
+			if m, ok := p.record(seg, ord, raw); ok {
+				p.add(m)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return LogPage{}, err
+	}
+	page := LogPage{Lines: make([]LogLine, 0, len(found)), NextCursor: next}
+	for _, m := range found {
+		page.Lines = append(page.Lines, m.LogLine)
+	}
+	return page, nil
+}
+
+// ScanLogs calls fn with each log record a forward QueryLogs, or SearchLogs
+// when q.Search is set, would return, oldest first, reading every segment
+// once. Segments are read one period at a time, so memory is bounded by
+// the records of one period whatever the range. q.NumLines, q.Cursor and
+// q.Forward are ignored. It stops at the first error fn returns.
+func (d *DiskStorage) ScanLogs(q SearchQuery, fn func(l LogLine) error) error {
+	var query *search.Query
+	if q.Search != "" {
+		var err error
+		if query, err = search.Parse(q.Search); err != nil {
+			return fmt.Errorf("%w: %v", ErrBadQuery, err)
+		}
+	}
+	q.Cursor, q.Forward = "", true
+	d.writers.flush() // make buffered records visible
+	pattern := filepath.Join(d.dir, logStreamPattern(q.Selector))
+	d.sealMu.RLock()
+	segs, err := segmentsIn(pattern, q.Start, q.End)
+	d.sealMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(segs, func(i, j int) bool { return segs[i].start.Before(segs[j].start) })
+	all := func(lo, hi uint32) bool { return true }
+	for len(segs) > 0 {
+		from := segs[0].start
+		n, until := nextPeriod(segs)
+		segs = segs[n:]
+		lo, hi := from, until.Add(-time.Nanosecond)
+		if q.Start.After(lo) {
+			lo = q.Start
+		}
+		if !q.End.IsZero() && q.End.Before(hi) {
+			hi = q.End
+		}
+		// the period is listed again: compaction may have moved its records
+		p := &logPager{q: q.LogQuery, forward: true}
+		d.sealMu.RLock()
+		period, err := segmentsIn(pattern, lo, hi)
+		for _, seg := range period {
+			if err != nil {
+				break
+			}
+			if query != nil {
+				err = d.searchSegment(seg, query, p)
+				continue
+			}
+			_, err = d.readRecords(seg, all, func(ord uint32, raw []byte) error {
+				if m, ok := p.record(seg, ord, raw); ok {
+					p.add(m)
+				}
+				return nil
+			})
+		}
+		d.sealMu.RUnlock()
+		if err != nil {
+			return err
+		}
+		sort.Slice(p.found, func(i, j int) bool { return p.less(&p.found[i].LogLine, &p.found[j].LogLine) })
+		for _, m := range p.found {
+			if err := fn(m.LogLine); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
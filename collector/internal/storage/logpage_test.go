@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// pageAll pages through a log query with the given page size and returns
+// every line in the order the pages gave them.
+func pageAll(t *testing.T, s Store, q LogQuery, size int) []string {
+	t.Helper()
+	q.NumLines = size
+	var got []string
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("paging does not end")
+		}
+		page, err := s.QueryLogs(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, logLines(page.Lines)...)
+		if page.NextCursor == "" {
+			return got
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+// Paging in either direction returns every line of every stream exactly
+// once, merged by timestamp, also across segments and equal timestamps.
+func TestLogPagingBothDirections(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Backend) {
+		s := open()
+		defer s.Close()
+		t0 := time.Now().UTC().Add(-3 * time.Hour).Truncate(time.Hour)
+		var want []string
+		for i := range 12 {
+			// two lines per timestamp, one per target, 20 minutes apart so
+			// that they span segments
+			ts := t0.Add(time.Duration(i/2)*20*time.Minute + time.Second)
+			target := fmt.Sprintf("h%d", i%2+1)
+			line := fmt.Sprintf("line %02d", i)
+			s.StoreLog("web", target, nil, ts, "[api] "+line)
+			want = append(want, line)
+		}
+
+		forward := pageAll(t, s, LogQuery{Selector: Selector{Job: "web"}, Forward: true}, 5)
+		if !sameLines(forward, want) || !ordered(forward) {
+			t.Fatalf("forward pages: %v", forward)
+		}
+		backward := pageAll(t, s, LogQuery{Selector: Selector{Job: "web"}}, 5)
+		reversed := slices.Clone(forward)
+		slices.Reverse(reversed)
+		if !slices.Equal(backward, reversed) {
+			t.Fatalf("backward pages: %v, want %v", backward, reversed)
+		}
+
+		// a range pages only its own lines, each way
+		q := LogQuery{Selector: Selector{Job: "web", Start: t0.Add(20 * time.Minute), End: t0.Add(41 * time.Minute)}, Forward: true}
+		inRange := pageAll(t, s, q, 1)
+		if len(inRange) != 4 {
+			t.Fatalf("lines in range: %v", inRange)
+		}
+		q.Forward = false
+		back := pageAll(t, s, q, 3)
+		slices.Reverse(back)
+		if !slices.Equal(back, inRange) {
+			t.Fatalf("backward lines in range: %v, want %v", back, inRange)
+		}
+	})
+}
+
+// sameLines reports whether a holds the lines of b in any order.
+func sameLines(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// ordered reports whether lines numbered as stored come oldest first; the
+// two lines of one timestamp may come in either order.
+func ordered(lines []string) bool {
+	for i := 1; i < len(lines); i++ {
+		var a, b int
+		fmt.Sscanf(lines[i-1], "line %d", &a)
+		fmt.Sscanf(lines[i], "line %d", &b)
+		if a/2 > b/2 {
+			return false
+		}
+	}
+	return true
+}
+
+// ScanLogs gives the lines of forward pages, or of forward search pages,
+// in the same order, and stops at the first error of its callback.
+func TestScanLogs(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Backend) {
+		s := open()
+		defer s.Close()
+		t0 := time.Now().UTC().Add(-3 * time.Hour).Truncate(time.Hour)
+		for i := range 30 {
+			// lines of two apps on two targets, several per timestamp,
+			// spanning segments
+			ts := t0.Add(time.Duration(i/3)*10*time.Minute + time.Second)
+			app := []string{"api", "worker"}[i%2]
+			s.StoreLog("web", fmt.Sprintf("h%d", i%3), nil, ts, fmt.Sprintf("[%s] line %02d", app, i))
+		}
+		scan := func(q SearchQuery) []string {
+			t.Helper()
+			var got []string
+			err := s.ScanLogs(q, func(l LogLine) error {
+				got = append(got, l.Line)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return got
+		}
+
+		q := LogQuery{Selector: Selector{Job: "web", Start: t0.Add(15 * time.Minute)}, Forward: true}
+		if got, want := scan(SearchQuery{LogQuery: q}), pageAll(t, s, q, 7); len(got) != 24 || !slices.Equal(got, want) {
+			t.Fatalf("scanned %v, paged %v", got, want)
+		}
+		q.App = "worker"
+		var want []string
+		for {
+			res, err := s.SearchLogs(SearchQuery{LogQuery: q, Search: "line -\"line 07\""})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range res.Matches {
+				want = append(want, m.Line)
+			}
+			if res.NextCursor == "" {
+				break
+			}
+			q.Cursor = res.NextCursor
+		}
+		q.Cursor = ""
+		if got := scan(SearchQuery{LogQuery: q, Search: "line -\"line 07\""}); len(got) != 11 || !slices.Equal(got, want) {
+			t.Fatalf("scanned %v, searched %v", got, want)
+		}
+
+		n := 0
+		stop := errors.New("stop")
+		if err := s.ScanLogs(SearchQuery{}, func(LogLine) error { n++; return stop }); err != stop || n != 1 {
+			t.Fatalf("after an error: %d lines, %v", n, err)
+		}
+		if err := s.ScanLogs(SearchQuery{Search: "\"open"}, func(LogLine) error { return nil }); !errors.Is(err, ErrBadQuery) {
+			t.Fatalf("bad search: %v", err)
+		}
+	})
+}
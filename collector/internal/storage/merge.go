@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"sort"
+	"time"
+)
+
+// The Merge functions combine the answers of several backends to the same
+// query, as if one backend held all their data. The backends must be of
+// the same type and hold different jobs.
+
+// MergeRecords merges stored records, each list in timestamp order as
+// QueryMetrics and QueryProcesses return them, into one in timestamp order.
+func MergeRecords(lists ...[]json.RawMessage) []json.RawMessage {
+	type timed struct {
+		ts  time.Time
+		rec json.RawMessage
+	}
+	var all []timed
+	for _, l := range lists {
+		for _, rec := range l {
+			var head struct {
+				Timestamp time.Time `json:"timestamp"`
+			}
+			json.Unmarshal(rec, &head)
+			all = append(all, timed{head.Timestamp, rec})
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].ts.Before(all[j].ts) })
+	out := make([]json.RawMessage, 0, len(all))
+	for _, t := range all {
+		out = append(out, t.rec)
+	}
+	return out
+}
+
+// MergeNames merges the sorted names ListAllTargets, ListJobsByTarget and
+// QueryApps return into one sorted list without duplicates.
+func MergeNames(lists ...[]json.RawMessage) []json.RawMessage {
+	out := []json.RawMessage{}
+	for _, l := range lists {
+		out = append(out, l...)
+	}
+	slices.SortStableFunc(out, func(a, b json.RawMessage) int { return bytes.Compare(a, b) })
+	return slices.CompactFunc(out, func(a, b json.RawMessage) bool { return bytes.Equal(a, b) })
+}
+
+// MergeEvents merges the events of QueryEvents into timestamp order,
+// keeping the q.NumLines latest.
+func MergeEvents(q EventQuery, lists ...[]Event) []Event {
+	type timedEvent struct {
+		ts time.Time
+		ev Event
+	}
+	var found []timedEvent
+	for _, l := range lists {
+		for _, ev := range l {
+			ts, _ := time.Parse(time.RFC3339Nano, ev.Timestamp)
+			found = append(found, timedEvent{ts, ev})
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].ts.Before(found[j].ts) })
+	events := make([]Event, 0, len(found))
+	for _, te := range found {
+		events = append(events, te.ev)
+	}
+	if q.NumLines > 0 && len(events) > q.NumLines {
+		events = events[len(events)-q.NumLines:]
+	}
+	return events
+}
+
+// MergeProcessDiffs merges the diffs of DiffProcesses for the same range.
+func MergeProcessDiffs(diffs ...ProcessDiff) ProcessDiff {
+	out := ProcessDiff{Added: []ProcessState{}, Removed: []ProcessState{}, Changed: []ProcessChange{}}
+	for i, d := range diffs {
+		if i == 0 {
+			out.From, out.To = d.From, d.To
+		}
+		out.Added = append(out.Added, d.Added...)
+		out.Removed = append(out.Removed, d.Removed...)
+		out.Changed = append(out.Changed, d.Changed...)
+	}
+	return out
+}
+
+// MergeRetentionReports sums the retention previews of several backends.
+func MergeRetentionReports(reports ...RetentionReport) RetentionReport {
+	out := RetentionReport{Deletions: []RetentionDeletion{}}
+	for _, r := range reports {
+		out.Deletions = append(out.Deletions, r.Deletions...)
+		out.Bytes += r.Bytes
+		out.KeptBytes += r.KeptBytes
+	}
+	return out
+}
+
+// MergeLogPages merges the pages QueryLogs returned for q into one page in
+// the same order, whose cursors continue the merged query: a cursor names
+// a position in the order of every backend, so q with it reads the next
+// page from each. SQLite keys are row ids, so of two records of different
+// backends stored at the same nanosecond with the same id, one is skipped.
+func MergeLogPages(q LogQuery, pages ...LogPage) (LogPage, error) {
+	p, err := newLogPager(q, defaultLogLimit, maxLogLimit)
+	if err != nil {
+		return LogPage{}, err
+	}
+	more := false
+	for _, page := range pages {
+		for _, l := range page.Lines {
+			p.found = append(p.found, LogMatch{LogLine: l})
+		}
+		more = more || page.NextCursor != ""
+	}
+	p.trim()
+	found, next := p.page(more)
+	out := LogPage{Lines: make([]LogLine, 0, len(found)), NextCursor: next}
+	for _, m := range found {
+		out.Lines = append(out.Lines, m.LogLine)
+	}
+	return out, nil
+}
+
+// MergeLogSearches merges the results SearchLogs returned for q as
+// MergeLogPages merges pages.
+func MergeLogSearches(q SearchQuery, results ...LogSearchResult) (LogSearchResult, error) {
+	p, err := newLogPager(q.LogQuery, defaultSearchLimit, maxSearchLimit)
+	if err != nil {
+		return LogSearchResult{}, err
+	}
+	more := false
+	for _, r := range results {
+		p.found = append(p.found, r.Matches...)
+		more = more || r.NextCursor != ""
+	}
+	p.trim()
+	found, next := p.page(more)
+	return LogSearchResult{Matches: append([]LogMatch{}, found...), NextCursor: next}, nil
+}
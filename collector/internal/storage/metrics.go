@@ -0,0 +1,95 @@
+// internal/storage/metrics.go
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// MetricQuery selects scrapes, or the rollups Step and Resolution pick
+// (see metricsKind).
+type MetricQuery struct {
+	Selector
+	Step       time.Duration // the wanted spacing of points, picks the resolution
+	Resolution string        // raw, 5m, 1h, or auto (default)
+}
+
+// MetricSample is one series value taken from a stored scrape.
+type MetricSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// DecodeMetricsRecord parses one line of a metrics_<job>_<target> segment back
+// into its scrape time and metric families.
+func DecodeMetricsRecord(raw []byte) (time.Time, map[string]*dto.MetricFamily, error) {
+	ts, _, mfs, err := decodeMetricsLine(raw)
+	return ts, mfs, err
+}
+
+// decodeMetricsLine is DecodeMetricsRecord that also returns the target
+// labels stored with the scrape.
+func decodeMetricsLine(raw []byte) (time.Time, map[string]string, map[string]*dto.MetricFamily, error) {
+	var rec struct {
+		Timestamp string            `json:"timestamp"`
+		Labels    map[string]string `json:"labels"`
+		Metrics   map[string]string `json:"metrics"`
+	}
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return time.Time{}, nil, nil, err
+	}
+	ts, err := time.Parse(time.RFC3339Nano, rec.Timestamp)
+	if err != nil {
+		return time.Time{}, nil, nil, err
+	}
+	mfs := make(map[string]*dto.MetricFamily, len(rec.Metrics))
+	for name, enc := range rec.Metrics {
+		bts, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			continue
+		}
+		mf := &dto.MetricFamily{}
+		if err := proto.Unmarshal(bts, mf); err != nil {
+			continue
+		}
+		mfs[name] = mf
+	}
+	return ts, rec.Labels, mfs, nil
+}
+
+// Samples flattens metric families into one sample per series. Gauges,
+// counters and untyped metrics yield their value; summaries and histograms
+// yield their sample sum and count as <name>_sum and <name>_count.
+func Samples(mfs map[string]*dto.MetricFamily) []MetricSample {
+	var out []MetricSample
+	for name, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			switch {
+			case m.Gauge != nil:
+				out = append(out, MetricSample{Name: name, Labels: labels, Value: m.GetGauge().GetValue()})
+			case m.Counter != nil:
+				out = append(out, MetricSample{Name: name, Labels: labels, Value: m.GetCounter().GetValue()})
+			case m.Untyped != nil:
+				out = append(out, MetricSample{Name: name, Labels: labels, Value: m.GetUntyped().GetValue()})
+			case m.Summary != nil:
+				out = append(out,
+					MetricSample{Name: name + "_sum", Labels: labels, Value: m.GetSummary().GetSampleSum()},
+					MetricSample{Name: name + "_count", Labels: labels, Value: float64(m.GetSummary().GetSampleCount())})
+			case m.Histogram != nil:
+				out = append(out,
+					MetricSample{Name: name + "_sum", Labels: labels, Value: m.GetHistogram().GetSampleSum()},
+					MetricSample{Name: name + "_count", Labels: labels, Value: float64(m.GetHistogram().GetSampleCount())})
+			}
+		}
+	}
+	return out
+}
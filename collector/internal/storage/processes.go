@@ -0,0 +1,653 @@
+// internal/storage/processes.go
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/labels"
+)
+
+// ProcessQuery selects the process snapshots of one job and target;
+// without a range, only the latest.
+type ProcessQuery struct {
+	Selector
+	At time.Time // the snapshot in effect at this instant, instead of a range
+}
+
+// AppQuery selects the apps seen in the snapshots within the range, or,
+// without a range, every app cataloged with logs or processes.
+type AppQuery struct {
+	Selector
+}
+
+// ProcessState is the subset of a PM2 process that we track over time.
+// A new snapshot is only written when one of these fields changes.
+type ProcessState struct {
+	Name         string `json:"name"`
+	PMID         int    `json:"pm_id"`
+	PID          int    `json:"pid"`
+	Status       string `json:"status"`
+	RestartCount int    `json:"restart_time"`
+	Version      string `json:"version,omitempty"`
+	EnvHash      string `json:"env_hash,omitempty"`
+}
+
+// key identifies one PM2 process across snapshots.
+func (p ProcessState) key() string {
+	return fmt.Sprintf("%s#%d", p.Name, p.PMID)
+}
+
+// TimelineEntry is one state change of a single process.
+type TimelineEntry struct {
+	Timestamp    string `json:"timestamp"`
+	PID          int    `json:"pid"`
+	Status       string `json:"status"`
+	RestartCount int    `json:"restart_time"`
+	Version      string `json:"version,omitempty"`
+	EnvHash      string `json:"env_hash,omitempty"`
+	Removed      bool   `json:"removed,omitempty"`
+}
+
+// ProcessTimeline is the state history of one process.
+type ProcessTimeline struct {
+	Name   string          `json:"name"`
+	PMID   int             `json:"pm_id"`
+	States []TimelineEntry `json:"states"`
+}
+
+// FieldChange holds the old and new value of a changed field.
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// ProcessChange describes how one process differs between two snapshots.
+type ProcessChange struct {
+	Name   string                 `json:"name"`
+	PMID   int                    `json:"pm_id"`
+	Fields map[string]FieldChange `json:"fields"`
+}
+
+// ProcessDiff compares the process snapshots in effect at two points in time.
+type ProcessDiff struct {
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Added   []ProcessState  `json:"added"`
+	Removed []ProcessState  `json:"removed"`
+	Changed []ProcessChange `json:"changed"`
+}
+
+// processSnapshot is one parsed line of processes_<job>_<target>.jsonl.
+type processSnapshot struct {
+	ts     time.Time
+	raw    json.RawMessage
+	labels map[string]string
+	states []ProcessState
+}
+
+// parseProcessStates extracts the tracked fields from a raw /processes payload.
+func parseProcessStates(data []byte) ([]ProcessState, error) {
+	var procs []struct {
+		Name         string `json:"name"`
+		PMID         int    `json:"pm_id"`
+		PID          int    `json:"pid"`
+		Status       string `json:"status"`
+		RestartCount int    `json:"restart_time"`
+		PM2Env       struct {
+			Version string          `json:"version"`
+			Env     json.RawMessage `json:"env"`
+		} `json:"pm2_env"`
+	}
+	if err := json.Unmarshal(data, &procs); err != nil {
+		return nil, err
+	}
+	states := make([]ProcessState, 0, len(procs))
+	for _, p := range procs {
+		states = append(states, ProcessState{
+			Name:         p.Name,
+			PMID:         p.PMID,
+			PID:          p.PID,
+			Status:       p.Status,
+			RestartCount: p.RestartCount,
+			Version:      p.PM2Env.Version,
+			EnvHash:      envHash(p.PM2Env.Env),
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].key() < states[j].key() })
+	return states, nil
+}
+
+// ParseProcessSnapshot decodes one stored snapshot line (as returned by
+// QueryProcesses) into its timestamp and tracked process states.
+func ParseProcessSnapshot(raw json.RawMessage) (time.Time, []ProcessState, error) {
+	var rec struct {
+		Timestamp string          `json:"timestamp"`
+		Data      json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return time.Time{}, nil, err
+	}
+	ts, err := time.Parse(time.RFC3339Nano, rec.Timestamp)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	states, err := parseProcessStates(rec.Data)
+	return ts, states, err
+}
+
+// envHash returns a short, stable hash of a process environment. Re-encoding
+// through a map sorts the keys so field order in the payload does not matter.
+func envHash(env json.RawMessage) string {
+	if len(env) == 0 {
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal(env, &v); err != nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// statesEqual reports whether two sorted state lists are identical.
+func statesEqual(a, b []ProcessState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// lastStates returns the states of the newest snapshot on disk, caching them
+// so the file is only scanned once per stream. ok is false if there is none.
+// Caller must hold d.mu.
+func (d *DiskStorage) lastStates(fn string) ([]ProcessState, bool) {
+	if states, ok := d.procLast[fn]; ok {
+		return states, true
+	}
+	d.writers.flushFile(fn)
+	snaps, err := readProcessSnapshots(fn, latestSnapshot)
+	if err != nil || len(snaps) == 0 {
+		return nil, false
+	}
+	states := snaps[len(snaps)-1].states
+	d.procLast[fn] = states
+	return states, true
+}
+
+// readProcessSnapshots loads the snapshots of a stream in file order,
+// starting with the one in effect at from; a zero from loads them all.
+// The file is read from its end so that only the needed tail is parsed.
+func readProcessSnapshots(fn string, from time.Time) ([]processSnapshot, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	if from.IsZero() {
+		var snaps []processSnapshot
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			if s, ok := parseSnapshotLine(append([]byte(nil), scanner.Bytes()...)); ok {
+				snaps = append(snaps, s)
+			}
+		}
+		return snaps, scanner.Err()
+	}
+
+	var rev []processSnapshot
+	err = scanLinesBackward(f, func(line []byte) bool {
+		s, ok := parseSnapshotLine(line)
+		if !ok {
+			return true
+		}
+		rev = append(rev, s)
+		return s.ts.After(from)
+	})
+	for i, j := 0, len(rev)-1; i < j; i, j = i+1, j-1 {
+		rev[i], rev[j] = rev[j], rev[i]
+	}
+	return rev, err
+}
+
+// parseSnapshotLine decodes one line of a processes file.
+func parseSnapshotLine(line []byte) (processSnapshot, bool) {
+	ts, states, err := ParseProcessSnapshot(line)
+	if err != nil {
+		return processSnapshot{}, false
+	}
+	return processSnapshot{ts: ts, raw: line, labels: recordLabels(line), states: states}, true
+}
+
+// scanLinesBackward calls fn with each non-empty line of f, last line
+// first, until fn returns false.
+func scanLinesBackward(f *os.File, fn func(line []byte) bool) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	const chunk = 64 * 1024
+	var tail []byte
+	for off := fi.Size(); off > 0; {
+		n := int64(chunk)
+		if off < n {
+			n = off
+		}
+		off -= n
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+			return err
+		}
+		tail = append(buf, tail...)
+		// every complete line after the first newline; the part before it
+		// may continue in the previous chunk
+		for {
+			i := bytes.LastIndexByte(tail, '\n')
+			if i < 0 {
+				break
+			}
+			line := tail[i+1:]
+			tail = tail[:i]
+			if len(line) > 0 && !fn(append([]byte(nil), line...)) {
+				return nil
+			}
+		}
+	}
+	if len(tail) > 0 {
+		fn(tail)
+	}
+	return nil
+}
+
+// latestSnapshot, as the start of a history read, loads only the newest
+// snapshot.
+var latestSnapshot = time.Unix(0, math.MaxInt64)
+
+// historyFrom returns the instant whose snapshot is the oldest the query
+// needs: the one at q.At, the one in effect at q.Start, or the latest.
+// Zero means the whole history.
+func (q ProcessQuery) historyFrom() time.Time {
+	switch {
+	case !q.At.IsZero():
+		return q.At
+	case !q.Start.IsZero():
+		return q.Start
+	case q.End.IsZero():
+		return latestSnapshot
+	}
+	return time.Time{}
+}
+
+// processSnapshots reads the snapshot history for a job/target from the
+// snapshot in effect at from (see readProcessSnapshots). Matchers are not
+// applied here: a query first picks snapshots by time, then matches them.
+func (d *DiskStorage) processSnapshots(q ProcessQuery, from time.Time) ([]processSnapshot, error) {
+	d.writers.flush() // make buffered records visible
+	fn := filepath.Join(d.dir, streamName("processes", q.Job, q.Target)+".jsonl")
+	return readProcessSnapshots(fn, from)
+}
+
+// matching reports whether a snapshot's labels match the query's matchers.
+func (s processSnapshot) matching(ms []labels.Matcher) bool {
+	return len(ms) == 0 || labels.MatchAll(ms, s.labels)
+}
+
+// snapshotAt returns the index of the snapshot in effect at t, or -1.
+func snapshotAt(snaps []processSnapshot, t time.Time) int {
+	i := sort.Search(len(snaps), func(i int) bool { return snaps[i].ts.After(t) })
+	return i - 1
+}
+
+// filterApp keeps only states for the given app name (all if app is empty).
+func filterApp(states []ProcessState, app string) []ProcessState {
+	if app == "" {
+		return states
+	}
+	var out []ProcessState
+	for _, s := range states {
+		if s.Name == app {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// queryProcessSnapshots returns the snapshots of a process query: the one
+// in effect at q.At, those inside [q.Start, q.End], or the latest.
+func (d *DiskStorage) queryProcessSnapshots(q ProcessQuery) ([]processSnapshot, error) {
+	snaps, err := d.processSnapshots(q, q.historyFrom())
+	if err != nil {
+		return nil, err
+	}
+	return selectSnapshots(snaps, q), nil
+}
+
+// selectSnapshots picks the snapshots of a process query from the history
+// by time, then keeps those whose labels match the query's matchers.
+func selectSnapshots(snaps []processSnapshot, q ProcessQuery) []processSnapshot {
+	if len(snaps) == 0 {
+		return nil
+	}
+	var out []processSnapshot
+	switch {
+	case !q.At.IsZero():
+		if i := snapshotAt(snaps, q.At); i >= 0 {
+			out = snaps[i : i+1]
+		}
+	case q.Start.IsZero() && q.End.IsZero():
+		out = snaps[len(snaps)-1:]
+	default:
+		// the snapshot that was already in effect when the range began
+		if !q.Start.IsZero() {
+			if i := snapshotAt(snaps, q.Start); i >= 0 && snaps[i].ts.Before(q.Start) {
+				out = append(out, snaps[i])
+			}
+		}
+		for _, s := range snaps {
+			if (q.Start.IsZero() || !s.ts.Before(q.Start)) && (q.End.IsZero() || !s.ts.After(q.End)) {
+				out = append(out, s)
+			}
+		}
+	}
+
+	kept := out[:0:0]
+	for _, s := range out {
+		if s.matching(q.Matchers) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// appSnapshots narrows snapshots to the processes of one app, dropping
+// snapshots without any. The raw lines are rewritten to hold only that
+// app's processes.
+func appSnapshots(snaps []processSnapshot, app string) []processSnapshot {
+	if app == "" {
+		return snaps
+	}
+	var out []processSnapshot
+	for _, s := range snaps {
+		states := filterApp(s.states, app)
+		if len(states) == 0 {
+			continue
+		}
+		raw, err := filterSnapshotData(s.raw, app)
+		if err != nil {
+			continue
+		}
+		out = append(out, processSnapshot{ts: s.ts, raw: raw, labels: s.labels, states: states})
+	}
+	return out
+}
+
+// filterSnapshotData rewrites a stored snapshot line so its data holds only
+// the processes named app.
+func filterSnapshotData(raw json.RawMessage, app string) (json.RawMessage, error) {
+	var rec map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return nil, err
+	}
+	var procs []json.RawMessage
+	if err := json.Unmarshal(rec["data"], &procs); err != nil {
+		return nil, err
+	}
+	kept := []json.RawMessage{}
+	for _, p := range procs {
+		var named struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal(p, &named) == nil && named.Name == app {
+			kept = append(kept, p)
+		}
+	}
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	rec["data"] = data
+	return json.Marshal(rec)
+}
+
+// queryProcessApps returns the distinct app names of the matching job and
+// target: those seen in the snapshots within q.Start and q.End if given,
+// otherwise every app cataloged with logs or processes.
+func (d *DiskStorage) queryProcessApps(q AppQuery) ([]json.RawMessage, error) {
+	if q.Start.IsZero() && q.End.IsZero() {
+		return catalogApps(d.Catalog(CatalogQuery{Job: q.Job, Target: q.Target, Matchers: q.Matchers})), nil
+	}
+	snaps, err := d.queryProcessSnapshots(ProcessQuery{Selector: q.Selector})
+	if err != nil {
+		return nil, err
+	}
+	return snapshotApps(snaps), nil
+}
+
+// snapshotApps returns the distinct app names of snapshots as {"name"}
+// objects, in order of appearance.
+func snapshotApps(snaps []processSnapshot) []json.RawMessage {
+	seen := make(map[string]struct{})
+	var results []json.RawMessage
+	for _, s := range snaps {
+		for _, st := range s.states {
+			if _, ok := seen[st.Name]; ok {
+				continue
+			}
+			seen[st.Name] = struct{}{}
+			nm, err := json.Marshal(appName(st.Name))
+			if err != nil {
+				continue
+			}
+			results = append(results, json.RawMessage(nm))
+		}
+	}
+	return results
+}
+
+// appName is how /apps lists an app.
+func appName(name string) interface{} {
+	return struct {
+		Name string `json:"name"`
+	}{Name: name}
+}
+
+// QueryProcessTimeline returns, per process, every state change within the
+// query range. The state in effect at q.Start is included as the first entry.
+// It reads the whole history, as that entry carries the time of the change.
+func (d *DiskStorage) QueryProcessTimeline(q ProcessQuery) ([]ProcessTimeline, error) {
+	snaps, err := d.processSnapshots(q, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return processTimeline(snaps, q), nil
+}
+
+// processTimeline builds the timeline of a process query from the history.
+// Snapshots whose labels do not match the query's matchers are skipped; if
+// the one in effect at q.Start is among them, there is no baseline entry.
+func processTimeline(snaps []processSnapshot, q ProcessQuery) []ProcessTimeline {
+	byKey := make(map[string]*ProcessTimeline)
+	var order []string
+	prev := make(map[string]ProcessState)
+	for _, s := range snaps {
+		if !q.End.IsZero() && s.ts.After(q.End) {
+			break
+		}
+		if !s.matching(q.Matchers) {
+			if !q.Start.IsZero() && s.ts.Before(q.Start) {
+				byKey = make(map[string]*ProcessTimeline)
+				order = nil
+				prev = make(map[string]ProcessState)
+			}
+			continue
+		}
+		ts := s.ts.Format(time.RFC3339Nano)
+		inRange := q.Start.IsZero() || !s.ts.Before(q.Start)
+		cur := make(map[string]ProcessState)
+		for _, st := range filterApp(s.states, q.App) {
+			cur[st.key()] = st
+			old, existed := prev[st.key()]
+			if existed && old == st {
+				continue
+			}
+			tl := byKey[st.key()]
+			if tl == nil {
+				tl = &ProcessTimeline{Name: st.Name, PMID: st.PMID}
+				byKey[st.key()] = tl
+				order = append(order, st.key())
+			}
+			entry := TimelineEntry{
+				Timestamp:    ts,
+				PID:          st.PID,
+				Status:       st.Status,
+				RestartCount: st.RestartCount,
+				Version:      st.Version,
+				EnvHash:      st.EnvHash,
+			}
+			if inRange {
+				tl.States = append(tl.States, entry)
+			} else {
+				// before the range: keep only the latest state as the baseline
+				tl.States = []TimelineEntry{entry}
+			}
+		}
+		for k, old := range prev {
+			if _, ok := cur[k]; ok {
+				continue
+			}
+			entry := TimelineEntry{Timestamp: ts, PID: old.PID, Status: old.Status, RestartCount: old.RestartCount, Removed: true}
+			if inRange {
+				byKey[k].States = append(byKey[k].States, entry)
+			} else {
+				byKey[k].States = []TimelineEntry{entry}
+			}
+		}
+		prev = cur
+	}
+
+	result := make([]ProcessTimeline, 0, len(order))
+	for _, k := range order {
+		tl := byKey[k]
+		// drop processes that were already gone before the range started
+		if len(tl.States) == 1 && tl.States[0].Removed && !q.Start.IsZero() {
+			if ts, err := time.Parse(time.RFC3339Nano, tl.States[0].Timestamp); err == nil && ts.Before(q.Start) {
+				continue
+			}
+		}
+		result = append(result, *tl)
+	}
+	return result
+}
+
+// DiffProcesses compares the snapshot in effect at q.Start with the one in
+// effect at q.End (now if End is zero).
+func (d *DiskStorage) DiffProcesses(q ProcessQuery) (ProcessDiff, error) {
+	snaps, err := d.processSnapshots(q, q.historyFrom())
+	if err != nil {
+		return ProcessDiff{Added: []ProcessState{}, Removed: []ProcessState{}, Changed: []ProcessChange{}}, err
+	}
+	return diffSnapshots(snaps, q), nil
+}
+
+// diffSnapshots compares the snapshots of the history in effect at q.Start
+// and q.End. A snapshot whose labels do not match the query's matchers
+// counts as none.
+func diffSnapshots(snaps []processSnapshot, q ProcessQuery) ProcessDiff {
+	diff := ProcessDiff{Added: []ProcessState{}, Removed: []ProcessState{}, Changed: []ProcessChange{}}
+	end := q.End
+	if end.IsZero() {
+		end = time.Now().UTC()
+	}
+	diff.From = q.Start.UTC().Format(time.RFC3339Nano)
+	diff.To = end.UTC().Format(time.RFC3339Nano)
+
+	var from, to []ProcessState
+	if i := snapshotAt(snaps, q.Start); i >= 0 && snaps[i].matching(q.Matchers) {
+		from = filterApp(snaps[i].states, q.App)
+	}
+	if i := snapshotAt(snaps, end); i >= 0 && snaps[i].matching(q.Matchers) {
+		to = filterApp(snaps[i].states, q.App)
+	}
+
+	old := make(map[string]ProcessState, len(from))
+	for _, s := range from {
+		old[s.key()] = s
+	}
+	for _, s := range to {
+		o, ok := old[s.key()]
+		if !ok {
+			diff.Added = append(diff.Added, s)
+			continue
+		}
+		delete(old, s.key())
+		if fields := changedFields(o, s); len(fields) > 0 {
+			diff.Changed = append(diff.Changed, ProcessChange{Name: s.Name, PMID: s.PMID, Fields: fields})
+		}
+	}
+	for _, s := range from {
+		if _, ok := old[s.key()]; ok {
+			diff.Removed = append(diff.Removed, s)
+		}
+	}
+	return diff
+}
+
+// changedFields lists every tracked field that differs between a and b.
+func changedFields(a, b ProcessState) map[string]FieldChange {
+	fields := make(map[string]FieldChange)
+	if a.PID != b.PID {
+		fields["pid"] = FieldChange{a.PID, b.PID}
+	}
+	if a.Status != b.Status {
+		fields["status"] = FieldChange{a.Status, b.Status}
+	}
+	if a.RestartCount != b.RestartCount {
+		fields["restart_time"] = FieldChange{a.RestartCount, b.RestartCount}
+	}
+	if a.Version != b.Version {
+		fields["version"] = FieldChange{a.Version, b.Version}
+	}
+	if a.EnvHash != b.EnvHash {
+		fields["env_hash"] = FieldChange{a.EnvHash, b.EnvHash}
+	}
+	return fields
+}
+
+// rawSnapshots converts snapshots back into the stored JSON lines.
+func rawSnapshots(snaps []processSnapshot) []json.RawMessage {
+	out := make([]json.RawMessage, 0, len(snaps))
+	for _, s := range snaps {
+		out = append(out, s.raw)
+	}
+	return out
+}
+
+// isProcessFile reports whether fn holds process snapshots.
+func isProcessFile(fn string) bool {
+	return strings.HasPrefix(filepath.Base(fn), "processes_")
+}
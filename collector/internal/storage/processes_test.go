@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Snapshots are picked by time before matchers apply: a matcher that only
+// an older snapshot satisfies does not bring that snapshot back.
+func TestProcessSnapshotMatchersAfterTime(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Backend) {
+		s := open()
+		defer s.Close()
+		t0 := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+		for i := range 4 {
+			env := "prod"
+			if i >= 2 {
+				env = "dev"
+			}
+			s.StoreProcesses("web", "h1", map[string]string{"env": env}, t0.Add(time.Duration(i)*time.Minute), procsJSON(i))
+		}
+		prod := matcher(t, "env=prod")
+
+		if snaps, _ := s.QueryProcesses(ProcessQuery{Selector: Selector{Job: "web", Target: "h1", Matchers: prod}}); len(snaps) != 0 {
+			t.Fatalf("latest env=prod: got %d snapshots, want 0", len(snaps))
+		}
+		if snaps, _ := s.QueryProcesses(ProcessQuery{Selector: Selector{Job: "web", Target: "h1", Matchers: prod}, At: t0.Add(150 * time.Second)}); len(snaps) != 0 {
+			t.Fatalf("env=prod at t0+150s: got %d snapshots, want 0", len(snaps))
+		}
+		snaps, _ := s.QueryProcesses(ProcessQuery{Selector: Selector{Job: "web", Target: "h1", Matchers: prod}, At: t0.Add(90 * time.Second)})
+		if len(snaps) != 1 {
+			t.Fatalf("env=prod at t0+90s: got %d snapshots, want 1", len(snaps))
+		}
+		if _, states, _ := ParseProcessSnapshot(snaps[0]); states[0].RestartCount != 1 {
+			t.Fatalf("env=prod at t0+90s: %+v", states)
+		}
+		snaps, _ = s.QueryProcesses(ProcessQuery{Selector: Selector{Job: "web", Target: "h1", Start: t0.Add(90 * time.Second), End: t0.Add(time.Hour)}})
+		if len(snaps) != 3 {
+			t.Fatalf("snapshots from t0+90s: got %d, want 3", len(snaps))
+		}
+
+		diff, err := s.DiffProcesses(ProcessQuery{Selector: Selector{Job: "web", Target: "h1", Start: t0, End: t0.Add(3 * time.Minute), Matchers: prod}})
+		if err != nil || len(diff.Removed) != 1 || len(diff.Changed) != 0 {
+			t.Fatalf("diff env=prod: %+v, %v", diff, err)
+		}
+	})
+}
+
+// A query for one app returns only that app's processes.
+func TestQueryProcessesApp(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Backend) {
+		s := open()
+		defer s.Close()
+		t0 := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+		procs := func(restarts int) []byte {
+			return []byte(fmt.Sprintf(`[{"name":"api","pm_id":0,"pid":100,"status":"online","restart_time":%d},`+
+				`{"name":"worker","pm_id":1,"pid":101,"status":"online","restart_time":0}]`, restarts))
+		}
+		s.StoreProcesses("web", "h1", nil, t0, procs(0))
+		s.StoreProcesses("web", "h1", nil, t0.Add(time.Minute), procs(1))
+
+		snaps, err := s.QueryProcesses(ProcessQuery{Selector: Selector{Job: "web", Target: "h1", App: "worker"}})
+		if err != nil || len(snaps) != 1 {
+			t.Fatalf("latest worker snapshot: %d, %v", len(snaps), err)
+		}
+		var rec struct {
+			Data []struct {
+				Name string `json:"name"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(snaps[0], &rec); err != nil || len(rec.Data) != 1 || rec.Data[0].Name != "worker" {
+			t.Fatalf("worker snapshot: %s, %v", snaps[0], err)
+		}
+		if snaps, _ := s.QueryProcesses(ProcessQuery{Selector: Selector{Job: "web", Target: "h1", App: "nope"}}); len(snaps) != 0 {
+			t.Fatalf("unknown app: got %d snapshots, want 0", len(snaps))
+		}
+	})
+}
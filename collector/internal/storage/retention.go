@@ -0,0 +1,453 @@
+package storage
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// Retention is planned before anything is deleted: every segment is given
+// the first retention rule that selects it (or the default retention of
+// its kind), then deleted by age, by its rule's size limit, and finally by
+// the storage-wide size limits. PreviewRetention returns the same plan
+// without carrying it out.
+
+// retentionRule is a compiled config.RetentionRule.
+type retentionRule struct {
+	config.RetentionRule
+	match *regexp.Regexp
+}
+
+var retentionKinds = append([]string{"processes", "events"}, segmentKinds...)
+
+func compileRetentionRules(cfgs []config.RetentionRule) ([]retentionRule, error) {
+	rules := make([]retentionRule, 0, len(cfgs))
+	for i, c := range cfgs {
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		r := retentionRule{RetentionRule: c}
+		if c.Kind != "" && !contains(retentionKinds, c.Kind) {
+			return nil, fmt.Errorf("storage: retention rule %s: unknown kind %q", c.Name, c.Kind)
+		}
+		for _, p := range []string{c.Job, c.Target, c.App} {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("storage: retention rule %s: bad pattern %q", c.Name, p)
+			}
+		}
+		if c.Match != "" {
+			if c.Kind != "logs" {
+				return nil, fmt.Errorf("storage: retention rule %s: match needs kind logs", c.Name)
+			}
+			re, err := regexp.Compile(c.Match)
+			if err != nil {
+				return nil, fmt.Errorf("storage: retention rule %s: %v", c.Name, err)
+			}
+			r.match = re
+		}
+		if c.MaxAge < 0 || c.MaxBytes < 0 {
+			return nil, fmt.Errorf("storage: retention rule %s: limits must not be negative", c.Name)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// selects reports whether the rule's kind and patterns select a stream.
+func (r *retentionRule) selects(kind, job, target, app string) bool {
+	glob := func(pattern, s string) bool {
+		ok, _ := path.Match(pattern, s)
+		return pattern == "" || ok
+	}
+	return (r.Kind == "" || r.Kind == kind) && glob(r.Job, job) && glob(r.Target, target) && glob(r.App, app)
+}
+
+// RetentionDeletion is one deletion retention would make: a whole segment,
+// the lines of a log segment that one rule applies to (Partial, when its
+// lines fall to several), or for processes and events the records of a
+// file before Before. The Bytes of a partial deletion are estimated from
+// the lines' share of the segment.
+type RetentionDeletion struct {
+	Stream  string    `json:"stream"`
+	Kind    string    `json:"kind"`
+	Job     string    `json:"job"`
+	Target  string    `json:"target"`
+	App     string    `json:"app,omitempty"`
+	Start   time.Time `json:"start,omitzero"`
+	End     time.Time `json:"end,omitzero"`
+	Before  time.Time `json:"before,omitzero"`
+	Bytes   int64     `json:"bytes"`
+	Reason  string    `json:"reason"`         // age or size
+	Rule    string    `json:"rule,omitempty"` // the rule that applied, if any
+	Partial bool      `json:"partial,omitempty"`
+
+	seg  segment
+	rule int
+}
+
+// RetentionReport is what one retention round would delete.
+type RetentionReport struct {
+	Deletions []RetentionDeletion `json:"deletions"`
+	Bytes     int64               `json:"bytes"`      // freed by deleting the segments
+	KeptBytes int64               `json:"kept_bytes"` // of the segments left
+}
+
+// retentionState serializes retention rounds and remembers how the lines
+// of log segments split between rules, keyed by path.
+type retentionState struct {
+	mu     sync.Mutex
+	splits map[string]lineSplit
+}
+
+// lineSplit is the raw bytes of a segment's lines by the rule applying to
+// each, when its size was size.
+type lineSplit struct {
+	size  int64
+	bytes map[int]int64
+}
+
+// lineRules returns the rules with a match pattern that select a stream,
+// in order, up to the first rule without one, which applies to the lines
+// none of them match (-1: the default retention of the kind).
+func (d *DiskStorage) lineRules(stream string) (match []int, rule int) {
+	kind, job, target, app := parseStream(stream)
+	for i := range d.rules {
+		r := &d.rules[i]
+		if !r.selects(kind, job, target, app) {
+			continue
+		}
+		if r.match == nil {
+			return match, i
+		}
+		match = append(match, i)
+	}
+	return match, -1
+}
+
+// lineRule returns the rule applying to a line, given the lineRules of its
+// stream.
+func (d *DiskStorage) lineRule(match []int, rule int, line string) int {
+	for _, i := range match {
+		if d.rules[i].match.MatchString(line) {
+			return i
+		}
+	}
+	return rule
+}
+
+// splitLines returns how the lines of a log segment split between rules,
+// rescanning only segments that changed since the last round. Callers hold
+// d.retention.mu.
+func (d *DiskStorage) splitLines(seg segment, match []int, rule int, seen map[string]bool) map[int]int64 {
+	seen[seg.path] = true
+	if sp, ok := d.retention.splits[seg.path]; ok && sp.size == seg.size {
+		return sp.bytes
+	}
+	bytes := make(map[int]int64)
+	all := func(lo, hi uint32) bool { return true }
+	d.sealMu.RLock()
+	d.readRecords(seg, all, func(_ uint32, raw []byte) error {
+		bytes[d.lineRule(match, rule, recordLine(raw))] += int64(len(raw)) + 1
+		return nil
+	})
+	d.sealMu.RUnlock()
+	d.retention.splits[seg.path] = lineSplit{size: seg.size, bytes: bytes}
+	return bytes
+}
+
+// ruleFor returns the index of the first rule selecting a segment, or -1.
+// Rules with a match pattern apply to the lines they match rather than to
+// whole segments: when the lines of a log segment fall to more than one
+// rule, ruleFor also returns the share of the segment's size each applies
+// to, and the rule of its other lines.
+func (d *DiskStorage) ruleFor(seg segment, seen map[string]bool) (int, map[int]int64) {
+	match, rule := d.lineRules(seg.stream)
+	if len(match) == 0 {
+		return rule, nil
+	}
+	bytes := d.splitLines(seg, match, rule, seen)
+	if len(bytes) < 2 {
+		for r := range bytes {
+			return r, nil
+		}
+		return rule, nil
+	}
+	var raw int64
+	for _, n := range bytes {
+		raw += n
+	}
+	parts := make(map[int]int64, len(bytes))
+	for r, n := range bytes {
+		parts[r] = seg.size * n / raw
+	}
+	return rule, parts
+}
+
+// maxAge returns the age limit of a rule, or the default of a kind for -1.
+func (d *DiskStorage) maxAge(rule int, kind string) time.Duration {
+	if rule >= 0 {
+		return d.rules[rule].MaxAge
+	}
+	return time.Duration(d.retentionFor(kind)) * 24 * time.Hour
+}
+
+// planRetention returns the segments one retention round deletes. Callers
+// hold d.retention.mu.
+func (d *DiskStorage) planRetention(now time.Time) RetentionReport {
+	var all []segment
+	for _, kind := range segmentKinds {
+		segs, err := segmentsIn(filepath.Join(d.dir, kind+"_*"), time.Time{}, time.Time{})
+		if err != nil {
+			continue
+		}
+		all = append(all, segs...)
+	}
+	rollup := func(seg segment) bool {
+		return strings.HasPrefix(seg.stream, "metrics") && streamKind(seg.stream) != "metrics"
+	}
+	// under size pressure raw data goes before rollups
+	sort.SliceStable(all, func(i, j int) bool {
+		if ri, rj := rollup(all[i]), rollup(all[j]); ri != rj {
+			return rj
+		}
+		return all[i].start.Before(all[j].start)
+	})
+
+	report := RetentionReport{Deletions: []RetentionDeletion{}}
+	seen := make(map[string]bool)
+	del := func(seg segment, rule int, reason string, partial bool) {
+		kind, job, target, app := parseStream(seg.stream)
+		del := RetentionDeletion{Stream: seg.stream, Kind: kind, Job: job, Target: target, App: app,
+			Start: seg.start, End: seg.end, Bytes: seg.size, Reason: reason, Partial: partial, seg: seg, rule: rule}
+		if rule >= 0 {
+			del.Rule = d.rules[rule].Name
+		}
+		report.Deletions = append(report.Deletions, del)
+		report.Bytes += seg.size
+	}
+	expired := func(seg segment, rule int) bool {
+		age := d.maxAge(rule, streamKind(seg.stream))
+		return age > 0 && !seg.end.After(now.Add(-age))
+	}
+
+	// parts holds the bytes each rule applies to of a segment whose lines
+	// fall to several; dropping a part leaves the others in the segment.
+	type ruled struct {
+		segment
+		rule  int
+		parts map[int]int64
+	}
+	drop := func(s *ruled, rule int, reason string) {
+		part := s.segment
+		part.size = s.parts[rule]
+		del(part, rule, reason, true)
+		s.size -= part.size
+		delete(s.parts, rule)
+	}
+	var kept []*ruled
+	for _, seg := range all {
+		rule, parts := d.ruleFor(seg, seen)
+		s := &ruled{seg, rule, parts}
+		if parts == nil {
+			if expired(seg, rule) {
+				del(seg, rule, "age", false)
+				continue
+			}
+			kept = append(kept, s)
+			continue
+		}
+		var gone []int
+		for _, r := range slices.Sorted(maps.Keys(parts)) {
+			if expired(seg, r) {
+				gone = append(gone, r)
+			}
+		}
+		if len(gone) == len(parts) {
+			if _, ok := parts[rule]; !ok {
+				rule = gone[0]
+			}
+			del(seg, rule, "age", false)
+			continue
+		}
+		for _, r := range gone {
+			drop(s, r, "age")
+		}
+		kept = append(kept, s)
+	}
+	for key := range d.retention.splits {
+		if !seen[key] {
+			delete(d.retention.splits, key) // segment gone
+		}
+	}
+
+	// rules returns the bytes of a kept segment by rule.
+	rules := func(s *ruled) map[int]int64 {
+		if s.parts == nil {
+			return map[int]int64{s.rule: s.size}
+		}
+		return s.parts
+	}
+	ruleBytes := make(map[int]int64)
+	var total int64
+	perTarget := make(map[string]int64)
+	for _, s := range kept {
+		for r, n := range rules(s) {
+			ruleBytes[r] += n
+		}
+		total += s.size
+		perTarget[streamTarget(s.stream)] += s.size
+	}
+	overRule := func(r int) bool {
+		return r >= 0 && d.rules[r].MaxBytes > 0 && ruleBytes[r] > d.rules[r].MaxBytes
+	}
+	for _, s := range kept {
+		t := streamTarget(s.stream)
+		// a rule over its limit drops its lines of a segment it shares
+		for _, r := range slices.Sorted(maps.Keys(s.parts)) {
+			if len(s.parts) > 1 && overRule(r) {
+				n := s.parts[r]
+				drop(s, r, "size")
+				ruleBytes[r] -= n
+				total -= n
+				perTarget[t] -= n
+			}
+		}
+		over := (d.maxBytes > 0 && total > d.maxBytes) || (d.maxTargetBytes > 0 && perTarget[t] > d.maxTargetBytes)
+		for r := range rules(s) {
+			over = over || overRule(r)
+		}
+		if !over {
+			continue
+		}
+		rule := s.rule
+		if len(s.parts) == 1 {
+			for r := range s.parts {
+				rule = r // the other rules' lines are gone
+			}
+		}
+		del(s.segment, rule, "size", false)
+		for r, n := range rules(s) {
+			ruleBytes[r] -= n
+		}
+		total -= s.size
+		perTarget[t] -= s.size
+	}
+	report.KeptBytes = total
+	return report
+}
+
+// enforceSegmentRetention carries out one retention round over the
+// segments. The segment being written is never kept open across a
+// deletion: its writer is closed first. Segments losing some of their
+// lines are rewritten without them.
+func (d *DiskStorage) enforceSegmentRetention(now time.Time) {
+	d.retention.mu.Lock()
+	defer d.retention.mu.Unlock()
+	report := d.planRetention(now)
+	deleted := make(map[string]bool)
+	for _, del := range report.Deletions {
+		if !del.Partial {
+			d.deleteSegment(del.seg, del.Reason)
+			deleted[del.seg.path] = true
+		}
+	}
+	var trims []segment
+	dropped := make(map[string]map[int]bool)
+	for _, del := range report.Deletions {
+		if !del.Partial || deleted[del.seg.path] {
+			continue
+		}
+		if dropped[del.seg.path] == nil {
+			dropped[del.seg.path] = make(map[int]bool)
+			trims = append(trims, del.seg)
+		}
+		dropped[del.seg.path][del.rule] = true
+	}
+	for _, seg := range trims {
+		match, rule := d.lineRules(seg.stream)
+		keep := func(line string) bool { return !dropped[seg.path][d.lineRule(match, rule, line)] }
+		if err := d.trimSegment(seg, keep); err != nil {
+			fmt.Fprintf(os.Stderr, "retention: trim %s: %v\n", seg.path, err)
+		}
+	}
+	d.writers.storedBytes.Store(report.KeptBytes)
+	d.catalog.prune(d.dir, d.writers.flush)
+}
+
+// recordCutoff returns the time before which the records of a processes or
+// events file are pruned, and the rule that set it.
+func (d *DiskStorage) recordCutoff(file string, now time.Time) (time.Time, int, bool) {
+	kind, job, target, _ := parseStream(filepath.Base(file))
+	rule := -1
+	for i := range d.rules {
+		if d.rules[i].selects(kind, job, target, "") {
+			rule = i
+			break
+		}
+	}
+	age := d.maxAge(rule, kind)
+	if age <= 0 {
+		return time.Time{}, rule, false
+	}
+	return now.Add(-age), rule, true
+}
+
+// recordFiles returns the processes and events files.
+func (d *DiskStorage) recordFiles() []string {
+	var files []string
+	for _, kind := range []string{"processes", "events"} {
+		matches, _ := filepath.Glob(filepath.Join(d.dir, kind+"_*.jsonl"))
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// PreviewRetention returns what a retention round would delete now,
+// without deleting anything. Processes and events files are listed when
+// they hold records to prune; they are pruned daily.
+func (d *DiskStorage) PreviewRetention() RetentionReport {
+	return d.previewRetention(time.Now())
+}
+
+// previewRetention implements PreviewRetention for a round at now.
+func (d *DiskStorage) previewRetention(now time.Time) RetentionReport {
+	d.writers.flush() // count buffered records in segment sizes
+	d.retention.mu.Lock()
+	report := d.planRetention(now)
+	d.retention.mu.Unlock()
+	for _, fn := range d.recordFiles() {
+		cutoff, rule, ok := d.recordCutoff(fn, now)
+		if !ok {
+			continue
+		}
+		if first, _, ok := recordSpan(fn); !ok || !first.Before(cutoff) {
+			continue // nothing to prune
+		}
+		kind, job, target, _ := parseStream(filepath.Base(fn))
+		del := RetentionDeletion{Stream: filepath.Base(fn), Kind: kind, Job: job, Target: target, Before: cutoff.UTC(), Reason: "age"}
+		if rule >= 0 {
+			del.Rule = d.rules[rule].Name
+		}
+		report.Deletions = append(report.Deletions, del)
+	}
+	return report
+}
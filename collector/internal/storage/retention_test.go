@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// previewRetention previews a retention round of a backend at now.
+func previewRetention(t *testing.T, b Backend, now time.Time) RetentionReport {
+	t.Helper()
+	switch s := b.(type) {
+	case *DiskStorage:
+		return s.previewRetention(now)
+	case *SQLiteStorage:
+		return s.previewRetention(now)
+	}
+	t.Fatalf("no retention for %T", b)
+	return RetentionReport{}
+}
+
+// applyRetention carries out one retention round of a backend at now.
+func applyRetention(t *testing.T, b Backend, now time.Time) {
+	t.Helper()
+	switch s := b.(type) {
+	case *DiskStorage:
+		s.writers.flush()
+		s.enforceSegmentRetention(now)
+	case *SQLiteStorage:
+		s.enforceRetention(now)
+	default:
+		t.Fatalf("no retention for %T", b)
+	}
+}
+
+// The preview lists what a retention round deletes, by rule, without
+// deleting it; the round then deletes exactly that. The rounds run three
+// hours ahead so that the background round at open deletes nothing.
+func TestRetentionPreviewThenApply(t *testing.T) {
+	for _, typ := range backendTypes {
+		t.Run(typ, func(t *testing.T) {
+			cfg := testStorageConfig(typ, t.TempDir())
+			cfg.Compression = "none"
+			cfg.Retention = []config.RetentionRule{{Name: "debug", Kind: "logs", App: "debug", MaxAge: time.Hour}}
+			s, err := Open(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			now := time.Now().UTC()
+			later := now.Add(3 * time.Hour)
+			s.StoreLog("web", "h1", nil, now.Add(-30*time.Minute), "[debug] old debug")
+			s.StoreLog("web", "h1", nil, later, "[debug] new debug")
+			s.StoreLog("web", "h1", nil, now.Add(-30*time.Minute), "[api] old api")
+			lines := func() []string {
+				t.Helper()
+				page, err := s.QueryLogs(LogQuery{Selector: Selector{Job: "web"}, Forward: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := logLines(page.Lines)
+				slices.Sort(got)
+				return got
+			}
+
+			report := previewRetention(t, s, later)
+			var planned []RetentionDeletion
+			for _, d := range report.Deletions {
+				if d.Kind == "logs" {
+					planned = append(planned, d)
+				}
+			}
+			if len(planned) != 1 || planned[0].App != "debug" || planned[0].Rule != "debug" || planned[0].Reason != "age" || planned[0].Bytes <= 0 {
+				t.Fatalf("planned deletions: %+v", report.Deletions)
+			}
+			if got := lines(); !slices.Equal(got, []string{"new debug", "old api", "old debug"}) {
+				t.Fatalf("lines after the preview: %v", got)
+			}
+
+			applyRetention(t, s, later)
+			if got := lines(); !slices.Equal(got, []string{"new debug", "old api"}) {
+				t.Fatalf("lines after retention: %v", got)
+			}
+			for _, d := range previewRetention(t, s, later).Deletions {
+				if d.Kind == "logs" {
+					t.Fatalf("planned after retention: %+v", d)
+				}
+			}
+		})
+	}
+}
+
+// Retention rules are checked when the disk backend opens.
+func TestRetentionRuleErrors(t *testing.T) {
+	for _, r := range []config.RetentionRule{
+		{Kind: "traces"},
+		{Job: "["},
+		{Kind: "metrics", Match: "ERROR"},
+		{Kind: "logs", Match: "("},
+		{MaxAge: -time.Hour},
+	} {
+		if _, err := compileRetentionRules([]config.RetentionRule{r}); err == nil {
+			t.Errorf("rule %+v accepted", r)
+		}
+	}
+	rules, err := compileRetentionRules([]config.RetentionRule{{Kind: "logs", Match: "ERROR"}, {Job: "web-*"}})
+	if err != nil || rules[0].Name != "rule1" || rules[1].Name != "rule2" {
+		t.Fatalf("default names: %+v, %v", rules, err)
+	}
+}
+
+// Rules with a match pattern apply to the lines they match: a segment whose
+// lines fall to several rules loses only those of the rules that expired,
+// and is deleted once they all have. The rounds run two days ahead.
+func TestLineRetention(t *testing.T) {
+	for _, compression := range []string{"none", "gzip"} {
+		t.Run(compression, func(t *testing.T) {
+			d := openSegmented(t, func(cfg *config.StorageConfig) {
+				cfg.Compression = compression
+				cfg.Retention = []config.RetentionRule{
+					{Name: "errors", Kind: "logs", Match: "ERROR", MaxAge: 30 * 24 * time.Hour},
+					{Name: "debug", Kind: "logs", Match: "DEBUG", MaxAge: 24 * time.Hour},
+					{Name: "info", Kind: "logs", MaxAge: 3 * 24 * time.Hour},
+				}
+			})
+			now := time.Now().UTC()
+			later := now.Add(48 * time.Hour)
+			for _, at := range []time.Time{now.Add(-48 * time.Hour), now} {
+				for _, line := range []string{"ERROR failed", "info served", "DEBUG state"} {
+					d.StoreLog("web", "h1", nil, at, "[api] "+line)
+				}
+			}
+			d.writers.flush()
+			stream := streamName("logs", "web", "h1", "api")
+			lines := func() []string {
+				t.Helper()
+				page, err := d.QueryLogs(LogQuery{Selector: Selector{Job: "web"}, Forward: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return logLines(page.Lines)
+			}
+
+			var planned []string
+			for _, del := range d.previewRetention(later).Deletions {
+				if del.Kind == "logs" {
+					if !del.Partial || del.Bytes <= 0 || del.Reason != "age" {
+						t.Errorf("deletion: %+v", del)
+					}
+					planned = append(planned, del.Start.Format(time.DateOnly)+" "+del.Rule)
+				}
+			}
+			old, cur := now.Add(-48*time.Hour).Format(time.DateOnly), now.Format(time.DateOnly)
+			if want := []string{old + " debug", old + " info", cur + " debug"}; !slices.Equal(planned, want) {
+				t.Fatalf("planned deletions: got %v, want %v", planned, want)
+			}
+
+			d.enforceSegmentRetention(later)
+			if got, want := lines(), []string{"ERROR failed", "ERROR failed", "info served"}; !slices.Equal(got, want) {
+				t.Fatalf("lines after retention: got %v, want %v", got, want)
+			}
+			res, err := d.SearchLogs(SearchQuery{Search: "served"})
+			if err != nil || len(res.Matches) != 1 {
+				t.Fatalf("search after rewriting: %+v, %v", res.Matches, err)
+			}
+			for _, del := range d.previewRetention(later).Deletions {
+				if del.Kind == "logs" {
+					t.Fatalf("planned after retention: %+v", del)
+				}
+			}
+			d.StoreLog("web", "h1", nil, now, "[api] DEBUG appended")
+			if got := lines(); len(got) != 4 || got[3] != "DEBUG appended" {
+				t.Fatalf("lines after an append: %v", got)
+			}
+
+			d.enforceSegmentRetention(now.Add(40 * 24 * time.Hour))
+			if files := segmentFiles(t, d, stream); len(files) != 0 {
+				t.Fatalf("segments left: %v", files)
+			}
+		})
+	}
+}
@@ -0,0 +1,580 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// Raw scrapes are rolled up into 5m buckets, and those into 1h buckets,
+// stored as streams of their own next to the raw one: metrics5m_<job>_<target>
+// and metrics1h_<job>_<target>. Each record summarizes every series of one
+// bucket. A bucket is rolled up once it is complete, and the last record
+// written is where the next round resumes, so rollups need no state of
+// their own and survive restarts. Rollup segments are retained, compressed
+// and queried like raw ones. Scrapes stored after their bucket was rolled
+// up, imported or replayed from an exporter's buffer, are noted as late and
+// their buckets rolled up again by the next round (see lateScrapes).
+
+const (
+	rollupDelay    = 2 * time.Minute // scrapes of a bucket may be stored this late
+	maxQueryPoints = 11000           // points per series a query should return at most
+)
+
+// rollupLevel is one rollup resolution.
+type rollupLevel struct {
+	kind          string // stream kind, e.g. metrics5m
+	step          time.Duration
+	segment       time.Duration // period of one segment file
+	retentionDays int           // 0 keeps them
+}
+
+func newRollupLevels(cfg config.RollupConfig) []rollupLevel {
+	if cfg.Disabled {
+		return nil
+	}
+	days := func(v, def int) int {
+		switch {
+		case v == 0:
+			return def
+		case v < 0:
+			return 0
+		}
+		return v
+	}
+	return []rollupLevel{
+		{kind: "metrics5m", step: 5 * time.Minute, segment: 24 * time.Hour, retentionDays: days(cfg.RetentionDays5m, 30)},
+		{kind: "metrics1h", step: time.Hour, segment: 7 * 24 * time.Hour, retentionDays: days(cfg.RetentionDays1h, 365)},
+	}
+}
+
+// RollupSeries summarizes one series over a rollup bucket.
+type RollupSeries struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Min    float64           `json:"min"`
+	Max    float64           `json:"max"`
+	Avg    float64           `json:"avg"`
+	Last   float64           `json:"last"`
+	Count  int64             `json:"count"`
+}
+
+// rollupRecord is one line of a rollup segment: all series of a job/target
+// over the bucket starting at Timestamp.
+type rollupRecord struct {
+	Timestamp  string            `json:"timestamp"`
+	Resolution string            `json:"resolution"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Series     []RollupSeries    `json:"series"`
+}
+
+// seriesAgg accumulates one series of a bucket.
+type seriesAgg struct {
+	RollupSeries
+	sum    float64
+	lastTS time.Time
+}
+
+func (a *seriesAgg) merge(s RollupSeries, ts time.Time) {
+	if a.Count == 0 {
+		a.RollupSeries, a.sum, a.lastTS = s, s.Avg*float64(s.Count), ts
+		return
+	}
+	a.Min = math.Min(a.Min, s.Min)
+	a.Max = math.Max(a.Max, s.Max)
+	a.sum += s.Avg * float64(s.Count)
+	a.Count += s.Count
+	if !ts.Before(a.lastTS) {
+		a.Last, a.lastTS = s.Last, ts
+	}
+}
+
+// rollupBucket accumulates all series of one bucket.
+type rollupBucket struct {
+	labels   map[string]string
+	labelsTS time.Time
+	series   map[string]*seriesAgg
+}
+
+func (b *rollupBucket) add(s RollupSeries, ls map[string]string, ts time.Time) {
+	if ts.After(b.labelsTS) || b.labels == nil {
+		b.labels, b.labelsTS = ls, ts
+	}
+	k := seriesKey(s.Name, s.Labels)
+	a := b.series[k]
+	if a == nil {
+		a = &seriesAgg{}
+		b.series[k] = a
+	}
+	a.merge(s, ts)
+}
+
+// seriesKey identifies a series by name and labels.
+func seriesKey(name string, ls map[string]string) string {
+	keys := make([]string, 0, len(ls))
+	for k := range ls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteString("\x00" + k + "=" + ls[k])
+	}
+	return b.String()
+}
+
+// rollupMetrics writes the rollups of every metrics stream for the buckets
+// completed since the last round: 5m from raw scrapes, 1h from 5m.
+func (d *DiskStorage) rollupMetrics(now time.Time) {
+	if len(d.rollups) == 0 {
+		return
+	}
+	d.rollupLate(now)
+	d.writers.flush() // earlier rollups and scrapes must be visible
+	dirs, err := streamDirs(filepath.Join(d.dir, "metrics_*"))
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		rest := strings.TrimPrefix(filepath.Base(dir), "metrics_")
+		src, srcDone := filepath.Base(dir), now.Add(-rollupDelay)
+		for _, l := range d.rollups {
+			dst := l.kind + "_" + rest
+			done, err := d.rollupStream(l, src, dst, srcDone)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "storage: rollup %s: %v\n", dst, err)
+				break
+			}
+			src, srcDone = dst, done
+		}
+	}
+}
+
+// rollupLate rolls up again the buckets of the scrapes stored late, at
+// every level. Each stream is caught up first, as late scrapes may fall
+// past the buckets rolled up so far.
+func (d *DiskStorage) rollupLate(now time.Time) {
+	late := d.late.take()
+	if len(late) == 0 {
+		return
+	}
+	d.writers.flush() // the late scrapes must be visible
+	for k, span := range late {
+		src, srcDone := streamName("metrics", k.job, k.target), now.Add(-rollupDelay)
+		for _, l := range d.rollups {
+			dst := streamName(l.kind, k.job, k.target)
+			done, err := d.rollupStream(l, src, dst, srcDone)
+			if from, to := span.buckets(l, done); err == nil && from.Before(to) {
+				err = d.rollupAgain(l, src, dst, from, to)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "storage: rollup %s: %v\n", dst, err)
+				break
+			}
+			src, srcDone = dst, done
+		}
+	}
+}
+
+// rollupAgain replaces the records of dst for the buckets in [from, to)
+// with a new rollup of src.
+func (d *DiskStorage) rollupAgain(l rollupLevel, src, dst string, from, to time.Time) error {
+	recs, err := d.rollupRange(l, src, from, to)
+	if err != nil {
+		return err
+	}
+	for start := from.Truncate(l.segment); start.Before(to); start = start.Add(l.segment) {
+		lo, hi := start, start.Add(l.segment)
+		if lo.Before(from) {
+			lo = from
+		}
+		if hi.After(to) {
+			hi = to
+		}
+		var lines [][]byte
+		for len(recs) > 0 {
+			ts, _ := time.Parse(time.RFC3339Nano, recs[0].Timestamp)
+			if !ts.Before(hi) {
+				break
+			}
+			if line, err := json.Marshal(recs[0]); err == nil {
+				lines = append(lines, line)
+				d.noteStream(dst, recs[0].Labels)
+			}
+			recs = recs[1:]
+		}
+		if err := d.replaceRecords(filepath.Join(d.dir, dst, segmentName(start, l.segment)), lo, hi, lines); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceRecords replaces the records of the segment at path dated within
+// [lo, hi) with lines, dated within it and oldest first, keeping the
+// segment in time order. The segment is written back plain, for compaction
+// to compress again.
+func (d *DiskStorage) replaceRecords(path string, lo, hi time.Time, lines [][]byte) error {
+	d.sealMu.Lock()
+	defer d.sealMu.Unlock()
+	w := d.writers.lock(path)
+	defer w.mu.Unlock()
+	if err := d.writers.closeLocked(w); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	put := func(line []byte) {
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	seg, found := findSegment(path)
+	if found {
+		f, err := d.openSegment(seg, time.Time{}, time.Time{})
+		if err != nil {
+			return err
+		}
+		err = eachLine(f, func(raw []byte) error {
+			var head struct {
+				Timestamp string `json:"timestamp"`
+			}
+			json.Unmarshal(raw, &head)
+			ts, err := time.Parse(time.RFC3339Nano, head.Timestamp)
+			if err == nil && !ts.Before(lo) {
+				if ts.Before(hi) {
+					return nil // replaced
+				}
+				for _, line := range lines {
+					put(line)
+				}
+				lines = nil
+			}
+			put(raw)
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, line := range lines {
+		put(line)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if found {
+		removeFiles(append(seg.sealing, path+compressedSuffix))
+	}
+	return nil
+}
+
+// lateScrapes notes, per job/target, the span of the scrapes stored after
+// their 5m bucket may have been rolled up. It is kept in memory only: the
+// buckets are rolled up again by the next round or, at the latest, when
+// the store closes.
+type lateScrapes struct {
+	mu    sync.Mutex
+	spans map[jobTarget]lateSpan
+}
+
+type jobTarget struct{ job, target string }
+
+// lateSpan is the span of the late scrapes of a job/target, inclusive.
+type lateSpan struct{ first, last time.Time }
+
+// note records a scrape of job/target at ts if it is stored at now, after
+// the round that rolls its bucket up may have run.
+func (ls *lateScrapes) note(levels []rollupLevel, job, target string, ts, now time.Time) {
+	if len(levels) == 0 || ts.Truncate(levels[0].step).Add(levels[0].step).After(now.Add(-rollupDelay)) {
+		return
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.spans == nil {
+		ls.spans = make(map[jobTarget]lateSpan)
+	}
+	k := jobTarget{job, target}
+	span, ok := ls.spans[k]
+	if !ok || ts.Before(span.first) {
+		span.first = ts
+	}
+	if !ok || ts.After(span.last) {
+		span.last = ts
+	}
+	ls.spans[k] = span
+}
+
+// take returns the spans noted since the last call.
+func (ls *lateScrapes) take() map[jobTarget]lateSpan {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	spans := ls.spans
+	ls.spans = nil
+	return spans
+}
+
+// buckets returns the buckets of l the span falls in, [from, to), up to
+// done, the end of those already rolled up.
+func (span lateSpan) buckets(l rollupLevel, done time.Time) (from, to time.Time) {
+	from, to = span.first.Truncate(l.step), span.last.Truncate(l.step).Add(l.step)
+	if to.After(done) {
+		to = done
+	}
+	return from, to
+}
+
+// rollupStream rolls src up into dst for the buckets that end by srcDone,
+// the time up to which src is complete. It returns the time up to which dst
+// is complete.
+func (d *DiskStorage) rollupStream(l rollupLevel, src, dst string, srcDone time.Time) (time.Time, error) {
+	from, ok := d.rollupWatermark(l, dst)
+	if !ok {
+		segs := listSegments(filepath.Join(d.dir, src))
+		if len(segs) == 0 {
+			return time.Time{}, nil
+		}
+		from = segs[0].start.Truncate(l.step)
+	}
+	until := srcDone.Truncate(l.step)
+	for from.Before(until) {
+		// one segment's worth at a time bounds memory after a long pause
+		to := from.Truncate(l.segment).Add(l.segment)
+		if to.After(until) {
+			to = until
+		}
+		recs, err := d.rollupRange(l, src, from, to)
+		if err != nil {
+			return from, err
+		}
+		for _, rec := range recs {
+			line, err := json.Marshal(rec)
+			if err != nil {
+				continue
+			}
+			ts, _ := time.Parse(time.RFC3339Nano, rec.Timestamp)
+			d.writers.append(filepath.Join(d.dir, dst, segmentName(ts.Truncate(l.segment), l.segment)), line)
+			d.noteStream(dst, rec.Labels)
+		}
+		from = to
+	}
+	return from, nil
+}
+
+// rollupWatermark returns the end of the last bucket written to dst.
+func (d *DiskStorage) rollupWatermark(l rollupLevel, dst string) (time.Time, bool) {
+	d.sealMu.RLock()
+	defer d.sealMu.RUnlock()
+	seg, ok := newestSegment(filepath.Join(d.dir, dst))
+	if !ok {
+		return time.Time{}, false
+	}
+	line, err := d.segmentLastLine(seg)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var head struct {
+		Timestamp string `json:"timestamp"`
+	}
+	if json.Unmarshal(line, &head) != nil {
+		return time.Time{}, false
+	}
+	ts, err := time.Parse(time.RFC3339Nano, head.Timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts.Add(l.step), true
+}
+
+// rollupRange summarizes the records of src in [from, to) into buckets of
+// l.step, oldest first. src holds raw scrapes or rollups of a finer level.
+func (d *DiskStorage) rollupRange(l rollupLevel, src string, from, to time.Time) ([]rollupRecord, error) {
+	agg := newRollupAgg(l, from, to, strings.HasPrefix(src, "metrics_"))
+	d.sealMu.RLock()
+	defer d.sealMu.RUnlock()
+	segs, err := segmentsIn(filepath.Join(d.dir, src), from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segs {
+		f, err := d.openSegment(seg, from, to)
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for sc.Scan() {
+			agg.addLine(sc.Bytes())
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return agg.records(), nil
+}
+
+// rollupAgg summarizes raw scrape or finer rollup records into the buckets
+// of one level within [from, to).
+type rollupAgg struct {
+	l        rollupLevel
+	from, to time.Time
+	raw      bool
+	buckets  map[time.Time]*rollupBucket
+}
+
+func newRollupAgg(l rollupLevel, from, to time.Time, raw bool) *rollupAgg {
+	return &rollupAgg{l: l, from: from, to: to, raw: raw, buckets: make(map[time.Time]*rollupBucket)}
+}
+
+func (a *rollupAgg) add(ts time.Time, ls map[string]string, series []RollupSeries) {
+	if ts.Before(a.from) || !ts.Before(a.to) {
+		return
+	}
+	start := ts.Truncate(a.l.step)
+	b := a.buckets[start]
+	if b == nil {
+		b = &rollupBucket{series: make(map[string]*seriesAgg)}
+		a.buckets[start] = b
+	}
+	for _, s := range series {
+		b.add(s, ls, ts)
+	}
+}
+
+// addLine adds one stored record; unreadable ones are skipped.
+func (a *rollupAgg) addLine(line []byte) {
+	if a.raw {
+		ts, ls, mfs, err := decodeMetricsLine(line)
+		if err != nil {
+			return
+		}
+		var series []RollupSeries
+		for _, s := range Samples(mfs) {
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				continue // not representable in JSON
+			}
+			series = append(series, RollupSeries{Name: s.Name, Labels: s.Labels, Min: s.Value, Max: s.Value, Avg: s.Value, Last: s.Value, Count: 1})
+		}
+		a.add(ts, ls, series)
+		return
+	}
+	var rec rollupRecord
+	if json.Unmarshal(line, &rec) != nil {
+		return
+	}
+	ts, err := time.Parse(time.RFC3339Nano, rec.Timestamp)
+	if err != nil {
+		return
+	}
+	a.add(ts, rec.Labels, rec.Series)
+}
+
+// records returns the rollup records of the buckets, oldest first.
+func (a *rollupAgg) records() []rollupRecord {
+	starts := make([]time.Time, 0, len(a.buckets))
+	for ts := range a.buckets {
+		starts = append(starts, ts)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	out := make([]rollupRecord, 0, len(starts))
+	for _, ts := range starts {
+		b := a.buckets[ts]
+		keys := make([]string, 0, len(b.series))
+		for k := range b.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		rec := rollupRecord{Timestamp: ts.UTC().Format(time.RFC3339Nano), Resolution: formatLength(a.l.step), Labels: b.labels}
+		for _, k := range keys {
+			s := b.series[k]
+			s.Avg = s.sum / float64(s.Count)
+			rec.Series = append(rec.Series, s.RollupSeries)
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// metricsKind picks the stream kind a metrics query is answered from. An
+// explicit q.Resolution (raw, 5m or 1h) wins; otherwise the coarsest
+// resolution no coarser than the step, or than the range split into
+// maxQueryPoints, that is still retained at q.Start.
+func (d *DiskStorage) metricsKind(q MetricQuery, now time.Time) (string, error) {
+	return pickMetricsKind(q, now, d.retentionDays, d.rollups)
+}
+
+// pickMetricsKind implements metricsKind for raw scrapes kept retentionDays
+// (0 keeps them) and the given rollup levels.
+func pickMetricsKind(q MetricQuery, now time.Time, retentionDays int, rollups []rollupLevel) (string, error) {
+	step := func(i int) time.Duration {
+		if i < len(rollups) {
+			return rollups[i].step
+		}
+		return math.MaxInt64
+	}
+	switch q.Resolution {
+	case "raw":
+		return "metrics", nil
+	case "", "auto":
+	default:
+		for _, l := range rollups {
+			if q.Resolution == formatLength(l.step) {
+				return l.kind, nil
+			}
+		}
+		return "", fmt.Errorf("%w: unknown resolution %q", ErrBadQuery, q.Resolution)
+	}
+
+	want := q.Step
+	if !q.Start.IsZero() {
+		end := q.End
+		if end.IsZero() {
+			end = now
+		}
+		if span := end.Sub(q.Start) / maxQueryPoints; span > want {
+			want = span
+		}
+	}
+	retained := func(days int) bool {
+		return days <= 0 || q.Start.IsZero() || !q.Start.Before(now.Add(-time.Duration(days)*24*time.Hour))
+	}
+	kind := "metrics"
+	if retained(retentionDays) && want < step(0) {
+		return kind, nil
+	}
+	for i, l := range rollups {
+		kind = l.kind
+		if retained(l.retentionDays) && want < step(i+1) {
+			break
+		}
+	}
+	return kind, nil
+}
+
+// retentionFor returns the retention in days of a segment stream kind.
+func (d *DiskStorage) retentionFor(kind string) int {
+	for _, l := range d.rollups {
+		if l.kind == kind {
+			return l.retentionDays
+		}
+	}
+	return d.retentionDays
+}
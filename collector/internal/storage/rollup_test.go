@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// Queries are answered from the coarsest resolution no coarser than their
+// step or range that is still retained at their start, unless they ask for
+// one.
+func TestPickMetricsKind(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	rollups := newRollupLevels(config.RollupConfig{})
+	day := 24 * time.Hour
+	for _, c := range []struct {
+		name string
+		q    MetricQuery
+		raw  int // retention days of raw scrapes
+		want string
+	}{
+		{"latest", MetricQuery{}, 7, "metrics"},
+		{"explicit raw", MetricQuery{Selector: Selector{Start: now.Add(-300 * day)}, Resolution: "raw"}, 7, "metrics"},
+		{"explicit 1h", MetricQuery{Resolution: "1h"}, 7, "metrics1h"},
+		{"auto", MetricQuery{Resolution: "auto"}, 7, "metrics"},
+		{"step below 5m", MetricQuery{Step: time.Minute}, 7, "metrics"},
+		{"step of 10m", MetricQuery{Step: 10 * time.Minute}, 7, "metrics5m"},
+		{"step of 2h", MetricQuery{Step: 2 * time.Hour}, 7, "metrics1h"},
+		{"one day", MetricQuery{Selector: Selector{Start: now.Add(-day)}}, 7, "metrics"},
+		{"before raw retention", MetricQuery{Selector: Selector{Start: now.Add(-10 * day), End: now.Add(-9 * day)}}, 7, "metrics5m"},
+		{"before 5m retention", MetricQuery{Selector: Selector{Start: now.Add(-60 * day), End: now.Add(-59 * day)}}, 7, "metrics1h"},
+	} {
+		got, err := pickMetricsKind(c.q, now, c.raw, rollups)
+		if err != nil || got != c.want {
+			t.Errorf("%s: got %s, %v, want %s", c.name, got, err, c.want)
+		}
+	}
+	if _, err := pickMetricsKind(MetricQuery{Resolution: "1m"}, now, 7, rollups); !errors.Is(err, ErrBadQuery) {
+		t.Errorf("unknown resolution: %v", err)
+	}
+	// forty days of raw points are more than a query should return
+	long := newRollupLevels(config.RollupConfig{RetentionDays5m: 60})
+	if got, _ := pickMetricsKind(MetricQuery{Selector: Selector{Start: now.Add(-40 * day)}}, now, 0, long); got != "metrics5m" {
+		t.Errorf("forty days: got %s, want metrics5m", got)
+	}
+	if got, _ := pickMetricsKind(MetricQuery{Step: 2 * time.Hour}, now, 7, nil); got != "metrics" {
+		t.Errorf("without rollups: got %s", got)
+	}
+}
+
+// Complete buckets are rolled up into 5m and 1h summaries of every series,
+// which queries return at those resolutions.
+func TestRollupSummaries(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Backend) {
+		s := open()
+		t0 := time.Now().UTC().Add(-3 * time.Hour).Truncate(time.Hour)
+		for i := range 10 {
+			s.StoreMetrics("web", "h1", nil, t0.Add(time.Duration(i)*time.Minute), gaugeFamily("pm2_up", float64(i)))
+		}
+		s.Close()
+
+		// rollups are written in the background once the store opens
+		s = open()
+		defer s.Close()
+		query := func(res string) []rollupRecord {
+			t.Helper()
+			raws, err := s.QueryMetrics(MetricQuery{Selector: Selector{Job: "web", Start: t0}, Resolution: res})
+			if err != nil {
+				t.Fatal(err)
+			}
+			recs := make([]rollupRecord, len(raws))
+			for i, raw := range raws {
+				if err := json.Unmarshal(raw, &recs[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return recs
+		}
+		var hourly []rollupRecord
+		for deadline := time.Now().Add(5 * time.Second); len(hourly) == 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("no 1h rollup")
+			}
+			hourly = query("1h")
+		}
+
+		five := query("5m")
+		if len(five) != 2 {
+			t.Fatalf("5m rollups: got %d, want 2", len(five))
+		}
+		for i, want := range []RollupSeries{
+			{Name: "pm2_up", Min: 0, Max: 4, Avg: 2, Last: 4, Count: 5},
+			{Name: "pm2_up", Min: 5, Max: 9, Avg: 7, Last: 9, Count: 5},
+		} {
+			if len(five[i].Series) != 1 || !sameSummary(five[i].Series[0], want) {
+				t.Errorf("5m bucket %d: %+v, want %+v", i, five[i].Series, want)
+			}
+		}
+		if len(hourly) != 1 || len(hourly[0].Series) != 1 || !sameSummary(hourly[0].Series[0], RollupSeries{Name: "pm2_up", Min: 0, Max: 9, Avg: 4.5, Last: 9, Count: 10}) {
+			t.Errorf("1h rollup: %+v", hourly)
+		}
+		if ts, _ := time.Parse(time.RFC3339Nano, hourly[0].Timestamp); !ts.Equal(t0) {
+			t.Errorf("1h bucket starts at %s, want %s", hourly[0].Timestamp, t0)
+		}
+	})
+}
+
+// Scrapes stored after their buckets were rolled up, as imported ones are,
+// are rolled up again with the scrapes stored before, at every level.
+func TestLateScrapeRollups(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Backend) {
+		s := open()
+		t0 := time.Now().UTC().Add(-3 * time.Hour).Truncate(time.Hour)
+		for i := range 10 {
+			s.StoreMetrics("web", "h1", nil, t0.Add(time.Duration(i)*time.Minute), gaugeFamily("pm2_up", float64(i)))
+		}
+		s.Close()
+		s = open()
+		waitRollup(t, s, t0, "1h", 1)
+
+		// late scrapes in a rolled up bucket and in one without any yet
+		s.StoreMetrics("web", "h1", nil, t0.Add(30*time.Second), gaugeFamily("pm2_up", 20))
+		s.StoreMetrics("web", "h1", nil, t0.Add(20*time.Minute), gaugeFamily("pm2_up", 10))
+		s.Close()
+		s = open()
+		defer s.Close()
+
+		five := waitRollup(t, s, t0, "5m", 3)
+		for i, want := range []RollupSeries{
+			{Name: "pm2_up", Min: 0, Max: 20, Avg: 5, Last: 4, Count: 6},
+			{Name: "pm2_up", Min: 5, Max: 9, Avg: 7, Last: 9, Count: 5},
+			{Name: "pm2_up", Min: 10, Max: 10, Avg: 10, Last: 10, Count: 1},
+		} {
+			if len(five[i].Series) != 1 || !sameSummary(five[i].Series[0], want) {
+				t.Errorf("5m bucket %d: %+v, want %+v", i, five[i].Series, want)
+			}
+		}
+		hourly := waitRollup(t, s, t0, "1h", 1)
+		if len(hourly[0].Series) != 1 || !sameSummary(hourly[0].Series[0], RollupSeries{Name: "pm2_up", Min: 0, Max: 20, Avg: 75.0 / 12, Last: 10, Count: 12}) {
+			t.Errorf("1h rollup: %+v", hourly)
+		}
+	})
+}
+
+// waitRollup waits for the rollups of job web from t0 at resolution res to
+// hold n buckets, as the background rounds write them, and returns them.
+func waitRollup(t *testing.T, s Backend, t0 time.Time, res string, n int) []rollupRecord {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		raws, err := s.QueryMetrics(MetricQuery{Selector: Selector{Job: "web", Start: t0}, Resolution: res})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(raws) == n {
+			recs := make([]rollupRecord, n)
+			for i, raw := range raws {
+				if err := json.Unmarshal(raw, &recs[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return recs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s rollups: got %d, want %d", res, len(raws), n)
+		}
+	}
+}
+
+func sameSummary(a, b RollupSeries) bool {
+	return a.Name == b.Name && a.Min == b.Min && a.Max == b.Max && a.Avg == b.Avg && a.Last == b.Last && a.Count == b.Count
+}
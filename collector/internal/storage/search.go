@@ -0,0 +1,456 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/search"
+)
+
+// Every log segment has an inverted index from the terms of its lines to
+// the ordinals of the records holding them, a record's ordinal being its
+// position in the segment in the order openSegment reads it. The index of
+// a segment in use lives in memory and is updated on every append; once
+// the segment is sealed, or has been idle for indexIdle, it is saved to
+// path+".idx" and dropped from memory. Records the saved index does not
+// cover (lost in a crash, or stored before indexing) are indexed from the
+// segment on first use. Search results are always checked against the
+// records themselves, so the index only narrows what is read.
+const (
+	indexSuffix = ".idx"
+	indexIdle   = 10 * time.Minute
+)
+
+// ErrBadQuery marks errors in a client's search query or cursor.
+var ErrBadQuery = errors.New("bad query")
+
+// errStopScan ends readRecords early without an error.
+var errStopScan = errors.New("stop scan")
+
+// logIndex is the inverted index of one log segment.
+type logIndex struct {
+	path string
+
+	mu      sync.Mutex
+	loaded  bool
+	dropped bool // removed from d.indexes; lockers must look it up again
+	lines   uint32
+	terms   map[string][]uint32
+	saved   uint32 // records covered by the index file
+	lastUse time.Time
+}
+
+// logIndexFile is the saved form of a logIndex.
+type logIndexFile struct {
+	Lines uint32              `json:"lines"`
+	Terms map[string][]uint32 `json:"terms"`
+}
+
+// Term implements search.Postings.
+func (ix *logIndex) Term(t string) []uint32 { return ix.terms[t] }
+
+// Prefix implements search.Postings.
+func (ix *logIndex) Prefix(p string) []uint32 {
+	var lists [][]uint32
+	for t, ids := range ix.terms {
+		if strings.HasPrefix(t, p) {
+			lists = append(lists, ids)
+		}
+	}
+	return search.Union(lists...)
+}
+
+// add indexes the next record of the segment.
+func (ix *logIndex) add(line string) {
+	for _, t := range search.Terms(line) {
+		ix.terms[t] = append(ix.terms[t], ix.lines)
+	}
+	ix.lines++
+}
+
+func (d *DiskStorage) index(path string) *logIndex {
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+	ix := d.indexes[path]
+	if ix == nil {
+		ix = &logIndex{path: path}
+		d.indexes[path] = ix
+	}
+	return ix
+}
+
+// lockIndex returns the loaded index of a log segment, locked, for
+// appending to the segment. Callers must not hold d.sealMu.
+func (d *DiskStorage) lockIndex(path string) *logIndex {
+	for {
+		ix := d.index(path)
+		ix.mu.Lock()
+		if !ix.dropped && !ix.loaded {
+			// loading reads the segment, which compaction must not move
+			ix.mu.Unlock()
+			d.sealMu.RLock()
+			ix.mu.Lock()
+			if !ix.dropped {
+				d.loadIndexLocked(ix)
+			}
+			d.sealMu.RUnlock()
+		}
+		if !ix.dropped {
+			ix.lastUse = time.Now()
+			return ix
+		}
+		ix.mu.Unlock()
+	}
+}
+
+// lockIndexSealed is lockIndex for callers holding d.sealMu for reading.
+func (d *DiskStorage) lockIndexSealed(path string) *logIndex {
+	for {
+		ix := d.index(path)
+		ix.mu.Lock()
+		if !ix.dropped {
+			d.loadIndexLocked(ix)
+			ix.lastUse = time.Now()
+			return ix
+		}
+		ix.mu.Unlock()
+	}
+}
+
+// loadIndexLocked reads the saved index and indexes the records after it.
+func (d *DiskStorage) loadIndexLocked(ix *logIndex) {
+	if ix.loaded {
+		return
+	}
+	ix.loaded = true
+	ix.terms, ix.lines, ix.saved = make(map[string][]uint32), 0, 0
+	if f, err := readIndexFile(ix.path + indexSuffix); err == nil {
+		ix.terms, ix.lines, ix.saved = f.Terms, f.Lines, f.Lines
+		if ix.terms == nil {
+			ix.terms = make(map[string][]uint32)
+		}
+	}
+	seg, ok := findSegment(ix.path)
+	if !ok {
+		if ix.lines > 0 {
+			ix.terms, ix.lines, ix.saved = make(map[string][]uint32), 0, 0
+		}
+		return
+	}
+	d.writers.flushFile(ix.path)
+	from := ix.lines
+	total, err := d.readRecords(seg, func(lo, hi uint32) bool { return hi > from }, func(ord uint32, raw []byte) error {
+		if ord >= from {
+			ix.add(recordLine(raw))
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "storage: index %s: %v\n", ix.path, err)
+	}
+	if total < from {
+		// the saved index describes more records than there are: rebuild it
+		os.Remove(ix.path + indexSuffix)
+		ix.loaded = false
+		d.loadIndexLocked(ix)
+	}
+}
+
+func readIndexFile(fn string) (logIndexFile, error) {
+	var out logIndexFile
+	f, err := os.Open(fn)
+	if err != nil {
+		return out, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return out, err
+	}
+	err = json.NewDecoder(zr).Decode(&out)
+	return out, err
+}
+
+// saveIndexLocked writes the index next to its segment if it grew.
+func (d *DiskStorage) saveIndexLocked(ix *logIndex) error {
+	if !ix.loaded || ix.lines == ix.saved {
+		return nil
+	}
+	fn := ix.path + indexSuffix
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	err = json.NewEncoder(zw).Encode(logIndexFile{Lines: ix.lines, Terms: ix.terms})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	ix.saved = ix.lines
+	return nil
+}
+
+// releaseIndex saves the index of a log segment and drops it from memory.
+func (d *DiskStorage) releaseIndex(path string) {
+	ix := d.lockIndex(path)
+	if err := d.saveIndexLocked(ix); err != nil {
+		fmt.Fprintf(os.Stderr, "storage: save index %s: %v\n", path, err)
+	}
+	d.dropIndexLocked(ix)
+	ix.mu.Unlock()
+}
+
+// forgetIndex drops the index of a deleted segment.
+func (d *DiskStorage) forgetIndex(path string) {
+	d.indexMu.Lock()
+	ix := d.indexes[path]
+	delete(d.indexes, path)
+	d.indexMu.Unlock()
+	if ix != nil {
+		ix.mu.Lock()
+		ix.dropped = true
+		ix.mu.Unlock()
+	}
+}
+
+func (d *DiskStorage) dropIndexLocked(ix *logIndex) {
+	ix.dropped = true
+	d.indexMu.Lock()
+	if d.indexes[ix.path] == ix {
+		delete(d.indexes, ix.path)
+	}
+	d.indexMu.Unlock()
+}
+
+// releaseIdleIndexes saves and drops the indexes unused for indexIdle, or
+// all of them when all is set.
+func (d *DiskStorage) releaseIdleIndexes(all bool) {
+	d.indexMu.Lock()
+	ixs := make([]*logIndex, 0, len(d.indexes))
+	for _, ix := range d.indexes {
+		ixs = append(ixs, ix)
+	}
+	d.indexMu.Unlock()
+	for _, ix := range ixs {
+		ix.mu.Lock()
+		if !ix.dropped && (all || time.Since(ix.lastUse) > indexIdle) {
+			if err := d.saveIndexLocked(ix); err != nil {
+				fmt.Fprintf(os.Stderr, "storage: save index %s: %v\n", ix.path, err)
+			} else {
+				d.dropIndexLocked(ix)
+			}
+		}
+		ix.mu.Unlock()
+	}
+}
+
+// findSegment returns the segment whose plain path is path.
+func findSegment(path string) (segment, bool) {
+	for _, seg := range listSegments(filepath.Dir(path)) {
+		if seg.path == path {
+			return seg, true
+		}
+	}
+	return segment{}, false
+}
+
+// recordLine returns the line of a stored log record.
+func recordLine(raw []byte) string {
+	var rec struct {
+		Line string `json:"line"`
+	}
+	json.Unmarshal(raw, &rec)
+	return rec.Line
+}
+
+// readRecords calls fn with the ordinal and content of the records of seg,
+// skipping compressed blocks for which need reports no wanted ordinals in
+// [lo, hi). fn may return errStopScan to end early. It returns the number
+// of records in the segment, or up to where it stopped.
+func (d *DiskStorage) readRecords(seg segment, need func(lo, hi uint32) bool, fn func(ord uint32, raw []byte) error) (uint32, error) {
+	var ord uint32
+	var ix segmentIndex
+	if seg.compressed {
+		f, err := os.Open(seg.path + compressedSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		if err == nil {
+			defer f.Close()
+			if ix, _, err = readIndex(f); err != nil {
+				return 0, fmt.Errorf("%s: %w", f.Name(), err)
+			}
+			for _, b := range ix.Blocks {
+				lo, hi := ord, ord+uint32(b.Lines)
+				if need(lo, hi) {
+					zr, err := blockOpener(f, b)()
+					if err != nil {
+						return ord, err
+					}
+					if err := scanRecords(zr, &ord, fn); err != nil {
+						if err == errStopScan {
+							return ord, nil
+						}
+						return ord, err
+					}
+				}
+				ord = hi
+			}
+		}
+	}
+	var files []string
+	for _, fn := range seg.sealing {
+		if !ix.includes(fn) {
+			files = append(files, fn)
+		}
+	}
+	if seg.plain {
+		files = append(files, seg.path)
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return ord, err
+		}
+		err = scanRecords(f, &ord, fn)
+		f.Close()
+		if err == errStopScan {
+			return ord, nil
+		}
+		if err != nil {
+			return ord, err
+		}
+	}
+	return ord, nil
+}
+
+// scanRecords calls fn for each non-empty line of r, numbering them from *ord.
+func scanRecords(r io.Reader, ord *uint32, fn func(uint32, []byte) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		if err := fn(*ord, sc.Bytes()); err != nil {
+			*ord++
+			return err
+		}
+		*ord++
+	}
+	return sc.Err()
+}
+
+// --- search ---
+
+// SearchQuery selects one page of the log records matching Search (see
+// package search).
+type SearchQuery struct {
+	LogQuery
+	Search string
+}
+
+// LogMatch is one log record found by SearchLogs.
+type LogMatch struct {
+	LogLine
+	Highlights [][2]int `json:"highlights"` // byte ranges of line that matched
+}
+
+// LogSearchResult is a page of search matches, newest first (oldest first
+// when the query is forward). NextCursor continues with the next page.
+type LogSearchResult struct {
+	Matches    []LogMatch `json:"matches"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// SearchLogs finds the log records matching q.Search within the job,
+// target, app, time range and labels of q, paged like QueryLogs but with
+// at most 1000 per page. Segments are searched in page order and the
+// search stops once no further segment can change the page.
+func (d *DiskStorage) SearchLogs(q SearchQuery) (LogSearchResult, error) {
+	query, err := search.Parse(q.Search)
+	if err != nil {
+		return LogSearchResult{}, fmt.Errorf("%w: %v", ErrBadQuery, err)
+	}
+	p, err := newLogPager(q.LogQuery, defaultSearchLimit, maxSearchLimit)
+	if err != nil {
+		return LogSearchResult{}, err
+	}
+	found, next, err := d.pageLogs(p, func(seg segment) error {
+		return d.searchSegment(seg, query, p)
+	})
+	if err != nil {
+		return LogSearchResult{}, err
+	}
+	return LogSearchResult{Matches: append([]LogMatch{}, found...), NextCursor: next}, nil
+}
+
+// searchSegment adds the matches of one segment to the pager. Callers hold
+// d.sealMu for reading.
+func (d *DiskStorage) searchSegment(seg segment, query *search.Query, p *logPager) error {
+	ix := d.lockIndexSealed(seg.path)
+	ids, all := query.Candidates(ix)
+	n := ix.lines
+	ix.mu.Unlock()
+	if !all && len(ids) == 0 {
+		return nil
+	}
+
+	need := func(lo, hi uint32) bool {
+		if lo >= n {
+			return false
+		}
+		if all {
+			return true
+		}
+		i := sort.Search(len(ids), func(i int) bool { return ids[i] >= lo })
+		return i < len(ids) && ids[i] < hi
+	}
+	_, err := d.readRecords(seg, need, func(ord uint32, raw []byte) error {
+		if ord >= n {
+			return errStopScan // appended after the index was read
+		}
+		if !need(ord, ord+1) {
+			return nil
+		}
+		m, ok := p.record(seg, ord, raw)
+		if !ok {
+			return nil
+		}
+		if ok, m.Highlights = query.Match(m.Line); ok {
+			p.add(m)
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A log line the writer drops is not indexed, so the lines after it are
+// still found at their own positions in the segment.
+func TestSearchAfterDroppedLine(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testStorageConfig("disk", dir)
+	cfg.FlushInterval, cfg.FsyncInterval = time.Hour, time.Hour
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the stream directory is a file, so the lines stay buffered
+	blocker := filepath.Join(dir, logStream("web", "h1", "api"))
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now().UTC()
+	filler := strings.Repeat("x", 64<<10)
+	for i := 0; s.writers.stats["logs"].dropped.Load() == 0; i++ {
+		if i > 2*maxUnwritten/len(filler) {
+			t.Fatal("no line dropped with the buffer full")
+		}
+		s.StoreLog("web", "h1", nil, ts, "[api] filler "+filler)
+	}
+	s.StoreLog("web", "h1", nil, ts, "[api] lost")
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	s.writers.flush()
+	s.StoreLog("web", "h1", nil, ts, "[api] needle")
+	s.writers.flush()
+
+	res, err := s.SearchLogs(SearchQuery{LogQuery: LogQuery{Selector: Selector{Job: "web"}}, Search: "needle"})
+	if err != nil || len(res.Matches) != 1 || res.Matches[0].Line != "needle" {
+		t.Fatalf("search needle: %d matches, %v", len(res.Matches), err)
+	}
+	if res, _ := s.SearchLogs(SearchQuery{LogQuery: LogQuery{Selector: Selector{Job: "web"}}, Search: "lost"}); len(res.Matches) != 0 {
+		t.Fatalf("search lost: found %q", res.Matches[0].Line)
+	}
+}
@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Logs and metrics are stored per stream in a directory named like the
+// stream (logs_<job>_<target>_<app>, metrics_<job>_<target>) holding one
+// segment file per period, named <start>+<length>.jsonl with the start in
+// UTC, e.g. 20261018T1600Z+1h.jsonl. A record goes to the segment covering
+// its timestamp, so queries open only the segments overlapping their range
+// and retention deletes whole segments instead of rewriting files. Sealed
+// segments are compressed (see compress.go).
+const segmentTimeFormat = "20060102T1504Z"
+
+// segmentKinds are the stream kinds stored in segments.
+var segmentKinds = []string{"logs", "metrics", "metrics5m", "metrics1h"}
+
+// segment is one segment and the period it covers, [start, end). Its
+// records are spread over up to three kinds of files: the compressed
+// path+".gz", sealing files being compressed, and path itself, which takes
+// the appends.
+type segment struct {
+	path       string
+	stream     string // directory name
+	start, end time.Time
+	size       int64 // of all its files
+	plain      bool
+	compressed bool
+	sealing    []string // paths, oldest first
+}
+
+func segmentName(start time.Time, length time.Duration) string {
+	return start.UTC().Format(segmentTimeFormat) + "+" + formatLength(length) + ".jsonl"
+}
+
+// formatLength writes whole hours as "6h" and anything else in minutes.
+func formatLength(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	}
+	return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+}
+
+func parseSegmentName(name string) (start, end time.Time, ok bool) {
+	stem, found := strings.CutSuffix(name, ".jsonl")
+	if !found {
+		return start, end, false
+	}
+	ts, length, found := strings.Cut(stem, "+")
+	if !found {
+		return start, end, false
+	}
+	start, err := time.Parse(segmentTimeFormat, ts)
+	if err != nil {
+		return start, end, false
+	}
+	d, err := time.ParseDuration(length)
+	if err != nil || d <= 0 {
+		return start, end, false
+	}
+	return start, start.Add(d), true
+}
+
+// segmentPath returns the segment of stream that holds a record at ts.
+func (d *DiskStorage) segmentPath(stream string, ts time.Time) string {
+	start := ts.UTC().Truncate(d.segLength)
+	return filepath.Join(d.dir, stream, segmentName(start, d.segLength))
+}
+
+// listSegments returns the segments of one stream directory, oldest first.
+func listSegments(dir string) []segment {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	stream := filepath.Base(dir)
+	byName := make(map[string]*segment)
+	for _, e := range entries {
+		name := e.Name()
+		i := strings.Index(name, ".jsonl")
+		if i < 0 || e.IsDir() {
+			continue
+		}
+		plain := name[:i+len(".jsonl")]
+		start, end, ok := parseSegmentName(plain)
+		if !ok {
+			continue
+		}
+		seg := byName[plain]
+		if seg == nil {
+			seg = &segment{path: filepath.Join(dir, plain), stream: stream, start: start, end: end}
+			byName[plain] = seg
+		}
+		switch rest := name[len(plain):]; {
+		case rest == "":
+			seg.plain = true
+		case rest == compressedSuffix:
+			seg.compressed = true
+		case strings.HasSuffix(rest, sealingSuffix):
+			seg.sealing = append(seg.sealing, filepath.Join(dir, name))
+		case rest == indexSuffix:
+		default:
+			continue // temporary files
+		}
+		if info, err := e.Info(); err == nil {
+			seg.size += info.Size()
+		}
+	}
+	out := make([]segment, 0, len(byName))
+	for _, seg := range byName {
+		sort.Strings(seg.sealing)
+		out = append(out, *seg)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].start.Before(out[j].start) })
+	return out
+}
+
+// overlaps reports whether the segment may hold records in [start, end];
+// zero bounds are open.
+func (s segment) overlaps(start, end time.Time) bool {
+	return (start.IsZero() || s.end.After(start)) && (end.IsZero() || !s.start.After(end))
+}
+
+// streamDirs returns the stream directories matching a glob pattern.
+func streamDirs(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	dirs := matches[:0]
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil && info.IsDir() {
+			dirs = append(dirs, m)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// segmentsIn returns the segments of every stream matching pattern that
+// overlap [start, end], ordered by stream and then time.
+func segmentsIn(pattern string, start, end time.Time) ([]segment, error) {
+	dirs, err := streamDirs(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var out []segment
+	for _, dir := range dirs {
+		for _, seg := range listSegments(dir) {
+			if seg.overlaps(start, end) {
+				out = append(out, seg)
+			}
+		}
+	}
+	return out, nil
+}
+
+// nextPeriod returns how many of segs, sorted by start, make up the first
+// period, and when it ends. A period spans segments that overlap each
+// other: the same segment of each stream, unless the segment length
+// changed.
+func nextPeriod(segs []segment) (n int, until time.Time) {
+	until, n = segs[0].end, 1
+	for ; n < len(segs) && segs[n].start.Before(until); n++ {
+		if segs[n].end.After(until) {
+			until = segs[n].end
+		}
+	}
+	return n, until
+}
+
+// newestSegment returns the newest non-empty segment of a stream.
+func newestSegment(dir string) (segment, bool) {
+	segs := listSegments(dir)
+	for i := len(segs) - 1; i >= 0; i-- {
+		if segs[i].size > 0 {
+			return segs[i], true
+		}
+	}
+	return segment{}, false
+}
+
+// migrateFlatFiles moves logs and metrics files from before segmenting into
+// their stream directory as one segment spanning their first to last record,
+// and points log offsets checkpointed in them at the new location.
+func (d *DiskStorage) migrateFlatFiles() error {
+	moved := make(map[string]string)
+	defer func() {
+		if len(moved) == 0 {
+			return
+		}
+		for _, offs := range d.logOffsets {
+			for stream, o := range offs {
+				if to, ok := moved[o.File]; ok {
+					o.File = to
+					offs[stream] = o
+				}
+			}
+		}
+		if err := d.saveLogOffsetsLocked(); err != nil {
+			fmt.Fprintf(os.Stderr, "storage: checkpoint log offsets: %v\n", err)
+		}
+	}()
+	for _, kind := range []string{"logs", "metrics"} {
+		files, err := filepath.Glob(filepath.Join(d.dir, kind+"_*.jsonl"))
+		if err != nil {
+			return err
+		}
+		for _, fn := range files {
+			first, last, ok := recordSpan(fn)
+			if !ok {
+				os.Remove(fn) // no readable records
+				continue
+			}
+			start := first.Truncate(time.Hour)
+			length := last.Sub(start).Truncate(time.Hour) + time.Hour
+			dir := strings.TrimSuffix(fn, ".jsonl")
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return err
+			}
+			dst := filepath.Join(dir, segmentName(start, length))
+			if _, err := os.Stat(dst); err == nil {
+				return fmt.Errorf("migrate %s: %s already exists", fn, dst)
+			}
+			if err := os.Rename(fn, dst); err != nil {
+				return err
+			}
+			to := filepath.Join(filepath.Base(dir), filepath.Base(dst))
+			moved[filepath.Base(fn)] = to
+			fmt.Fprintf(os.Stderr, "storage: moved %s to segment %s\n", filepath.Base(fn), to)
+		}
+	}
+	return nil
+}
+
+// recordSpan returns the earliest and latest record timestamps of a file.
+func recordSpan(fn string) (first, last time.Time, ok bool) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return first, last, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var head struct {
+			Timestamp string `json:"timestamp"`
+		}
+		if json.Unmarshal(sc.Bytes(), &head) != nil {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339Nano, head.Timestamp)
+		if err != nil {
+			continue
+		}
+		ts = ts.UTC()
+		if !ok || ts.Before(first) {
+			first = ts
+		}
+		if !ok || ts.After(last) {
+			last = ts
+		}
+		ok = true
+	}
+	return first, last, ok
+}
+
+// streamKind returns the kind of a stream directory, e.g. logs.
+func streamKind(stream string) string {
+	kind, _, _ := strings.Cut(stream, "_")
+	return kind
+}
+
+// streamTarget returns the job/target a stream directory belongs to.
+func streamTarget(stream string) string {
+	_, job, target, _ := parseStream(stream)
+	return offsetKey(job, target)
+}
+
+// deleteSegment removes all files of a segment.
+func (d *DiskStorage) deleteSegment(seg segment, reason string) {
+	removed := false
+	check := func(err error) {
+		switch {
+		case err == nil:
+			removed = true
+		case !os.IsNotExist(err):
+			fmt.Fprintf(os.Stderr, "retention: delete %s: %v\n", seg.path, err)
+		}
+	}
+	check(d.writers.remove(seg.path))
+	check(os.Remove(seg.path + compressedSuffix))
+	d.forgetIndex(seg.path)
+	check(os.Remove(seg.path + indexSuffix))
+	for _, fn := range seg.sealing {
+		check(os.Remove(fn))
+	}
+	if !removed {
+		return
+	}
+	d.writers.segmentsDeleted(reason)
+	// drop the stream directory once its last segment is gone
+	os.Remove(filepath.Dir(seg.path))
+}
+
+// trimSegment rewrites a log segment without the lines keep rejects. When
+// segments are compressed, its records are compressed first, so only the
+// compressed file is rewritten; records arriving meanwhile start a new
+// plain file and are left to the next round. The segment's search index
+// counts records by position, so it is dropped and rebuilt on next use.
+func (d *DiskStorage) trimSegment(seg segment, keep func(line string) bool) error {
+	if d.compress && (seg.plain || len(seg.sealing) > 0) {
+		if err := d.compactSegment(seg); err != nil {
+			return err
+		}
+		var ok bool
+		if seg, ok = findSegment(seg.path); !ok {
+			return nil
+		}
+	}
+	var tmp string
+	if seg.compressed {
+		var err error
+		tmp, err = filterCompressed(seg.path+compressedSuffix, func(raw []byte) bool { return keep(recordLine(raw)) })
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp) // no-op once renamed
+	}
+	filter := func(data []byte) []byte {
+		var out []byte
+		eachLine(bytes.NewReader(data), func(raw []byte) error {
+			if keep(recordLine(raw)) {
+				out = append(append(out, raw...), '\n')
+			}
+			return nil
+		})
+		return out // nil deletes the file
+	}
+
+	// no reader or appender may see the segment half rewritten
+	d.sealMu.Lock()
+	defer d.sealMu.Unlock()
+	ix := d.index(seg.path)
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	var errs []error
+	if tmp != "" {
+		errs = append(errs, os.Rename(tmp, seg.path+compressedSuffix))
+	}
+	if !d.compress {
+		files := append([]string(nil), seg.sealing...)
+		if seg.plain {
+			files = append(files, seg.path)
+		}
+		for _, fn := range files {
+			if err := d.writers.rewrite(fn, filter); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	d.dropIndexLocked(ix)
+	os.Remove(seg.path + indexSuffix)
+	return errors.Join(errs...)
+}
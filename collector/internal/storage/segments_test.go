@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+)
+
+// Segment names carry their start and length and parse back to the period.
+func TestSegmentNames(t *testing.T) {
+	start := time.Date(2026, 10, 18, 16, 0, 0, 0, time.UTC)
+	for _, length := range []time.Duration{time.Hour, 6 * time.Hour, 30 * time.Minute} {
+		name := segmentName(start, length)
+		s, e, ok := parseSegmentName(name)
+		if !ok || !s.Equal(start) || !e.Equal(start.Add(length)) {
+			t.Errorf("%s: parsed %s-%s, %v", name, s, e, ok)
+		}
+	}
+	if got := segmentName(start, time.Hour); got != "20261018T1600Z+1h.jsonl" {
+		t.Errorf("segment name: got %s", got)
+	}
+	for _, name := range []string{"20261018T1600Z.jsonl", "20261018T1600Z+0h.jsonl", "x+1h.jsonl", "20261018T1600Z+1h.json"} {
+		if _, _, ok := parseSegmentName(name); ok {
+			t.Errorf("%s parsed as a segment", name)
+		}
+	}
+}
+
+// openSegmented opens a disk backend with 1h uncompressed segments.
+func openSegmented(t *testing.T, tweak func(*config.StorageConfig)) *DiskStorage {
+	t.Helper()
+	cfg := testStorageConfig("disk", t.TempDir())
+	cfg.Compression = "none"
+	if tweak != nil {
+		tweak(&cfg)
+	}
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func segmentFiles(t *testing.T, d *DiskStorage, stream string) []string {
+	t.Helper()
+	var names []string
+	for _, seg := range listSegments(filepath.Join(d.dir, stream)) {
+		names = append(names, filepath.Base(seg.path))
+	}
+	return names
+}
+
+// Records go to the segment of their hour, and a range query reads only
+// the records of the segments it overlaps.
+func TestLogSegmentRollover(t *testing.T) {
+	d := openSegmented(t, nil)
+	t0 := time.Now().UTC().Add(-5 * time.Hour).Truncate(time.Hour)
+	for i, line := range []string{"first", "second", "third"} {
+		d.StoreLog("web", "h1", nil, t0.Add(time.Duration(i)*time.Hour+time.Minute), "[api] "+line)
+	}
+	d.writers.flush()
+
+	stream := streamName("logs", "web", "h1", "api")
+	want := []string{segmentName(t0, time.Hour), segmentName(t0.Add(time.Hour), time.Hour), segmentName(t0.Add(2*time.Hour), time.Hour)}
+	if got := segmentFiles(t, d, stream); !slices.Equal(got, want) {
+		t.Fatalf("segments: got %v, want %v", got, want)
+	}
+	page, err := d.QueryLogs(LogQuery{Selector: Selector{Job: "web", Start: t0.Add(time.Hour), End: t0.Add(2*time.Hour - time.Second)}, Forward: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := logLines(page.Lines); !slices.Equal(got, []string{"second"}) {
+		t.Fatalf("lines of the second hour: %v", got)
+	}
+}
+
+// Retention deletes whole segments: those that ended before the age limit,
+// then the oldest while a target is over its size limit. The rounds run
+// six hours ahead so that the background round at open deletes nothing.
+func TestSegmentRetention(t *testing.T) {
+	d := openSegmented(t, func(cfg *config.StorageConfig) { cfg.RetentionDays = 1 })
+	now := time.Now().UTC().Add(6 * time.Hour)
+	d.StoreLog("web", "h1", nil, now.Add(-26*time.Hour), "[api] expired")
+	d.StoreLog("web", "h1", nil, now.Add(-3*time.Hour), "[api] old")
+	d.StoreLog("web", "h1", nil, now.Add(-2*time.Hour), "[api] recent")
+	d.StoreLog("web", "h1", nil, now, "[api] current")
+	d.writers.flush()
+	stream := streamName("logs", "web", "h1", "api")
+	if n := len(segmentFiles(t, d, stream)); n != 4 {
+		t.Fatalf("segments before retention: got %d, want 4", n)
+	}
+
+	d.enforceSegmentRetention(now)
+	if n := len(segmentFiles(t, d, stream)); n != 3 {
+		t.Fatalf("segments after age retention: got %d, want 3", n)
+	}
+	segs := listSegments(filepath.Join(d.dir, stream))
+	d.retention.mu.Lock()
+	d.maxTargetBytes = segs[1].size + segs[2].size
+	d.retention.mu.Unlock()
+	d.enforceSegmentRetention(now)
+	page, err := d.QueryLogs(LogQuery{Selector: Selector{Job: "web"}, Forward: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := logLines(page.Lines); !slices.Equal(got, []string{"recent", "current"}) {
+		t.Fatalf("lines after size retention: %v", got)
+	}
+	if _, err := os.Stat(segs[0].path); !os.IsNotExist(err) {
+		t.Fatalf("oldest segment kept: %v", err)
+	}
+}
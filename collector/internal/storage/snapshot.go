@@ -0,0 +1,746 @@
+// internal/storage/snapshot.go
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A snapshot is a point-in-time copy of the data directory, kept in
+// <directory>/snapshots/<name> with a manifest.json listing every file
+// with its size and SHA-256. The disk backend flushes buffered records and,
+// while compaction, retention and log acknowledgements wait, hard-links the
+// files that are never written again (compressed and sealing segments) and
+// opens the others, which are then copied up to their last complete record
+// at that moment. Search indexes are left out; they are rebuilt when
+// needed. The sqlite backend copies its database with VACUUM INTO. Other
+// files of the directory, such as alert state and silences, are copied as
+// they are.
+// With tenants, each tenant backend's snapshot is moved into the
+// collector's, below tenants/<name> (see AdoptSnapshot).
+//
+// An archive is a tar file of a snapshot: manifest.json first, then the
+// files. Restoring one checks every file against the manifest before the
+// restored directory is moved into place.
+
+const (
+	snapshotsDir = "snapshots"
+	manifestFile = "manifest.json"
+)
+
+// ErrNoSnapshot is returned for snapshot names that do not exist.
+var ErrNoSnapshot = errors.New("no such snapshot")
+
+// SnapshotFile is one file of a snapshot.
+type SnapshotFile struct {
+	Path   string `json:"path"` // relative to the snapshot, slash-separated
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// SnapshotManifest describes a snapshot. Listings leave Files out.
+type SnapshotManifest struct {
+	Name    string         `json:"name"`
+	Backend string         `json:"backend"` // disk or sqlite
+	Created time.Time      `json:"created"`
+	Bytes   int64          `json:"bytes"`
+	Files   []SnapshotFile `json:"files,omitempty"`
+}
+
+// SnapshotCheck is the result of verifying a snapshot or an archive
+// against its manifest.
+type SnapshotCheck struct {
+	Name     string   `json:"name"`
+	Backend  string   `json:"backend"`
+	Files    int      `json:"files"`
+	Bytes    int64    `json:"bytes"`
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems"`
+}
+
+func (c *SnapshotCheck) problem(format string, args ...interface{}) {
+	c.Problems = append(c.Problems, fmt.Sprintf(format, args...))
+}
+
+// Snapshotter takes and manages the snapshots of a backend.
+type Snapshotter interface {
+	Snapshot() (SnapshotManifest, error)
+	Snapshots() ([]SnapshotManifest, error)
+	VerifySnapshot(name string) (SnapshotCheck, error)
+	WriteSnapshotArchive(name string, w io.Writer) error
+	DeleteSnapshot(name string) error
+}
+
+// snapshotSource is a file to put in a snapshot: already hard-linked into
+// it, or open and to be copied up to size.
+type snapshotSource struct {
+	rel     string // slash-separated
+	f       *os.File
+	size    int64
+	records bool // cut after the last complete record
+}
+
+// createSnapshotDir creates the directory of a new snapshot, named after
+// the current time.
+func createSnapshotDir(dataDir string, now time.Time) (name, dir string, err error) {
+	root := filepath.Join(dataDir, snapshotsDir)
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return "", "", err
+	}
+	base := now.UTC().Format("20060102T150405Z")
+	for i := 1; ; i++ {
+		name = base
+		if i > 1 {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		dir = filepath.Join(root, name)
+		err := os.Mkdir(dir, 0o755)
+		if err == nil {
+			return name, dir, nil
+		}
+		if !os.IsExist(err) {
+			return "", "", err
+		}
+	}
+}
+
+// openSnapshotSource opens a file to be copied, noting its current size.
+func openSnapshotSource(fn, rel string, records bool) (snapshotSource, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return snapshotSource{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return snapshotSource{}, err
+	}
+	return snapshotSource{rel: rel, f: f, size: info.Size(), records: records}, nil
+}
+
+// linkSnapshotSource hard-links a file that is never written again into
+// the snapshot, copying it where links are not possible.
+func linkSnapshotSource(fn, dir, rel string) (snapshotSource, error) {
+	dst := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return snapshotSource{}, err
+	}
+	if err := os.Link(fn, dst); err == nil {
+		return snapshotSource{rel: rel}, nil
+	}
+	return openSnapshotSource(fn, rel, false)
+}
+
+// otherDataFiles opens the files directly in the data directory that no
+// backend owns, such as alert state and silences.
+func otherDataFiles(dataDir string, owned func(name string) bool) ([]snapshotSource, error) {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var srcs []snapshotSource
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasSuffix(name, ".tmp") || owned(name) {
+			continue
+		}
+		src, err := openSnapshotSource(filepath.Join(dataDir, name), name, false)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			closeSnapshotSources(srcs)
+			return nil, err
+		}
+		srcs = append(srcs, src)
+	}
+	return srcs, nil
+}
+
+func closeSnapshotSources(srcs []snapshotSource) {
+	for _, src := range srcs {
+		if src.f != nil {
+			src.f.Close()
+		}
+	}
+}
+
+// finishSnapshot copies the open sources into the snapshot, checksums every
+// file and writes the manifest. The snapshot is removed if that fails.
+func finishSnapshot(dir string, m SnapshotManifest, srcs []snapshotSource) (SnapshotManifest, error) {
+	defer closeSnapshotSources(srcs)
+	m.Files = make([]SnapshotFile, 0, len(srcs))
+	for _, src := range srcs {
+		dst := filepath.Join(dir, filepath.FromSlash(src.rel))
+		var f SnapshotFile
+		var err error
+		if src.f != nil {
+			f, err = copySnapshotFile(dst, src)
+		} else {
+			f, err = hashFile(dst)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return SnapshotManifest{}, fmt.Errorf("snapshot %s: %w", src.rel, err)
+		}
+		f.Path = src.rel
+		m.Files = append(m.Files, f)
+		m.Bytes += f.Size
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		err = writeFileSync(filepath.Join(dir, manifestFile), data)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return SnapshotManifest{}, fmt.Errorf("snapshot manifest: %w", err)
+	}
+	return m, nil
+}
+
+// AdoptSnapshot moves snapshot from, taken of the backend whose data
+// directory is sub below dataDir, into snapshot name of dataDir, its files
+// below sub, and copies the given files of dataDir (slash-separated paths)
+// into it, skipping those that do not exist. The manifest of name is
+// replaced by one listing them all.
+func AdoptSnapshot(dataDir, name, sub, from string, files ...string) (SnapshotManifest, error) {
+	dir, err := snapshotPath(dataDir, name)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+	fromDir, err := snapshotPath(filepath.Join(dataDir, filepath.FromSlash(sub)), from)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+	fm, err := readManifest(fromDir)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+	for _, f := range fm.Files {
+		f.Path = sub + "/" + f.Path
+		dst := filepath.Join(dir, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return SnapshotManifest{}, err
+		}
+		if err := os.Rename(filepath.Join(fromDir, filepath.FromSlash(f.Path[len(sub)+1:])), dst); err != nil {
+			return SnapshotManifest{}, err
+		}
+		m.Files = append(m.Files, f)
+		m.Bytes += f.Size
+	}
+	if err := os.RemoveAll(fromDir); err != nil {
+		return SnapshotManifest{}, err
+	}
+	for _, rel := range files {
+		src, err := openSnapshotSource(filepath.Join(dataDir, filepath.FromSlash(rel)), rel, false)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return SnapshotManifest{}, err
+		}
+		f, err := copySnapshotFile(filepath.Join(dir, filepath.FromSlash(rel)), src)
+		src.f.Close()
+		if err != nil {
+			return SnapshotManifest{}, fmt.Errorf("snapshot %s: %w", rel, err)
+		}
+		f.Path = rel
+		m.Files = append(m.Files, f)
+		m.Bytes += f.Size
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+	tmp := filepath.Join(dir, manifestFile+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return SnapshotManifest{}, fmt.Errorf("snapshot manifest: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, manifestFile)); err != nil {
+		return SnapshotManifest{}, fmt.Errorf("snapshot manifest: %w", err)
+	}
+	return m, nil
+}
+
+// copySnapshotFile copies a source up to its size, or for records up to
+// the last newline before it.
+func copySnapshotFile(dst string, src snapshotSource) (SnapshotFile, error) {
+	size := src.size
+	if src.records {
+		size = lastRecordEnd(src.f, size)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return SnapshotFile{}, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), io.NewSectionReader(src.f, 0, size))
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	return SnapshotFile{Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// lastRecordEnd returns the offset just past the last newline in the
+// first size bytes of f.
+func lastRecordEnd(f *os.File, size int64) int64 {
+	buf := make([]byte, 64*1024)
+	for end := size; end > 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return 0
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return start + int64(i) + 1
+		}
+		end = start
+	}
+	return 0
+}
+
+func hashFile(fn string) (SnapshotFile, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	return SnapshotFile{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// writeFileSync writes a file and syncs it to disk.
+func writeFileSync(fn string, data []byte) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// snapshotPath returns the directory of an existing snapshot.
+func snapshotPath(dataDir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", ErrNoSnapshot
+	}
+	dir := filepath.Join(dataDir, snapshotsDir, name)
+	if _, err := os.Stat(filepath.Join(dir, manifestFile)); err != nil {
+		return "", ErrNoSnapshot
+	}
+	return dir, nil
+}
+
+func readManifest(dir string) (SnapshotManifest, error) {
+	var m SnapshotManifest
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("%s: %w", manifestFile, err)
+	}
+	return m, nil
+}
+
+// listSnapshots returns the complete snapshots of a data directory,
+// oldest first, without their file lists.
+func listSnapshots(dataDir string) ([]SnapshotManifest, error) {
+	entries, err := os.ReadDir(filepath.Join(dataDir, snapshotsDir))
+	if os.IsNotExist(err) {
+		return []SnapshotManifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := []SnapshotManifest{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		m, err := readManifest(filepath.Join(dataDir, snapshotsDir, e.Name()))
+		if err != nil {
+			continue // being taken, or failed
+		}
+		m.Files = nil
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// verifySnapshot checks the files of a snapshot against its manifest.
+func verifySnapshot(dataDir, name string) (SnapshotCheck, error) {
+	dir, err := snapshotPath(dataDir, name)
+	if err != nil {
+		return SnapshotCheck{}, err
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		return SnapshotCheck{}, err
+	}
+	c := SnapshotCheck{Name: m.Name, Backend: m.Backend, Problems: []string{}}
+	for _, want := range m.Files {
+		got, err := hashFile(filepath.Join(dir, filepath.FromSlash(want.Path)))
+		if err != nil {
+			c.problem("%s: %v", want.Path, err)
+			continue
+		}
+		checkSnapshotFile(&c, want, got)
+	}
+	c.OK = len(c.Problems) == 0
+	return c, nil
+}
+
+func checkSnapshotFile(c *SnapshotCheck, want, got SnapshotFile) {
+	c.Files++
+	c.Bytes += got.Size
+	switch {
+	case got.Size != want.Size:
+		c.problem("%s: size %d, manifest says %d", want.Path, got.Size, want.Size)
+	case got.SHA256 != want.SHA256:
+		c.problem("%s: checksum mismatch", want.Path)
+	}
+}
+
+func deleteSnapshot(dataDir, name string) error {
+	dir, err := snapshotPath(dataDir, name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// writeSnapshotArchive writes a snapshot as a tar archive. Nothing is
+// written if the snapshot does not exist.
+func writeSnapshotArchive(dataDir, name string, w io.Writer) error {
+	dir, err := snapshotPath(dataDir, name)
+	if err != nil {
+		return err
+	}
+	manifest, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return err
+	}
+	var m SnapshotManifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return fmt.Errorf("%s: %w", manifestFile, err)
+	}
+	tw := tar.NewWriter(w)
+	hdr := &tar.Header{Name: manifestFile, Mode: 0o644, Size: int64(len(manifest)), ModTime: m.Created, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	for _, file := range m.Files {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file.Path)))
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: file.Path, Mode: 0o644, Size: file.Size, ModTime: m.Created, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			f.Close()
+			return err
+		}
+		_, err = io.CopyN(tw, f, file.Size)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Path, err)
+		}
+	}
+	return tw.Close()
+}
+
+// VerifyArchive checks every file of a snapshot archive against its
+// manifest.
+func VerifyArchive(r io.Reader) (SnapshotCheck, error) {
+	return readArchive(r, "")
+}
+
+// RestoreArchive extracts a snapshot archive into dir, which must not exist
+// or be empty, and returns what was restored. Files are extracted next to
+// dir and moved into place only if all of them match the manifest; the
+// collector must not be running on dir meanwhile.
+func RestoreArchive(r io.Reader, dir string) (SnapshotCheck, error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return SnapshotCheck{}, fmt.Errorf("%s is not empty", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return SnapshotCheck{}, err
+	}
+	tmp := filepath.Clean(dir) + ".restoring"
+	if err := os.RemoveAll(tmp); err != nil {
+		return SnapshotCheck{}, err
+	}
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return SnapshotCheck{}, err
+	}
+	c, err := readArchive(r, tmp)
+	if err == nil && !c.OK {
+		err = fmt.Errorf("archive does not match its manifest")
+	}
+	if err == nil {
+		os.Remove(dir) // empty, if it exists
+		err = os.Rename(tmp, dir)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return c, err
+	}
+	return c, nil
+}
+
+// readArchive checks the files of an archive against its manifest,
+// extracting them into dst unless it is empty.
+func readArchive(r io.Reader, dst string) (SnapshotCheck, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return SnapshotCheck{}, fmt.Errorf("archive: %w", err)
+	}
+	if hdr.Name != manifestFile {
+		return SnapshotCheck{}, fmt.Errorf("archive: starts with %s, not %s", hdr.Name, manifestFile)
+	}
+	var m SnapshotManifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return SnapshotCheck{}, fmt.Errorf("archive: %s: %w", manifestFile, err)
+	}
+	c := SnapshotCheck{Name: m.Name, Backend: m.Backend, Problems: []string{}}
+	want := make(map[string]SnapshotFile, len(m.Files))
+	for _, f := range m.Files {
+		want[f.Path] = f
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return c, fmt.Errorf("archive: %w", err)
+		}
+		name := hdr.Name
+		f, ok := want[name]
+		switch {
+		case hdr.Typeflag != tar.TypeReg:
+			c.problem("%s: not a regular file", name)
+			continue
+		case path.IsAbs(name) || name != path.Clean(name) || strings.HasPrefix(name, "../"):
+			c.problem("%s: unsafe path", name)
+			continue
+		case !ok:
+			c.problem("%s: not in the manifest", name)
+			continue
+		}
+		delete(want, name)
+		got, err := extractArchiveFile(tr, dst, name)
+		if err != nil {
+			return c, fmt.Errorf("archive: %s: %w", name, err)
+		}
+		checkSnapshotFile(&c, f, got)
+	}
+	missing := make([]string, 0, len(want))
+	for name := range want {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		c.problem("%s: missing from the archive", name)
+	}
+	c.OK = len(c.Problems) == 0
+	return c, nil
+}
+
+// extractArchiveFile checksums one archive file, writing it below dst
+// unless dst is empty.
+func extractArchiveFile(r io.Reader, dst, name string) (SnapshotFile, error) {
+	h := sha256.New()
+	if dst == "" {
+		n, err := io.Copy(h, r)
+		return SnapshotFile{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, err
+	}
+	fn := filepath.Join(dst, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fn), 0o755); err != nil {
+		return SnapshotFile{}, err
+	}
+	out, err := os.Create(fn)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	n, err := io.Copy(io.MultiWriter(out, h), r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return SnapshotFile{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, err
+}
+
+// --- disk backend ---
+
+// Snapshot takes a snapshot of the data directory.
+func (d *DiskStorage) Snapshot() (SnapshotManifest, error) {
+	now := time.Now()
+	name, dir, err := createSnapshotDir(d.dir, now)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+	d.retention.mu.Lock()
+	d.offMu.Lock()
+	d.sealMu.Lock()
+	d.writers.flush()
+	srcs, err := d.snapshotSources(dir)
+	d.sealMu.Unlock()
+	d.offMu.Unlock()
+	d.retention.mu.Unlock()
+	if err != nil {
+		closeSnapshotSources(srcs)
+		os.RemoveAll(dir)
+		return SnapshotManifest{}, fmt.Errorf("snapshot: %w", err)
+	}
+	return finishSnapshot(dir, SnapshotManifest{Name: name, Backend: "disk", Created: now.UTC()}, srcs)
+}
+
+// snapshotSources links the immutable files of the segment streams into
+// dir and opens the others. Callers hold every lock under which files are
+// renamed or deleted.
+func (d *DiskStorage) snapshotSources(dir string) ([]snapshotSource, error) {
+	var srcs []snapshotSource
+	for _, kind := range segmentKinds {
+		streams, err := streamDirs(filepath.Join(d.dir, kind+"_*"))
+		if err != nil {
+			return srcs, err
+		}
+		for _, stream := range streams {
+			entries, err := os.ReadDir(stream)
+			if err != nil {
+				return srcs, err
+			}
+			for _, e := range entries {
+				name := e.Name()
+				i := strings.Index(name, ".jsonl")
+				if i < 0 || !e.Type().IsRegular() {
+					continue
+				}
+				fn := filepath.Join(stream, name)
+				rel := filepath.Base(stream) + "/" + name
+				var src snapshotSource
+				switch rest := name[i+len(".jsonl"):]; {
+				case rest == "":
+					src, err = openSnapshotSource(fn, rel, true)
+				case rest == compressedSuffix || strings.HasSuffix(rest, sealingSuffix):
+					src, err = linkSnapshotSource(fn, dir, rel)
+				default:
+					continue // search indexes and temporary files
+				}
+				if err != nil {
+					return srcs, err
+				}
+				srcs = append(srcs, src)
+			}
+		}
+	}
+	others, err := otherDataFiles(d.dir, func(string) bool { return false })
+	if err != nil {
+		return srcs, err
+	}
+	for i := range others {
+		others[i].records = strings.HasSuffix(others[i].rel, ".jsonl")
+	}
+	return append(srcs, others...), nil
+}
+
+func (d *DiskStorage) Snapshots() ([]SnapshotManifest, error) { return listSnapshots(d.dir) }
+
+func (d *DiskStorage) VerifySnapshot(name string) (SnapshotCheck, error) {
+	return verifySnapshot(d.dir, name)
+}
+
+func (d *DiskStorage) WriteSnapshotArchive(name string, w io.Writer) error {
+	return writeSnapshotArchive(d.dir, name, w)
+}
+
+func (d *DiskStorage) DeleteSnapshot(name string) error { return deleteSnapshot(d.dir, name) }
+
+// --- sqlite backend ---
+
+// Snapshot takes a snapshot of the database and the other files of the
+// data directory.
+func (s *SQLiteStorage) Snapshot() (SnapshotManifest, error) {
+	now := time.Now()
+	dataDir := filepath.Dir(s.path)
+	name, dir, err := createSnapshotDir(dataDir, now)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+	s.flush()
+	if _, err := s.db.Exec(`VACUUM INTO ?`, filepath.Join(dir, sqliteFile)); err != nil {
+		os.RemoveAll(dir)
+		return SnapshotManifest{}, fmt.Errorf("snapshot: %w", err)
+	}
+	srcs, err := otherDataFiles(dataDir, func(name string) bool { return strings.HasPrefix(name, sqliteFile) })
+	if err != nil {
+		os.RemoveAll(dir)
+		return SnapshotManifest{}, fmt.Errorf("snapshot: %w", err)
+	}
+	srcs = append(srcs, snapshotSource{rel: sqliteFile})
+	return finishSnapshot(dir, SnapshotManifest{Name: name, Backend: "sqlite", Created: now.UTC()}, srcs)
+}
+
+func (s *SQLiteStorage) Snapshots() ([]SnapshotManifest, error) {
+	return listSnapshots(filepath.Dir(s.path))
+}
+
+func (s *SQLiteStorage) VerifySnapshot(name string) (SnapshotCheck, error) {
+	return verifySnapshot(filepath.Dir(s.path), name)
+}
+
+func (s *SQLiteStorage) WriteSnapshotArchive(name string, w io.Writer) error {
+	return writeSnapshotArchive(filepath.Dir(s.path), name, w)
+}
+
+func (s *SQLiteStorage) DeleteSnapshot(name string) error {
+	return deleteSnapshot(filepath.Dir(s.path), name)
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// tamperArchive rewrites an archive with the first byte of file changed.
+func tamperArchive(t *testing.T, archive []byte, file string) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	tr, tw := tar.NewReader(bytes.NewReader(archive)), tar.NewWriter(&out)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == file && len(data) > 0 {
+			data[0] ^= 0xff
+			found = true
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatalf("%s not in the archive", file)
+	}
+	return out.Bytes()
+}
+
+// A snapshot holds the records stored before it; it verifies against its
+// manifest, and its archive restores to a directory the backend opens.
+func TestSnapshotVerifyRestore(t *testing.T) {
+	for _, typ := range backendTypes {
+		t.Run(typ, func(t *testing.T) {
+			cfg := testStorageConfig(typ, t.TempDir())
+			s, err := Open(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			now := time.Now().UTC()
+			s.StoreLog("web", "h1", nil, now.Add(-time.Minute), "[api] before")
+			s.StoreMetrics("web", "h1", nil, now.Add(-time.Minute), gaugeFamily("pm2_up", 1))
+			m, err := s.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.StoreLog("web", "h1", nil, now, "[api] after")
+			if m.Backend != typ || len(m.Files) == 0 {
+				t.Fatalf("manifest: %+v", m)
+			}
+			if list, err := s.Snapshots(); err != nil || len(list) != 1 || list[0].Name != m.Name || list[0].Files != nil {
+				t.Fatalf("snapshots: %+v, %v", list, err)
+			}
+			c, err := s.VerifySnapshot(m.Name)
+			if err != nil || !c.OK || c.Files != len(m.Files) || c.Bytes != m.Bytes {
+				t.Fatalf("verify: %+v, %v", c, err)
+			}
+
+			var archive bytes.Buffer
+			if err := s.WriteSnapshotArchive(m.Name, &archive); err != nil {
+				t.Fatal(err)
+			}
+			if c, err := VerifyArchive(bytes.NewReader(archive.Bytes())); err != nil || !c.OK || c.Files != len(m.Files) {
+				t.Fatalf("verify archive: %+v, %v", c, err)
+			}
+			restored := filepath.Join(t.TempDir(), "restored")
+			if c, err := RestoreArchive(bytes.NewReader(archive.Bytes()), restored); err != nil || !c.OK {
+				t.Fatalf("restore: %+v, %v", c, err)
+			}
+			r, err := Open(testStorageConfig(typ, restored))
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, err := r.QueryLogs(LogQuery{Selector: Selector{Job: "web"}, Forward: true})
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := logLines(page.Lines); !slices.Equal(got, []string{"before"}) {
+				t.Fatalf("restored lines: %v", got)
+			}
+			if _, err := RestoreArchive(bytes.NewReader(archive.Bytes()), restored); err == nil {
+				t.Fatal("restored into a directory that is not empty")
+			}
+
+			// a changed file fails the checks, and is not restored
+			tampered := tamperArchive(t, archive.Bytes(), m.Files[0].Path)
+			if c, err := VerifyArchive(bytes.NewReader(tampered)); err != nil || c.OK || len(c.Problems) != 1 {
+				t.Fatalf("verify tampered archive: %+v, %v", c, err)
+			}
+			other := filepath.Join(t.TempDir(), "other")
+			if _, err := RestoreArchive(bytes.NewReader(tampered), other); err == nil {
+				t.Fatal("tampered archive restored")
+			}
+			if _, err := os.Stat(other); !os.IsNotExist(err) {
+				t.Fatalf("tampered archive left files behind: %v", err)
+			}
+			snapDir := filepath.Join(cfg.Directory, snapshotsDir, m.Name)
+			if err := os.WriteFile(filepath.Join(snapDir, filepath.FromSlash(m.Files[0].Path)), []byte("x"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if c, err := s.VerifySnapshot(m.Name); err != nil || c.OK || len(c.Problems) != 1 {
+				t.Fatalf("verify changed snapshot: %+v, %v", c, err)
+			}
+
+			if err := s.DeleteSnapshot(m.Name); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{m.Name, "..", "a/b"} {
+				if _, err := s.VerifySnapshot(name); !errors.Is(err, ErrNoSnapshot) {
+					t.Errorf("verify %q: %v", name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,544 @@
+// internal/storage/sqlite.go
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/discovery"
+	dto "github.com/prometheus/client_model/go"
+	_ "modernc.org/sqlite" // pure-Go driver, registered as "sqlite"
+)
+
+// The sqlite backend keeps every record in one database, pm2.db in the
+// storage directory, instead of segment files. Records are stored as the
+// disk backend stores them, so the API answers the same, next to indexed
+// columns for job, target, app and time; scrapes are also split into one
+// row per series in samples for ad-hoc SQL. Timestamps are Unix
+// nanoseconds and labels JSON objects. Records are written in batches every
+// flush interval, except acknowledged log entries, which are committed
+// before they are acknowledged.
+
+const sqliteFile = "pm2.db"
+
+// sqliteMigrations upgrade the schema one version at a time; the version
+// applied last is kept in PRAGMA user_version. Append, never edit.
+var sqliteMigrations = []string{
+	`CREATE TABLE scrapes (
+		id     INTEGER PRIMARY KEY,
+		job    TEXT NOT NULL,
+		target TEXT NOT NULL,
+		ts     INTEGER NOT NULL,
+		labels TEXT,
+		record TEXT NOT NULL
+	);
+	CREATE INDEX scrapes_stream ON scrapes (job, target, ts);
+	CREATE TABLE samples (
+		scrape_id INTEGER NOT NULL REFERENCES scrapes (id) ON DELETE CASCADE,
+		job       TEXT NOT NULL,
+		target    TEXT NOT NULL,
+		ts        INTEGER NOT NULL,
+		name      TEXT NOT NULL,
+		labels    TEXT,
+		value     REAL
+	);
+	CREATE INDEX samples_series ON samples (name, job, target, ts);
+	CREATE INDEX samples_scrape ON samples (scrape_id);
+	CREATE TABLE rollups (
+		id         INTEGER PRIMARY KEY,
+		resolution TEXT NOT NULL,
+		job        TEXT NOT NULL,
+		target     TEXT NOT NULL,
+		ts         INTEGER NOT NULL,
+		labels     TEXT,
+		record     TEXT NOT NULL
+	);
+	CREATE INDEX rollups_stream ON rollups (resolution, job, target, ts);
+	CREATE TABLE processes (
+		id     INTEGER PRIMARY KEY,
+		job    TEXT NOT NULL,
+		target TEXT NOT NULL,
+		ts     INTEGER NOT NULL,
+		labels TEXT,
+		record TEXT NOT NULL
+	);
+	CREATE INDEX processes_stream ON processes (job, target, ts);
+	CREATE TABLE events (
+		id     INTEGER PRIMARY KEY,
+		job    TEXT NOT NULL,
+		target TEXT NOT NULL,
+		app    TEXT NOT NULL,
+		type   TEXT NOT NULL,
+		ts     INTEGER NOT NULL,
+		labels TEXT,
+		record TEXT NOT NULL
+	);
+	CREATE INDEX events_stream ON events (job, target, ts);
+	CREATE TABLE logs (
+		id     INTEGER PRIMARY KEY,
+		job    TEXT NOT NULL,
+		target TEXT NOT NULL,
+		app    TEXT NOT NULL,
+		ts     INTEGER NOT NULL,
+		line   TEXT NOT NULL,
+		labels TEXT,
+		stream TEXT,
+		seq    INTEGER
+	);
+	CREATE INDEX logs_time ON logs (ts, id);
+	CREATE INDEX logs_stream ON logs (job, target, app, ts, id);
+	CREATE TABLE log_offsets (
+		job    TEXT NOT NULL,
+		target TEXT NOT NULL,
+		stream TEXT NOT NULL,
+		seq    INTEGER NOT NULL,
+		PRIMARY KEY (job, target, stream)
+	);
+	CREATE TABLE streams (
+		kind   TEXT NOT NULL,
+		job    TEXT NOT NULL,
+		target TEXT NOT NULL,
+		app    TEXT NOT NULL DEFAULT '',
+		labels TEXT,
+		PRIMARY KEY (kind, job, target, app)
+	);`,
+}
+
+// SQLiteStorage implements discovery.Store and Store over SQLite. qmu
+// guards the queued writes, wmu serializes transactions and mu the process
+// change state.
+type SQLiteStorage struct {
+	db            *sql.DB
+	path          string
+	retentionDays int
+	rollups       []rollupLevel
+	late          lateScrapes
+	rules         []retentionRule
+	flushEvery    time.Duration
+	qmu           sync.Mutex
+	queue         []sqlWrite
+	wmu           sync.Mutex
+	mu            sync.Mutex
+	procLast      map[string][]ProcessState // job/target -> states of newest snapshot
+	events        eventDetector
+	catMu         sync.Mutex
+	cataloged     map[string]string // catalog key -> labels JSON last written
+	stats         map[string]*kindStats
+	deleted       map[string]*atomic.Uint64 // rows deleted by retention, by kind
+	stop          chan struct{}
+	done          sync.WaitGroup
+}
+
+// sqlWrite is one queued write of a record of kind; catalog writes have no
+// kind.
+type sqlWrite struct {
+	kind  string
+	bytes int
+	fn    func(tx *sql.Tx) error
+}
+
+var _ discovery.Store = (*SQLiteStorage)(nil)
+var _ Store = (*SQLiteStorage)(nil)
+
+// NewSQLite opens or creates the database, migrates its schema and starts
+// the background flusher, rollups and retention. Size limits, segments and
+// compression apply to the disk backend only.
+func NewSQLite(cfg config.StorageConfig) (*SQLiteStorage, error) {
+	if cfg.MaxBytes > 0 || cfg.MaxTargetBytes > 0 {
+		return nil, fmt.Errorf("storage: max_bytes and max_target_bytes are not supported by the sqlite backend")
+	}
+	rules, err := compileRetentionRules(cfg.Retention)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if r.MaxBytes > 0 || r.match != nil {
+			return nil, fmt.Errorf("storage: retention rule %s: max_bytes and match are not supported by the sqlite backend", r.Name)
+		}
+	}
+	if err := os.MkdirAll(cfg.Directory, 0o755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(cfg.Directory, sqliteFile)
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("storage: migrate %s: %w", path, err)
+	}
+	flushEvery := cfg.FlushInterval
+	if flushEvery <= 0 {
+		flushEvery = 200 * time.Millisecond
+	}
+	s := &SQLiteStorage{db: db, path: path, retentionDays: cfg.RetentionDays, rollups: newRollupLevels(cfg.Rollups), rules: rules,
+		flushEvery: flushEvery, procLast: make(map[string][]ProcessState), events: newEventDetector(),
+		cataloged: make(map[string]string), stats: make(map[string]*kindStats), deleted: make(map[string]*atomic.Uint64), stop: make(chan struct{})}
+	for _, k := range recordKinds {
+		s.stats[k] = &kindStats{}
+		s.deleted[k] = &atomic.Uint64{}
+	}
+	restarts, err := recentRestarts(s)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.events.seed(restarts)
+	s.done.Add(2)
+	go s.run()
+	go s.runRetention()
+	return s, nil
+}
+
+// migrateSQLite applies the migrations the database has not seen yet, each
+// in its own transaction.
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("schema version %d is newer than this collector (%d)", version, len(sqliteMigrations))
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// PRAGMA takes no parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the background work, commits the queued writes and closes
+// the database.
+func (s *SQLiteStorage) Close() error {
+	close(s.stop)
+	s.done.Wait()
+	s.flush()
+	return s.db.Close()
+}
+
+// run commits the queued writes every flush interval.
+func (s *SQLiteStorage) run() {
+	defer s.done.Done()
+	t := time.NewTicker(s.flushEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			s.flush()
+		}
+	}
+}
+
+// enqueue queues a write for the next flush.
+func (s *SQLiteStorage) enqueue(kind string, bytes int, fn func(tx *sql.Tx) error) {
+	s.qmu.Lock()
+	s.queue = append(s.queue, sqlWrite{kind, bytes, fn})
+	s.qmu.Unlock()
+}
+
+// flush commits the queued writes in one transaction. A write that fails
+// is counted and skipped; the others are still committed.
+func (s *SQLiteStorage) flush() {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.qmu.Lock()
+	queue := s.queue
+	s.queue = nil
+	s.qmu.Unlock()
+	if len(queue) == 0 {
+		return
+	}
+	failed := func(ws []sqlWrite, err error) {
+		fmt.Fprintf(os.Stderr, "storage: sqlite write: %v\n", err)
+		for _, w := range ws {
+			if st := s.stats[w.kind]; st != nil {
+				st.errors.Add(1)
+			}
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		failed(queue, err)
+		return
+	}
+	var ok []sqlWrite
+	for _, w := range queue {
+		if err := w.fn(tx); err != nil {
+			failed([]sqlWrite{w}, err)
+			continue
+		}
+		ok = append(ok, w)
+	}
+	if err := tx.Commit(); err != nil {
+		failed(ok, err)
+		return
+	}
+	for _, w := range ok {
+		if st := s.stats[w.kind]; st != nil {
+			st.records.Add(1)
+			st.bytes.Add(uint64(w.bytes))
+		}
+	}
+}
+
+// labelsJSON encodes target labels for a labels column; nil stays NULL.
+func labelsJSON(ls map[string]string) interface{} {
+	if len(ls) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(ls)
+	return string(b)
+}
+
+// parseLabels decodes a labels column.
+func parseLabels(v sql.NullString) map[string]string {
+	if !v.Valid {
+		return nil
+	}
+	var ls map[string]string
+	json.Unmarshal([]byte(v.String), &ls)
+	return ls
+}
+
+// nanos converts a time to a ts column value.
+func nanos(t time.Time) int64 { return t.UnixNano() }
+
+// fromNanos formats a ts column value as stored records do.
+func fromNanos(ns int64) time.Time { return time.Unix(0, ns).UTC() }
+
+// note catalogs a stream, writing the streams table only when it is new or
+// its labels changed.
+func (s *SQLiteStorage) note(e CatalogEntry) {
+	ls, _ := labelsJSON(e.Labels).(string)
+	s.catMu.Lock()
+	old, ok := s.cataloged[e.key()]
+	s.cataloged[e.key()] = ls
+	s.catMu.Unlock()
+	if ok && old == ls {
+		return
+	}
+	s.enqueue("", 0, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO streams (kind, job, target, app, labels) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (kind, job, target, app) DO UPDATE SET labels = excluded.labels`,
+			e.Kind, e.Job, e.Target, e.App, labelsJSON(e.Labels))
+		return err
+	})
+}
+
+// --- discovery.Store implementation ---
+
+// StoreMetrics stores a scrape as the disk backend does, and each of its
+// series as a row of samples.
+func (s *SQLiteStorage) StoreMetrics(job, target string, ls map[string]string, ts time.Time, mfs map[string]*dto.MetricFamily) {
+	rec, err := encodeMetrics(ts, ls, mfs)
+	if err != nil {
+		return
+	}
+	samples := Samples(mfs)
+	s.enqueue("metrics", len(rec), func(tx *sql.Tx) error {
+		res, err := tx.Exec(`INSERT INTO scrapes (job, target, ts, labels, record) VALUES (?, ?, ?, ?, ?)`,
+			job, target, nanos(ts), labelsJSON(ls), string(rec))
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(`INSERT INTO samples (scrape_id, job, target, ts, name, labels, value) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, smp := range samples {
+			var v interface{} = smp.Value
+			if math.IsNaN(smp.Value) {
+				v = nil
+			}
+			if _, err := stmt.Exec(id, job, target, nanos(ts), smp.Name, labelsJSON(smp.Labels), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	s.note(CatalogEntry{Kind: "metrics", Job: job, Target: target, Labels: ls})
+	s.late.note(s.rollups, job, target, ts, time.Now())
+}
+
+// StoreProcesses stores a snapshot when a tracked field changed since the
+// previous one, and the resulting events.
+func (s *SQLiteStorage) StoreProcesses(job, target string, ls map[string]string, ts time.Time, data []byte) {
+	states, err := parseProcessStates(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "StoreProcesses: parse %s/%s: %v\n", job, target, err)
+		return
+	}
+	now := ts.UTC()
+	key := offsetKey(job, target)
+
+	s.mu.Lock()
+	prev, hadPrev := s.procLast[key]
+	if !hadPrev {
+		prev, hadPrev = s.lastStates(job, target)
+	}
+	if hadPrev && statesEqual(prev, states) {
+		s.mu.Unlock()
+		return
+	}
+	s.procLast[key] = states
+	var events []Event
+	if hadPrev {
+		events = s.events.detect(job, target, ls, prev, states, now)
+	}
+	s.mu.Unlock()
+
+	rec, err := json.Marshal(processRecord(now, ls, data))
+	if err != nil {
+		return
+	}
+	s.enqueue("processes", len(rec), func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO processes (job, target, ts, labels, record) VALUES (?, ?, ?, ?, ?)`,
+			job, target, nanos(now), labelsJSON(ls), string(rec))
+		return err
+	})
+	s.note(CatalogEntry{Kind: "processes", Job: job, Target: target, Labels: ls})
+	for _, st := range states {
+		s.note(CatalogEntry{Kind: "processes", Job: job, Target: target, App: st.Name, Labels: ls})
+	}
+	for _, ev := range events {
+		ev := ev
+		b, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		s.enqueue("events", len(b), func(tx *sql.Tx) error {
+			_, err := tx.Exec(`INSERT INTO events (job, target, app, type, ts, labels, record) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				job, target, ev.App, ev.Type, nanos(now), labelsJSON(ls), string(b))
+			return err
+		})
+	}
+	if len(events) > 0 {
+		s.note(CatalogEntry{Kind: "events", Job: job, Target: target, Labels: ls})
+	}
+}
+
+// lastStates returns the states of the newest stored snapshot of a
+// job/target. Caller must hold s.mu.
+func (s *SQLiteStorage) lastStates(job, target string) ([]ProcessState, bool) {
+	s.flush()
+	var rec string
+	err := s.db.QueryRow(`SELECT record FROM processes WHERE job = ? AND target = ? ORDER BY ts DESC, id DESC LIMIT 1`, job, target).Scan(&rec)
+	if err != nil {
+		return nil, false
+	}
+	_, states, err := ParseProcessSnapshot(json.RawMessage(rec))
+	return states, err == nil
+}
+
+// StoreLog strips the "[app]" prefix and stores the line under its app.
+func (s *SQLiteStorage) StoreLog(job, target string, ls map[string]string, ts time.Time, line string) {
+	app, msg := SplitAppPrefix(line)
+	s.enqueue("logs", len(msg), func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO logs (job, target, app, ts, line, labels) VALUES (?, ?, ?, ?, ?, ?)`,
+			job, target, app, nanos(ts), msg, labelsJSON(ls))
+		return err
+	})
+	s.note(CatalogEntry{Kind: "logs", Job: job, Target: target, App: app, Labels: ls})
+}
+
+// LogOffsets returns the highest stored sequence number per stream.
+func (s *SQLiteStorage) LogOffsets(job, target string) map[string]uint64 {
+	out := make(map[string]uint64)
+	rows, err := s.db.Query(`SELECT stream, seq FROM log_offsets WHERE job = ? AND target = ?`, job, target)
+	if err != nil {
+		return out
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stream string
+		var seq int64
+		if rows.Scan(&stream, &seq) == nil {
+			out[stream] = uint64(seq)
+		}
+	}
+	return out
+}
+
+// StoreLogEntries stores the entries not stored yet and their new offsets
+// in one transaction, committed before the offsets are returned.
+func (s *SQLiteStorage) StoreLogEntries(job, target string, ls map[string]string, entries []discovery.LogEntry) (map[string]uint64, error) {
+	s.flush() // keeps queued lines before these
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	offs := s.LogOffsets(job, target)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return offs, fmt.Errorf("store logs: %w", err)
+	}
+	defer tx.Rollback()
+	next := make(map[string]uint64, len(offs))
+	for k, v := range offs {
+		next[k] = v
+	}
+	apps := make(map[string]bool)
+	var n, size int
+	for _, e := range entries {
+		if e.Seq <= next[e.Stream] {
+			continue // already stored, or repeated within the batch
+		}
+		app, msg := SplitAppPrefix(e.Line)
+		if _, err := tx.Exec(`INSERT INTO logs (job, target, app, ts, line, labels, stream, seq) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			job, target, app, nanos(e.Timestamp), msg, labelsJSON(ls), e.Stream, int64(e.Seq)); err != nil {
+			s.stats["logs"].errors.Add(1)
+			return offs, fmt.Errorf("store logs: %w", err)
+		}
+		next[e.Stream] = e.Seq
+		apps[app] = true
+		n++
+		size += len(msg)
+	}
+	for stream, seq := range next {
+		if seq == offs[stream] {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO log_offsets (job, target, stream, seq) VALUES (?, ?, ?, ?)
+			ON CONFLICT (job, target, stream) DO UPDATE SET seq = excluded.seq`, job, target, stream, int64(seq)); err != nil {
+			return offs, fmt.Errorf("checkpoint log offsets: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		s.stats["logs"].errors.Add(uint64(n))
+		return offs, fmt.Errorf("store logs: %w", err)
+	}
+	s.stats["logs"].records.Add(uint64(n))
+	s.stats["logs"].bytes.Add(uint64(size))
+	for app := range apps {
+		s.note(CatalogEntry{Kind: "logs", Job: job, Target: target, App: app, Labels: ls})
+	}
+	return next, nil
+}
@@ -0,0 +1,468 @@
+// internal/storage/sqlite_query.go
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/labels"
+	"github.com/aalish/pm2-full/internal/search"
+)
+
+// sqlWhere builds the conditions of a query: empty values match everything
+// and zero times are open bounds.
+type sqlWhere struct {
+	conds []string
+	args  []interface{}
+}
+
+func (w *sqlWhere) eq(col, v string) {
+	if v != "" {
+		w.add(col+" = ?", v)
+	}
+}
+
+func (w *sqlWhere) between(start, end time.Time) {
+	if !start.IsZero() {
+		w.add("ts >= ?", nanos(start))
+	}
+	if !end.IsZero() {
+		w.add("ts <= ?", nanos(end))
+	}
+}
+
+func (w *sqlWhere) add(cond string, args ...interface{}) {
+	w.conds = append(w.conds, cond)
+	w.args = append(w.args, args...)
+}
+
+func (w *sqlWhere) String() string {
+	if len(w.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conds, " AND ")
+}
+
+// records returns the record column of the matching rows of a table, in
+// time order, keeping those whose labels match ms.
+func (s *SQLiteStorage) records(table string, w *sqlWhere, ms []labels.Matcher) ([]json.RawMessage, error) {
+	out := []json.RawMessage{}
+	err := s.scanRecords(table, w, ms, func(_, _ string, rec json.RawMessage) error {
+		out = append(out, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// scanBatch is the number of rows scanRecords reads per query.
+const scanBatch = 1000
+
+// scanRecords calls fn with the record column, job and target of the rows
+// records returns. Rows are read scanBatch at a time so that no read
+// transaction stays open while fn runs.
+func (s *SQLiteStorage) scanRecords(table string, w *sqlWhere, ms []labels.Matcher, fn func(job, target string, rec json.RawMessage) error) error {
+	type row struct {
+		job, target, rec string
+		ls               sql.NullString
+	}
+	var lastTS, lastID int64
+	for first := true; ; first = false {
+		page := &sqlWhere{conds: w.conds, args: w.args}
+		if !first {
+			page = &sqlWhere{conds: append(w.conds[:len(w.conds):len(w.conds)], "(ts > ? OR (ts = ? AND id > ?))"),
+				args: append(w.args[:len(w.args):len(w.args)], lastTS, lastTS, lastID)}
+		}
+		rows, err := s.db.Query("SELECT id, ts, job, target, record, labels FROM "+table+page.String()+" ORDER BY ts, id LIMIT ?",
+			append(page.args, scanBatch)...)
+		if err != nil {
+			return err
+		}
+		var batch []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&lastID, &lastTS, &r.job, &r.target, &r.rec, &r.ls); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, r := range batch {
+			if !labels.MatchAll(ms, parseLabels(r.ls)) {
+				continue
+			}
+			if err := fn(r.job, r.target, json.RawMessage(r.rec)); err != nil {
+				return err
+			}
+		}
+		if len(batch) < scanBatch {
+			return nil
+		}
+	}
+}
+
+// --- storage.Store implementation ---
+
+// QueryMetrics returns the raw scrapes, or the rollups picked as the disk
+// backend picks them, of the matching job and target within [q.Start, q.End].
+func (s *SQLiteStorage) QueryMetrics(q MetricQuery) ([]json.RawMessage, error) {
+	results := []json.RawMessage{}
+	err := s.ScanMetrics(q, func(_, _ string, rec json.RawMessage) error {
+		results = append(results, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ScanMetrics calls fn with each record QueryMetrics would return, in the
+// same order, and the job and target it was stored for.
+func (s *SQLiteStorage) ScanMetrics(q MetricQuery, fn func(job, target string, rec json.RawMessage) error) error {
+	kind, err := pickMetricsKind(q, time.Now(), s.retentionDays, s.rollups)
+	if err != nil {
+		return err
+	}
+	s.flush()
+	w := &sqlWhere{}
+	table := "scrapes"
+	if kind != "metrics" {
+		table = "rollups"
+		w.add("resolution = ?", s.resolution(kind))
+	}
+	w.eq("job", q.Job)
+	w.eq("target", q.Target)
+	w.between(q.Start, q.End)
+	return s.scanRecords(table, w, q.Matchers, fn)
+}
+
+// resolution returns the resolution column value of a rollup kind.
+func (s *SQLiteStorage) resolution(kind string) string {
+	for _, l := range s.rollups {
+		if l.kind == kind {
+			return formatLength(l.step)
+		}
+	}
+	return kind
+}
+
+// processSnapshots loads the snapshot history of a job/target from the
+// snapshot in effect at from; a zero from loads it all. Matchers are
+// applied once the query has picked its snapshots by time.
+func (s *SQLiteStorage) processSnapshots(q ProcessQuery, from time.Time) ([]processSnapshot, error) {
+	s.flush()
+	w := &sqlWhere{}
+	w.add("job = ?", q.Job)
+	w.add("target = ?", q.Target)
+	if !from.IsZero() {
+		w.add("ts >= COALESCE((SELECT MAX(ts) FROM processes WHERE job = ? AND target = ? AND ts <= ?), 0)",
+			q.Job, q.Target, nanos(from))
+	}
+	recs, err := s.records("processes", w, nil)
+	if err != nil {
+		return nil, err
+	}
+	snaps := make([]processSnapshot, 0, len(recs))
+	for _, rec := range recs {
+		ts, states, err := ParseProcessSnapshot(rec)
+		if err != nil {
+			continue
+		}
+		snaps = append(snaps, processSnapshot{ts: ts, raw: rec, labels: recordLabels(rec), states: states})
+	}
+	return snaps, nil
+}
+
+func (s *SQLiteStorage) QueryProcesses(q ProcessQuery) ([]json.RawMessage, error) {
+	snaps, err := s.processSnapshots(q, q.historyFrom())
+	if err != nil {
+		return nil, err
+	}
+	return rawSnapshots(appSnapshots(selectSnapshots(snaps, q), q.App)), nil
+}
+
+func (s *SQLiteStorage) QueryProcessTimeline(q ProcessQuery) ([]ProcessTimeline, error) {
+	snaps, err := s.processSnapshots(q, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return processTimeline(snaps, q), nil
+}
+
+func (s *SQLiteStorage) DiffProcesses(q ProcessQuery) (ProcessDiff, error) {
+	snaps, err := s.processSnapshots(q, q.historyFrom())
+	if err != nil {
+		return ProcessDiff{Added: []ProcessState{}, Removed: []ProcessState{}, Changed: []ProcessChange{}}, err
+	}
+	return diffSnapshots(snaps, q), nil
+}
+
+// QueryApps lists the cataloged apps, or those of the snapshots within
+// q.Start and q.End if given.
+func (s *SQLiteStorage) QueryApps(q AppQuery) ([]json.RawMessage, error) {
+	if q.Start.IsZero() && q.End.IsZero() {
+		return catalogApps(s.Catalog(CatalogQuery{Job: q.Job, Target: q.Target, Matchers: q.Matchers})), nil
+	}
+	pq := ProcessQuery{Selector: q.Selector}
+	snaps, err := s.processSnapshots(pq, pq.historyFrom())
+	if err != nil {
+		return nil, err
+	}
+	return snapshotApps(selectSnapshots(snaps, pq)), nil
+}
+
+func (s *SQLiteStorage) ListAllTargets(q TargetQuery) ([]json.RawMessage, error) {
+	return catalogTargets(s.Catalog(CatalogQuery{Matchers: q.Matchers})), nil
+}
+
+func (s *SQLiteStorage) ListJobsByTarget(q JobQuery) ([]json.RawMessage, error) {
+	return catalogJobs(s.Catalog(CatalogQuery{Target: q.Target, Matchers: q.Matchers})), nil
+}
+
+// Catalog returns the streams of the matching kind, job, target and app
+// whose newest labels match q.Matchers. Their Path is the table holding
+// them.
+func (s *SQLiteStorage) Catalog(q CatalogQuery) []CatalogEntry {
+	s.flush()
+	w := &sqlWhere{}
+	w.eq("kind", q.Kind)
+	w.eq("job", q.Job)
+	w.eq("target", q.Target)
+	w.eq("app", q.App)
+	out := []CatalogEntry{}
+	rows, err := s.db.Query("SELECT kind, job, target, app, labels FROM streams"+w.String()+" ORDER BY kind, job, target, app", w.args...)
+	if err != nil {
+		return out
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e CatalogEntry
+		var ls sql.NullString
+		if rows.Scan(&e.Kind, &e.Job, &e.Target, &e.App, &ls) != nil {
+			continue
+		}
+		e.Labels = parseLabels(ls)
+		e.Path = kindTable(e.Kind)
+		if labels.MatchAll(q.Matchers, e.Labels) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// kindTable returns the table holding the records of a stream kind.
+func kindTable(kind string) string {
+	switch kind {
+	case "metrics":
+		return "scrapes"
+	case "metrics5m", "metrics1h":
+		return "rollups"
+	}
+	return kind
+}
+
+// QueryEvents returns events matching the job/target/app, time range and
+// types, ordered by timestamp.
+func (s *SQLiteStorage) QueryEvents(q EventQuery) ([]Event, error) {
+	s.flush()
+	w := &sqlWhere{}
+	w.eq("job", q.Job)
+	w.eq("target", q.Target)
+	w.eq("app", q.App)
+	w.between(q.Start, q.End)
+	if len(q.Types) > 0 {
+		w.add("type IN (?"+strings.Repeat(", ?", len(q.Types)-1)+")", stringArgs(q.Types)...)
+	}
+	recs, err := s.records("events", w, q.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]Event, 0, len(recs))
+	for _, rec := range recs {
+		var ev Event
+		if json.Unmarshal(rec, &ev) == nil {
+			events = append(events, ev)
+		}
+	}
+	if q.NumLines > 0 && len(events) > q.NumLines {
+		events = events[len(events)-q.NumLines:]
+	}
+	return events, nil
+}
+
+func stringArgs(vs []string) []interface{} {
+	out := make([]interface{}, len(vs))
+	for i, v := range vs {
+		out[i] = v
+	}
+	return out
+}
+
+// --- logs ---
+
+// sqlLogBatch is how many rows a log page reads at a time.
+const sqlLogBatch = 500
+
+// logKey orders log rows with equal timestamps by id.
+func logKey(id int64) string { return fmt.Sprintf("%020d", id) }
+
+// pageLogs reads the log rows selected by the pager's query in page order,
+// keeping those match accepts, until the page is complete.
+func (s *SQLiteStorage) pageLogs(p *logPager, match func(m *LogMatch) bool) ([]LogMatch, string, error) {
+	s.flush()
+	start, end := p.bounds()
+	base := sqlWhere{}
+	base.eq("job", p.q.Job)
+	base.eq("target", p.q.Target)
+	base.eq("app", p.q.App)
+	base.between(start, end)
+	order, cmp := "DESC", "<"
+	if p.forward {
+		order, cmp = "ASC", ">"
+	}
+	var afterTS, afterID int64
+	after := p.after != nil
+	if after {
+		id, err := strconv.ParseInt(p.after.Key, 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: invalid cursor", ErrBadQuery)
+		}
+		afterTS, afterID = nanos(p.after.TS), id
+	}
+
+	for {
+		w := base
+		w.conds = append([]string(nil), base.conds...)
+		w.args = append([]interface{}(nil), base.args...)
+		if after {
+			w.add(fmt.Sprintf("(ts %s ? OR (ts = ? AND id %s ?))", cmp, cmp), afterTS, afterTS, afterID)
+		}
+		rows, err := s.db.Query(fmt.Sprintf("SELECT id, job, target, app, ts, line, labels FROM logs%s ORDER BY ts %s, id %s LIMIT %d",
+			w.String(), order, order, sqlLogBatch), w.args...)
+		if err != nil {
+			return nil, "", err
+		}
+		n := 0
+		for rows.Next() {
+			var id, ts int64
+			var m LogMatch
+			var ls sql.NullString
+			if err := rows.Scan(&id, &m.Job, &m.Target, &m.App, &ts, &m.Line, &ls); err != nil {
+				rows.Close()
+				return nil, "", err
+			}
+			n++
+			after, afterTS, afterID = true, ts, id
+			m.Labels = parseLabels(ls)
+			if !labels.MatchAll(p.q.Matchers, m.Labels) {
+				continue
+			}
+			m.ts = fromNanos(ts)
+			m.Timestamp = m.ts.Format(time.RFC3339Nano)
+			m.key = logKey(id)
+			if match(&m) {
+				p.found = append(p.found, m)
+			}
+			if len(p.found) > p.limit {
+				break
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, "", err
+		}
+		if len(p.found) > p.limit || n < sqlLogBatch {
+			break
+		}
+	}
+	found, next := p.page(false)
+	return found, next, nil
+}
+
+// ScanLogs calls fn with each log line a forward QueryLogs, or SearchLogs
+// when q.Search is set, would return, oldest first, reading the rows in
+// batches that each continue after the last.
+func (s *SQLiteStorage) ScanLogs(q SearchQuery, fn func(l LogLine) error) error {
+	match := func(*LogMatch) bool { return true }
+	if q.Search != "" {
+		query, err := search.Parse(q.Search)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBadQuery, err)
+		}
+		match = func(m *LogMatch) bool {
+			ok, _ := query.Match(m.Line)
+			return ok
+		}
+	}
+	p := &logPager{q: q.LogQuery, forward: true, limit: sqlLogBatch}
+	for {
+		found, next, err := s.pageLogs(p, match)
+		if err != nil {
+			return err
+		}
+		for _, m := range found {
+			if err := fn(m.LogLine); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		c, err := decodeCursor(next)
+		if err != nil {
+			return err
+		}
+		p = &logPager{q: q.LogQuery, forward: true, limit: sqlLogBatch, after: &c}
+	}
+}
+
+// QueryLogs returns a page of log lines as the disk backend does. Cursors
+// of one backend are not valid for the other.
+func (s *SQLiteStorage) QueryLogs(q LogQuery) (LogPage, error) {
+	p, err := newLogPager(q, defaultLogLimit, maxLogLimit)
+	if err != nil {
+		return LogPage{}, err
+	}
+	found, next, err := s.pageLogs(p, func(*LogMatch) bool { return true })
+	if err != nil {
+		return LogPage{}, err
+	}
+	page := LogPage{Lines: make([]LogLine, 0, len(found)), NextCursor: next}
+	for _, m := range found {
+		page.Lines = append(page.Lines, m.LogLine)
+	}
+	return page, nil
+}
+
+// SearchLogs finds the log lines matching q.Search, paged like QueryLogs.
+// Lines are matched as they are read; there is no term index.
+func (s *SQLiteStorage) SearchLogs(q SearchQuery) (LogSearchResult, error) {
+	query, err := search.Parse(q.Search)
+	if err != nil {
+		return LogSearchResult{}, fmt.Errorf("%w: %v", ErrBadQuery, err)
+	}
+	p, err := newLogPager(q.LogQuery, defaultSearchLimit, maxSearchLimit)
+	if err != nil {
+		return LogSearchResult{}, err
+	}
+	found, next, err := s.pageLogs(p, func(m *LogMatch) bool {
+		var ok bool
+		ok, m.Highlights = query.Match(m.Line)
+		return ok
+	})
+	if err != nil {
+		return LogSearchResult{}, err
+	}
+	return LogSearchResult{Matches: append([]LogMatch{}, found...), NextCursor: next}, nil
+}
@@ -0,0 +1,379 @@
+// internal/storage/sqlite_retention.go
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// runRetention rolls metrics up and deletes expired rows every
+// retentionInterval, as the disk backend does with segments.
+func (s *SQLiteStorage) runRetention() {
+	defer s.done.Done()
+	s.rollupMetrics(time.Now())
+	s.enforceRetention(time.Now())
+	t := time.NewTicker(retentionInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			s.rollupLate(time.Now())
+			return
+		case now := <-t.C:
+			s.rollupMetrics(now)
+			s.enforceRetention(now)
+		}
+	}
+}
+
+// --- rollups ---
+
+// rollupMetrics writes the rollups of every job/target for the buckets
+// completed since the last round: 5m from raw scrapes, 1h from 5m.
+func (s *SQLiteStorage) rollupMetrics(now time.Time) {
+	if len(s.rollups) == 0 {
+		return
+	}
+	s.rollupLate(now)
+	s.flush()
+	rows, err := s.db.Query(`SELECT job, target FROM streams WHERE kind = 'metrics'`)
+	if err != nil {
+		return
+	}
+	type pair struct{ job, target string }
+	var pairs []pair
+	for rows.Next() {
+		var p pair
+		if rows.Scan(&p.job, &p.target) == nil {
+			pairs = append(pairs, p)
+		}
+	}
+	rows.Close()
+	for _, p := range pairs {
+		src, srcDone := "", now.Add(-rollupDelay)
+		for _, l := range s.rollups {
+			done, err := s.rollupStream(l, p.job, p.target, src, srcDone)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "storage: rollup %s: %v\n", streamName(l.kind, p.job, p.target), err)
+				break
+			}
+			src, srcDone = formatLength(l.step), done
+		}
+	}
+}
+
+// rollupLate rolls up again the buckets of the scrapes stored late, as the
+// disk backend does.
+func (s *SQLiteStorage) rollupLate(now time.Time) {
+	late := s.late.take()
+	if len(late) == 0 {
+		return
+	}
+	s.flush() // the late scrapes must be visible
+	for k, span := range late {
+		src, srcDone := "", now.Add(-rollupDelay)
+		for _, l := range s.rollups {
+			done, err := s.rollupStream(l, k.job, k.target, src, srcDone)
+			if from, to := span.buckets(l, done); err == nil && from.Before(to) {
+				err = s.rollupRange(l, k.job, k.target, src, from, to, true)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "storage: rollup %s: %v\n", streamName(l.kind, k.job, k.target), err)
+				break
+			}
+			src, srcDone = formatLength(l.step), done
+		}
+	}
+}
+
+// rollupWatermark returns the end of the last bucket of level l stored for
+// a job/target.
+func (s *SQLiteStorage) rollupWatermark(l rollupLevel, job, target string) (time.Time, bool, error) {
+	var last sql.NullInt64
+	if err := s.db.QueryRow(`SELECT MAX(ts) FROM rollups WHERE resolution = ? AND job = ? AND target = ?`, formatLength(l.step), job, target).Scan(&last); err != nil {
+		return time.Time{}, false, err
+	}
+	if !last.Valid {
+		return time.Time{}, false, nil
+	}
+	return fromNanos(last.Int64).Add(l.step), true, nil
+}
+
+// rollupStream rolls the rows of a job/target at resolution src (raw
+// scrapes if empty) up into level l for the buckets that end by srcDone.
+// It returns the time up to which l is complete.
+func (s *SQLiteStorage) rollupStream(l rollupLevel, job, target, src string, srcDone time.Time) (time.Time, error) {
+	from, ok, err := s.rollupWatermark(l, job, target)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		table, where, args := sourceRows(job, target, src)
+		var first sql.NullInt64
+		if err := s.db.QueryRow("SELECT MIN(ts) FROM "+table+" WHERE "+where, args...).Scan(&first); err != nil {
+			return time.Time{}, err
+		}
+		if !first.Valid {
+			return time.Time{}, nil
+		}
+		from = fromNanos(first.Int64).Truncate(l.step)
+	}
+	until := srcDone.Truncate(l.step)
+	for from.Before(until) {
+		// one segment's worth at a time bounds memory after a long pause
+		to := from.Truncate(l.segment).Add(l.segment)
+		if to.After(until) {
+			to = until
+		}
+		if err := s.rollupRange(l, job, target, src, from, to, false); err != nil {
+			return from, err
+		}
+		from = to
+	}
+	return from, nil
+}
+
+// sourceRows returns the table and conditions selecting the rows of a
+// job/target at resolution src, raw scrapes if empty.
+func sourceRows(job, target, src string) (table, where string, args []interface{}) {
+	if src != "" {
+		return "rollups", "resolution = ? AND job = ? AND target = ?", []interface{}{src, job, target}
+	}
+	return "scrapes", "job = ? AND target = ?", []interface{}{job, target}
+}
+
+// rollupRange rolls the rows at resolution src in [from, to) up into the
+// buckets of level l, first deleting those stored when replace is set.
+func (s *SQLiteStorage) rollupRange(l rollupLevel, job, target, src string, from, to time.Time, replace bool) error {
+	res := formatLength(l.step)
+	table, where, args := sourceRows(job, target, src)
+	agg := newRollupAgg(l, from, to, src == "")
+	rows, err := s.db.Query("SELECT record FROM "+table+" WHERE "+where+" AND ts >= ? AND ts < ? ORDER BY ts, id",
+		append(args, nanos(from), nanos(to))...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var rec string
+		if rows.Scan(&rec) == nil {
+			agg.addLine([]byte(rec))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if replace {
+		s.enqueue("", 0, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`DELETE FROM rollups WHERE resolution = ? AND job = ? AND target = ? AND ts >= ? AND ts < ?`,
+				res, job, target, nanos(from), nanos(to))
+			return err
+		})
+	}
+	for _, rec := range agg.records() {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			continue
+		}
+		ts, _ := time.Parse(time.RFC3339Nano, rec.Timestamp)
+		ls := rec.Labels
+		s.enqueue(l.kind, len(line), func(tx *sql.Tx) error {
+			_, err := tx.Exec(`INSERT INTO rollups (resolution, job, target, ts, labels, record) VALUES (?, ?, ?, ?, ?, ?)`,
+				res, job, target, nanos(ts), labelsJSON(ls), string(line))
+			return err
+		})
+		s.note(CatalogEntry{Kind: l.kind, Job: job, Target: target, Labels: ls})
+	}
+	s.flush() // the next chunk and level resume from these
+	return nil
+}
+
+// --- retention ---
+
+// streamRows returns the table and conditions selecting the rows of a
+// cataloged stream, and the column whose length counts as its size.
+func (s *SQLiteStorage) streamRows(e CatalogEntry) (table, col string, w *sqlWhere) {
+	w = &sqlWhere{}
+	table, col = kindTable(e.Kind), "record"
+	if table == "rollups" {
+		w.add("resolution = ?", s.resolution(e.Kind))
+	}
+	w.add("job = ?", e.Job)
+	w.add("target = ?", e.Target)
+	if e.Kind == "logs" {
+		w.add("app = ?", e.App)
+		col = "line"
+	}
+	return table, col, w
+}
+
+// sqlRetention is the age cutoff of one stream.
+type sqlRetention struct {
+	CatalogEntry
+	cutoff time.Time // zero keeps everything
+	rule   int
+}
+
+// retentionPlan returns the cutoff of every stream. Processes entries of
+// single apps share their job/target's rows and are left out.
+func (s *SQLiteStorage) retentionPlan(now time.Time) []sqlRetention {
+	var plan []sqlRetention
+	for _, e := range s.Catalog(CatalogQuery{}) {
+		if e.Kind == "processes" && e.App != "" {
+			continue
+		}
+		rule := -1
+		for i := range s.rules {
+			if s.rules[i].selects(e.Kind, e.Job, e.Target, e.App) {
+				rule = i
+				break
+			}
+		}
+		var age time.Duration
+		if rule >= 0 {
+			age = s.rules[rule].MaxAge
+		} else {
+			days := s.retentionDays
+			for _, l := range s.rollups {
+				if l.kind == e.Kind {
+					days = l.retentionDays
+				}
+			}
+			age = time.Duration(days) * 24 * time.Hour
+		}
+		r := sqlRetention{CatalogEntry: e, rule: rule}
+		if age > 0 {
+			r.cutoff = now.Add(-age)
+		}
+		plan = append(plan, r)
+	}
+	return plan
+}
+
+// enforceRetention deletes the rows older than their stream's cutoff and
+// then uncatalogs the streams left empty.
+func (s *SQLiteStorage) enforceRetention(now time.Time) {
+	plan := s.retentionPlan(now)
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	for _, r := range plan {
+		if r.cutoff.IsZero() {
+			continue
+		}
+		table, _, w := s.streamRows(r.CatalogEntry)
+		w.add("ts < ?", nanos(r.cutoff))
+		res, err := s.db.Exec("DELETE FROM "+table+w.String(), w.args...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "storage: retention %s: %v\n", streamName(r.Kind, r.Job, r.Target, r.App), err)
+			continue
+		}
+		if n, err := res.RowsAffected(); err == nil && s.deleted[r.Kind] != nil {
+			s.deleted[r.Kind].Add(uint64(n))
+		}
+	}
+	pruned := false
+	for _, r := range plan {
+		table, _, w := s.streamRows(r.CatalogEntry)
+		var one int
+		if err := s.db.QueryRow("SELECT 1 FROM "+table+w.String()+" LIMIT 1", w.args...).Scan(&one); err != sql.ErrNoRows {
+			continue
+		}
+		q := `DELETE FROM streams WHERE kind = ? AND job = ? AND target = ? AND app = ?`
+		args := []interface{}{r.Kind, r.Job, r.Target, r.App}
+		if r.Kind == "processes" {
+			// with the entries of its apps
+			q = `DELETE FROM streams WHERE kind = ? AND job = ? AND target = ?`
+			args = args[:3]
+		}
+		if _, err := s.db.Exec(q, args...); err == nil {
+			pruned = true
+		}
+	}
+	if pruned {
+		s.catMu.Lock()
+		s.cataloged = make(map[string]string) // streams stored again are recataloged
+		s.catMu.Unlock()
+	}
+}
+
+// PreviewRetention returns what a retention round would delete now: for
+// each stream, the rows older than its cutoff.
+func (s *SQLiteStorage) PreviewRetention() RetentionReport {
+	return s.previewRetention(time.Now())
+}
+
+// previewRetention implements PreviewRetention for a round at now.
+func (s *SQLiteStorage) previewRetention(now time.Time) RetentionReport {
+	report := RetentionReport{Deletions: []RetentionDeletion{}}
+	for _, r := range s.retentionPlan(now) {
+		table, col, w := s.streamRows(r.CatalogEntry)
+		var total, old int64
+		var n int
+		isOld := "0" // nothing is old without a cutoff
+		args := w.args
+		if !r.cutoff.IsZero() {
+			isOld = "ts < ?"
+			c := nanos(r.cutoff)
+			args = append([]interface{}{c, c}, args...)
+		}
+		q := fmt.Sprintf("SELECT COALESCE(SUM(LENGTH(%[1]s)), 0), COALESCE(SUM(CASE WHEN %[2]s THEN LENGTH(%[1]s) END), 0), COUNT(CASE WHEN %[2]s THEN 1 END) FROM %[3]s%[4]s",
+			col, isOld, table, w.String())
+		if err := s.db.QueryRow(q, args...).Scan(&total, &old, &n); err != nil {
+			continue
+		}
+		report.KeptBytes += total - old
+		if n == 0 {
+			continue
+		}
+		del := RetentionDeletion{Stream: streamName(r.Kind, r.Job, r.Target, r.App), Kind: r.Kind, Job: r.Job, Target: r.Target, App: r.App,
+			Before: r.cutoff.UTC(), Bytes: old, Reason: "age"}
+		if r.rule >= 0 {
+			del.Rule = s.rules[r.rule].Name
+		}
+		report.Deletions = append(report.Deletions, del)
+		report.Bytes += old
+	}
+	return report
+}
+
+// --- self-metrics ---
+
+var (
+	databaseBytesDesc = prometheus.NewDesc("pm2_collector_storage_database_bytes",
+		"Size of the sqlite database and its write-ahead log.",
+		nil, nil)
+	rowsDeletedDesc = prometheus.NewDesc("pm2_collector_storage_rows_deleted_total",
+		"Rows deleted from the sqlite database by retention, by kind.",
+		[]string{"kind"}, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (s *SQLiteStorage) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{writtenRecordsDesc, writtenBytesDesc, writeErrorsDesc, databaseBytesDesc, rowsDeletedDesc} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (s *SQLiteStorage) Collect(ch chan<- prometheus.Metric) {
+	for kind, st := range s.stats {
+		ch <- prometheus.MustNewConstMetric(writtenRecordsDesc, prometheus.CounterValue, float64(st.records.Load()), kind)
+		ch <- prometheus.MustNewConstMetric(writtenBytesDesc, prometheus.CounterValue, float64(st.bytes.Load()), kind)
+		ch <- prometheus.MustNewConstMetric(writeErrorsDesc, prometheus.CounterValue, float64(st.errors.Load()), kind)
+	}
+	for kind, n := range s.deleted {
+		ch <- prometheus.MustNewConstMetric(rowsDeletedDesc, prometheus.CounterValue, float64(n.Load()), kind)
+	}
+	var size int64
+	for _, fn := range []string{s.path, s.path + "-wal"} {
+		if info, err := os.Stat(fn); err == nil {
+			size += info.Size()
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(databaseBytesDesc, prometheus.GaugeValue, float64(size))
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withMigrations appends migrations to the schema for the rest of the test.
+func withMigrations(t *testing.T, more ...string) {
+	orig := sqliteMigrations
+	sqliteMigrations = append(append([]string{}, orig...), more...)
+	t.Cleanup(func() { sqliteMigrations = orig })
+}
+
+// existingDatabase creates a database in dir with the current schema and
+// some logs, as a previous run of the collector leaves it.
+func existingDatabase(t *testing.T, dir string) time.Time {
+	t.Helper()
+	s, err := NewSQLite(testStorageConfig("sqlite", dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now().UTC().Add(-time.Minute)
+	s.StoreLog("web", "h1", nil, ts, "[api] started")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// schema returns the database's user_version and the columns of table.
+func schema(t *testing.T, dir, table string) (int, []string) {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(dir, sqliteFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var cols []string
+	for rows.Next() {
+		var c string
+		rows.Scan(&c)
+		cols = append(cols, c)
+	}
+	return version, cols
+}
+
+func setUserVersion(t *testing.T, dir string, v int) {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(dir, sqliteFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("PRAGMA user_version = " + strconv.Itoa(v)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A database of an older schema is migrated in place, keeping its data.
+func TestSQLiteMigratesExistingDatabase(t *testing.T) {
+	dir := t.TempDir()
+	existingDatabase(t, dir)
+	base, _ := schema(t, dir, "logs")
+
+	withMigrations(t, `ALTER TABLE logs ADD COLUMN source TEXT`, `CREATE INDEX logs_source ON logs (source)`)
+	s, err := NewSQLite(testStorageConfig("sqlite", dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := s.QueryLogs(LogQuery{Selector: Selector{Job: "web"}})
+	s.Close()
+	if err != nil || len(page.Lines) != 1 || page.Lines[0].Line != "started" {
+		t.Fatalf("logs after migrating: %+v, %v", page.Lines, err)
+	}
+	version, cols := schema(t, dir, "logs")
+	if version != base+2 || cols[len(cols)-1] != "source" {
+		t.Fatalf("schema after migrating: version %d, columns %v", version, cols)
+	}
+
+	// reopening applies nothing again
+	s, err = NewSQLite(testStorageConfig("sqlite", dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if v, _ := schema(t, dir, "logs"); v != base+2 {
+		t.Fatalf("version after reopening: %d", v)
+	}
+}
+
+// A failed migration is rolled back, leaving the database as it was.
+func TestSQLiteFailedMigration(t *testing.T) {
+	dir := t.TempDir()
+	existingDatabase(t, dir)
+	base, cols := schema(t, dir, "logs")
+
+	withMigrations(t, `ALTER TABLE logs ADD COLUMN source TEXT; SELECT * FROM no_such_table`)
+	if _, err := NewSQLite(testStorageConfig("sqlite", dir)); err == nil || !strings.Contains(err.Error(), "migration") {
+		t.Fatalf("opening with a failing migration: %v", err)
+	}
+	if v, after := schema(t, dir, "logs"); v != base || len(after) != len(cols) {
+		t.Fatalf("schema after a failed migration: version %d, columns %v", v, after)
+	}
+}
+
+// A database migrated by a newer collector is not opened.
+func TestSQLiteNewerSchema(t *testing.T) {
+	dir := t.TempDir()
+	existingDatabase(t, dir)
+	setUserVersion(t, dir, len(sqliteMigrations)+1)
+	if _, err := NewSQLite(testStorageConfig("sqlite", dir)); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("opening a newer schema: %v", err)
+	}
+}
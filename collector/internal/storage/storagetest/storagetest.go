@@ -0,0 +1,23 @@
+// Package storagetest opens throwaway stores for the tests of the packages
+// built on storage.
+package storagetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/storage"
+)
+
+// Open returns a disk store in a temporary directory that flushes every
+// 10ms and is closed when the test ends.
+func Open(t testing.TB) storage.Backend {
+	t.Helper()
+	s, err := storage.Open(config.StorageConfig{Type: "disk", Directory: t.TempDir(), FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/labels"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// The Store conformance suite: every backend answers every query the same
+// way over the same data.
+
+func gaugeFamily(name string, v float64) map[string]*dto.MetricFamily {
+	return map[string]*dto.MetricFamily{name: {
+		Name:   proto.String(name),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(v)}}},
+	}}
+}
+
+// conformanceData stores the data the suite queries: two targets of job
+// web, labelled by env, and one of job batch; t0 is the first scrape.
+func conformanceData(t *testing.T, s Backend) time.Time {
+	t.Helper()
+	t0 := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	prod, dev := map[string]string{"env": "prod"}, map[string]string{"env": "dev"}
+	for i := range 3 {
+		ts := t0.Add(time.Duration(i) * time.Minute)
+		s.StoreMetrics("web", "h1", prod, ts, gaugeFamily("pm2_up", float64(i)))
+		s.StoreMetrics("web", "h2", dev, ts, gaugeFamily("pm2_up", 1))
+		s.StoreProcesses("web", "h1", prod, ts, procsJSON(i))
+	}
+	s.StoreMetrics("batch", "h1", nil, t0, gaugeFamily("pm2_up", 1))
+	for i, line := range []string{"started", "GET /health 200", "GET /login 500", "stopping"} {
+		s.StoreLog("web", "h1", prod, t0.Add(time.Duration(i)*time.Second), "[api] "+line)
+	}
+	if _, err := s.StoreLogEntries("web", "h2", dev, []discovery.LogEntry{
+		{Stream: "out", Seq: 1, Timestamp: t0.Add(10 * time.Second), Line: "worker ready"},
+		{Stream: "out", Seq: 2, Timestamp: t0.Add(11 * time.Second), Line: "worker GET /jobs"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return t0
+}
+
+func matcher(t *testing.T, s string) []labels.Matcher {
+	t.Helper()
+	m, err := labels.ParseMatcher(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []labels.Matcher{m}
+}
+
+// names decodes the JSON strings ListAllTargets and ListJobsByTarget
+// return, and the {"name"} objects of QueryApps.
+func names(t *testing.T, raw []json.RawMessage) []string {
+	t.Helper()
+	out := []string{}
+	for _, r := range raw {
+		var s string
+		if json.Unmarshal(r, &s) != nil {
+			var app struct{ Name string }
+			if err := json.Unmarshal(r, &app); err != nil {
+				t.Fatal(err)
+			}
+			s = app.Name
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func logLines(page []LogLine) []string {
+	out := []string{}
+	for _, l := range page {
+		out = append(out, l.Line)
+	}
+	return out
+}
+
+func TestStoreConformance(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Backend) {
+		s := open()
+		defer s.Close()
+		t0 := conformanceData(t, s)
+
+		t.Run("metrics", func(t *testing.T) {
+			recs, err := s.QueryMetrics(MetricQuery{Selector: Selector{Job: "web", Target: "h1"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var values []float64
+			for _, r := range recs {
+				_, mfs, err := DecodeMetricsRecord(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				values = append(values, mfs["pm2_up"].GetMetric()[0].GetGauge().GetValue())
+			}
+			if !slices.Equal(values, []float64{0, 1, 2}) {
+				t.Fatalf("web/h1 values: %v", values)
+			}
+			if recs, _ := s.QueryMetrics(MetricQuery{Selector: Selector{Start: t0.Add(time.Minute)}}); len(recs) != 4 {
+				t.Fatalf("scrapes since the second: got %d, want 4", len(recs))
+			}
+			if recs, _ := s.QueryMetrics(MetricQuery{Selector: Selector{Matchers: matcher(t, "env=dev")}}); len(recs) != 3 {
+				t.Fatalf("scrapes of env=dev: got %d, want 3", len(recs))
+			}
+			var scanned []string
+			err = s.ScanMetrics(MetricQuery{Selector: Selector{Job: "web"}}, func(job, target string, _ json.RawMessage) error {
+				scanned = append(scanned, job+"/"+target)
+				return nil
+			})
+			if err != nil || len(scanned) != 6 {
+				t.Fatalf("scanned %v, %v", scanned, err)
+			}
+		})
+
+		t.Run("processes", func(t *testing.T) {
+			snaps, err := s.QueryProcesses(ProcessQuery{Selector: Selector{Job: "web", Target: "h1"}})
+			if err != nil || len(snaps) != 1 {
+				t.Fatalf("latest snapshot: %d, %v", len(snaps), err)
+			}
+			ts, states, err := ParseProcessSnapshot(snaps[0])
+			if err != nil || !ts.Equal(t0.Add(2*time.Minute)) || states[0].RestartCount != 2 {
+				t.Fatalf("latest snapshot: %s %+v %v", ts, states, err)
+			}
+			snaps, _ = s.QueryProcesses(ProcessQuery{Selector: Selector{Job: "web", Target: "h1"}, At: t0.Add(90 * time.Second)})
+			if _, states, _ := ParseProcessSnapshot(snaps[0]); states[0].RestartCount != 1 {
+				t.Fatalf("snapshot at t0+90s: %+v", states)
+			}
+			snaps, _ = s.QueryProcesses(ProcessQuery{Selector: Selector{Job: "web", Target: "h1", Start: t0, End: t0.Add(time.Hour)}})
+			if len(snaps) != 3 {
+				t.Fatalf("snapshots in range: got %d, want 3", len(snaps))
+			}
+
+			tl, err := s.QueryProcessTimeline(ProcessQuery{Selector: Selector{Job: "web", Target: "h1"}})
+			if err != nil || len(tl) != 1 || len(tl[0].States) != 3 || tl[0].Name != "api" {
+				t.Fatalf("timeline: %+v, %v", tl, err)
+			}
+			diff, err := s.DiffProcesses(ProcessQuery{Selector: Selector{Job: "web", Target: "h1", Start: t0, End: t0.Add(2 * time.Minute)}})
+			if err != nil || len(diff.Changed) != 1 || diff.Changed[0].Fields["restart_time"] != (FieldChange{0, 2}) {
+				t.Fatalf("diff: %+v, %v", diff, err)
+			}
+
+			events, err := s.QueryEvents(EventQuery{Selector: Selector{Job: "web"}, Types: []string{EventRestart}})
+			if err != nil || len(events) != 2 {
+				t.Fatalf("restart events: %+v, %v", events, err)
+			}
+			if events, _ := s.QueryEvents(EventQuery{Types: []string{EventRestart}, NumLines: 1}); len(events) != 1 || events[0].Timestamp != t0.Add(2*time.Minute).Format(time.RFC3339Nano) {
+				t.Fatalf("latest restart event: %+v", events)
+			}
+		})
+
+		t.Run("logs", func(t *testing.T) {
+			all := []string{"started", "GET /health 200", "GET /login 500", "stopping", "worker ready", "worker GET /jobs"}
+			var got []string
+			q := LogQuery{Selector: Selector{Job: "web"}, Forward: true, NumLines: 4}
+			for {
+				page, err := s.QueryLogs(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, logLines(page.Lines)...)
+				if page.NextCursor == "" {
+					break
+				}
+				q.Cursor = page.NextCursor
+			}
+			if !slices.Equal(got, all) {
+				t.Fatalf("forward pages: %v", got)
+			}
+			page, err := s.QueryLogs(LogQuery{Selector: Selector{Job: "web"}, NumLines: 2})
+			if err != nil || !slices.Equal(logLines(page.Lines), []string{"worker GET /jobs", "worker ready"}) || page.NextCursor == "" {
+				t.Fatalf("newest page: %v, %q, %v", logLines(page.Lines), page.NextCursor, err)
+			}
+			page, _ = s.QueryLogs(LogQuery{Selector: Selector{Job: "web", App: "api"}, Cursor: page.Lines[0].Cursor})
+			if len(page.Lines) != 4 || page.Lines[0].App != "api" {
+				t.Fatalf("api lines: %+v", page.Lines)
+			}
+			page, _ = s.QueryLogs(LogQuery{Selector: Selector{Matchers: matcher(t, "env=dev")}})
+			if !slices.Equal(logLines(page.Lines), []string{"worker GET /jobs", "worker ready"}) {
+				t.Fatalf("env=dev lines: %v", logLines(page.Lines))
+			}
+			if _, err := s.QueryLogs(LogQuery{Cursor: "nonsense"}); err == nil {
+				t.Fatal("invalid cursor accepted")
+			}
+
+			res, err := s.SearchLogs(SearchQuery{LogQuery: LogQuery{Selector: Selector{Job: "web"}}, Search: "GET"})
+			if err != nil || len(res.Matches) != 3 {
+				t.Fatalf("search GET: %+v, %v", res.Matches, err)
+			}
+			if m := res.Matches[0]; m.Line != "worker GET /jobs" || len(m.Highlights) != 1 || m.Line[m.Highlights[0][0]:m.Highlights[0][1]] != "GET" {
+				t.Fatalf("first match: %+v", m)
+			}
+			if res, _ := s.SearchLogs(SearchQuery{LogQuery: LogQuery{Forward: true, NumLines: 1}, Search: "GET"}); len(res.Matches) != 1 || res.Matches[0].Line != "GET /health 200" || res.NextCursor == "" {
+				t.Fatalf("first match forward: %+v", res)
+			}
+
+			if offs := s.LogOffsets("web", "h2"); offs["out"] != 2 {
+				t.Fatalf("log offsets: %v", offs)
+			}
+			acks, err := s.StoreLogEntries("web", "h2", nil, []discovery.LogEntry{{Stream: "out", Seq: 2, Timestamp: t0.Add(11 * time.Second), Line: "worker GET /jobs"}})
+			if err != nil || acks["out"] != 2 {
+				t.Fatalf("acknowledged again: %v, %v", acks, err)
+			}
+			if page, _ := s.QueryLogs(LogQuery{Selector: Selector{Target: "h2"}}); len(page.Lines) != 2 {
+				t.Fatalf("a redelivered entry was stored twice: %v", logLines(page.Lines))
+			}
+		})
+
+		t.Run("catalog", func(t *testing.T) {
+			if got := names(t, mustRaw(t)(s.ListAllTargets(TargetQuery{}))); !slices.Equal(got, []string{"h1", "h2"}) {
+				t.Fatalf("targets: %v", got)
+			}
+			if got := names(t, mustRaw(t)(s.ListAllTargets(TargetQuery{Matchers: matcher(t, "env=prod")}))); !slices.Equal(got, []string{"h1"}) {
+				t.Fatalf("targets of env=prod: %v", got)
+			}
+			if got := names(t, mustRaw(t)(s.ListJobsByTarget(JobQuery{Target: "h1"}))); !slices.Equal(got, []string{"batch", "web"}) {
+				t.Fatalf("jobs of h1: %v", got)
+			}
+			if got := names(t, mustRaw(t)(s.QueryApps(AppQuery{Selector: Selector{Job: "web"}}))); !slices.Equal(got, []string{"api"}) {
+				t.Fatalf("apps: %v", got)
+			}
+			if got := names(t, mustRaw(t)(s.QueryApps(AppQuery{Selector: Selector{Job: "web", Target: "h1", Start: t0, End: t0.Add(time.Hour)}}))); !slices.Equal(got, []string{"api"}) {
+				t.Fatalf("apps in range: %v", got)
+			}
+
+			for _, kind := range []string{"metrics", "processes", "events", "logs"} {
+				entries := s.Catalog(CatalogQuery{Kind: kind, Job: "web", Target: "h1"})
+				if len(entries) == 0 {
+					t.Errorf("no %s stream of web/h1", kind)
+				}
+				for _, e := range entries {
+					if e.Labels["env"] != "prod" {
+						t.Errorf("%s labels: %v", kind, e.Labels)
+					}
+				}
+			}
+			if got := s.Catalog(CatalogQuery{Kind: "metrics", Matchers: matcher(t, "env!=prod")}); len(got) != 2 {
+				t.Fatalf("metric streams not env=prod: %+v", got)
+			}
+		})
+
+		t.Run("retention", func(t *testing.T) {
+			report := s.PreviewRetention()
+			if len(report.Deletions) != 0 || report.Bytes != 0 || report.KeptBytes == 0 {
+				t.Fatalf("retention preview without limits: %+v", report)
+			}
+		})
+	})
+}
+
+// mustRaw returns a function that fails t on a query error and passes the
+// result through otherwise.
+func mustRaw(t *testing.T) func([]json.RawMessage, error) []json.RawMessage {
+	t.Helper()
+	return func(raw []json.RawMessage, err error) []json.RawMessage {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+}
+
+// Data survives closing and reopening the backend.
+func TestStoreReopen(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, open func() Backend) {
+		s := open()
+		t0 := conformanceData(t, s)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		s = open()
+		defer s.Close()
+		if recs, _ := s.QueryMetrics(MetricQuery{}); len(recs) != 7 {
+			t.Fatalf("scrapes after reopening: got %d, want 7", len(recs))
+		}
+		if page, _ := s.QueryLogs(LogQuery{Selector: Selector{Start: t0}}); len(page.Lines) != 6 {
+			t.Fatalf("log lines after reopening: %v", logLines(page.Lines))
+		}
+		if offs := s.LogOffsets("web", "h2"); offs["out"] != 2 {
+			t.Fatalf("log offsets after reopening: %v", offs)
+		}
+		if got := s.Catalog(CatalogQuery{Kind: "metrics"}); len(got) != 3 {
+			t.Fatalf("metric streams after reopening: %+v", got)
+		}
+		if got := s.Catalog(CatalogQuery{Kind: "logs"}); len(got) != 2 {
+			t.Fatalf("log streams after reopening: %+v", got)
+		}
+	})
+}
@@ -0,0 +1,627 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxPending is how many buffered bytes a file may hold before they are
+// written without waiting for the next flush.
+const maxPending = 64 * 1024
+
+// maxUnwritten is how many bytes a file whose writes keep failing may hold
+// before further records are dropped.
+const maxUnwritten = 16 << 20
+
+// idleClose is how long an unused file handle stays open.
+const idleClose = 2 * time.Minute
+
+// fileWriter appends records to one JSONL file through a cached handle.
+// Each record is framed as a complete line in memory and lines reach the
+// file in a single write, so a crash can only tear the final line, which
+// recoverTornTails removes on the next start. Lines a failed write did not
+// store stay buffered and are written by the next flush.
+type fileWriter struct {
+	path  string
+	stats *kindStats
+
+	mu       sync.Mutex
+	f        *os.File // nil while closed
+	buf      []byte   // complete lines not written yet
+	unsynced bool     // written since the last fsync
+	lastUse  time.Time
+	removed  bool // dropped from the pool; appenders must get a new writer
+}
+
+// writerPool holds one writer per file and flushes, syncs and closes them
+// in the background.
+type writerPool struct {
+	flushEvery time.Duration
+	syncEvery  time.Duration
+	maxOpen    int
+	sync       func(*os.File) error // fsync; tests make it fail
+
+	mu      sync.Mutex
+	writers map[string]*fileWriter
+
+	stats     map[string]*kindStats // by record kind
+	openFiles atomic.Int64
+	fsyncs    atomic.Uint64
+	fsyncNs   atomic.Uint64
+	truncated atomic.Uint64 // torn records removed at startup
+
+	storedBytes atomic.Int64 // size of all segments at the last retention pass
+	deletedMu   sync.Mutex
+	deleted     map[string]uint64 // segments deleted by retention, by reason
+}
+
+// kindStats counts the write path of one record kind.
+type kindStats struct {
+	records atomic.Uint64
+	bytes   atomic.Uint64
+	errors  atomic.Uint64
+	dropped atomic.Uint64 // records refused while maxUnwritten bytes were buffered
+}
+
+var recordKinds = []string{"metrics", "metrics5m", "metrics1h", "processes", "events", "logs"}
+
+func newWriterPool(flushEvery, syncEvery time.Duration, maxOpen int) *writerPool {
+	if flushEvery <= 0 {
+		flushEvery = 200 * time.Millisecond
+	}
+	if syncEvery <= 0 {
+		syncEvery = time.Second
+	}
+	if maxOpen <= 0 {
+		maxOpen = 256
+	}
+	p := &writerPool{
+		flushEvery: flushEvery,
+		syncEvery:  syncEvery,
+		maxOpen:    maxOpen,
+		sync:       (*os.File).Sync,
+		writers:    make(map[string]*fileWriter),
+		stats:      make(map[string]*kindStats, len(recordKinds)),
+		deleted:    map[string]uint64{"age": 0, "size": 0},
+	}
+	for _, k := range recordKinds {
+		p.stats[k] = &kindStats{}
+	}
+	return p
+}
+
+// get returns the writer of a file, creating it on first use.
+func (p *writerPool) get(path string) *fileWriter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := p.writers[path]
+	if w == nil {
+		name := filepath.Base(path)
+		if _, _, ok := parseSegmentName(name); ok {
+			name = filepath.Base(filepath.Dir(path)) // the stream directory
+		}
+		kind, _, _ := strings.Cut(name, "_")
+		st := p.stats[kind]
+		if st == nil {
+			st = &kindStats{}
+		}
+		w = &fileWriter{path: path, stats: st}
+		p.writers[path] = w
+	}
+	return w
+}
+
+// all returns a snapshot of the writers.
+func (p *writerPool) all() []*fileWriter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]*fileWriter, 0, len(p.writers))
+	for _, w := range p.writers {
+		out = append(out, w)
+	}
+	return out
+}
+
+// lock returns the writer of a file, locked and still in the pool.
+func (p *writerPool) lock(path string) *fileWriter {
+	for {
+		w := p.get(path)
+		w.mu.Lock()
+		if !w.removed {
+			return w
+		}
+		w.mu.Unlock()
+	}
+}
+
+// append buffers one record; line must not contain a newline. It reports
+// whether the record was kept: it is dropped while maxUnwritten bytes of
+// the file are waiting to be written.
+func (p *writerPool) append(path string, line []byte) bool {
+	w := p.lock(path)
+	defer w.mu.Unlock()
+	if len(w.buf) >= maxUnwritten {
+		w.stats.dropped.Add(1)
+		return false
+	}
+	w.buf = append(w.buf, line...)
+	w.buf = append(w.buf, '\n')
+	w.stats.records.Add(1)
+	w.lastUse = time.Now()
+	if len(w.buf) >= maxPending {
+		p.writeLocked(w)
+	}
+	return true
+}
+
+// appendSync writes records and syncs the file before returning, for
+// writes that are acknowledged to the sender. It returns the file size. On
+// failure the records are neither kept buffered nor left in the file, even
+// if only the fsync failed: the sender sends them again.
+func (p *writerPool) appendSync(path string, lines [][]byte) (int64, error) {
+	w := p.lock(path)
+	defer w.mu.Unlock()
+	w.lastUse = time.Now()
+	// write what is already buffered first, so everything past size is ours
+	if err := p.writeLocked(w); err != nil {
+		return 0, err
+	}
+	size, err := writtenSize(w)
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range lines {
+		w.buf = append(w.buf, l...)
+		w.buf = append(w.buf, '\n')
+	}
+	added := int64(len(w.buf))
+	w.stats.records.Add(uint64(len(lines)))
+	if err := p.syncLocked(w); err != nil {
+		w.buf = w.buf[:0]
+		if w.f != nil {
+			if terr := w.f.Truncate(size); terr != nil {
+				return 0, fmt.Errorf("%w (and could not remove the records: %v)", err, terr)
+			}
+		}
+		return 0, err
+	}
+	return size + added, nil
+}
+
+// writtenSize returns the size of a writer's file, 0 if it does not exist.
+func writtenSize(w *fileWriter) (int64, error) {
+	var info os.FileInfo
+	var err error
+	if w.f != nil {
+		info, err = w.f.Stat()
+	} else {
+		info, err = os.Stat(w.path)
+	}
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// writeLocked hands the buffered lines to the OS in one write. If the file
+// cannot be opened or written the lines stay buffered for the next attempt;
+// the part of them a short write stored is cut off the file again, so no
+// partial line is left before the lines appended after it.
+func (p *writerPool) writeLocked(w *fileWriter) error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if w.f == nil {
+		f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if os.IsNotExist(err) {
+			// first segment of a stream, or its directory was just pruned
+			if err = os.MkdirAll(filepath.Dir(w.path), 0o755); err == nil {
+				f, err = os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			}
+		}
+		if err != nil {
+			w.stats.errors.Add(1)
+			return err
+		}
+		w.f = f
+		p.openFiles.Add(1)
+	}
+	n, err := w.f.Write(w.buf)
+	if err == nil {
+		w.stats.bytes.Add(uint64(n))
+		w.buf = w.buf[:0]
+		w.unsynced = true
+		return nil
+	}
+	w.stats.errors.Add(1)
+	if n > 0 {
+		if terr := cutTail(w.f, int64(n)); terr != nil {
+			// the partial line stays, so the next write must complete it
+			w.stats.bytes.Add(uint64(n))
+			w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+			w.unsynced = true
+			return fmt.Errorf("%w (and could not cut the partial write: %v)", err, terr)
+		}
+	}
+	return err
+}
+
+// cutTail removes the last n bytes of f.
+func cutTail(f *os.File, n int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return f.Truncate(info.Size() - n)
+}
+
+func (p *writerPool) syncLocked(w *fileWriter) error {
+	if err := p.writeLocked(w); err != nil {
+		return err
+	}
+	if !w.unsynced || w.f == nil {
+		return nil
+	}
+	began := time.Now()
+	err := p.sync(w.f)
+	p.fsyncs.Add(1)
+	p.fsyncNs.Add(uint64(time.Since(began)))
+	if err != nil {
+		w.stats.errors.Add(1)
+		return err
+	}
+	w.unsynced = false
+	return nil
+}
+
+func (p *writerPool) closeLocked(w *fileWriter) error {
+	err := p.syncLocked(w)
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+		p.openFiles.Add(-1)
+	}
+	return err
+}
+
+// flush writes every buffered line, without syncing, so readers see it.
+func (p *writerPool) flush() {
+	for _, w := range p.all() {
+		w.mu.Lock()
+		if err := p.writeLocked(w); err != nil {
+			fmt.Fprintf(os.Stderr, "storage: write %s: %v\n", w.path, err)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// flushFile writes the buffered lines of one file.
+func (p *writerPool) flushFile(path string) {
+	p.mu.Lock()
+	w := p.writers[path]
+	p.mu.Unlock()
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if err := p.writeLocked(w); err != nil {
+		fmt.Fprintf(os.Stderr, "storage: write %s: %v\n", w.path, err)
+	}
+	w.mu.Unlock()
+}
+
+// run flushes every flushEvery and syncs every syncEvery, closing handles
+// that were idle or exceed maxOpen, least recently used first. Writers of
+// closed files are dropped, so past segments do not accumulate, until stop
+// is closed.
+func (p *writerPool) run(stop <-chan struct{}) {
+	flush := time.NewTicker(p.flushEvery)
+	defer flush.Stop()
+	lastSync := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-flush.C:
+		}
+		doSync := time.Since(lastSync) >= p.syncEvery
+		if doSync {
+			lastSync = time.Now()
+		}
+		writers := p.all()
+		var open []*fileWriter
+		for _, w := range writers {
+			w.mu.Lock()
+			var err error
+			switch {
+			case w.f != nil && time.Since(w.lastUse) > idleClose:
+				err = p.closeLocked(w)
+			case doSync:
+				err = p.syncLocked(w)
+			default:
+				err = p.writeLocked(w)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "storage: write %s: %v\n", w.path, err)
+			}
+			if w.f != nil {
+				open = append(open, w)
+			}
+			w.mu.Unlock()
+		}
+		if excess := len(open) - p.maxOpen; excess > 0 {
+			sort.Slice(open, func(i, j int) bool { return open[i].lastUse.Before(open[j].lastUse) })
+			for _, w := range open[:excess] {
+				w.mu.Lock()
+				p.closeLocked(w)
+				w.mu.Unlock()
+			}
+		}
+		p.dropIdle()
+	}
+}
+
+// dropIdle removes writers whose file is closed and that hold no lines.
+func (p *writerPool) dropIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for path, w := range p.writers {
+		w.mu.Lock()
+		if w.f == nil && len(w.buf) == 0 && time.Since(w.lastUse) > idleClose {
+			w.removed = true
+			delete(p.writers, path)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// remove closes a file's writer and deletes the file.
+func (p *writerPool) remove(path string) error {
+	p.mu.Lock()
+	w := p.writers[path]
+	delete(p.writers, path)
+	p.mu.Unlock()
+	if w != nil {
+		w.mu.Lock()
+		p.closeLocked(w)
+		w.removed = true
+		w.mu.Unlock()
+	}
+	return os.Remove(path)
+}
+
+func (p *writerPool) segmentsDeleted(reason string) {
+	p.deletedMu.Lock()
+	p.deleted[reason]++
+	p.deletedMu.Unlock()
+}
+
+// Close writes, syncs and closes every file.
+func (p *writerPool) Close() error {
+	var first error
+	for _, w := range p.all() {
+		w.mu.Lock()
+		if err := p.closeLocked(w); err != nil && first == nil {
+			first = err
+		}
+		w.mu.Unlock()
+	}
+	return first
+}
+
+// rename closes a file's writer and renames the file; later records start
+// a new file at path.
+func (p *writerPool) rename(path, to string) error {
+	w := p.lock(path)
+	defer w.mu.Unlock()
+	if err := p.closeLocked(w); err != nil {
+		return err
+	}
+	return os.Rename(path, to)
+}
+
+// rewrite replaces a file's content while no records are appended to it:
+// fn receives the current content and returns the new one, or nil to
+// delete the file. The new content is written to a temporary file and
+// renamed over the old one.
+func (p *writerPool) rewrite(path string, fn func(data []byte) []byte) error {
+	w := p.lock(path)
+	defer w.mu.Unlock()
+	if err := p.closeLocked(w); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	out := fn(data)
+	if out == nil {
+		return os.Remove(path)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// recoverTornTails truncates every data file and segment to its last
+// complete line, removing a record torn by a crash mid-write, and deletes
+// leftover temporary files from interrupted rewrites.
+func (p *writerPool) recoverTornTails(dir string) error {
+	for _, pat := range []string{"*.jsonl.tmp", "*/*.jsonl.tmp", "*/*.jsonl.gz.tmp", "*/*.jsonl.idx.tmp"} {
+		tmps, _ := filepath.Glob(filepath.Join(dir, pat))
+		for _, t := range tmps {
+			os.Remove(t)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	segs, err := filepath.Glob(filepath.Join(dir, "*", "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	files = append(files, segs...)
+	for _, fn := range files {
+		n, err := truncateTornTail(fn)
+		if err != nil {
+			return fmt.Errorf("recover %s: %w", fn, err)
+		}
+		if n > 0 {
+			p.truncated.Add(1)
+			fmt.Fprintf(os.Stderr, "storage: removed torn record (%d bytes) at the end of %s\n", n, fn)
+		}
+	}
+	return nil
+}
+
+// truncateTornTail cuts fn after its last newline and returns the number
+// of bytes removed.
+func truncateTornTail(fn string) (int64, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return 0, nil
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, size-1); err != nil {
+		return 0, err
+	}
+	if last[0] == '\n' {
+		return 0, nil
+	}
+
+	// find the last newline, reading backwards in chunks
+	const chunk = 64 * 1024
+	end := int64(0)
+	for off := size; off > 0 && end == 0; {
+		n := int64(chunk)
+		if off < n {
+			n = off
+		}
+		off -= n
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := len(buf) - 1; i >= 0; i-- {
+			if buf[i] == '\n' {
+				end = off + int64(i) + 1
+				break
+			}
+		}
+	}
+	if err := f.Truncate(end); err != nil {
+		return 0, err
+	}
+	return size - end, f.Sync()
+}
+
+var (
+	writtenRecordsDesc = prometheus.NewDesc("pm2_collector_storage_records_written_total",
+		"Records appended to storage, by kind.",
+		[]string{"kind"}, nil)
+	writtenBytesDesc = prometheus.NewDesc("pm2_collector_storage_bytes_written_total",
+		"Bytes written to storage files, by kind.",
+		[]string{"kind"}, nil)
+	writeErrorsDesc = prometheus.NewDesc("pm2_collector_storage_write_errors_total",
+		"Failed opens, writes or syncs of storage files, by kind.",
+		[]string{"kind"}, nil)
+	droppedRecordsDesc = prometheus.NewDesc("pm2_collector_storage_records_dropped_total",
+		"Records dropped because too many earlier ones of their file could not be written, by kind.",
+		[]string{"kind"}, nil)
+	openFilesDesc = prometheus.NewDesc("pm2_collector_storage_open_files",
+		"Storage file handles currently cached open.",
+		nil, nil)
+	fsyncsDesc = prometheus.NewDesc("pm2_collector_storage_fsyncs_total",
+		"File syncs performed by the storage write path.",
+		nil, nil)
+	fsyncSecondsDesc = prometheus.NewDesc("pm2_collector_storage_fsync_seconds_total",
+		"Time spent syncing storage files.",
+		nil, nil)
+	tornRecordsDesc = prometheus.NewDesc("pm2_collector_storage_torn_records_truncated_total",
+		"Partially written records removed from storage files at startup.",
+		nil, nil)
+	storedBytesDesc = prometheus.NewDesc("pm2_collector_storage_segment_bytes",
+		"Total size of log and metric segments at the last retention pass.",
+		nil, nil)
+	segmentsDeletedDesc = prometheus.NewDesc("pm2_collector_storage_segments_deleted_total",
+		"Segments deleted by retention, by reason (age or size).",
+		[]string{"reason"}, nil)
+	compressedSegmentsDesc = prometheus.NewDesc("pm2_collector_storage_segments_compressed_total",
+		"Segment compactions, each compressing a sealed segment's new records.",
+		nil, nil)
+	compressionInDesc = prometheus.NewDesc("pm2_collector_storage_compression_input_bytes_total",
+		"Uncompressed bytes of records compressed into sealed segments.",
+		nil, nil)
+	compressionOutDesc = prometheus.NewDesc("pm2_collector_storage_compression_output_bytes_total",
+		"Compressed bytes written for those records, including block indexes.",
+		nil, nil)
+	compressionSavedDesc = prometheus.NewDesc("pm2_collector_storage_compression_saved_bytes_total",
+		"Bytes saved by compressing sealed segments.",
+		nil, nil)
+	compressionRatioDesc = prometheus.NewDesc("pm2_collector_storage_compression_ratio",
+		"Uncompressed to compressed size of all records compressed since start.",
+		nil, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (d *DiskStorage) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{writtenRecordsDesc, writtenBytesDesc, writeErrorsDesc, droppedRecordsDesc,
+		openFilesDesc, fsyncsDesc, fsyncSecondsDesc, tornRecordsDesc, storedBytesDesc, segmentsDeletedDesc,
+		compressedSegmentsDesc, compressionInDesc, compressionOutDesc, compressionSavedDesc, compressionRatioDesc} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (d *DiskStorage) Collect(ch chan<- prometheus.Metric) {
+	p := d.writers
+	for kind, st := range p.stats {
+		ch <- prometheus.MustNewConstMetric(writtenRecordsDesc, prometheus.CounterValue, float64(st.records.Load()), kind)
+		ch <- prometheus.MustNewConstMetric(writtenBytesDesc, prometheus.CounterValue, float64(st.bytes.Load()), kind)
+		ch <- prometheus.MustNewConstMetric(writeErrorsDesc, prometheus.CounterValue, float64(st.errors.Load()), kind)
+		ch <- prometheus.MustNewConstMetric(droppedRecordsDesc, prometheus.CounterValue, float64(st.dropped.Load()), kind)
+	}
+	ch <- prometheus.MustNewConstMetric(openFilesDesc, prometheus.GaugeValue, float64(p.openFiles.Load()))
+	ch <- prometheus.MustNewConstMetric(fsyncsDesc, prometheus.CounterValue, float64(p.fsyncs.Load()))
+	ch <- prometheus.MustNewConstMetric(fsyncSecondsDesc, prometheus.CounterValue, time.Duration(p.fsyncNs.Load()).Seconds())
+	ch <- prometheus.MustNewConstMetric(tornRecordsDesc, prometheus.CounterValue, float64(p.truncated.Load()))
+	ch <- prometheus.MustNewConstMetric(storedBytesDesc, prometheus.GaugeValue, float64(p.storedBytes.Load()))
+	p.deletedMu.Lock()
+	for reason, n := range p.deleted {
+		ch <- prometheus.MustNewConstMetric(segmentsDeletedDesc, prometheus.CounterValue, float64(n), reason)
+	}
+	p.deletedMu.Unlock()
+
+	in, out := d.compression.in.Load(), d.compression.out.Load()
+	ch <- prometheus.MustNewConstMetric(compressedSegmentsDesc, prometheus.CounterValue, float64(d.compression.segments.Load()))
+	ch <- prometheus.MustNewConstMetric(compressionInDesc, prometheus.CounterValue, float64(in))
+	ch <- prometheus.MustNewConstMetric(compressionOutDesc, prometheus.CounterValue, float64(out))
+	ch <- prometheus.MustNewConstMetric(compressionSavedDesc, prometheus.CounterValue, float64(in)-float64(out))
+	if out > 0 {
+		ch <- prometheus.MustNewConstMetric(compressionRatioDesc, prometheus.GaugeValue, float64(in)/float64(out))
+	}
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A short write is cut off the file again, and the lines are written whole
+// by the next flush.
+func TestWriterCutsShortWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events_web_h1.jsonl")
+	p := newWriterPool(time.Hour, time.Hour, 0)
+	p.append(path, []byte(`{"n":1}`))
+	p.flush()
+
+	// files may grow by 4 more bytes, so the next write stops mid-line
+	signal.Ignore(syscall.SIGXFSZ)
+	defer signal.Reset(syscall.SIGXFSZ)
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &lim); err != nil {
+		t.Fatal(err)
+	}
+	small := lim
+	small.Cur = uint64(len("{\"n\":1}\n") + 4)
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &small); err != nil {
+		t.Skipf("cannot limit file size: %v", err)
+	}
+	p.append(path, []byte(`{"n":2}`))
+	p.append(path, []byte(`{"n":3}`))
+	w := p.lock(path)
+	err := p.writeLocked(w)
+	w.mu.Unlock()
+	if restore := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &lim); restore != nil {
+		t.Fatal(restore)
+	}
+	if err == nil {
+		t.Fatal("write past the file size limit succeeded")
+	}
+	if got, want := readFile(t, path), "{\"n\":1}\n"; got != want {
+		t.Fatalf("file after the short write:\n%q\nwant\n%q", got, want)
+	}
+
+	p.flush()
+	if got, want := readFile(t, path), "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n"; got != want {
+		t.Fatalf("file after the retry:\n%q\nwant\n%q", got, want)
+	}
+	p.Close()
+}
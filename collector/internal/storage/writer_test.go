@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// Lines whose file cannot be opened stay buffered until it can.
+func TestWriterKeepsLinesAfterOpenFailure(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "metrics_web_h1")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(blocker, "2026-10-01.jsonl") // its directory is a file
+
+	p := newWriterPool(time.Hour, time.Hour, 0)
+	p.append(path, []byte(`{"n":1}`))
+	p.append(path, []byte(`{"n":2}`))
+	w := p.lock(path)
+	if err := p.writeLocked(w); err == nil {
+		t.Fatal("write through a file succeeded")
+	}
+	w.mu.Unlock()
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	p.append(path, []byte(`{"n":3}`))
+	p.flush()
+	if got, want := readFile(t, path), "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n"; got != want {
+		t.Fatalf("file after the retry:\n%q\nwant\n%q", got, want)
+	}
+	if n := p.get(path).stats.errors.Load(); n != 1 {
+		t.Errorf("write errors: got %d, want 1", n)
+	}
+	p.Close()
+}
+
+// A synced append that fails is not written later: its sender retries it.
+func TestWriterSyncFailureDropsOwnLines(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "logs_web_h1_api")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(blocker, "2026-10-01.jsonl")
+
+	p := newWriterPool(time.Hour, time.Hour, 0)
+	p.append(path, []byte(`{"n":1}`))
+	if _, err := p.appendSync(path, [][]byte{[]byte(`{"n":2}`)}); err == nil {
+		t.Fatal("synced write through a file succeeded")
+	}
+	os.Remove(blocker)
+	if _, err := p.appendSync(path, [][]byte{[]byte(`{"n":3}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, path), "{\"n\":1}\n{\"n\":3}\n"; got != want {
+		t.Fatalf("file:\n%q\nwant\n%q", got, want)
+	}
+	p.Close()
+}
+
+// Records whose fsync failed are cut off the file again, so the sender's
+// retry does not store them twice.
+func TestWriterSyncFailureRemovesWrittenLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events_web_h1.jsonl")
+	p := newWriterPool(time.Hour, time.Hour, 0)
+	p.append(path, []byte(`{"n":1}`))
+	p.sync = func(*os.File) error { return errors.New("fsync failed") }
+	if _, err := p.appendSync(path, [][]byte{[]byte(`{"n":2}`)}); err == nil {
+		t.Fatal("synced write succeeded while fsync failed")
+	}
+	if got, want := readFile(t, path), "{\"n\":1}\n"; got != want {
+		t.Fatalf("file after the failed sync:\n%q\nwant\n%q", got, want)
+	}
+
+	p.sync = (*os.File).Sync
+	size, err := p.appendSync(path, [][]byte{[]byte(`{"n":2}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"n\":1}\n{\"n\":2}\n"
+	if got := readFile(t, path); got != want || size != int64(len(want)) {
+		t.Fatalf("file after the retry (size %d):\n%q\nwant\n%q", size, got, want)
+	}
+	p.Close()
+}
+
+// A record torn by a crash is cut off at the next start, from segments and
+// flat files alike, and leftover temporary files are removed.
+func TestRecoverTornTails(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testStorageConfig("disk", dir)
+	cfg.Compression = "none"
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	d.StoreLog("web", "h1", nil, now, "[api] whole")
+	d.StoreProcesses("web", "h1", nil, now, []byte(`[]`))
+	d.Close()
+
+	seg := filepath.Join(dir, "logs_web_h1_api", segmentFiles(t, d, "logs_web_h1_api")[0])
+	flat := filepath.Join(dir, "processes_web_h1.jsonl")
+	whole := map[string]string{seg: readFile(t, seg), flat: readFile(t, flat)}
+	for fn := range whole {
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(`{"timestamp":"2026-10`)
+		f.Close()
+	}
+	tmps := []string{flat + ".tmp", seg + ".tmp"}
+	for _, fn := range tmps {
+		if err := os.WriteFile(fn, []byte("partial"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for fn, data := range whole {
+		if got := readFile(t, fn); got != data {
+			t.Errorf("%s after recovery:\n%q\nwant\n%q", filepath.Base(fn), got, data)
+		}
+	}
+	for _, fn := range tmps {
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", filepath.Base(fn), err)
+		}
+	}
+	want := `
+# HELP pm2_collector_storage_torn_records_truncated_total Partially written records removed from storage files at startup.
+# TYPE pm2_collector_storage_torn_records_truncated_total counter
+pm2_collector_storage_torn_records_truncated_total 2
+`
+	if err := testutil.CollectAndCompare(d, strings.NewReader(want), "pm2_collector_storage_torn_records_truncated_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,291 @@
+package tenant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ErrQuotaExceeded is wrapped by the errors of data refused over a quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota names, as reported in metrics.
+const (
+	QuotaSeries   = "series"
+	QuotaLogBytes = "log_bytes"
+)
+
+// seriesTTL is how long the series of a target that is no longer scraped
+// or pushed keep counting against its tenant's quota.
+const seriesTTL = 15 * time.Minute
+
+// usageSaveInterval is how often usage is saved while log lines are
+// stored; it is saved on Close too.
+const usageSaveInterval = time.Minute
+
+// savedUsage is how a tenant's usage is persisted, so that a restart does
+// not reset the log quota of the day or forget the series of its targets.
+type savedUsage struct {
+	Day      string                 `json:"day"`
+	LogBytes int64                  `json:"log_bytes"`
+	Series   map[string]savedSeries `json:"series,omitempty"`
+}
+
+type savedSeries struct {
+	N    int       `json:"n"`
+	Seen time.Time `json:"seen"`
+}
+
+// load reads the usage saved at path, if any.
+func (u *usage) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var saved savedUsage
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("usage %s: %w", path, err)
+	}
+	u.day, u.logBytes = saved.Day, saved.LogBytes
+	for key, c := range saved.Series {
+		u.series[key] = seriesCount{n: c.N, seen: c.Seen}
+	}
+	return nil
+}
+
+// saveLocked writes the usage to path atomically. Caller must hold u.mu.
+func (u *usage) saveLocked(path string, now time.Time) error {
+	saved := savedUsage{Day: u.day, LogBytes: u.logBytes, Series: make(map[string]savedSeries, len(u.series))}
+	for key, c := range u.series {
+		saved.Series[key] = savedSeries{N: c.n, Seen: c.seen}
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	u.saved = now
+	return os.Rename(tmp, path)
+}
+
+// saveUsage writes the tenant's usage.
+func (t *Tenant) saveUsage() error {
+	t.usage.mu.Lock()
+	defer t.usage.mu.Unlock()
+	return t.usage.saveLocked(t.usagePath, time.Now())
+}
+
+// checkSeries reports whether a scrape of n series from job/target fits
+// the series quota, and records it if so and record is set.
+func (t *Tenant) checkSeries(key string, n int, now time.Time, record bool) error {
+	u := &t.usage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if max := t.quotas.MaxSeries; max > 0 {
+		if total := u.seriesTotal(key, now) + n; total > max {
+			u.rejected[QuotaSeries]++
+			return fmt.Errorf("tenant %q: %d series over the limit of %d: %w", t.Name, total, max, ErrQuotaExceeded)
+		}
+	}
+	if record {
+		u.series[key] = seriesCount{n: n, seen: now}
+	}
+	return nil
+}
+
+// seriesTotal sums the latest scrapes of the tenant's targets other than
+// skip, forgetting those not seen within seriesTTL. Caller must hold u.mu.
+func (u *usage) seriesTotal(skip string, now time.Time) int {
+	total := 0
+	for key, c := range u.series {
+		if now.Sub(c.seen) > seriesTTL {
+			delete(u.series, key)
+			continue
+		}
+		if key != skip {
+			total += c.n
+		}
+	}
+	return total
+}
+
+// allowLogBytes returns how many of the lines, by size, fit the log quota
+// of the day, recording their bytes and counting the others as refused.
+func (t *Tenant) allowLogBytes(sizes []int, now time.Time) int {
+	u := &t.usage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if day := now.UTC().Format(time.DateOnly); day != u.day {
+		u.day, u.logBytes = day, 0
+	}
+	n := 0
+	for _, size := range sizes {
+		if max := t.quotas.MaxLogBytesPerDay; max > 0 && u.logBytes+int64(size) > max {
+			break
+		}
+		u.logBytes += int64(size)
+		n++
+	}
+	u.rejected[QuotaLogBytes] += uint64(len(sizes) - n)
+	if now.Sub(u.saved) >= usageSaveInterval {
+		if err := u.saveLocked(t.usagePath, now); err != nil {
+			log.Printf("tenant %q: save usage: %v", t.Name, err)
+		}
+	}
+	return n
+}
+
+func (t *Tenant) logQuotaError() error {
+	return fmt.Errorf("tenant %q: over the limit of %d log bytes per day: %w", t.Name, t.quotas.MaxLogBytesPerDay, ErrQuotaExceeded)
+}
+
+// Limiter refuses data over the quotas of the tenant owning its job before
+// passing it on: scrapes over the series quota and log lines over the
+// daily log quota are dropped, and counted in the tenant's metrics.
+type Limiter struct {
+	next discovery.Store
+	set  *Set
+}
+
+// Limit returns a Limiter storing through next.
+func (s *Set) Limit(next discovery.Store) *Limiter {
+	return &Limiter{next: next, set: s}
+}
+
+// AdmitMetrics checks a pushed scrape against the series quota before it
+// is stored, so the exporter can be told it was refused.
+func (l *Limiter) AdmitMetrics(job, target string, mfs map[string]*dto.MetricFamily) error {
+	if t := l.set.Owner(job); t != nil {
+		return t.checkSeries(job+"/"+target, len(storage.Samples(mfs)), time.Now(), false)
+	}
+	return nil
+}
+
+// AdmitLog checks a pushed log line against the log quota and, if it fits,
+// stores it.
+func (l *Limiter) AdmitLog(job, target string, ls map[string]string, ts time.Time, line string) error {
+	if t := l.set.Owner(job); t != nil && t.allowLogBytes([]int{len(line)}, time.Now()) == 0 {
+		return t.logQuotaError()
+	}
+	l.next.StoreLog(job, target, ls, ts, line)
+	return nil
+}
+
+func (l *Limiter) StoreMetrics(job, target string, ls map[string]string, ts time.Time, mfs map[string]*dto.MetricFamily) {
+	if t := l.set.Owner(job); t != nil {
+		if t.checkSeries(job+"/"+target, len(storage.Samples(mfs)), time.Now(), true) != nil {
+			return
+		}
+	}
+	l.next.StoreMetrics(job, target, ls, ts, mfs)
+}
+
+func (l *Limiter) StoreProcesses(job, target string, ls map[string]string, ts time.Time, data []byte) {
+	l.next.StoreProcesses(job, target, ls, ts, data)
+}
+
+func (l *Limiter) StoreLog(job, target string, ls map[string]string, ts time.Time, line string) {
+	l.AdmitLog(job, target, ls, ts, line)
+}
+
+// StoreLogEntries stores the lines that fit the log quota, in order, and
+// returns ErrQuotaExceeded with the acknowledgements if any did not. Lines
+// already stored do not count again.
+func (l *Limiter) StoreLogEntries(job, target string, ls map[string]string, entries []discovery.LogEntry) (map[string]uint64, error) {
+	t := l.set.Owner(job)
+	if t == nil {
+		return l.next.StoreLogEntries(job, target, ls, entries)
+	}
+	prev := l.next.LogOffsets(job, target)
+	fresh := make([]discovery.LogEntry, 0, len(entries))
+	var sizes []int
+	for _, e := range entries {
+		if e.Seq > prev[e.Stream] {
+			fresh = append(fresh, e)
+			sizes = append(sizes, len(e.Line))
+		}
+	}
+	n := t.allowLogBytes(sizes, time.Now())
+	if n == len(fresh) {
+		return l.next.StoreLogEntries(job, target, ls, fresh)
+	}
+	acks, err := prev, error(nil)
+	if n > 0 {
+		acks, err = l.next.StoreLogEntries(job, target, ls, fresh[:n])
+	}
+	if err == nil {
+		err = t.logQuotaError()
+	}
+	return acks, err
+}
+
+func (l *Limiter) LogOffsets(job, target string) map[string]uint64 {
+	return l.next.LogOffsets(job, target)
+}
+
+// --- metrics ---
+
+var (
+	seriesDesc = prometheus.NewDesc("pm2_collector_tenant_series",
+		"Series of the latest scrape of each target of the tenant, summed.",
+		[]string{"tenant"}, nil)
+	logBytesDesc = prometheus.NewDesc("pm2_collector_tenant_log_bytes_today",
+		"Bytes of log lines stored for the tenant since midnight UTC.",
+		[]string{"tenant"}, nil)
+	quotaDesc = prometheus.NewDesc("pm2_collector_tenant_quota",
+		"Limit of a quota of the tenant.",
+		[]string{"tenant", "quota"}, nil)
+	rejectedDesc = prometheus.NewDesc("pm2_collector_tenant_quota_rejections_total",
+		"Scrapes and log lines refused for exceeding a quota of the tenant.",
+		[]string{"tenant", "quota"}, nil)
+)
+
+// usageCollector reports the tenants' usage against their quotas.
+type usageCollector struct{ set *Set }
+
+// Describe implements prometheus.Collector.
+func (c usageCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{seriesDesc, logBytesDesc, quotaDesc, rejectedDesc} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c usageCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, t := range c.set.Tenants {
+		u := &t.usage
+		u.mu.Lock()
+		series := u.seriesTotal("", now)
+		logBytes := u.logBytes
+		if u.day != now.UTC().Format(time.DateOnly) {
+			logBytes = 0
+		}
+		ch <- prometheus.MustNewConstMetric(seriesDesc, prometheus.GaugeValue, float64(series), t.Name)
+		ch <- prometheus.MustNewConstMetric(logBytesDesc, prometheus.GaugeValue, float64(logBytes), t.Name)
+		for _, q := range []string{QuotaSeries, QuotaLogBytes} {
+			ch <- prometheus.MustNewConstMetric(rejectedDesc, prometheus.CounterValue, float64(u.rejected[q]), t.Name, q)
+		}
+		u.mu.Unlock()
+		if t.quotas.MaxSeries > 0 {
+			ch <- prometheus.MustNewConstMetric(quotaDesc, prometheus.GaugeValue, float64(t.quotas.MaxSeries), t.Name, QuotaSeries)
+		}
+		if t.quotas.MaxLogBytesPerDay > 0 {
+			ch <- prometheus.MustNewConstMetric(quotaDesc, prometheus.GaugeValue, float64(t.quotas.MaxLogBytesPerDay), t.Name, QuotaLogBytes)
+		}
+	}
+}
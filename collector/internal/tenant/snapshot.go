@@ -0,0 +1,60 @@
+package tenant
+
+import (
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/aalish/pm2-full/internal/storage"
+)
+
+// Snapshot takes a snapshot of the whole data directory: the collector's
+// own backend, then each tenant's, whose files are moved below
+// tenants/<name> in it, with its usage saved and copied next to them.
+// Restoring it restores every tenant.
+func (s *Set) Snapshot() (storage.SnapshotManifest, error) {
+	m, err := s.Default.Snapshot()
+	if err != nil || len(s.Tenants) == 0 {
+		return m, err
+	}
+	name := m.Name
+	for _, t := range s.Tenants {
+		if m, err = s.adopt(name, t); err != nil {
+			s.Default.DeleteSnapshot(name)
+			return storage.SnapshotManifest{}, fmt.Errorf("snapshot tenant %q: %w", t.Name, err)
+		}
+	}
+	return m, nil
+}
+
+// adopt snapshots one tenant into the collector's snapshot name.
+func (s *Set) adopt(name string, t *Tenant) (storage.SnapshotManifest, error) {
+	if err := t.saveUsage(); err != nil {
+		return storage.SnapshotManifest{}, err
+	}
+	tm, err := t.Store.Snapshot()
+	if err != nil {
+		return storage.SnapshotManifest{}, err
+	}
+	sub := path.Join(tenantsDir, t.Name)
+	m, err := storage.AdoptSnapshot(s.dir, name, sub, tm.Name, sub+usageSuffix)
+	if err != nil {
+		t.Store.DeleteSnapshot(tm.Name)
+	}
+	return m, err
+}
+
+// Snapshots are kept, verified, archived and deleted in the collector's own
+// data directory.
+
+func (s *Set) Snapshots() ([]storage.SnapshotManifest, error) { return s.Default.Snapshots() }
+
+func (s *Set) VerifySnapshot(name string) (storage.SnapshotCheck, error) {
+	return s.Default.VerifySnapshot(name)
+}
+
+func (s *Set) WriteSnapshotArchive(name string, w io.Writer) error {
+	return s.Default.WriteSnapshotArchive(name, w)
+}
+
+func (s *Set) DeleteSnapshot(name string) error { return s.Default.DeleteSnapshot(name) }
@@ -0,0 +1,403 @@
+// Package tenant keeps the data of teams sharing one collector apart. Each
+// tenant owns the jobs matching its patterns; their data is stored in a
+// backend of its own under <storage.directory>/tenants/<name>, within the
+// tenant's quotas, and the data of all other jobs in the collector's own.
+package tenant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/discovery"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// tenantsDir is the directory below the data directory holding the
+// tenants' data.
+const tenantsDir = "tenants"
+
+// usageSuffix names the file, next to a tenant's directory, its usage
+// against its quotas is saved in.
+const usageSuffix = ".usage.json"
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Tenant is one team and the backend holding the data of its jobs.
+type Tenant struct {
+	Name      string
+	Jobs      []string // glob patterns
+	BasicAuth config.AuthCreds
+	Store     storage.Backend
+
+	quotas    config.TenantQuotas
+	usage     usage
+	usagePath string
+}
+
+// Owns reports whether job is one of the tenant's.
+func (t *Tenant) Owns(job string) bool {
+	return matchAny(t.Jobs, job)
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Set is the configured tenants and the collector's own backend, which
+// holds the jobs none of them owns. It stores and reads data through the
+// backend owning each job, so the scrapers and alert rules need not know
+// about tenants.
+type Set struct {
+	Default storage.Backend
+	Tenants []*Tenant
+
+	dir string // the collector's data directory
+}
+
+// compile-time assertions
+var (
+	_ discovery.Store     = (*Set)(nil)
+	_ storage.Store       = (*Set)(nil)
+	_ storage.Snapshotter = (*Set)(nil)
+)
+
+// Open opens the backend of every tenant with the storage settings of the
+// collector and the tenant's retention. Tenant names, which name their
+// directories, and usernames must be unique.
+func Open(cfgs []config.TenantConfig, sc config.StorageConfig, def storage.Backend) (*Set, error) {
+	s := &Set{Default: def, dir: sc.Directory}
+	names, users := make(map[string]bool), make(map[string]bool)
+	for _, tc := range cfgs {
+		if err := checkConfig(tc, names, users); err != nil {
+			s.Close()
+			return nil, err
+		}
+		tsc := sc
+		tsc.Directory = filepath.Join(sc.Directory, tenantsDir, tc.Name)
+		if tc.Quotas.RetentionDays > 0 {
+			tsc.RetentionDays = tc.Quotas.RetentionDays
+		}
+		t := &Tenant{Name: tc.Name, Jobs: tc.Jobs, BasicAuth: tc.BasicAuth, quotas: tc.Quotas,
+			usage:     usage{series: make(map[string]seriesCount), rejected: make(map[string]uint64)},
+			usagePath: filepath.Join(sc.Directory, tenantsDir, tc.Name+usageSuffix)}
+		if err := t.usage.load(t.usagePath); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("tenant %q: %w", tc.Name, err)
+		}
+		backend, err := storage.Open(tsc)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("tenant %q: %w", tc.Name, err)
+		}
+		t.Store = backend
+		s.Tenants = append(s.Tenants, t)
+	}
+	return s, nil
+}
+
+func checkConfig(tc config.TenantConfig, names, users map[string]bool) error {
+	if !validName.MatchString(tc.Name) {
+		return fmt.Errorf("tenant %q: name must be letters, digits, _ or -", tc.Name)
+	}
+	if names[tc.Name] {
+		return fmt.Errorf("duplicate tenant %q", tc.Name)
+	}
+	names[tc.Name] = true
+	if len(tc.Jobs) == 0 {
+		return fmt.Errorf("tenant %q: no jobs", tc.Name)
+	}
+	for _, p := range tc.Jobs {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("tenant %q: job pattern %q: %w", tc.Name, p, err)
+		}
+	}
+	if tc.BasicAuth.Username == "" || tc.BasicAuth.Password == "" {
+		return fmt.Errorf("tenant %q: basic_auth username and password are required", tc.Name)
+	}
+	if users[tc.BasicAuth.Username] {
+		return fmt.Errorf("tenant %q: basic_auth username %q is taken", tc.Name, tc.BasicAuth.Username)
+	}
+	users[tc.BasicAuth.Username] = true
+	if tc.Quotas.MaxSeries < 0 || tc.Quotas.MaxLogBytesPerDay < 0 || tc.Quotas.RetentionDays < 0 {
+		return fmt.Errorf("tenant %q: quotas must not be negative", tc.Name)
+	}
+	return nil
+}
+
+// Owner returns the tenant owning job, or nil if the collector does.
+func (s *Set) Owner(job string) *Tenant {
+	for _, t := range s.Tenants {
+		if t.Owns(job) {
+			return t
+		}
+	}
+	return nil
+}
+
+// backend returns the backend holding the data of job.
+func (s *Set) backend(job string) storage.Backend {
+	if t := s.Owner(job); t != nil {
+		return t.Store
+	}
+	return s.Default
+}
+
+// Register registers the backends' metrics with reg. With tenants they are
+// labelled by tenant, empty for the collector's own, and the tenants'
+// usage and quotas are registered too.
+func (s *Set) Register(reg prometheus.Registerer) error {
+	if len(s.Tenants) == 0 {
+		return reg.Register(s.Default)
+	}
+	if err := prometheus.WrapRegistererWith(prometheus.Labels{"tenant": ""}, reg).Register(s.Default); err != nil {
+		return err
+	}
+	for _, t := range s.Tenants {
+		if err := prometheus.WrapRegistererWith(prometheus.Labels{"tenant": t.Name}, reg).Register(t.Store); err != nil {
+			return err
+		}
+	}
+	return reg.Register(usageCollector{s})
+}
+
+// Close saves the tenants' usage and closes their backends, leaving the
+// collector's own open.
+func (s *Set) Close() error {
+	var errs []error
+	for _, t := range s.Tenants {
+		if err := t.saveUsage(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q: save usage: %w", t.Name, err))
+		}
+		if err := t.Store.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q: %w", t.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// --- discovery.Store ---
+
+func (s *Set) StoreMetrics(job, target string, ls map[string]string, ts time.Time, mfs map[string]*dto.MetricFamily) {
+	s.backend(job).StoreMetrics(job, target, ls, ts, mfs)
+}
+
+func (s *Set) StoreProcesses(job, target string, ls map[string]string, ts time.Time, data []byte) {
+	s.backend(job).StoreProcesses(job, target, ls, ts, data)
+}
+
+func (s *Set) StoreLog(job, target string, ls map[string]string, ts time.Time, line string) {
+	s.backend(job).StoreLog(job, target, ls, ts, line)
+}
+
+func (s *Set) StoreLogEntries(job, target string, ls map[string]string, entries []discovery.LogEntry) (map[string]uint64, error) {
+	return s.backend(job).StoreLogEntries(job, target, ls, entries)
+}
+
+func (s *Set) LogOffsets(job, target string) map[string]uint64 {
+	return s.backend(job).LogOffsets(job, target)
+}
+
+// --- storage.Store ---
+//
+// Queries naming a job are answered by the backend holding it. Without a
+// job, every backend answers and the answers are merged, so the collector's
+// own API sees the data of every tenant too.
+
+// backends returns the backends holding the data of job, or every backend
+// without a job.
+func (s *Set) backends(job string) []storage.Backend {
+	if job != "" {
+		return []storage.Backend{s.backend(job)}
+	}
+	all := []storage.Backend{s.Default}
+	for _, t := range s.Tenants {
+		all = append(all, t.Store)
+	}
+	return all
+}
+
+// each calls read on every backend and returns their answers.
+func each[T any](s *Set, read func(b storage.Backend) (T, error)) ([]T, error) {
+	var out []T
+	for _, b := range s.backends("") {
+		v, err := read(b)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (s *Set) QueryMetrics(q storage.MetricQuery) ([]json.RawMessage, error) {
+	if q.Job != "" {
+		return s.backend(q.Job).QueryMetrics(q)
+	}
+	lists, err := each(s, func(b storage.Backend) ([]json.RawMessage, error) { return b.QueryMetrics(q) })
+	if err != nil {
+		return nil, err
+	}
+	return storage.MergeRecords(lists...), nil
+}
+
+// ScanMetrics scans one backend after the other when q names no job, so
+// the records are in timestamp order within each backend only.
+func (s *Set) ScanMetrics(q storage.MetricQuery, fn func(job, target string, rec json.RawMessage) error) error {
+	for _, b := range s.backends(q.Job) {
+		if err := b.ScanMetrics(q, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Set) QueryProcesses(q storage.ProcessQuery) ([]json.RawMessage, error) {
+	if q.Job != "" {
+		return s.backend(q.Job).QueryProcesses(q)
+	}
+	lists, err := each(s, func(b storage.Backend) ([]json.RawMessage, error) { return b.QueryProcesses(q) })
+	if err != nil {
+		return nil, err
+	}
+	return storage.MergeRecords(lists...), nil
+}
+
+func (s *Set) QueryProcessTimeline(q storage.ProcessQuery) ([]storage.ProcessTimeline, error) {
+	if q.Job != "" {
+		return s.backend(q.Job).QueryProcessTimeline(q)
+	}
+	lists, err := each(s, func(b storage.Backend) ([]storage.ProcessTimeline, error) { return b.QueryProcessTimeline(q) })
+	if err != nil {
+		return nil, err
+	}
+	out := []storage.ProcessTimeline{}
+	for _, l := range lists {
+		out = append(out, l...)
+	}
+	return out, nil
+}
+
+func (s *Set) DiffProcesses(q storage.ProcessQuery) (storage.ProcessDiff, error) {
+	if q.Job != "" {
+		return s.backend(q.Job).DiffProcesses(q)
+	}
+	diffs, err := each(s, func(b storage.Backend) (storage.ProcessDiff, error) { return b.DiffProcesses(q) })
+	if err != nil {
+		return storage.MergeProcessDiffs(), err
+	}
+	return storage.MergeProcessDiffs(diffs...), nil
+}
+
+func (s *Set) QueryEvents(q storage.EventQuery) ([]storage.Event, error) {
+	if q.Job != "" {
+		return s.backend(q.Job).QueryEvents(q)
+	}
+	lists, err := each(s, func(b storage.Backend) ([]storage.Event, error) { return b.QueryEvents(q) })
+	if err != nil {
+		return nil, err
+	}
+	return storage.MergeEvents(q, lists...), nil
+}
+
+func (s *Set) QueryLogs(q storage.LogQuery) (storage.LogPage, error) {
+	if q.Job != "" {
+		return s.backend(q.Job).QueryLogs(q)
+	}
+	pages, err := each(s, func(b storage.Backend) (storage.LogPage, error) { return b.QueryLogs(q) })
+	if err != nil {
+		return storage.LogPage{}, err
+	}
+	return storage.MergeLogPages(q, pages...)
+}
+
+func (s *Set) SearchLogs(q storage.SearchQuery) (storage.LogSearchResult, error) {
+	if q.Job != "" {
+		return s.backend(q.Job).SearchLogs(q)
+	}
+	results, err := each(s, func(b storage.Backend) (storage.LogSearchResult, error) { return b.SearchLogs(q) })
+	if err != nil {
+		return storage.LogSearchResult{}, err
+	}
+	return storage.MergeLogSearches(q, results...)
+}
+
+// ScanLogs scans one backend after the other when q names no job, so the
+// lines are oldest first within each backend only.
+func (s *Set) ScanLogs(q storage.SearchQuery, fn func(l storage.LogLine) error) error {
+	for _, b := range s.backends(q.Job) {
+		if err := b.ScanLogs(q, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PreviewRetention previews retention in every backend.
+func (s *Set) PreviewRetention() storage.RetentionReport {
+	reports, _ := each(s, func(b storage.Backend) (storage.RetentionReport, error) { return b.PreviewRetention(), nil })
+	return storage.MergeRetentionReports(reports...)
+}
+
+func (s *Set) QueryApps(q storage.AppQuery) ([]json.RawMessage, error) {
+	if q.Job != "" {
+		return s.backend(q.Job).QueryApps(q)
+	}
+	return s.names(func(b storage.Backend) ([]json.RawMessage, error) { return b.QueryApps(q) })
+}
+
+// ListAllTargets and ListJobsByTarget name no job, so they always read
+// every backend.
+func (s *Set) ListAllTargets(q storage.TargetQuery) ([]json.RawMessage, error) {
+	return s.names(func(b storage.Backend) ([]json.RawMessage, error) { return b.ListAllTargets(q) })
+}
+
+func (s *Set) ListJobsByTarget(q storage.JobQuery) ([]json.RawMessage, error) {
+	return s.names(func(b storage.Backend) ([]json.RawMessage, error) { return b.ListJobsByTarget(q) })
+}
+
+// names merges the names every backend lists.
+func (s *Set) names(read func(b storage.Backend) ([]json.RawMessage, error)) ([]json.RawMessage, error) {
+	lists, err := each(s, read)
+	if err != nil {
+		return nil, err
+	}
+	return storage.MergeNames(lists...), nil
+}
+
+// Catalog lists the streams of every backend when q names no job.
+func (s *Set) Catalog(q storage.CatalogQuery) []storage.CatalogEntry {
+	out := []storage.CatalogEntry{}
+	for _, b := range s.backends(q.Job) {
+		out = append(out, b.Catalog(q)...)
+	}
+	return out
+}
+
+// usage is what a tenant has stored against its quotas.
+type usage struct {
+	mu       sync.Mutex
+	series   map[string]seriesCount // job/target -> its latest scrape
+	day      string                 // UTC date logBytes counts
+	logBytes int64
+	rejected map[string]uint64 // quota -> scrapes and log lines refused
+	saved    time.Time         // when the usage was last saved
+}
+
+type seriesCount struct {
+	n    int
+	seen time.Time
+}
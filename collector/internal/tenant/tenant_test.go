@@ -0,0 +1,216 @@
+package tenant
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/internal/config"
+	"github.com/aalish/pm2-full/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var teamConfig = config.TenantConfig{Name: "team", Jobs: []string{"team-*"}, BasicAuth: config.AuthCreds{Username: "team", Password: "pw"}}
+
+// openSet opens the collector's own backend in dir and tenants over it,
+// and returns them with a function closing both, once.
+func openSet(t *testing.T, dir string, cfgs ...config.TenantConfig) (*Set, func()) {
+	t.Helper()
+	sc := config.StorageConfig{Type: "disk", Directory: dir, FlushInterval: 10 * time.Millisecond}
+	def, err := storage.Open(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(cfgs, sc, def)
+	if err != nil {
+		def.Close()
+		t.Fatal(err)
+	}
+	closeAll := sync.OnceFunc(func() {
+		s.Close()
+		def.Close()
+	})
+	t.Cleanup(closeAll)
+	return s, closeAll
+}
+
+// Reads naming no job see every backend, in one order, and pages of logs
+// continue across them.
+func TestReadsAcrossBackends(t *testing.T) {
+	s, _ := openSet(t, t.TempDir(), teamConfig)
+	t0 := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	for i, job := range []string{"edge", "team-web", "edge", "team-web"} {
+		s.StoreLog(job, "host", nil, t0.Add(time.Duration(i)*time.Second), job)
+	}
+
+	var got []string
+	q := storage.LogQuery{Forward: true, NumLines: 3}
+	for {
+		page, err := s.QueryLogs(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range page.Lines {
+			got = append(got, l.Line)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	if want := []string{"edge", "team-web", "edge", "team-web"}; !slices.Equal(got, want) {
+		t.Fatalf("logs: got %v, want %v", got, want)
+	}
+
+	page, err := s.QueryLogs(storage.LogQuery{Selector: storage.Selector{Job: "team-web"}})
+	if err != nil || len(page.Lines) != 2 {
+		t.Fatalf("logs of team-web: %v, %v", page.Lines, err)
+	}
+
+	jobs, err := s.ListJobsByTarget(storage.JobQuery{Target: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, j := range jobs {
+		var name string
+		json.Unmarshal(j, &name)
+		names = append(names, name)
+	}
+	if want := []string{"edge", "team-web"}; !slices.Equal(names, want) {
+		t.Fatalf("jobs: got %v, want %v", names, want)
+	}
+
+	own, tenant := s.Default.PreviewRetention(), s.Tenants[0].Store.PreviewRetention()
+	if got := s.PreviewRetention(); got.KeptBytes != own.KeptBytes+tenant.KeptBytes || tenant.KeptBytes == 0 {
+		t.Fatalf("retention preview kept %d bytes, want %d + %d", got.KeptBytes, own.KeptBytes, tenant.KeptBytes)
+	}
+}
+
+// The day's log bytes count against the quota across a restart.
+func TestUsageSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := teamConfig
+	cfg.Quotas.MaxLogBytesPerDay = 10
+	ts := time.Now().UTC()
+
+	s, closeAll := openSet(t, dir, cfg)
+	if err := s.Limit(s).AdmitLog("team-web", "host", nil, ts, "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	closeAll()
+
+	s, _ = openSet(t, dir, cfg)
+	if err := s.Limit(s).AdmitLog("team-web", "host", nil, ts, "12345678"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("after restart: got %v, want %v", err, ErrQuotaExceeded)
+	}
+}
+
+// A snapshot of the collector holds the tenants' data and usage, and
+// restoring its archive brings them back.
+func TestSnapshotRestoresTenants(t *testing.T) {
+	cfg := teamConfig
+	cfg.Quotas.MaxLogBytesPerDay = 10
+	ts := time.Now().UTC()
+	s, _ := openSet(t, t.TempDir(), cfg)
+	s.StoreLog("edge", "host", nil, ts, "edge line")
+	if err := s.Limit(s).AdmitLog("team-web", "host", nil, ts, "team line"); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.VerifySnapshot(m.Name); err != nil || !c.OK {
+		t.Fatalf("verify: %+v, %v", c, err)
+	}
+	var archive bytes.Buffer
+	if err := s.WriteSnapshotArchive(m.Name, &archive); err != nil {
+		t.Fatal(err)
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	if c, err := storage.RestoreArchive(&archive, restored); err != nil || !c.OK {
+		t.Fatalf("restore: %+v, %v", c, err)
+	}
+
+	r, _ := openSet(t, restored, cfg)
+	for job, want := range map[string]string{"edge": "edge line", "team-web": "team line"} {
+		page, err := r.QueryLogs(storage.LogQuery{Selector: storage.Selector{Job: job}})
+		if err != nil || len(page.Lines) != 1 || page.Lines[0].Line != want {
+			t.Fatalf("logs of %s after restoring: %+v, %v", job, page.Lines, err)
+		}
+	}
+	if err := r.Limit(r).AdmitLog("team-web", "host", nil, ts, "12345678"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("usage after restoring: got %v, want %v", err, ErrQuotaExceeded)
+	}
+}
+
+// scrape parses the text exposition of a scrape.
+func scrape(t *testing.T, text string) map[string]*dto.MetricFamily {
+	t.Helper()
+	mfs, err := new(expfmt.TextParser).TextToMetricFamilies(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfs
+}
+
+// A scrape taking a tenant over its series quota is dropped and counted,
+// the target's own previous scrape aside; jobs of no tenant are not
+// limited, and targets no longer scraped stop counting after seriesTTL.
+func TestSeriesQuota(t *testing.T) {
+	cfg := teamConfig
+	cfg.Quotas.MaxSeries = 3
+	s, _ := openSet(t, t.TempDir(), cfg)
+	reg := prometheus.NewRegistry()
+	if err := s.Register(reg); err != nil {
+		t.Fatal(err)
+	}
+	l := s.Limit(s)
+	ts := time.Now().UTC()
+	two, three := scrape(t, "a 1\nb 1\n"), scrape(t, "a 1\nb 1\nc 1\n")
+
+	l.StoreMetrics("team-web", "h1", nil, ts, two)
+	l.StoreMetrics("team-web", "h2", nil, ts, two)
+	l.StoreMetrics("team-web", "h1", nil, ts, three)
+	l.StoreMetrics("edge", "h2", nil, ts, three)
+	if err := l.AdmitMetrics("team-web", "h2", scrape(t, "a 1\n")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("push over the quota: got %v, want %v", err, ErrQuotaExceeded)
+	}
+	for _, c := range []struct {
+		job, target string
+		want        int
+	}{{"team-web", "h1", 2}, {"team-web", "h2", 0}, {"edge", "h2", 1}} {
+		recs, err := s.QueryMetrics(storage.MetricQuery{Selector: storage.Selector{Job: c.job, Target: c.target}})
+		if err != nil || len(recs) != c.want {
+			t.Errorf("scrapes of %s/%s: got %d, %v, want %d", c.job, c.target, len(recs), err, c.want)
+		}
+	}
+
+	want := `
+# HELP pm2_collector_tenant_quota_rejections_total Scrapes and log lines refused for exceeding a quota of the tenant.
+# TYPE pm2_collector_tenant_quota_rejections_total counter
+pm2_collector_tenant_quota_rejections_total{quota="log_bytes",tenant="team"} 0
+pm2_collector_tenant_quota_rejections_total{quota="series",tenant="team"} 2
+# HELP pm2_collector_tenant_series Series of the latest scrape of each target of the tenant, summed.
+# TYPE pm2_collector_tenant_series gauge
+pm2_collector_tenant_series{tenant="team"} 3
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "pm2_collector_tenant_quota_rejections_total", "pm2_collector_tenant_series"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Tenants[0].checkSeries("team-web/h2", 3, ts.Add(seriesTTL+time.Minute), false); err != nil {
+		t.Fatalf("after h1 expired: %v", err)
+	}
+}
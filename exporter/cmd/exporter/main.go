@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"github.com/aalish/pm2-full/config"
 	"github.com/aalish/pm2-full/logs"
 	"github.com/aalish/pm2-full/metrics"
 	"github.com/aalish/pm2-full/pm2"
+	"github.com/aalish/pm2-full/push"
 	"github.com/aalish/pm2-full/server"
 )
 
@@ -24,8 +26,33 @@ func main() {
 	metricsExporter := metrics.NewExporter(pm2Client)
 	logStreamer := logs.NewStreamer(cfg.Log.Paths)
 
+	// Spool every log line on disk until a collector acknowledges it, when
+	// pushing or if log.spool is configured
+	var spool *logs.Spool
+	if cfg.Push.Enabled || cfg.Log.Spool != (config.SpoolConfig{}) {
+		spool, err = logs.OpenSpool(cfg.Log.Paths, cfg.Log.Spool)
+		if err != nil {
+			log.Fatalf("log spool: %v", err)
+		}
+		go spool.Run(context.Background())
+	}
+
+	// Push to a collector if configured; without a listen address the
+	// exporter runs in push-only mode
+	if cfg.Push.Enabled {
+		pusher, err := push.New(cfg.Push, pm2Client, spool)
+		if err != nil {
+			log.Fatalf("push: %v", err)
+		}
+		if cfg.Server.Listen == "" {
+			pusher.Run(context.Background())
+			return
+		}
+		go pusher.Run(context.Background())
+	}
+
 	// Start HTTP server with PM2 client
-	srv := server.New(cfg.Server, pm2Client, metricsExporter, logStreamer)
+	srv := server.New(cfg.Server, pm2Client, metricsExporter, logStreamer, spool)
 	log.Printf("starting exporter on %s", cfg.Server.Listen)
 	if err := srv.Run(); err != nil {
 		log.Fatalf("server error: %v", err)
@@ -25,13 +25,46 @@ type PM2Config struct {
 }
 
 type LogConfig struct {
-	Paths []string `mapstructure:"paths"`
+	Paths []string    `mapstructure:"paths"`
+	Spool SpoolConfig `mapstructure:"spool"`
+}
+
+// SpoolConfig controls the on-disk log spool. Every line read from the log
+// files is appended to it with a sequence number and kept until a collector
+// acknowledges it, so lines survive collector outages and exporter restarts.
+// MaxBytes bounds each file's spool; beyond it the oldest lines are dropped.
+// The spool runs in push mode, or when any of these is set.
+type SpoolConfig struct {
+	Dir          string `mapstructure:"dir"`
+	MaxBytes     int64  `mapstructure:"max_bytes"`
+	SegmentBytes int64  `mapstructure:"segment_bytes"`
+}
+
+// PushConfig makes the exporter send its data to a collector instead of, or
+// in addition to, being scraped. Instance identifies this host to the
+// collector and defaults to the hostname. While the collector is unreachable
+// payloads are kept in BufferDir, up to MaxBufferBytes (oldest dropped first).
+type PushConfig struct {
+	Enabled            bool              `mapstructure:"enabled"`
+	URL                string            `mapstructure:"url"`
+	Username           string            `mapstructure:"username"`
+	Password           string            `mapstructure:"password"`
+	Job                string            `mapstructure:"job"`
+	Instance           string            `mapstructure:"instance"`
+	Labels             map[string]string `mapstructure:"labels"`
+	Interval           time.Duration     `mapstructure:"interval"`
+	Timeout            time.Duration     `mapstructure:"timeout"`
+	BufferDir          string            `mapstructure:"buffer_dir"`
+	MaxBufferBytes     int64             `mapstructure:"max_buffer_bytes"`
+	CAFile             string            `mapstructure:"ca_file"`
+	InsecureSkipVerify bool              `mapstructure:"insecure_skip_verify"`
 }
 
 type Config struct {
 	Server ServerConfig `mapstructure:"server"`
 	PM2    PM2Config    `mapstructure:"pm2"`
 	Log    LogConfig    `mapstructure:"log"`
+	Push   PushConfig   `mapstructure:"push"`
 }
 
 // Load reads the specified config file into Config
@@ -0,0 +1,17 @@
+//go:build unix
+
+package logs
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the inode of a file, which survives renames, so a rotated
+// log file can be told apart from its replacement.
+func fileID(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
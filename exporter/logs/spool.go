@@ -0,0 +1,626 @@
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aalish/pm2-full/config"
+)
+
+// Record is one spooled log line. Stream is the log file's base name, Seq
+// counts its lines from 1 and Line carries the "[app] " prefix.
+type Record struct {
+	Stream    string    `json:"stream"`
+	Seq       uint64    `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	Line      string    `json:"line"`
+}
+
+// spoolRecord is a Record as written to a segment, plus the source file and
+// the offset just past the line, so reading resumes there after a restart.
+type spoolRecord struct {
+	Record
+	Ino uint64 `json:"ino"`
+	Off int64  `json:"off"`
+}
+
+// Spool copies every line of the log files into an on-disk spool, one
+// directory per stream, and keeps it until a collector acknowledges it.
+// Each stream is a list of segment files named after their first sequence
+// number; fully acknowledged segments are deleted, and when a stream grows
+// past its limit the oldest segment is dropped even if unacknowledged.
+type Spool struct {
+	paths   []string
+	dir     string
+	max     int64
+	segSize int64
+
+	mu      sync.Mutex
+	streams map[string]*stream
+	changed chan struct{} // closed and replaced whenever lines are spooled
+}
+
+type stream struct {
+	name string
+	dir  string
+
+	mu    sync.Mutex
+	segs  []segment // oldest first
+	next  uint64    // sequence number of the next line
+	acked uint64
+	ino   uint64 // source file and offset after the last spooled line
+	off   int64
+	w     *os.File // newest segment, open for appending
+}
+
+type segment struct {
+	first uint64
+	path  string
+	size  int64
+}
+
+// OpenSpool loads the spool in cfg.Dir, truncating any segment torn by a
+// crash. Call Run to start reading the log files.
+func OpenSpool(paths []string, cfg config.SpoolConfig) (*Spool, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = "log-spool"
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 256 << 20
+	}
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = 4 << 20
+	}
+	if cfg.SegmentBytes > cfg.MaxBytes/2 {
+		cfg.SegmentBytes = cfg.MaxBytes / 2
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		paths:   paths,
+		dir:     cfg.Dir,
+		max:     cfg.MaxBytes,
+		segSize: cfg.SegmentBytes,
+		streams: make(map[string]*stream),
+		changed: make(chan struct{}),
+	}
+	dirs, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		st, err := loadStream(filepath.Join(cfg.Dir, d.Name()), d.Name())
+		if err != nil {
+			return nil, fmt.Errorf("spool %s: %w", d.Name(), err)
+		}
+		s.streams[st.name] = st
+		if pending := st.next - 1 - st.acked; pending > 0 {
+			log.Printf("spool: %s has %d unacknowledged lines", st.name, pending)
+		}
+	}
+	return s, nil
+}
+
+func loadStream(dir, name string) (*stream, error) {
+	st := &stream{name: name, dir: dir, next: 1}
+	if b, err := os.ReadFile(filepath.Join(dir, "acked")); err == nil {
+		st.acked, _ = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		n := f.Name()
+		if strings.HasSuffix(n, ".tmp") {
+			os.Remove(filepath.Join(dir, n))
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(n, ".seg"), 10, 64)
+		if !strings.HasSuffix(n, ".seg") || err != nil {
+			continue
+		}
+		seg := segment{first: first, path: filepath.Join(dir, n)}
+		if info, err := f.Info(); err == nil {
+			seg.size = info.Size()
+		}
+		st.segs = append(st.segs, seg)
+	}
+	sort.Slice(st.segs, func(i, j int) bool { return st.segs[i].first < st.segs[j].first })
+
+	// the newest record holds the next sequence number and source position
+	for i := len(st.segs) - 1; i >= 0; i-- {
+		last, size, err := lastRecord(st.segs[i].path)
+		if err != nil {
+			return nil, err
+		}
+		st.segs[i].size = size
+		if last != nil {
+			st.next, st.ino, st.off = last.Seq+1, last.Ino, last.Off
+			break
+		}
+	}
+	if st.next == 1 && st.acked > 0 {
+		st.next = st.acked + 1
+	}
+	return st, nil
+}
+
+// lastRecord returns the last complete record of a segment, truncating a
+// partially written tail.
+func lastRecord(path string) (*spoolRecord, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	var last *spoolRecord
+	good := 0
+	for good < len(data) {
+		i := bytes.IndexByte(data[good:], '\n')
+		if i < 0 {
+			break
+		}
+		var rec spoolRecord
+		if err := json.Unmarshal(data[good:good+i], &rec); err != nil {
+			break
+		}
+		last = &rec
+		good += i + 1
+	}
+	if good < len(data) {
+		log.Printf("spool: truncating torn tail of %s (%d bytes)", path, len(data)-good)
+		if err := os.Truncate(path, int64(good)); err != nil {
+			return nil, 0, err
+		}
+	}
+	return last, int64(good), nil
+}
+
+// Run follows the log files until ctx is done, picking up new files every
+// 10s. Files already in the spool resume where they were left; files found
+// at startup without a spool start at their end, like /logs, and files
+// created later are read from the start.
+func (s *Spool) Run(ctx context.Context) {
+	following := make(map[string]string) // stream -> path
+	first := true
+	for {
+		for _, pattern := range s.paths {
+			files, err := filepath.Glob(pattern)
+			if err != nil {
+				log.Printf("glob error for pattern %q: %v", pattern, err)
+				continue
+			}
+			for _, f := range files {
+				name := filepath.Base(f)
+				if p, ok := following[name]; ok {
+					if p != f {
+						log.Printf("spool: %s and %s share the stream name %s; only the first is spooled", p, f, name)
+						following[name] = p
+					}
+					continue
+				}
+				following[name] = f
+				st, existed := s.stream(name)
+				go s.follow(ctx, st, f, existed || !first)
+			}
+		}
+		first = false
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// stream returns the named stream, creating it if needed. existed reports
+// whether it was already spooled.
+func (s *Spool) stream(name string) (st *stream, existed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.streams[name]; st != nil {
+		return st, true
+	}
+	st = &stream{name: name, dir: filepath.Join(s.dir, name), next: 1}
+	s.streams[name] = st
+	return st, false
+}
+
+// Streams returns the names of all spooled streams.
+func (s *Spool) Streams() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]string, 0, len(s.streams))
+	for name := range s.streams {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Changed returns a channel that is closed when lines are next spooled.
+func (s *Spool) Changed() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+func (s *Spool) notify() {
+	s.mu.Lock()
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.mu.Unlock()
+}
+
+// Acked returns the highest acknowledged sequence number of a stream.
+func (s *Spool) Acked(name string) uint64 {
+	s.mu.Lock()
+	st := s.streams[name]
+	s.mu.Unlock()
+	if st == nil {
+		return 0
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.acked
+}
+
+// Ack records that a collector durably stored a stream up to seq, and
+// deletes the segments that are now fully acknowledged.
+func (s *Spool) Ack(name string, seq uint64) error {
+	s.mu.Lock()
+	st := s.streams[name]
+	s.mu.Unlock()
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if seq >= st.next {
+		seq = st.next - 1
+	}
+	if seq <= st.acked {
+		return nil
+	}
+	fn := filepath.Join(st.dir, "acked")
+	if err := writeFileSync(fn+".tmp", []byte(strconv.FormatUint(seq, 10))); err != nil {
+		return err
+	}
+	if err := os.Rename(fn+".tmp", fn); err != nil {
+		return err
+	}
+	syncDir(st.dir)
+	st.acked = seq
+	// the newest segment is kept: its last record is the source position
+	for len(st.segs) > 1 && st.segs[1].first-1 <= st.acked {
+		os.Remove(st.segs[0].path)
+		st.segs = st.segs[1:]
+	}
+	return nil
+}
+
+// writeFileSync writes data to a new file and syncs it before closing, so a
+// rename over the old file never leaves an empty one after a crash.
+func writeFileSync(fn string, data []byte) error {
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename in dir durable. Errors are ignored: not every
+// platform can sync a directory.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// line is a complete line read from a source file and the offset after it.
+type line struct {
+	text string
+	off  int64
+}
+
+// append spools lines read from the source file ino and syncs them.
+func (s *Spool) append(st *stream, ino uint64, lines []line) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.w == nil || st.segs[len(st.segs)-1].size >= s.segSize {
+		if err := st.rollLocked(); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	now := time.Now().UTC()
+	for i, l := range lines {
+		enc.Encode(spoolRecord{
+			Record: Record{Stream: st.name, Seq: st.next + uint64(i), Timestamp: now, Line: l.text},
+			Ino:    ino,
+			Off:    l.off,
+		})
+	}
+	if _, err := st.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := st.w.Sync(); err != nil {
+		return err
+	}
+	st.segs[len(st.segs)-1].size += int64(buf.Len())
+	st.next += uint64(len(lines))
+	st.ino, st.off = ino, lines[len(lines)-1].off
+
+	var total int64
+	for _, seg := range st.segs {
+		total += seg.size
+	}
+	for total > s.max && len(st.segs) > 1 {
+		old := st.segs[0]
+		if last := st.segs[1].first - 1; last > st.acked {
+			log.Printf("spool: %s is full; dropping lines %d-%d before they were acknowledged", st.name, max(old.first, st.acked+1), last)
+			st.acked = last
+		}
+		os.Remove(old.path)
+		st.segs = st.segs[1:]
+		total -= old.size
+	}
+	s.notify()
+	return nil
+}
+
+// rollLocked starts a new segment at the next sequence number.
+func (st *stream) rollLocked() error {
+	if err := os.MkdirAll(st.dir, 0o755); err != nil {
+		return err
+	}
+	if st.w != nil {
+		st.w.Close()
+	}
+	path := filepath.Join(st.dir, fmt.Sprintf("%020d.seg", st.next))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st.w = f
+	if n := len(st.segs); n == 0 || st.segs[n-1].path != path {
+		st.segs = append(st.segs, segment{first: st.next, path: path})
+	}
+	return nil
+}
+
+// follow reads one log file into its stream until ctx is done, following
+// it across rotation (a new file at the same path) and truncation.
+func (s *Spool) follow(ctx context.Context, st *stream, path string, fromStart bool) {
+	app := extractAppName(path)
+	f, ino, pos, err := openAt(st, path, fromStart)
+	if err != nil {
+		log.Printf("spool: open %s: %v", path, err)
+		return
+	}
+	defer func() { f.Close() }()
+
+	reader := bufio.NewReaderSize(f, 64*1024)
+	var partial []byte
+	var batch []line
+	for {
+		chunk, err := reader.ReadBytes('\n')
+		if len(chunk) > 0 {
+			pos += int64(len(chunk))
+			if chunk[len(chunk)-1] != '\n' {
+				partial = append(partial, chunk...)
+			} else {
+				text := strings.TrimRight(string(partial)+string(chunk), "\r\n")
+				partial = nil
+				batch = append(batch, line{text: fmt.Sprintf("[%s] %s", app, text), off: pos})
+				if len(batch) < 1000 {
+					continue
+				}
+			}
+		}
+		if err := s.append(st, ino, batch); err != nil {
+			log.Printf("spool: %s: %v", st.name, err)
+		}
+		batch = nil
+		if err == nil {
+			continue
+		}
+		if err != io.EOF {
+			log.Printf("error reading %s: %v", path, err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		info, serr := os.Stat(path)
+		if serr != nil {
+			continue // rotated away, wait for the new file
+		}
+		switch {
+		case fileID(info) != ino:
+			// drain what was written before the rename, then switch files
+			if rest, _ := io.ReadAll(reader); len(rest) > 0 || len(partial) > 0 {
+				s.appendRest(st, ino, app, append(partial, rest...), pos+int64(len(rest)))
+			}
+			partial = nil
+			nf, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			f.Close()
+			f, ino, pos = nf, fileID(info), 0
+			reader.Reset(f)
+		case info.Size() < pos:
+			log.Printf("spool: %s was truncated; reading from the start", path)
+			f.Seek(0, io.SeekStart)
+			pos, partial = 0, nil
+			reader.Reset(f)
+		}
+	}
+}
+
+// appendRest spools the final lines of a rotated file, including a last
+// line without a newline.
+func (s *Spool) appendRest(st *stream, ino uint64, app string, rest []byte, end int64) {
+	var lines []line
+	off := end - int64(len(rest))
+	for _, l := range strings.SplitAfter(string(rest), "\n") {
+		if l == "" {
+			continue
+		}
+		off += int64(len(l))
+		lines = append(lines, line{text: fmt.Sprintf("[%s] %s", app, strings.TrimRight(l, "\r\n")), off: off})
+	}
+	if err := s.append(st, ino, lines); err != nil {
+		log.Printf("spool: %s: %v", st.name, err)
+	}
+}
+
+// openAt opens a source file at the position to continue from: the spooled
+// position if it is the same file, else its start (it was rotated while
+// the exporter was down) or, for a stream never spooled, its end unless
+// fromStart.
+func openAt(st *stream, path string, fromStart bool) (*os.File, uint64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, 0, err
+	}
+	ino := fileID(info)
+
+	st.mu.Lock()
+	spooled, sameFile, off := st.next > 1, st.ino == ino, st.off
+	st.mu.Unlock()
+
+	var pos int64
+	switch {
+	case spooled && sameFile && info.Size() >= off:
+		pos = off
+	case spooled:
+		log.Printf("spool: %s changed while stopped; reading it from the start", path)
+	case !fromStart:
+		pos = info.Size()
+	}
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, 0, err
+	}
+	return f, ino, pos, nil
+}
+
+// Reader reads one stream's records in order.
+type Reader struct {
+	st    *stream
+	after uint64 // last sequence number returned
+	path  string // segment being read and the offset in it
+	pos   int64
+}
+
+// Reader returns a reader starting after sequence number after.
+func (s *Spool) Reader(name string, after uint64) *Reader {
+	st, _ := s.stream(name)
+	return &Reader{st: st, after: after}
+}
+
+// Next returns up to max records, or none if the reader is caught up.
+// Records dropped from a full spool are skipped.
+func (r *Reader) Next(max int) ([]Record, error) {
+	st := r.st
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if r.after+1 >= st.next || len(st.segs) == 0 {
+		return nil, nil
+	}
+
+	i := r.segmentLocked()
+	var out []Record
+	for ; i < len(st.segs) && len(out) < max; i++ {
+		seg := st.segs[i]
+		if seg.path != r.path {
+			r.path, r.pos = seg.path, 0
+		}
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return out, err
+		}
+		f.Seek(r.pos, io.SeekStart)
+		br := bufio.NewReader(f)
+		for len(out) < max {
+			b, err := br.ReadBytes('\n')
+			if err != nil {
+				break // only complete lines are ever written under st.mu
+			}
+			r.pos += int64(len(b))
+			var rec spoolRecord
+			if json.Unmarshal(b, &rec) != nil || rec.Seq <= r.after {
+				continue
+			}
+			r.after = rec.Seq
+			out = append(out, rec.Record)
+		}
+		f.Close()
+		if len(out) >= max {
+			break
+		}
+	}
+	return out, nil
+}
+
+// segmentLocked returns the index of the segment to continue reading from.
+func (r *Reader) segmentLocked() int {
+	st := r.st
+	for i, seg := range st.segs {
+		if seg.path == r.path {
+			return i
+		}
+	}
+	r.path, r.pos = "", 0
+	if r.after+1 < st.segs[0].first {
+		log.Printf("spool: %s lines %d-%d were dropped before delivery", st.name, r.after+1, st.segs[0].first-1)
+		return 0
+	}
+	for i := len(st.segs) - 1; i >= 0; i-- {
+		if st.segs[i].first <= r.after+1 {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WantsEntries reports whether a /logs request asks for spooled NDJSON
+// records rather than plain text lines.
+func WantsEntries(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// StreamHandler sends spooled records as newline-delimited JSON, first the
+// backlog and then new lines as they are spooled. A collector passes
+// after=<stream>:<seq> for every stream it has stored and the stream is
+// replayed from the next line; other streams start after their last
+// acknowledged line. Only AckHandler releases lines from the spool.
+func (s *Spool) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	after := make(map[string]uint64)
+	for _, v := range r.URL.Query()["after"] {
+		i := strings.LastIndex(v, ":")
+		seq, err := strconv.ParseUint(v[i+1:], 10, 64)
+		if i <= 0 || err != nil {
+			http.Error(w, fmt.Sprintf("after %q: expected <stream>:<seq>", v), http.StatusBadRequest)
+			return
+		}
+		after[v[:i]] = seq
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	readers := make(map[string]*Reader)
+	enc := json.NewEncoder(w)
+	for {
+		changed := s.Changed()
+		sent := 0
+		for _, name := range s.Streams() {
+			rd := readers[name]
+			if rd == nil {
+				start, ok := after[name]
+				if !ok {
+					start = s.Acked(name)
+				}
+				rd = s.Reader(name, start)
+				readers[name] = rd
+			}
+			recs, err := rd.Next(500)
+			if err != nil {
+				log.Printf("spool: read %s: %v", name, err)
+			}
+			for _, rec := range recs {
+				if err := enc.Encode(rec); err != nil {
+					return
+				}
+			}
+			sent += len(recs)
+		}
+		if sent > 0 {
+			flusher.Flush()
+			continue
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// AckHandler accepts a JSON object of stream -> highest stored sequence
+// number from a collector and releases those lines from the spool.
+func (s *Spool) AckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var acks map[string]uint64
+	if err := json.NewDecoder(r.Body).Decode(&acks); err != nil {
+		http.Error(w, "body must be a JSON object of stream -> seq", http.StatusBadRequest)
+		return
+	}
+	for stream, seq := range acks {
+		if err := s.Ack(stream, seq); err != nil {
+			log.Printf("spool: ack %s: %v", stream, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,261 @@
+package logs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/config"
+)
+
+func openSpool(t *testing.T, cfg config.SpoolConfig) *Spool {
+	t.Helper()
+	s, err := OpenSpool(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// spoolLines appends lines to a stream as if read from source file 1.
+func spoolLines(t *testing.T, s *Spool, name string, texts ...string) {
+	t.Helper()
+	st, _ := s.stream(name)
+	var lines []line
+	for i, text := range texts {
+		lines = append(lines, line{text: text, off: int64(i + 1)})
+	}
+	if err := s.append(st, 1, lines); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readAll reads a stream after seq until the reader is caught up.
+func readAll(t *testing.T, s *Spool, name string, after uint64) []Record {
+	t.Helper()
+	var out []Record
+	rd := s.Reader(name, after)
+	for {
+		recs, err := rd.Next(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) == 0 {
+			return out
+		}
+		out = append(out, recs...)
+	}
+}
+
+func seqs(recs []Record) []uint64 {
+	var out []uint64
+	for _, r := range recs {
+		out = append(out, r.Seq)
+	}
+	return out
+}
+
+func sameSeqs(got []Record, from, to uint64) bool {
+	if len(got) != int(to-from+1) {
+		return false
+	}
+	for i, r := range got {
+		if r.Seq != from+uint64(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Acknowledged segments are deleted, and a reopened spool keeps the
+// acknowledgement and continues the sequence.
+func TestSpoolAckAndReopen(t *testing.T) {
+	cfg := config.SpoolConfig{Dir: t.TempDir(), SegmentBytes: 150}
+	s := openSpool(t, cfg)
+	for i := range 6 {
+		spoolLines(t, s, "api-out.log", fmt.Sprintf("[api] line %d", i+1))
+	}
+	if got := readAll(t, s, "api-out.log", 0); !sameSeqs(got, 1, 6) || got[0].Line != "[api] line 1" {
+		t.Fatalf("records: %v", seqs(got))
+	}
+	st, _ := s.stream("api-out.log")
+	segs := len(st.segs)
+	if segs < 3 {
+		t.Fatalf("got %d segments, want several", segs)
+	}
+	if err := s.Ack("api-out.log", 4); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.segs) >= segs || st.segs[0].first > 5 {
+		t.Fatalf("segments after the ack: %+v", st.segs)
+	}
+	if err := s.Ack("api-out.log", 2); err != nil || s.Acked("api-out.log") != 4 {
+		t.Fatalf("ack went back: %d, %v", s.Acked("api-out.log"), err)
+	}
+
+	s = openSpool(t, cfg)
+	if got := s.Acked("api-out.log"); got != 4 {
+		t.Fatalf("acked after reopening: %d", got)
+	}
+	spoolLines(t, s, "api-out.log", "[api] line 7")
+	if got := readAll(t, s, "api-out.log", s.Acked("api-out.log")); !sameSeqs(got, 5, 7) {
+		t.Fatalf("records after reopening: %v", seqs(got))
+	}
+}
+
+// A torn record at the end of a segment is cut off when the spool opens.
+func TestSpoolTornTail(t *testing.T) {
+	cfg := config.SpoolConfig{Dir: t.TempDir()}
+	s := openSpool(t, cfg)
+	spoolLines(t, s, "api-out.log", "[api] one", "[api] two")
+	st, _ := s.stream("api-out.log")
+	f, err := os.OpenFile(st.segs[0].path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"stream":"api-out.log","seq":3,"li`)
+	f.Close()
+
+	s = openSpool(t, cfg)
+	spoolLines(t, s, "api-out.log", "[api] three")
+	got := readAll(t, s, "api-out.log", 0)
+	if !sameSeqs(got, 1, 3) || got[2].Line != "[api] three" {
+		t.Fatalf("records: %+v", got)
+	}
+}
+
+// A full spool drops its oldest segment, acknowledged or not, and readers
+// skip the dropped lines.
+func TestSpoolFull(t *testing.T) {
+	s := openSpool(t, config.SpoolConfig{Dir: t.TempDir(), MaxBytes: 600, SegmentBytes: 200})
+	for i := range 20 {
+		spoolLines(t, s, "api-out.log", fmt.Sprintf("[api] line %d", i+1))
+	}
+	acked := s.Acked("api-out.log")
+	if acked == 0 {
+		t.Fatal("no lines dropped")
+	}
+	got := readAll(t, s, "api-out.log", 0)
+	if len(got) == 0 || got[0].Seq <= acked || got[len(got)-1].Seq != 20 || !sameSeqs(got, got[0].Seq, 20) {
+		t.Fatalf("records after dropping up to %d: %v", acked, seqs(got))
+	}
+	st, _ := s.stream("api-out.log")
+	var total int64
+	for _, seg := range st.segs {
+		total += seg.size
+	}
+	if total > 600 {
+		t.Fatalf("spool holds %d bytes", total)
+	}
+}
+
+// follow spools a file from where the stream left off, after a restart too.
+func TestSpoolFollowResumes(t *testing.T) {
+	cfg := config.SpoolConfig{Dir: t.TempDir()}
+	src := filepath.Join(t.TempDir(), "api-out.log")
+	if err := os.WriteFile(src, []byte("one\ntwo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	follow := func(s *Spool, want uint64) {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		st, _ := s.stream("api-out.log")
+		go func() {
+			s.follow(ctx, st, src, true)
+			close(done)
+		}()
+		for deadline := time.Now().Add(5 * time.Second); len(readAll(t, s, "api-out.log", 0)) < int(want); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("lines not spooled: %v", seqs(readAll(t, s, "api-out.log", 0)))
+			}
+		}
+		cancel()
+		<-done
+	}
+	s := openSpool(t, cfg)
+	follow(s, 2)
+
+	f, err := os.OpenFile(src, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("three\n")
+	f.Close()
+	s = openSpool(t, cfg)
+	follow(s, 3)
+	got := readAll(t, s, "api-out.log", 0)
+	if !sameSeqs(got, 1, 3) || got[0].Line != "[api] one" || got[2].Line != "[api] three" {
+		t.Fatalf("records: %+v", got)
+	}
+}
+
+// The stream handler replays after the given sequence numbers without
+// acknowledging anything; only the ack handler releases lines.
+func TestSpoolHandlers(t *testing.T) {
+	s := openSpool(t, config.SpoolConfig{Dir: t.TempDir()})
+	spoolLines(t, s, "api-out.log", "[api] one", "[api] two", "[api] three")
+	spoolLines(t, s, "web-out.log", "[web] one")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/logs", s.StreamHandler)
+	mux.HandleFunc("/logs/ack", s.AckHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/logs?after=api-out.log:1", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !WantsEntries(req) || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("content type: %s", resp.Header.Get("Content-Type"))
+	}
+	sc := bufio.NewScanner(resp.Body)
+	got := make(map[string][]uint64)
+	for n := 0; n < 3 && sc.Scan(); n++ {
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		got[rec.Stream] = append(got[rec.Stream], rec.Seq)
+	}
+	if fmt.Sprint(got["api-out.log"]) != "[2 3]" || fmt.Sprint(got["web-out.log"]) != "[1]" {
+		t.Fatalf("records: %v", got)
+	}
+	cancel()
+	if s.Acked("api-out.log") != 0 || s.Acked("web-out.log") != 0 {
+		t.Fatal("streaming acknowledged lines")
+	}
+
+	resp, err = http.Post(srv.URL+"/logs/ack", "application/json", strings.NewReader(`{"api-out.log":9,"web-out.log":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || s.Acked("api-out.log") != 3 || s.Acked("web-out.log") != 1 {
+		t.Fatalf("ack: %d, acked %d and %d", resp.StatusCode, s.Acked("api-out.log"), s.Acked("web-out.log"))
+	}
+	for _, r := range []struct{ method, body string }{{http.MethodGet, ""}, {http.MethodPost, "[1]"}} {
+		req, _ := http.NewRequest(r.method, srv.URL+"/logs/ack", strings.NewReader(r.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 400 {
+			t.Errorf("%s %q: %d", r.method, r.body, resp.StatusCode)
+		}
+	}
+}
@@ -16,7 +16,6 @@ import (
 
 type Streamer struct {
 	paths []string
-	mu    sync.Mutex
 }
 
 // NewStreamer sets up log file patterns
@@ -34,7 +33,23 @@ func (s *Streamer) StreamHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := r.Context()
+	var mu sync.Mutex
+	s.Follow(r.Context(), func(line string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := w.Write([]byte(line)); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+}
+
+// Follow tails every matching log file from its current end and calls emit
+// with each new line, prefixed with "[app] ", until ctx is done. emit is
+// called concurrently from one goroutine per file; a file stops being
+// followed when emit returns an error.
+func (s *Streamer) Follow(ctx context.Context, emit func(line string) error) {
 	for _, pattern := range s.paths {
 		files, err := filepath.Glob(pattern)
 		if err != nil {
@@ -42,7 +57,7 @@ func (s *Streamer) StreamHandler(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 		for _, f := range files {
-			go streamFile(ctx, f, w, flusher, &s.mu)
+			go streamFile(ctx, f, emit)
 		}
 	}
 
@@ -50,7 +65,7 @@ func (s *Streamer) StreamHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // streamFile seeks to the end and then streams only new lines as they arrive
-func streamFile(ctx context.Context, path string, w io.Writer, flusher http.Flusher, mu *sync.Mutex) {
+func streamFile(ctx context.Context, path string, emit func(string) error) {
 	file, err := os.Open(path)
 	if err != nil {
 		log.Printf("failed to open %s: %v", path, err)
@@ -86,14 +101,10 @@ func streamFile(ctx context.Context, path string, w io.Writer, flusher http.Flus
 
 		// Prefix and write the new line
 		prefixed := fmt.Sprintf("[%s] %s", appName, line)
-		mu.Lock()
-		if _, writeErr := w.Write([]byte(prefixed)); writeErr != nil {
-			mu.Unlock()
+		if writeErr := emit(prefixed); writeErr != nil {
 			log.Printf("error writing to client: %v", writeErr)
 			return
 		}
-		flusher.Flush()
-		mu.Unlock()
 	}
 }
 
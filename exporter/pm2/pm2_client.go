@@ -57,6 +57,7 @@ type ProcessInfo struct {
 	PM2Env struct {
 		ExecArgs []string `json:"exec_args"`
 		Cwd      string   `json:"cwd"`
+		Version  string   `json:"version"`
 		Env      EnvMap   `json:"env"`
 	} `json:"pm2_env"`
 	CreatedAt    int64 `json:"created_at"`
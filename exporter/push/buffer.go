@@ -0,0 +1,141 @@
+package push
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry is one buffered request: what to send and when it was collected.
+type entry struct {
+	path string
+	kind string
+	ts   time.Time
+	size int64
+}
+
+// buffer keeps payloads that could not be delivered as one file each, named
+// <collected-unix-nanos>-<seq>.<kind>, so they can be replayed in order after
+// a restart. When the total size exceeds max the oldest files are dropped.
+type buffer struct {
+	dir string
+	max int64
+
+	mu      sync.Mutex
+	entries []entry
+	size    int64
+	seq     uint64
+}
+
+func openBuffer(dir string, max int64) (*buffer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	b := &buffer{dir: dir, max: max}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			os.Remove(filepath.Join(dir, f.Name())) // interrupted write
+			continue
+		}
+		e, ok := parseEntry(filepath.Join(dir, f.Name()))
+		if !ok {
+			continue
+		}
+		if info, err := f.Info(); err == nil {
+			e.size = info.Size()
+		}
+		b.entries = append(b.entries, e)
+		b.size += e.size
+	}
+	sort.Slice(b.entries, func(i, j int) bool { return b.entries[i].path < b.entries[j].path })
+	if n := len(b.entries); n > 0 {
+		log.Printf("push: %d buffered payloads (%d bytes) to replay", n, b.size)
+	}
+	return b, nil
+}
+
+// parseEntry decodes a buffer file name.
+func parseEntry(path string) (entry, bool) {
+	name := filepath.Base(path)
+	stem, kind, ok := strings.Cut(name, ".")
+	if !ok || kind == "" || strings.HasSuffix(kind, ".tmp") {
+		return entry{}, false
+	}
+	nanos, _, ok := strings.Cut(stem, "-")
+	if !ok {
+		return entry{}, false
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return entry{}, false
+	}
+	return entry{path: path, kind: kind, ts: time.Unix(0, n)}, true
+}
+
+// add stores a payload, evicting the oldest ones if the buffer is full.
+func (b *buffer) add(kind string, ts time.Time, body []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	name := fmt.Sprintf("%020d-%06d.%s", ts.UnixNano(), b.seq%1000000, kind)
+	path := filepath.Join(b.dir, name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	b.entries = append(b.entries, entry{path: path, kind: kind, ts: ts, size: int64(len(body))})
+	b.size += int64(len(body))
+
+	dropped := 0
+	for b.max > 0 && b.size > b.max && len(b.entries) > 1 {
+		b.removeLocked(b.entries[0])
+		dropped++
+	}
+	if dropped > 0 {
+		log.Printf("push: buffer full, dropped %d oldest payloads", dropped)
+	}
+	return nil
+}
+
+// oldest returns the next payload to replay.
+func (b *buffer) oldest() (entry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) == 0 {
+		return entry{}, false
+	}
+	return b.entries[0], true
+}
+
+// remove deletes a replayed (or undeliverable) payload.
+func (b *buffer) remove(e entry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeLocked(e)
+}
+
+func (b *buffer) removeLocked(e entry) {
+	for i, x := range b.entries {
+		if x.path == e.path {
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			b.size -= x.size
+			break
+		}
+	}
+	os.Remove(e.path)
+}
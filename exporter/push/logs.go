@@ -0,0 +1,102 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/aalish/pm2-full/logs"
+)
+
+const (
+	retryDelay = 5 * time.Second
+	batchLines = 500 // max lines per stream per request
+)
+
+// logLoop sends spooled log lines to the collector in batches. Lines stay
+// in the spool until the collector replies with the sequence numbers it
+// durably stored; after a failure every stream is resent from its last
+// acknowledged line, and the collector skips what it already has.
+func (p *Pusher) logLoop(ctx context.Context) {
+	readers := make(map[string]*logs.Reader)
+	for ctx.Err() == nil {
+		changed := p.spool.Changed()
+		var batch []logs.Record
+		for _, name := range p.spool.Streams() {
+			rd := readers[name]
+			if rd == nil {
+				rd = p.spool.Reader(name, p.spool.Acked(name))
+				readers[name] = rd
+			}
+			recs, err := rd.Next(batchLines)
+			if err != nil {
+				log.Printf("push: read spool %s: %v", name, err)
+			}
+			batch = append(batch, recs...)
+		}
+		if len(batch) == 0 {
+			select {
+			case <-ctx.Done():
+			case <-changed:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		acks, err := p.postLogs(batch)
+		if err != nil {
+			log.Printf("push: logs: %v; retrying in %s", err, retryDelay)
+			readers = make(map[string]*logs.Reader)
+			select {
+			case <-ctx.Done():
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+		sent := make(map[string]uint64)
+		for _, rec := range batch {
+			sent[rec.Stream] = rec.Seq
+		}
+		for stream, seq := range sent {
+			if err := p.spool.Ack(stream, acks[stream]); err != nil {
+				log.Printf("push: ack %s: %v", stream, err)
+			}
+			if acks[stream] < seq {
+				delete(readers, stream) // not all stored, resend
+			}
+		}
+	}
+}
+
+// postLogs sends a batch and returns the collector's acknowledgements.
+func (p *Pusher) postLogs(batch []logs.Record) (map[string]uint64, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, rec := range batch {
+		enc.Encode(rec)
+	}
+	req, err := p.request(kindLogs, &body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil, err
+	}
+	var reply struct {
+		Acks map[string]uint64 `json:"acks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("decode reply: %w", err)
+	}
+	return reply.Acks, nil
+}
@@ -0,0 +1,260 @@
+// Package push ships process snapshots, metrics and logs to a collector over
+// outbound connections, for hosts the collector cannot scrape.
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aalish/pm2-full/config"
+	"github.com/aalish/pm2-full/logs"
+	"github.com/aalish/pm2-full/pm2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Payload kinds, which are also the collector ingest paths.
+const (
+	kindMetrics   = "metrics"
+	kindProcesses = "processes"
+	kindLogs      = "logs"
+)
+
+// timestampHeader tells the collector when a payload was collected.
+const timestampHeader = "X-PM2-Timestamp"
+
+// Pusher periodically posts snapshots and sends spooled log lines to the
+// collector. Snapshots that cannot be delivered are buffered on disk and
+// replayed, oldest first, before anything new is sent; log lines stay in the
+// spool until the collector acknowledges them.
+type Pusher struct {
+	cfg      config.PushConfig
+	pm2      *pm2.Client
+	gatherer prometheus.Gatherer
+	spool    *logs.Spool
+	client   *http.Client
+	buf      *buffer
+	query    string
+
+	sendMu sync.Mutex // serialises delivery so buffered payloads stay ordered
+}
+
+// New validates the push configuration and opens the disk buffer.
+func New(cfg config.PushConfig, client *pm2.Client, spool *logs.Spool) (*Pusher, error) {
+	if cfg.URL == "" || cfg.Job == "" {
+		return nil, fmt.Errorf("push: url and job are required")
+	}
+	if cfg.Instance == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("push: instance not set and hostname unknown: %w", err)
+		}
+		cfg.Instance = host
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.BufferDir == "" {
+		cfg.BufferDir = "push-buffer"
+	}
+	if cfg.MaxBufferBytes <= 0 {
+		cfg.MaxBufferBytes = 100 << 20
+	}
+
+	tlsCfg := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("push: ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("push: ca_file %s: no certificates found", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsCfg}
+
+	buf, err := openBuffer(cfg.BufferDir, cfg.MaxBufferBytes)
+	if err != nil {
+		return nil, fmt.Errorf("push: buffer: %w", err)
+	}
+
+	q := url.Values{"job": {cfg.Job}, "instance": {cfg.Instance}}
+	for k, v := range cfg.Labels {
+		q.Add("label", k+"="+v)
+	}
+	return &Pusher{
+		cfg:      cfg,
+		pm2:      client,
+		gatherer: prometheus.DefaultGatherer,
+		spool:    spool,
+		client:   &http.Client{Transport: transport, Timeout: cfg.Timeout},
+		buf:      buf,
+		query:    q.Encode(),
+	}, nil
+}
+
+// Run pushes until ctx is cancelled.
+func (p *Pusher) Run(ctx context.Context) {
+	log.Printf("push: sending to %s as job=%s instance=%s", p.cfg.URL, p.cfg.Job, p.cfg.Instance)
+	go p.logLoop(ctx)
+
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		p.pushSnapshot()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pushSnapshot collects and sends the process list and metrics once.
+func (p *Pusher) pushSnapshot() {
+	now := time.Now()
+	if procs, err := p.pm2.List(); err != nil {
+		log.Printf("push: list processes: %v", err)
+	} else if body, err := json.Marshal(procs); err == nil {
+		p.send(kindProcesses, now, body)
+	}
+
+	if mfs, err := p.gatherer.Gather(); err != nil {
+		log.Printf("push: gather metrics: %v", err)
+	} else {
+		var buf bytes.Buffer
+		enc := expfmt.NewEncoder(&buf, expfmt.NewFormat(expfmt.TypeTextPlain))
+		for _, mf := range mfs {
+			enc.Encode(mf)
+		}
+		p.send(kindMetrics, now, buf.Bytes())
+	}
+}
+
+// send delivers a payload, or buffers it when the collector is unreachable
+// or older payloads are still waiting.
+func (p *Pusher) send(kind string, ts time.Time, body []byte) {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+
+	if p.flushLocked() {
+		err := p.post(kind, ts, body)
+		if err == nil {
+			return
+		}
+		if isPermanent(err) {
+			log.Printf("push: %s rejected: %v", kind, err)
+			return
+		}
+		log.Printf("push: %s: %v; buffering", kind, err)
+	}
+	if err := p.buf.add(kind, ts, body); err != nil {
+		log.Printf("push: buffer %s: %v", kind, err)
+	}
+}
+
+// flush replays buffered payloads. It reports whether the buffer is empty.
+func (p *Pusher) flush() bool {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	return p.flushLocked()
+}
+
+func (p *Pusher) flushLocked() bool {
+	for {
+		e, ok := p.buf.oldest()
+		if !ok {
+			return true
+		}
+		body, err := os.ReadFile(e.path)
+		if err != nil {
+			log.Printf("push: read buffered %s: %v", e.path, err)
+			p.buf.remove(e)
+			continue
+		}
+		if err := p.post(e.kind, e.ts, body); err != nil {
+			if !isPermanent(err) {
+				return false
+			}
+			log.Printf("push: buffered %s rejected, dropping: %v", e.kind, err)
+		}
+		p.buf.remove(e)
+	}
+}
+
+// post sends one payload to the collector's ingest endpoint for its kind.
+func (p *Pusher) post(kind string, ts time.Time, body []byte) error {
+	req, err := p.request(kind, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(timestampHeader, ts.UTC().Format(time.RFC3339Nano))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return checkStatus(resp)
+}
+
+func (p *Pusher) request(kind string, body io.Reader) (*http.Request, error) {
+	u := strings.TrimRight(p.cfg.URL, "/") + "/ingest/" + kind + "?" + p.query
+	req, err := http.NewRequest("POST", u, body)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	switch kind {
+	case kindMetrics:
+		req.Header.Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+	case kindProcesses:
+		req.Header.Set("Content-Type", "application/json")
+	case kindLogs:
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if p.cfg.Username != "" {
+		req.SetBasicAuth(p.cfg.Username, p.cfg.Password)
+	}
+	return req, nil
+}
+
+// permanentError marks failures that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+func isPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// checkStatus turns non-2xx replies into errors. Only malformed or oversized
+// payloads are permanent; everything else, including authentication
+// failures, is retried so nothing is lost while the configuration is fixed.
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := fmt.Errorf("collector replied %s", resp.Status)
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return permanentError{err}
+	}
+	return err
+}
@@ -0,0 +1,224 @@
+package push
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aalish/pm2-full/config"
+	"github.com/aalish/pm2-full/logs"
+)
+
+// pushed is one request a collector received.
+type pushed struct {
+	path, query, ts, body string
+}
+
+// collector stands in for a collector's ingest endpoints. While status is
+// not 0 it replies with it instead of storing.
+type collector struct {
+	*httptest.Server
+	status atomic.Int32
+
+	mu   sync.Mutex
+	got  []pushed
+	logs []logs.Record
+}
+
+func newCollector(t *testing.T) *collector {
+	t.Helper()
+	c := &collector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := c.status.Load(); s != 0 {
+			http.Error(w, "unavailable", int(s))
+			return
+		}
+		if user, pass, _ := r.BasicAuth(); user != "u" || pass != "p" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if r.URL.Path != "/ingest/logs" {
+			body, _ := io.ReadAll(r.Body)
+			c.got = append(c.got, pushed{r.URL.Path, r.URL.RawQuery, r.Header.Get(timestampHeader), string(body)})
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		acks := make(map[string]uint64)
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			var rec logs.Record
+			if err := json.Unmarshal(sc.Bytes(), &rec); err == nil {
+				c.logs = append(c.logs, rec)
+				acks[rec.Stream] = rec.Seq
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"lines": len(acks), "acks": acks})
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *collector) received() []pushed {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]pushed(nil), c.got...)
+}
+
+func newPusher(t *testing.T, url, dir string, spool *logs.Spool) *Pusher {
+	t.Helper()
+	p, err := New(config.PushConfig{URL: url + "/", Username: "u", Password: "p", Job: "web", Instance: "h1", Labels: map[string]string{"env": "prod"}, BufferDir: dir}, nil, spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Payloads are buffered while the collector is down, kept across a
+// restart and replayed oldest first with their collection time before
+// anything new is sent.
+func TestBufferedReplay(t *testing.T) {
+	c := newCollector(t)
+	dir := t.TempDir()
+	p := newPusher(t, c.URL, dir, nil)
+	t0 := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	c.status.Store(http.StatusServiceUnavailable)
+	p.send(kindMetrics, t0, []byte("up 1\n"))
+	p.send(kindProcesses, t0.Add(time.Second), []byte("[]"))
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Fatalf("buffered %d payloads, want 2", len(files))
+	}
+
+	p = newPusher(t, c.URL, dir, nil)
+	c.status.Store(0)
+	p.send(kindMetrics, t0.Add(2*time.Second), []byte("up 0\n"))
+	want := []pushed{
+		{"/ingest/metrics", "env=prod", t0.Format(time.RFC3339Nano), "up 1\n"},
+		{"/ingest/processes", "", t0.Add(time.Second).Format(time.RFC3339Nano), "[]"},
+		{"/ingest/metrics", "", t0.Add(2 * time.Second).Format(time.RFC3339Nano), "up 0\n"},
+	}
+	got := c.received()
+	if len(got) != len(want) {
+		t.Fatalf("received %+v", got)
+	}
+	for i, w := range want {
+		if got[i].path != w.path || got[i].ts != w.ts || got[i].body != w.body {
+			t.Errorf("payload %d: got %+v, want %+v", i, got[i], w)
+		}
+	}
+	if got[0].query != "instance=h1&job=web&label=env%3Dprod" {
+		t.Errorf("query: %s", got[0].query)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d payloads left in the buffer", len(files))
+	}
+}
+
+// A payload the collector rejects as malformed is dropped, not buffered;
+// other failures, such as bad credentials, are retried.
+func TestRejectedPayloads(t *testing.T) {
+	c := newCollector(t)
+	dir := t.TempDir()
+	p := newPusher(t, c.URL, dir, nil)
+	c.status.Store(http.StatusBadRequest)
+	p.send(kindMetrics, time.Now(), []byte("up{ 1\n"))
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("rejected payload buffered")
+	}
+	c.status.Store(http.StatusUnauthorized)
+	p.send(kindMetrics, time.Now(), []byte("up 1\n"))
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("payload refused for its credentials not buffered")
+	}
+	c.status.Store(0)
+	if !p.flush() || len(c.received()) != 1 {
+		t.Fatalf("replay: %+v", c.received())
+	}
+}
+
+// A full buffer drops its oldest payloads.
+func TestBufferFull(t *testing.T) {
+	dir := t.TempDir()
+	b, err := openBuffer(dir, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now()
+	for i := range 4 {
+		if err := b.add(kindMetrics, t0.Add(time.Duration(i)*time.Second), []byte(fmt.Sprintf("payload %d\n", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err = openBuffer(dir, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := b.oldest()
+	if !ok || len(b.entries) != 2 || b.size != 20 || !e.ts.Equal(t0.Add(2*time.Second)) || e.kind != kindMetrics {
+		t.Fatalf("buffer: %+v, %d bytes", b.entries, b.size)
+	}
+}
+
+// Spooled log lines are sent and released from the spool once the
+// collector acknowledges them.
+func TestLogDelivery(t *testing.T) {
+	c := newCollector(t)
+	src := filepath.Join(t.TempDir(), "api-out.log")
+	if err := os.WriteFile(src, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	spool, err := logs.OpenSpool([]string{src}, config.SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go spool.Run(ctx)
+	p := newPusher(t, c.URL, t.TempDir(), spool)
+	go p.logLoop(ctx)
+
+	// the spool starts at the end of the file once it follows it
+	f, err := os.OpenFile(src, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var last uint64
+	for i, deadline := 0, time.Now().Add(10*time.Second); ; i++ {
+		if i < 50 {
+			fmt.Fprintf(f, "line %d\n", i)
+		}
+		c.mu.Lock()
+		n := len(c.logs)
+		if n > 0 {
+			last = c.logs[n-1].Seq
+		}
+		c.mu.Unlock()
+		if i >= 50 && n > 0 && spool.Acked("api-out.log") == last {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d lines delivered, %d acknowledged", n, spool.Acked("api-out.log"))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, rec := range c.logs {
+		if rec.Seq != uint64(i+1) || rec.Stream != "api-out.log" {
+			t.Fatalf("record %d: %+v", i, rec)
+		}
+	}
+}
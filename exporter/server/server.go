@@ -18,14 +18,16 @@ type Server struct {
 	pm2Client *pm2.Client
 	metrics   *metrics.Exporter
 	logs      *logs.Streamer
+	spool     *logs.Spool
 }
 
-func New(cfg config.ServerConfig, pm2Client *pm2.Client, metricsExporter *metrics.Exporter, logStreamer *logs.Streamer) *Server {
+func New(cfg config.ServerConfig, pm2Client *pm2.Client, metricsExporter *metrics.Exporter, logStreamer *logs.Streamer, spool *logs.Spool) *Server {
 	return &Server{
 		cfg:       cfg,
 		pm2Client: pm2Client,
 		metrics:   metricsExporter,
 		logs:      logStreamer,
+		spool:     spool,
 	}
 }
 
@@ -40,12 +42,20 @@ func (s *Server) Run() error {
     }
     http.Handle("/metrics", metricsHandler)
 
-    // Logs
-    var logsHandler http.Handler = http.HandlerFunc(s.logs.StreamHandler)
+    // Logs: plain new lines, or, with a spool, spooled records for
+    // collectors that acknowledge what they stored at /logs/ack
+    var logsHandler http.Handler = http.HandlerFunc(s.handleLogs)
     if s.cfg.BasicAuth.Enabled {
         logsHandler = BasicAuthMiddleware(logsHandler, s.cfg.BasicAuth.Username, s.cfg.BasicAuth.Password)
     }
     http.Handle("/logs", logsHandler)
+    if s.spool != nil {
+        var ackHandler http.Handler = http.HandlerFunc(s.spool.AckHandler)
+        if s.cfg.BasicAuth.Enabled {
+            ackHandler = BasicAuthMiddleware(ackHandler, s.cfg.BasicAuth.Username, s.cfg.BasicAuth.Password)
+        }
+        http.Handle("/logs/ack", ackHandler)
+    }
 
     fmt.Printf("listening on %s\n", s.cfg.Listen)
     if s.cfg.TLSCert != "" && s.cfg.TLSKey != "" {
@@ -53,6 +63,14 @@ func (s *Server) Run() error {
     }
     return http.ListenAndServe(s.cfg.Listen, nil)
 }
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+    if s.spool != nil && logs.WantsEntries(r) {
+        s.spool.StreamHandler(w, r)
+        return
+    }
+    s.logs.StreamHandler(w, r)
+}
+
 func (s *Server) handleProcesses() http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         procs, err := s.pm2Client.List()